@@ -0,0 +1,72 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains attribute hashing: requests in which the requestor receives, instead of the
+// value of a disclosed attribute, only a salted hash of it, or only whether that hash equals a
+// hash that the requestor supplies (e.g. of an email address that it already has).
+//
+// The client still discloses the attribute to the IRMA server, which verifies the disclosure and
+// computes the hash, but the plaintext value never ends up in the session result. (The client
+// cannot send only the hash, as gabi cannot prove the hash of an undisclosed attribute, and a hash
+// that is not proven cannot be trusted.) For this
+// reason hashing is not supported in signature sessions, whose result contains the signature
+// including the disclosed attributes.
+
+// AttributeHash requires the value of an attribute to be replaced in the session result by its
+// salted hash SHA-256(value || Salt). If Expected is specified, the session result contains
+// neither the value nor the hash, but only whether the hash equals Expected.
+type AttributeHash struct {
+	Salt     []byte `json:"salt"`
+	Expected []byte `json:"expected,omitempty"`
+}
+
+// Validate checks that the salt is present and that the expected hash, if present, is a SHA-256 hash.
+func (h *AttributeHash) Validate() error {
+	if len(h.Salt) == 0 {
+		return errors.New("Attribute hash has no salt")
+	}
+	if h.Expected != nil && len(h.Expected) != sha256.Size {
+		return errors.Errorf("Expected attribute hash must consist of %d bytes", sha256.Size)
+	}
+	return nil
+}
+
+// Sum returns the salted hash of the attribute value, or nil if the attribute is absent.
+func (h *AttributeHash) Sum(val *string) []byte {
+	if val == nil {
+		return nil
+	}
+	sum := sha256.Sum256(append([]byte(*val), h.Salt...))
+	return sum[:]
+}
+
+// apply replaces the value of the disclosed attribute by its salted hash, or by whether the hash
+// matches the expected hash.
+func (h *AttributeHash) apply(attr *DisclosedAttribute, val *string) {
+	sum := h.Sum(val)
+	attr.RawValue = nil
+	attr.Value = nil
+	attr.Status = AttributeProofStatusHashed
+	if h.Expected == nil {
+		attr.Hash = sum
+		return
+	}
+	match := sum != nil && bytes.Equal(sum, h.Expected)
+	attr.Match = &match
+}
+
+func (ar *AttributeRequest) validateHash() error {
+	if ar.Value != nil || ar.Predicate != nil {
+		return errors.New("Attribute request cannot require hashing together with a value or a predicate")
+	}
+	if ar.Type.IsCredential() {
+		return errors.Errorf("Cannot request hash of %s: not an attribute type", ar.Type)
+	}
+	return ar.Hash.Validate()
+}
@@ -176,6 +176,17 @@ func (al *AttributeList) decode(i int) *string {
 	return decodeAttribute(attr, metadataVersion)
 }
 
+// Encode attribute value into a big.Int according to metadataVersion
+func encodeAttribute(val string, metadataVersion byte) *big.Int {
+	bi := new(big.Int).SetBytes([]byte(val))
+	if metadataVersion >= 3 {
+		// Set attribute to val << 1 + 1, distinguishing it from absent (null) attributes
+		bi.Lsh(bi, 1)
+		bi.Add(bi, big.NewInt(1))
+	}
+	return bi
+}
+
 // Decode attribute value into string according to metadataVersion
 func decodeAttribute(attr *big.Int, metadataVersion byte) *string {
 	bi := new(big.Int).Set(attr)
@@ -77,6 +77,11 @@ type CredentialType struct {
 	IssueURL     *TranslatedString `xml:"IssueURL"`
 	IsULIssueURL bool              `xml:"IsULIssueURL"`
 
+	// RefreshURL is an endpoint of the issuer that starts sessions to refresh (reissue) credentials
+	// of this type, by responding to a POST with the session pointer (irma.Qr) of an issuance
+	// session that also asks for disclosure of the credential being refreshed.
+	RefreshURL string `xml:"RefreshURL"`
+
 	DeprecatedSince Timestamp
 
 	Dependencies CredentialDependencies
@@ -207,6 +212,24 @@ const (
 	maxWizardComplexity = 10
 )
 
+// IssuesCredentialType returns whether the wizard contains an item issuing the specified credential
+// type.
+func (wizard IssueWizard) IssuesCredentialType(id CredentialTypeIdentifier) bool {
+	if wizard.Issues != nil && *wizard.Issues == id {
+		return true
+	}
+	for _, discon := range wizard.Contents {
+		for _, con := range discon {
+			for _, item := range con {
+				if item.Credential != nil && *item.Credential == id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // Path returns a list of IssueWizardItems to be used as the wizard item order.
 // If the ExpandDependencies boolean is set to false, the result of IssueWizardContents.ChoosePath
 // is returned. If not set or set to true, this is augmented with all dependencies of all items
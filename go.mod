@@ -16,7 +16,7 @@ require (
 	github.com/go-chi/cors v1.0.0
 	github.com/go-errors/errors v1.0.1
 	github.com/go-redis/redis/v8 v8.8.0
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gofrs/uuid v4.0.0+incompatible // indirect
 	github.com/golang-jwt/jwt/v4 v4.2.0
 	github.com/hashicorp/go-multierror v1.1.0
@@ -41,4 +41,5 @@ require (
 	github.com/timshannon/bolthold v0.0.0-20190812165541-a85bcc049a2e // indirect
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
 	go.etcd.io/bbolt v1.3.2
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 )
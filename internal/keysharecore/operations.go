@@ -54,6 +54,30 @@ func (c *Core) NewUserSecrets(pin string) (UserSecrets, error) {
 	return c.encryptUserSecrets(s)
 }
 
+// NewDeviceSecrets generates user secrets for an additional device of the user owning the given
+// secrets. They contain the same keyshare secret, but are secured with the given pin of the new
+// device, and have their own ID so that access tokens of one device are not valid for another.
+// The caller must have established that the user authorized the new device.
+func (c *Core) NewDeviceSecrets(secrets UserSecrets, pin string) (UserSecrets, error) {
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.setPin(pin); err != nil {
+		return nil, err
+	}
+	if err = s.setID(id); err != nil {
+		return nil, err
+	}
+	return c.encryptUserSecrets(s)
+}
+
 // ValidatePin checks pin for validity and generates JWT for future access.
 func (c *Core) ValidatePin(secrets UserSecrets, pin string) (string, error) {
 	s, err := c.decryptUserSecretsIfPinOK(secrets, pin)
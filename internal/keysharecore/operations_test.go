@@ -65,6 +65,37 @@ func TestPinFunctionality(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestDeviceSecrets(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	secrets, err := c.NewUserSecrets("pin1")
+	require.NoError(t, err)
+	deviceSecrets, err := c.NewDeviceSecrets(secrets, "pin2")
+	require.NoError(t, err)
+
+	// Each device has its own pin
+	_, err = c.ValidatePin(deviceSecrets, "pin1")
+	assert.Equal(t, ErrInvalidPin, err)
+	jwtt, err := c.ValidatePin(deviceSecrets, "pin2")
+	require.NoError(t, err)
+
+	// Access tokens are bound to the device
+	assert.NoError(t, c.ValidateJWT(deviceSecrets, jwtt))
+	assert.Equal(t, ErrInvalidJWT, c.ValidateJWT(secrets, jwtt))
+
+	// Both devices share the keyshare secret
+	s1, err := c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	s2, err := c.decryptUserSecrets(deviceSecrets)
+	require.NoError(t, err)
+	assert.Equal(t, s1.KeyshareSecret, s2.KeyshareSecret)
+	assert.NotEqual(t, s1.ID, s2.ID)
+}
+
 func TestVerifyAccess(t *testing.T) {
 	// Setup keys for test
 	var key AESKey
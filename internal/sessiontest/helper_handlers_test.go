@@ -25,6 +25,7 @@ func (i *TestClientHandler) UpdateAttributes()                               {}
 func (i *TestClientHandler) Revoked(cred *irma.CredentialIdentifier) {
 	i.revoked = cred
 }
+func (i *TestClientHandler) ExpiringCredentials(creds []*irmaclient.ExpiringCredential) {}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
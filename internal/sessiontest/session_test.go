@@ -3,10 +3,12 @@ package sessiontest
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -63,6 +65,8 @@ func TestRequestorServer(t *testing.T) {
 	t.Run("CombinedSessionMultipleAttributes", apply(testCombinedSessionMultipleAttributes, RequestorServerConfiguration))
 	t.Run("ConDisCon", apply(testConDisCon, RequestorServerConfiguration))
 	t.Run("OptionalDisclosure", apply(testOptionalDisclosure, RequestorServerConfiguration))
+	t.Run("AttributePredicates", apply(testAttributePredicates, RequestorServerConfiguration))
+	t.Run("AttributeHashing", apply(testAttributeHashing, RequestorServerConfiguration))
 }
 
 func TestIrmaServer(t *testing.T) {
@@ -72,6 +76,7 @@ func TestIrmaServer(t *testing.T) {
 	t.Run("DisclosureNewAttributeUpdateSchemeManager", apply(testDisclosureNewAttributeUpdateSchemeManager, IrmaServerConfiguration))
 	t.Run("BlindIssuanceSessionDifferentAmountOfRandomBlinds", apply(testBlindIssuanceSessionDifferentAmountOfRandomBlinds, IrmaServerConfiguration))
 	t.Run("OutdatedClientIrmaConfiguration", apply(testOutdatedClientIrmaConfiguration, IrmaServerConfiguration))
+	t.Run("CredentialRefresh", apply(testCredentialRefresh, IrmaServerConfiguration))
 
 	// Tests also run against the requestor server
 	t.Run("DisclosureSession", apply(testDisclosureSession, IrmaServerConfiguration))
@@ -538,6 +543,65 @@ func testChainedSessions(t *testing.T, conf interface{}, opts ...option) {
 	require.NoError(t, errors.New("newly issued credential not found in client"))
 }
 
+func testCredentialRefresh(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	require.IsType(t, IrmaServerConfiguration, conf)
+	irmaServer := StartIrmaServer(t, conf.(func() *server.Configuration)())
+	defer irmaServer.Stop()
+
+	// Issue the credential to be refreshed, as the only one of its type
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	for client.Attributes(credid, 0) != nil {
+		require.NoError(t, client.RemoveCredential(credid, 0))
+	}
+	doSession(t, getNameIssuanceRequest(), client, irmaServer, nil, nil, nil, opts...)
+	old := client.Attributes(credid, 0)
+	require.NotNil(t, old)
+
+	// The refresh endpoint starts a session disclosing the old credential and issuing a new one
+	refreshRequest := getNameIssuanceRequest()
+	refreshRequest.Credentials[0].Attributes["familyname"] = "Stuivezand-Jansen"
+	refreshRequest.Disclose = irma.AttributeConDisCon{{{
+		irma.NewAttributeRequest("irma-demo.MijnOverheid.fullName.familyname"),
+	}}}
+	refreshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qr, _, _, err := irmaServer.irma.StartSession(refreshRequest, nil)
+		require.NoError(t, err)
+		require.NoError(t, json.NewEncoder(w).Encode(qr))
+	}))
+	defer refreshServer.Close()
+	client.Configuration.CredentialTypes[credid].RefreshURL = refreshServer.URL
+
+	c := make(chan *SessionResult)
+	client.RefreshCredential(old.Hash(), &TestHandler{t: t, c: c, client: client})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// The old credential has been replaced, and the session is logged once as a renewal
+	refreshed := client.Attributes(credid, 0)
+	require.NotNil(t, refreshed)
+	require.Nil(t, client.Attributes(credid, 1))
+	require.NotEqual(t, old.Hash(), refreshed.Hash())
+	require.Equal(t, "Stuivezand-Jansen", *refreshed.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")))
+
+	logs, err := client.LoadNewestLogs(2)
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionIssuing, logs[0].Type)
+	require.Equal(t, old.Strings(), logs[0].Renewed[credid])
+	require.Empty(t, logs[1].Renewed)
+
+	// Credential types without refresh endpoint cannot be refreshed
+	client.Configuration.CredentialTypes[credid].RefreshURL = ""
+	c = make(chan *SessionResult, 1) // the handler is called before RefreshCredential returns
+	client.RefreshCredential(refreshed.Hash(), &TestHandler{t: t, c: c, client: client})
+	result := <-c
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorRefresh, result.Err.(*irma.SessionError).ErrorType)
+}
+
 // Test to check whether session stores (like Redis) correctly handle non-existing sessions
 func testUnknownRequestorToken(t *testing.T, conf interface{}, opts ...option) {
 	require.IsType(t, IrmaServerConfiguration, conf)
@@ -783,6 +847,85 @@ func testOptionalDisclosure(t *testing.T, conf interface{}, opts ...option) {
 	}
 }
 
+func testAttributePredicates(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+	studentid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID") // "456"
+	bound := func(s string) *string { return &s }
+
+	predicate := &irma.AttributePredicate{GreaterOrEqual: bound("400"), LessOrEqual: bound("500")}
+	for _, request := range []irma.SessionRequest{irma.NewDisclosureRequest(), irma.NewSignatureRequest("message")} {
+		// The client prefers proving the predicate over disclosing the attribute
+		request.Disclosure().Disclose = irma.AttributeConDisCon{
+			irma.AttributeDisCon{
+				irma.AttributeCon{irma.AttributeRequest{Type: studentid}},
+				irma.AttributeCon{irma.AttributeRequest{Type: studentid, Predicate: predicate}},
+			},
+		}
+		result := doSession(t, request, client, nil, nil, nil, conf, opts...)
+		require.Nil(t, result.Err)
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		require.Len(t, result.Disclosed, 1)
+		require.Len(t, result.Disclosed[0], 1)
+		attr := result.Disclosed[0][0]
+		require.Equal(t, studentid, attr.Identifier)
+		require.Equal(t, irma.AttributeProofStatusPredicate, attr.Status)
+		require.Nil(t, attr.RawValue)
+		require.Equal(t, predicate, attr.Predicate)
+	}
+
+	// A predicate that the attribute does not satisfy cannot be proven
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		irma.AttributeDisCon{
+			irma.AttributeCon{irma.AttributeRequest{Type: studentid, Predicate: &irma.AttributePredicate{GreaterOrEqual: bound("500")}}},
+		},
+	}
+	missing := doSession(t, request, client, nil, nil, nil, conf, append(opts, optionUnsatisfiableRequest)...).Missing
+	require.Len(t, missing, 1)
+	for _, candidates := range missing[0] {
+		for _, candidate := range candidates {
+			require.False(t, candidate.Present())
+		}
+	}
+}
+
+func testAttributeHashing(t *testing.T, conf interface{}, opts ...option) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID") // "456"
+	salt := []byte("salt")
+	expected := sha256.Sum256([]byte("456salt"))
+	other := sha256.Sum256([]byte("457salt"))
+	match, mismatch := true, false
+
+	tests := []struct {
+		hash  *irma.AttributeHash
+		match *bool
+	}{
+		{&irma.AttributeHash{Salt: salt}, nil},
+		{&irma.AttributeHash{Salt: salt, Expected: expected[:]}, &match},
+		{&irma.AttributeHash{Salt: salt, Expected: other[:]}, &mismatch},
+	}
+	for _, args := range tests {
+		request := irma.NewDisclosureRequest()
+		request.Disclose = irma.AttributeConDisCon{
+			irma.AttributeDisCon{irma.AttributeCon{irma.AttributeRequest{Type: id, Hash: args.hash}}},
+		}
+		result := doSession(t, request, nil, nil, nil, nil, conf, opts...)
+		require.Nil(t, result.Err)
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		attr := result.Disclosed[0][0]
+		require.Equal(t, irma.AttributeProofStatusHashed, attr.Status)
+		require.Nil(t, attr.RawValue)
+		require.Nil(t, attr.Value)
+		require.Equal(t, args.match, attr.Match)
+		if args.match == nil {
+			require.Equal(t, expected[:], attr.Hash)
+		} else {
+			require.Nil(t, attr.Hash)
+		}
+	}
+}
+
 // The following tests are currently not reused with different server/configuration types.
 
 func TestIssueNewAttributeUpdateSchemeManager(t *testing.T) {
@@ -1182,6 +1325,100 @@ func TestParallelSessions(t *testing.T) {
 	require.Len(t, logs, 2)
 }
 
+func TestSessionContext(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	startSession := func(ctx context.Context) (irma.RequestorToken, *SessionResult) {
+		qr, token, _, err := irmaServer.irma.StartSession(getDisclosureRequest(id), nil)
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+
+		// The handler takes longer to give permission than the context allows
+		c := make(chan *SessionResult, 1)
+		client.NewSessionContext(ctx, string(j), &TestHandler{t, c, client, nil, 2 * time.Second, "", nil, nil, nil})
+		return token, <-c
+	}
+	checkAborted := func(token irma.RequestorToken, result *SessionResult, errorType irma.ErrorType) {
+		require.NotNil(t, result)
+		require.Equal(t, errorType, result.Err.(*irma.SessionError).ErrorType)
+
+		// The session is deleted at the server, by a request that the client sends in the background
+		require.Eventually(t, func() bool {
+			serverResult, err := irmaServer.irma.GetSessionResult(token)
+			return err == nil && serverResult.Status == irma.ServerStatusCancelled
+		}, 5*time.Second, 20*time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	token, result := startSession(ctx)
+	checkAborted(token, result, irma.ErrorTimeout)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	token, result = startSession(ctx)
+	checkAborted(token, result, irma.ErrorCancelled)
+
+	// A context that is already done aborts the session before anything is requested
+	_, result = startSession(ctx)
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorCancelled, result.Err.(*irma.SessionError).ErrorType)
+}
+
+func TestProximitySession(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	clientConn, serverConn := irma.NewLoopbackProximityConn()
+	defer clientConn.Close()
+	served := make(chan error, 1)
+	go func() { served <- irmaServer.irma.ServeProximity(serverConn) }()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	finished := make(chan *server.SessionResult, 1)
+	qr, token, _, err := irmaServer.irma.StartProximitySession(getDisclosureRequest(id), func(result *server.SessionResult) {
+		finished <- result
+	})
+	require.NoError(t, err)
+	require.True(t, qr.IsProximity())
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	// Proximity sessions cannot be started without a connection
+	c := make(chan *SessionResult, 1)
+	client.NewSession(string(j), &TestHandler{t, c, client, nil, 0, "", nil, nil, nil})
+	result := <-c
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorInvalidRequest, result.Err.(*irma.SessionError).ErrorType)
+
+	c = make(chan *SessionResult, 1)
+	requestor := irma.NewRequestorInfo("localhost")
+	client.NewProximitySession(string(j), clientConn, &TestHandler{t, c, client, requestor, 0, "", nil, nil, nil})
+	require.Nil(t, <-c)
+
+	// The server finishes the session after the client has received its response
+	var serverResult *server.SessionResult
+	select {
+	case serverResult = <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proximity session did not finish")
+	}
+	require.Equal(t, token, serverResult.Token)
+	require.Equal(t, irma.ServerStatusDone, serverResult.Status)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Equal(t, "456", serverResult.Disclosed[0][0].Value["en"])
+
+	require.NoError(t, clientConn.Close())
+	require.NoError(t, <-served)
+}
+
 func expireKey(t *testing.T, conf *irma.Configuration) {
 	pk, err := conf.PublicKey(irma.NewIssuerIdentifier("irma-demo.RU"), 2)
 	require.NoError(t, err)
@@ -0,0 +1,41 @@
+package test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+const MySQLTestUrl = "testuser:testpassword@tcp(localhost:3306)/test"
+
+func RunScriptOnMySQLDB(t *testing.T, filename string, allowErr bool) {
+	db, err := sql.Open("mysql", MySQLTestUrl+"?multiStatements=true")
+	require.NoError(t, err)
+	defer common.Close(db)
+	scriptData, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	_, err = db.Exec(string(scriptData))
+	if !allowErr {
+		require.NoError(t, err)
+	}
+}
+
+var postgresPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// MySQLQuery converts a PostgreSQL query on tables in the irma schema using $1, $2, ... placeholders
+// to MySQL, returning the converted query and the accordingly ordered arguments.
+func MySQLQuery(query string, args ...interface{}) (string, []interface{}) {
+	var mysqlArgs []interface{}
+	for _, match := range postgresPlaceholder.FindAllStringSubmatch(query, -1) {
+		i, _ := strconv.Atoi(match[1])
+		mysqlArgs = append(mysqlArgs, args[i-1])
+	}
+	query = postgresPlaceholder.ReplaceAllString(query, "?")
+	return strings.ReplaceAll(query, "irma.", ""), mysqlArgs
+}
@@ -37,6 +37,9 @@ func configureEmail() keyshare.EmailConfiguration {
 		EmailAuth:       emailAuth,
 		EmailFrom:       viper.GetString("email_from"),
 		DefaultLanguage: viper.GetString("default_language"),
+		EmailMailer:     keyshare.MailerType(viper.GetString("email_mailer")),
+		EmailDir:        viper.GetString("email_dir"),
+		EmailQueue:      viper.GetBool("email_queue"),
 	}
 }
 
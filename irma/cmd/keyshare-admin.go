@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/spf13/cobra"
+)
+
+var keyshareAdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage users of an IRMA keyshare server using its admin API",
+	Long: `Manage users of an IRMA keyshare server using its admin API.
+
+The keyshare server must be configured with an admin token for the operator (--admin-tokens);
+every action performed through these commands is recorded in the log of the user concerned.`,
+}
+
+var keyshareAdminStatusCmd = &cobra.Command{
+	Use:   "status [<username>]",
+	Short: "Show the status of a keyshare user",
+	Example: `irma keyshare admin status --server https://keyshare.example.com --token mytoken 3sjH7FdkEwQY
+irma keyshare admin status --server https://keyshare.example.com --token mytoken --email user@example.com`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		transport := keyshareAdminTransport(cmd)
+		email, _ := cmd.Flags().GetString("email")
+		if (email == "") == (len(args) == 0) {
+			die("specify either a username or an email address", nil)
+		}
+
+		if email == "" {
+			var status keyshareserver.UserStatus
+			if err := transport.Get("users/"+url.PathEscape(args[0]), &status); err != nil {
+				die("failed to fetch user status", err)
+			}
+			fmt.Println(prettyprint(status))
+			return
+		}
+
+		var statuses []keyshareserver.UserStatus
+		if err := transport.Get("users?email="+url.QueryEscape(email), &statuses); err != nil {
+			die("failed to find users", err)
+		}
+		fmt.Println(prettyprint(statuses))
+	},
+}
+
+var keyshareAdminLogsCmd = &cobra.Command{
+	Use:   "logs <username>",
+	Short: "Show the event log of a keyshare user, newest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		transport := keyshareAdminTransport(cmd)
+		offset, _ := cmd.Flags().GetInt("offset")
+		amount, _ := cmd.Flags().GetInt("amount")
+
+		var entries []keyshareserver.LogEntry
+		path := fmt.Sprintf("users/%s/logs?offset=%d&amount=%d", url.PathEscape(args[0]), offset, amount)
+		if err := transport.Get(path, &entries); err != nil {
+			die("failed to fetch logs", err)
+		}
+		fmt.Println(prettyprint(entries))
+	},
+}
+
+var keyshareAdminUnblockCmd = &cobra.Command{
+	Use:   "unblock <username>",
+	Short: "Reset the PIN attempts of a keyshare user, unblocking her account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		transport := keyshareAdminTransport(cmd)
+		if err := transport.Post("users/"+url.PathEscape(args[0])+"/unblock", nil, nil); err != nil {
+			die("failed to unblock user", err)
+		}
+		fmt.Println("User unblocked")
+	},
+}
+
+var keyshareAdminCancelDeletionCmd = &cobra.Command{
+	Use:   "cancel-deletion <username>",
+	Short: "Cancel the scheduled deletion of the account of an inactive keyshare user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		transport := keyshareAdminTransport(cmd)
+		if err := transport.Post("users/"+url.PathEscape(args[0])+"/cancel-deletion", nil, nil); err != nil {
+			die("failed to cancel deletion", err)
+		}
+		fmt.Println("Deletion canceled")
+	},
+}
+
+func init() {
+	keyshareRootCmd.AddCommand(keyshareAdminCmd)
+	keyshareAdminCmd.AddCommand(keyshareAdminStatusCmd)
+	keyshareAdminCmd.AddCommand(keyshareAdminLogsCmd)
+	keyshareAdminCmd.AddCommand(keyshareAdminUnblockCmd)
+	keyshareAdminCmd.AddCommand(keyshareAdminCancelDeletionCmd)
+
+	flags := keyshareAdminCmd.PersistentFlags()
+	flags.StringP("server", "s", "", "URL of the keyshare server")
+	flags.StringP("token", "t", "", "admin token of the operator")
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+
+	keyshareAdminStatusCmd.Flags().String("email", "", "find users by email address instead of username")
+	keyshareAdminLogsCmd.Flags().Int("offset", 0, "number of log entries to skip")
+	keyshareAdminLogsCmd.Flags().Int("amount", 20, "number of log entries to show")
+}
+
+func keyshareAdminTransport(cmd *cobra.Command) *irma.HTTPTransport {
+	flags := cmd.Flags()
+	serverURL, _ := flags.GetString("server")
+	token, _ := flags.GetString("token")
+	verbosity, _ := flags.GetCount("verbose")
+	if serverURL == "" || token == "" {
+		die("--server and --token are required", nil)
+	}
+
+	logger.Level = server.Verbosity(verbosity)
+	irma.SetLogger(logger)
+
+	transport := irma.NewHTTPTransport(strings.TrimSuffix(serverURL, "/")+"/admin/", false)
+	transport.SetHeader("Authorization", token)
+	return transport
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/stdlib"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/spf13/cobra"
+)
+
+var keyshareMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the schema of the IRMA keyshare database",
+	Long: `Manage the schema of the IRMA keyshare database.
+
+The keyshare server, MyIRMA server and keyshare tasks apply pending migrations themselves on startup,
+so normally there is no need to run these commands. They refuse to start against a database whose
+schema is newer than they support.`,
+}
+
+var keyshareMigrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, dialect := keyshareMigrateDB(cmd)
+		applied, err := keyshare.MigrateUp(db, dialect)
+		if err != nil {
+			die("failed to apply migrations", err)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database schema is up to date")
+		}
+	},
+}
+
+var keyshareMigrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the most recently applied migrations",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		steps, _ := cmd.Flags().GetInt("steps")
+		if steps < 1 {
+			die("--steps must be at least 1", nil)
+		}
+		db, dialect := keyshareMigrateDB(cmd)
+		reverted, err := keyshare.MigrateDown(db, dialect, steps)
+		if err != nil {
+			die("failed to revert migrations", err)
+		}
+		for _, m := range reverted {
+			fmt.Printf("Reverted migration %d: %s\n", m.Version, m.Description)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No migrations to revert")
+		}
+	},
+}
+
+var keyshareMigrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which migrations have been applied",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, dialect := keyshareMigrateDB(cmd)
+		statuses, err := keyshare.MigrationStatuses(db, dialect)
+		if err != nil {
+			die("failed to determine migration status", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied on " + time.Unix(s.AppliedOn, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-30s %s\n", s.Version, s.Description, applied)
+		}
+	},
+}
+
+func init() {
+	keyshareRootCmd.AddCommand(keyshareMigrateCmd)
+	keyshareMigrateCmd.AddCommand(keyshareMigrateUpCmd, keyshareMigrateDownCmd, keyshareMigrateStatusCmd)
+
+	keyshareMigrateCmd.PersistentFlags().String("db-type", string(keyshare.DialectPostgres), "Type of database to connect to (postgres or mysql)")
+	keyshareMigrateCmd.PersistentFlags().String("db", "", "Database server connection string")
+	keyshareMigrateDownCmd.Flags().Int("steps", 1, "Number of migrations to revert")
+}
+
+func keyshareMigrateDB(cmd *cobra.Command) (*sql.DB, keyshare.Dialect) {
+	connstr, _ := cmd.Flags().GetString("db")
+	if connstr == "" {
+		die("--db is required", nil)
+	}
+	typ, _ := cmd.Flags().GetString("db-type")
+	dialect := keyshare.Dialect(typ)
+	driver := dialect.DriverName()
+	if driver == "" {
+		die("unsupported database type", nil)
+	}
+	db, err := sql.Open(driver, connstr)
+	if err != nil {
+		die("failed to open database", err)
+	}
+	if err = db.Ping(); err != nil {
+		die("failed to connect to database", err)
+	}
+	return db, dialect
+}
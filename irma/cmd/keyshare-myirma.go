@@ -4,6 +4,7 @@ import (
 	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/privacybydesign/irmago/server/keyshare/myirmaserver"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -53,7 +54,7 @@ func init() {
 	flags.StringSlice("cors-allowed-origins", nil, "CORS allowed origins")
 
 	headers["db-type"] = "Database configuration"
-	flags.String("db-type", string(myirmaserver.DBTypePostgres), "Type of database to connect keyshare server to")
+	flags.String("db-type", string(myirmaserver.DBTypePostgres), "Type of database to connect keyshare server to (postgres, mysql or memory)")
 	flags.String("db", "", "Database server connection string")
 
 	headers["keyshare-attributes"] = "IRMA session configuration"
@@ -67,6 +68,9 @@ func init() {
 	flags.String("email-username", "", "Username to use when authenticating with email server")
 	flags.String("email-password", "", "Password to use when authenticating with email server")
 	flags.String("email-from", "", "Email address to use as sender address")
+	flags.String("email-mailer", string(keyshare.MailerTypeSMTP), "How to deliver emails: smtp (using --email-server), file (writing .eml files to --email-dir) or log")
+	flags.String("email-dir", "", "Directory to write emails to when using the file mailer")
+	flags.Bool("email-queue", false, "Store emails in the database, to be delivered with retries by irma keyshare tasks")
 	flags.String("default-language", "en", "Default language, used as fallback when users preferred language is not available")
 	flags.StringToString("login-email-subjects", nil, "Translated subject lines for the login email")
 	flags.StringToString("login-email-files", nil, "Translated emails for the login email")
@@ -75,6 +79,8 @@ func init() {
 	flags.StringToString("delete-email-files", nil, "Translated emails for the delete email email")
 	flags.StringToString("delete-account-subjects", nil, "Translated subject lines for the delete account email")
 	flags.StringToString("delete-account-files", nil, "Translated emails for the delete account email")
+	flags.StringToString("email-added-subjects", nil, "Translated subject lines for the email address added notification")
+	flags.StringToString("email-added-files", nil, "Translated emails for the email address added notification (leave empty to disable)")
 	flags.Int("delete-delay", 0, "delay in days before a user or email address deletion becomes effective")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
@@ -114,13 +120,15 @@ func configureMyirmaServer(cmd *cobra.Command) (*myirmaserver.Configuration, err
 		DeleteEmailSubjects:   viper.GetStringMapString("delete_email_subjects"),
 		DeleteAccountFiles:    viper.GetStringMapString("delete_account_files"),
 		DeleteAccountSubjects: viper.GetStringMapString("delete_account_subjects"),
+		EmailAddedFiles:       viper.GetStringMapString("email_added_files"),
+		EmailAddedSubjects:    viper.GetStringMapString("email_added_subjects"),
 		DeleteDelay:           viper.GetInt("delete_delay"),
 
 		SessionLifetime: viper.GetInt("session_lifetime"),
 	}
 
-	if conf.Production && conf.DBType != myirmaserver.DBTypePostgres {
-		return nil, errors.New("in production mode, db-type must be postgres")
+	if conf.Production && conf.DBType == myirmaserver.DBTypeMemory {
+		return nil, errors.New("in production mode, db-type must be postgres or mysql")
 	}
 
 	conf.URL = server.ReplacePortString(viper.GetString("url"), viper.GetInt("port"))
@@ -5,6 +5,7 @@ import (
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -50,7 +51,7 @@ func init() {
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
 
 	headers["db-type"] = "Database configuration"
-	flags.String("db-type", string(keyshareserver.DBTypePostgres), "Type of database to connect keyshare server to")
+	flags.String("db-type", string(keyshareserver.DBTypePostgres), "Type of database to connect keyshare server to (postgres, mysql or memory)")
 	flags.String("db", "", "Database server connection string")
 
 	headers["jwt-privkey"] = "Cryptographic keys"
@@ -71,10 +72,27 @@ func init() {
 	flags.String("email-username", "", "Username to use when authenticating with email server")
 	flags.String("email-password", "", "Password to use when authenticating with email server")
 	flags.String("email-from", "", "Email address to use as sender address")
+	flags.String("email-mailer", string(keyshare.MailerTypeSMTP), "How to deliver emails: smtp (using --email-server), file (writing .eml files to --email-dir) or log")
+	flags.String("email-dir", "", "Directory to write emails to when using the file mailer")
+	flags.Bool("email-queue", false, "Store emails in the database, to be delivered with retries by irma keyshare tasks")
 	flags.String("default-language", "en", "Default language, used as fallback when users preferred language is not available")
 	flags.StringToString("registration-email-subjects", nil, "Translated subject lines for the registration email")
 	flags.StringToString("registration-email-files", nil, "Translated emails for the registration email")
 	flags.StringToString("verification-url", nil, "Base URL for the email verification link (localized)")
+	flags.StringToString("pin-blocked-email-subjects", nil, "Translated subject lines for the PIN blocked notification")
+	flags.StringToString("pin-blocked-email-files", nil, "Translated emails for the PIN blocked notification (leave empty to disable)")
+	flags.StringToString("pin-changed-email-subjects", nil, "Translated subject lines for the PIN changed notification")
+	flags.StringToString("pin-changed-email-files", nil, "Translated emails for the PIN changed notification (leave empty to disable)")
+
+	headers["admin-tokens"] = "Admin API configuration (leave empty to disable the admin API)"
+	flags.StringToString("admin-tokens", nil, "Tokens of operators allowed to use the admin API, as name=token pairs")
+
+	headers["pin-free-attempts"] = "PIN attempt policy"
+	flags.Int("pin-free-attempts", keyshareserver.PinFreeAttemptsDefault, "Number of consecutive failed PIN attempts before the account is blocked")
+	flags.Int64("pin-backoff-base", keyshareserver.PinBackoffBaseDefault, "Duration in seconds of the first block")
+	flags.Int64("pin-backoff-multiplier", keyshareserver.PinBackoffMultiplierDefault, "Factor by which the duration of each subsequent block is multiplied")
+	flags.Int64("pin-max-block-duration", 0, "Maximum duration of a block in seconds (0 for no maximum)")
+	flags.Int("pin-lock-after-blocks", 0, "Lock the account after this many blocks, until it is unblocked in MyIRMA or by an admin (0 to disable)")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -114,10 +132,24 @@ func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration,
 		RegistrationEmailSubjects: viper.GetStringMapString("registration_email_subjects"),
 		RegistrationEmailFiles:    viper.GetStringMapString("registration_email_files"),
 		VerificationURL:           viper.GetStringMapString("verification_url"),
+		PinBlockedEmailFiles:      viper.GetStringMapString("pin_blocked_email_files"),
+		PinBlockedEmailSubjects:   viper.GetStringMapString("pin_blocked_email_subjects"),
+		PinChangedEmailFiles:      viper.GetStringMapString("pin_changed_email_files"),
+		PinChangedEmailSubjects:   viper.GetStringMapString("pin_changed_email_subjects"),
+
+		AdminTokens: viper.GetStringMapString("admin_tokens"),
+
+		PinPolicy: keyshareserver.PinPolicy{
+			FreeAttempts:      viper.GetInt("pin_free_attempts"),
+			BackoffBase:       viper.GetInt64("pin_backoff_base"),
+			BackoffMultiplier: viper.GetInt64("pin_backoff_multiplier"),
+			MaxBlockDuration:  viper.GetInt64("pin_max_block_duration"),
+			LockAfterBlocks:   viper.GetInt("pin_lock_after_blocks"),
+		},
 	}
 
-	if conf.Production && conf.DBType != keyshareserver.DBTypePostgres {
-		return nil, errors.New("in production mode, db-type must be postgres")
+	if conf.Production && conf.DBType == keyshareserver.DBTypeMemory {
+		return nil, errors.New("in production mode, db-type must be postgres or mysql")
 	}
 
 	conf.URL = server.ReplacePortString(viper.GetString("url"), viper.GetInt("port"))
@@ -1,6 +1,14 @@
 package cmd
 
 import (
+	"expvar"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/privacybydesign/irmago/server/keyshare/tasks"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -11,12 +19,45 @@ var keyshareTaskCmd = &cobra.Command{
 	Short: "Perform IRMA keyshare background tasks",
 	Run: func(command *cobra.Command, args []string) {
 		conf := configureKeyshareTasks(command)
-		if err := tasks.Do(conf); err != nil {
-			die("", err)
+		if !viper.GetBool("daemon") {
+			if err := tasks.Do(conf); err != nil {
+				die("", err)
+			}
+			return
 		}
+		runKeyshareTasksDaemon(conf)
 	},
 }
 
+func runKeyshareTasksDaemon(conf *tasks.Configuration) {
+	daemon, err := tasks.NewDaemon(conf)
+	if err != nil {
+		die("", err)
+	}
+
+	var metricsServer *http.Server
+	if addr := viper.GetString("metrics_addr"); addr != "" {
+		metricsServer = &http.Server{Addr: addr, Handler: expvar.Handler()}
+		go func() {
+			if err := server.FilterStopError(metricsServer.ListenAndServe()); err != nil {
+				_ = server.LogError(err)
+			}
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	daemon.Start()
+	<-interrupt
+
+	logger.Debug("Caught interrupt")
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	daemon.Stop()
+	logger.Info("Exiting")
+}
+
 func init() {
 	keyshareRootCmd.AddCommand(keyshareTaskCmd)
 
@@ -29,7 +70,8 @@ func init() {
 
 	flags.StringP("config", "c", "", "path to configuration file")
 
-	headers["db"] = "Database configuration"
+	headers["db-type"] = "Database configuration"
+	flags.String("db-type", string(keyshare.DialectPostgres), "Type of database to connect to (postgres or mysql)")
 	flags.String("db", "", "Database server connection string")
 
 	headers["expiry-delay"] = "Time period configuration"
@@ -42,9 +84,23 @@ func init() {
 	flags.String("email-username", "", "Username to use when authenticating with email server")
 	flags.String("email-password", "", "Password to use when authenticating with email server")
 	flags.String("email-from", "", "Email address to use as sender address")
+	flags.String("email-mailer", string(keyshare.MailerTypeSMTP), "How to deliver emails: smtp (using --email-server), file (writing .eml files to --email-dir) or log")
+	flags.String("email-dir", "", "Directory to write emails to when using the file mailer")
+	flags.Bool("email-queue", false, "Store emails in the database, to be delivered with retries by irma keyshare tasks")
 	flags.String("default-language", "en", "Default language, used as fallback when users preferred language is not available")
 	flags.StringToString("expired-email-subjects", nil, "Translated subject lines for the expired account email")
 	flags.StringToString("expired-email-files", nil, "Translated emails for the expired account email")
+	flags.Int("email-max-attempts", tasks.EmailMaxAttemptsDefault, "Maximum number of attempts to deliver a queued email")
+	flags.Int("email-retry-delay", tasks.EmailRetryDelayDefault, "Seconds before retrying delivery of a queued email (doubled after each attempt)")
+
+	headers["daemon"] = "Daemon mode"
+	flags.Bool("daemon", false, "Keep running, performing each task periodically, instead of performing all tasks once")
+	flags.Int("cleanup-emails-interval", tasks.CleanupIntervalDefault, "Seconds between removing email addresses marked for deletion (negative to disable)")
+	flags.Int("cleanup-tokens-interval", tasks.CleanupIntervalDefault, "Seconds between removing expired login and verification tokens (negative to disable)")
+	flags.Int("cleanup-accounts-interval", tasks.CleanupIntervalDefault, "Seconds between removing accounts scheduled for deletion (negative to disable)")
+	flags.Int("expire-accounts-interval", tasks.ExpireAccountsIntervalDefault, "Seconds between marking inactive accounts for deletion (negative to disable)")
+	flags.Int("send-queued-emails-interval", tasks.SendQueuedEmailsIntervalDefault, "Seconds between delivering emails from the email queue (negative to disable)")
+	flags.String("metrics-addr", "", "Address to serve task statistics at /debug/vars (leave empty to disable)")
 
 	headers["verbose"] = "Other options"
 	flags.CountP("verbose", "v", "verbose (repeatable)")
@@ -58,6 +114,7 @@ func configureKeyshareTasks(cmd *cobra.Command) *tasks.Configuration {
 	return &tasks.Configuration{
 		EmailConfiguration: configureEmail(),
 
+		DBType:    keyshare.Dialect(viper.GetString("db_type")),
 		DBConnStr: viper.GetString("db_str"),
 
 		ExpiryDelay: viper.GetInt("expiry_delay"),
@@ -66,6 +123,15 @@ func configureKeyshareTasks(cmd *cobra.Command) *tasks.Configuration {
 		DeleteExpiredAccountSubjects: viper.GetStringMapString("expired_email_subjects"),
 		DeleteExpiredAccountFiles:    viper.GetStringMapString("expired_email_files"),
 
+		EmailMaxAttempts: viper.GetInt("email_max_attempts"),
+		EmailRetryDelay:  viper.GetInt("email_retry_delay"),
+
+		CleanupEmailsInterval:    viper.GetInt("cleanup_emails_interval"),
+		CleanupTokensInterval:    viper.GetInt("cleanup_tokens_interval"),
+		CleanupAccountsInterval:  viper.GetInt("cleanup_accounts_interval"),
+		ExpireAccountsInterval:   viper.GetInt("expire_accounts_interval"),
+		SendQueuedEmailsInterval: viper.GetInt("send_queued_emails_interval"),
+
 		Verbose: viper.GetInt("verbose"),
 		Quiet:   viper.GetBool("quiet"),
 		LogJSON: viper.GetBool("log_json"),
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var walletBackupCmd = &cobra.Command{
+	Use:   "backup <file>",
+	Short: "Write an encrypted backup of the wallet to a file",
+	Long: `Write an encrypted backup of the wallet to a file.
+
+The backup contains the secret key, credentials, keyshare server enrollments, logs and preferences
+of the wallet, encrypted with a key derived from the passphrase. The passphrase is read from
+--passphrase or from the IRMA_WALLET_PASSPHRASE environment variable.`,
+	Example: "IRMA_WALLET_PASSPHRASE=secret irma wallet backup wallet.backup",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase := walletPassphrase(cmd)
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		backup, err := client.ExportBackup(passphrase)
+		if err != nil {
+			die("failed to create backup", err)
+		}
+		if err = ioutil.WriteFile(args[0], backup, 0600); err != nil {
+			die("failed to write backup", err)
+		}
+		fmt.Println("Backup written to", args[0])
+	},
+}
+
+var walletRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Replace the contents of the wallet by an encrypted backup",
+	Long: `Replace the contents of the wallet by an encrypted backup created with "irma wallet backup".
+
+The signatures of all credentials in the backup are verified against the schemes of the wallet
+before anything is replaced. The passphrase is read from --passphrase or from the
+IRMA_WALLET_PASSPHRASE environment variable.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase := walletPassphrase(cmd)
+		backup, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			die("failed to read backup", err)
+		}
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		if err = client.ImportBackup(backup, passphrase); err != nil {
+			die("failed to restore backup", err)
+		}
+		fmt.Printf("Restored backup containing %d credentials\n", len(client.CredentialInfoList()))
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(walletBackupCmd)
+	walletCmd.AddCommand(walletRestoreCmd)
+
+	for _, cmd := range []*cobra.Command{walletBackupCmd, walletRestoreCmd} {
+		cmd.Flags().String("passphrase", "", "passphrase of the backup (default $IRMA_WALLET_PASSPHRASE)")
+	}
+}
+
+func walletPassphrase(cmd *cobra.Command) string {
+	passphrase, _ := cmd.Flags().GetString("passphrase")
+	if passphrase == "" {
+		passphrase = os.Getenv("IRMA_WALLET_PASSPHRASE")
+	}
+	if passphrase == "" {
+		die("specify the backup passphrase with --passphrase or IRMA_WALLET_PASSPHRASE", nil)
+	}
+	return passphrase
+}
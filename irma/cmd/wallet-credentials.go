@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var walletListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the credentials in the wallet as JSON",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		creds := client.CredentialInfoList()
+		if creds == nil {
+			creds = irma.CredentialInfoList{}
+		}
+		fmt.Println(prettyprint(creds))
+	},
+}
+
+var walletRemoveCmd = &cobra.Command{
+	Use:   "remove [hash...]",
+	Short: "Remove credentials from the wallet",
+	Long: `Remove the credentials with the specified hashes, as shown by "irma wallet list", from the
+wallet, or all credentials if --all is specified. Keyshare server enrollments are kept.`,
+	Example: `irma wallet remove 6+ZjmfTuOfnbsBfzgwhMUF63qmP/e3RQC3mmCGDMtHU=
+irma wallet remove --all`,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		if all == (len(args) > 0) {
+			die("specify either credential hashes or --all", nil)
+		}
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		hashes := args
+		if all {
+			hashes = nil
+			for _, cred := range client.CredentialInfoList() {
+				hashes = append(hashes, cred.Hash)
+			}
+		}
+		for _, hash := range hashes {
+			if err := client.RemoveCredentialByHash(hash); err != nil {
+				die("failed to remove credential "+hash, err)
+			}
+		}
+		fmt.Printf("Removed %d credentials\n", len(hashes))
+	},
+}
+
+var walletUpdateRevocationCmd = &cobra.Command{
+	Use:   "update-revocation",
+	Short: "Update the nonrevocation witnesses of the credentials in the wallet",
+	Long: `Fetch the latest revocation updates for all credentials in the wallet that support
+revocation, and update their nonrevocation witnesses. Credentials that turn out to be revoked
+are reported, and are shown as revoked by "irma wallet list".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		updated := map[irma.CredentialTypeIdentifier]struct{}{}
+		for _, cred := range client.CredentialInfoList() {
+			id := cred.Identifier()
+			if _, ok := updated[id]; ok || !cred.RevocationSupported {
+				continue
+			}
+			updated[id] = struct{}{}
+			if err := client.NonrevUpdateFromServer(id); err != nil {
+				die("failed to update nonrevocation witnesses of "+id.String(), err)
+			}
+			fmt.Println("Updated nonrevocation witnesses of", id)
+		}
+
+		for _, cred := range client.CredentialInfoList() {
+			if cred.Revoked {
+				fmt.Printf("Credential %s %s is revoked\n", cred.Identifier(), cred.Hash)
+			}
+		}
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(walletListCmd)
+	walletCmd.AddCommand(walletRemoveCmd)
+	walletCmd.AddCommand(walletUpdateRevocationCmd)
+
+	walletRemoveCmd.Flags().Bool("all", false, "remove all credentials")
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var walletEnrollCmd = &cobra.Command{
+	Use:   "enroll [scheme]",
+	Short: "Enroll the wallet at the keyshare server of a scheme",
+	Long: `Enroll the wallet at the keyshare server of a scheme, using the PIN from --pin.
+
+If no scheme is specified, the wallet is enrolled at the keyshare servers of all schemes
+having one at which it is not yet enrolled.`,
+	Example: "irma wallet enroll pbdf --pin 12345 --email user@example.com",
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		pin, _ := flags.GetString("pin")
+		email, _ := flags.GetString("email")
+		lang, _ := flags.GetString("lang")
+		if pin == "" {
+			die("specify the PIN with --pin", nil)
+		}
+
+		client, handler := openWallet(cmd)
+		defer client.Close()
+
+		var managers []irma.SchemeManagerIdentifier
+		if len(args) == 1 {
+			managers = []irma.SchemeManagerIdentifier{irma.NewSchemeManagerIdentifier(args[0])}
+		} else {
+			managers = client.UnenrolledSchemeManagers()
+			if len(managers) == 0 {
+				fmt.Println("Wallet is enrolled at all keyshare servers")
+				return
+			}
+		}
+
+		var emailPtr *string
+		if email != "" {
+			emailPtr = &email
+		}
+		for _, manager := range managers {
+			client.KeyshareEnroll(manager, emailPtr, pin, lang)
+			select {
+			case err := <-handler.enrollment:
+				if err != nil {
+					die("failed to enroll at keyshare server of "+manager.String(), err)
+				}
+			case <-walletTimeout(cmd):
+				die("failed to enroll at keyshare server of "+manager.String(), errors.New("timeout"))
+			}
+			fmt.Println("Enrolled at keyshare server of", manager)
+		}
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(walletEnrollCmd)
+
+	flags := walletEnrollCmd.Flags()
+	flags.String("pin", "", "PIN to enroll with (at least 5 digits)")
+	flags.String("email", "", "email address to register at the keyshare server")
+	flags.String("lang", "en", "language of the emails sent by the keyshare server")
+}
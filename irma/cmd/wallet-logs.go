@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var walletLogsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Print the most recent log entries of the wallet as JSON",
+	Long: `Print the most recent log entries of the wallet as JSON, newest first. For each entry the
+disclosed attributes, issued credentials, signed message or removed credentials are included.
+The entries can be filtered by session type, requestor, credential type and time.`,
+	Example: "irma wallet logs --type disclosing --type signing --credential irma-demo.RU.studentCard --from 2022-01-01",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		amount, _ := cmd.Flags().GetInt("amount")
+		filter, err := walletLogFilter(cmd)
+		if err != nil {
+			die("failed to parse filter", err)
+		}
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		entries, err := client.SearchLogs(filter, 0, amount)
+		if err != nil {
+			die("failed to load logs", err)
+		}
+		summaries := make([]*walletLogEntry, 0, len(entries))
+		for _, entry := range entries {
+			summary, err := summarizeLogEntry(entry, client.Configuration)
+			if err != nil {
+				die(fmt.Sprintf("failed to parse log entry %d", entry.ID), err)
+			}
+			summaries = append(summaries, summary)
+		}
+		fmt.Println(prettyprint(summaries))
+	},
+}
+
+// walletLogEntry is the human-readable form of an irmaclient.LogEntry printed by "irma wallet logs".
+type walletLogEntry struct {
+	ID        uint64                                                    `json:"id"`
+	Type      irma.Action                                               `json:"type"`
+	Time      irma.Timestamp                                            `json:"time"`
+	Requestor *irma.RequestorInfo                                       `json:"requestor,omitempty"`
+	Disclosed [][]*irma.DisclosedAttribute                              `json:"disclosed,omitempty"`
+	Issued    irma.CredentialInfoList                                   `json:"issued,omitempty"`
+	Message   string                                                    `json:"message,omitempty"`
+	Removed   map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"removed,omitempty"`
+	Renewed   map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"renewed,omitempty"`
+}
+
+func summarizeLogEntry(entry *irmaclient.LogEntry, conf *irma.Configuration) (*walletLogEntry, error) {
+	summary := &walletLogEntry{
+		ID:        entry.ID,
+		Type:      entry.Type,
+		Time:      entry.Time,
+		Requestor: entry.ServerName,
+		Removed:   entry.Removed,
+		Renewed:   entry.Renewed,
+	}
+	if entry.Type == irmaclient.ActionRemoval {
+		return summary, nil
+	}
+
+	var err error
+	if summary.Disclosed, err = entry.GetDisclosedCredentials(conf); err != nil {
+		return nil, err
+	}
+	if summary.Issued, err = entry.GetIssuedCredentials(conf); err != nil {
+		return nil, err
+	}
+	msg, err := entry.GetSignedMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg != nil {
+		summary.Message = msg.Message
+	}
+	return summary, nil
+}
+
+var walletExportLogsCmd = &cobra.Command{
+	Use:   "export-logs",
+	Short: "Export log entries of the wallet, including their proofs",
+	Long: `Export the log entries of the wallet matching the filter flags (all entries by default) as JSON,
+including the session requests, the proofs of disclosure sessions, and the signed messages of
+signature sessions with their timestamps. The export can be verified with "irma wallet verify-logs".`,
+	Example: "irma wallet export-logs --type signing --output signatures.json",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		filter, err := walletLogFilter(cmd)
+		if err != nil {
+			die("failed to parse filter", err)
+		}
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		export, err := client.ExportLogs(filter)
+		if err != nil {
+			die("failed to export logs", err)
+		}
+		bts, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			die("failed to serialize logs", err)
+		}
+		if output == "" {
+			fmt.Println(string(bts))
+			return
+		}
+		if err = ioutil.WriteFile(output, bts, 0600); err != nil {
+			die("failed to write logs", err)
+		}
+		fmt.Printf("Exported %d log entries to %s\n", len(export.Entries), output)
+	},
+}
+
+var walletVerifyLogsCmd = &cobra.Command{
+	Use:   "verify-logs <file>",
+	Short: "Verify the proofs in exported log entries",
+	Long: `Verify the proofs of the disclosure and signature sessions in log entries exported by
+"irma wallet export-logs", against the public keys in --schemes-path. Signatures are verified at the
+time of their timestamp, and disclosures at the time of the log entry. The wallet is not used.
+Exits with a nonzero status if any of the proofs is invalid.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		schemesPath, _ := cmd.Flags().GetString("schemes-path")
+		bts, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			die("failed to read logs", err)
+		}
+		export, err := irmaclient.ParseLogExport(bts)
+		if err != nil {
+			die("failed to parse logs", err)
+		}
+		conf, err := irma.NewConfiguration(schemesPath, irma.ConfigurationOptions{ReadOnly: true})
+		if err != nil {
+			die("failed to open schemes", err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			die("failed to parse schemes", err)
+		}
+
+		invalid := 0
+		for _, entry := range export.Entries {
+			status, err := entry.Verify(conf)
+			switch {
+			case err == irmaclient.ErrLogEntryUnverifiable:
+				fmt.Printf("%d (%s): no proofs\n", entry.ID, entry.Type)
+			case err != nil:
+				invalid++
+				fmt.Printf("%d (%s): %s: %v\n", entry.ID, entry.Type, status, err)
+			case status != irma.ProofStatusValid:
+				invalid++
+				fmt.Printf("%d (%s): %s\n", entry.ID, entry.Type, status)
+			default:
+				fmt.Printf("%d (%s): %s\n", entry.ID, entry.Type, status)
+			}
+		}
+		if invalid > 0 {
+			die(fmt.Sprintf("%d log entries have invalid proofs", invalid), nil)
+		}
+	},
+}
+
+// walletLogFilter returns the log filter specified by the flags of the command.
+func walletLogFilter(cmd *cobra.Command) (irmaclient.LogFilter, error) {
+	flags := cmd.Flags()
+	types, _ := flags.GetStringArray("type")
+	requestor, _ := flags.GetString("requestor")
+	hostname, _ := flags.GetString("hostname")
+	credential, _ := flags.GetString("credential")
+	from, _ := flags.GetString("from")
+	until, _ := flags.GetString("until")
+
+	filter := irmaclient.LogFilter{Hostname: hostname}
+	for _, t := range types {
+		filter.Types = append(filter.Types, irma.Action(t))
+	}
+	if requestor != "" {
+		filter.Requestor = irma.NewRequestorIdentifier(requestor)
+	}
+	if credential != "" {
+		filter.CredentialType = irma.NewCredentialTypeIdentifier(credential)
+	}
+	var err error
+	if filter.From, err = parseLogTime(from, false); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseLogTime(until, true); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// parseLogTime parses a date (2006-01-02) or an RFC 3339 time. Dates are parsed as the start of
+// the day, or as its end if endOfDay is true.
+func parseLogTime(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func addWalletLogFilterFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringArray("type", nil, "session type of the entries: disclosing, signing, issuing or removal (repeatable)")
+	flags.String("requestor", "", "identifier of the requestor of the entries")
+	flags.String("hostname", "", "hostname of the requestor of the entries")
+	flags.String("credential", "", "credential type disclosed, issued or removed in the entries")
+	flags.String("from", "", "earliest time of the entries (date or RFC 3339)")
+	flags.String("until", "", "latest time of the entries (date or RFC 3339)")
+}
+
+func init() {
+	walletCmd.AddCommand(walletLogsCmd, walletExportLogsCmd, walletVerifyLogsCmd)
+
+	walletLogsCmd.Flags().Int("amount", 20, "maximum number of log entries to print")
+	addWalletLogFilterFlags(walletLogsCmd)
+	walletExportLogsCmd.Flags().StringP("output", "o", "", "file to write the logs to (default standard output)")
+	addWalletLogFilterFlags(walletExportLogsCmd)
+}
@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/spf13/cobra"
+)
+
+var walletHandleCmd = &cobra.Command{
+	Use:   "handle <qr-json|url|->",
+	Short: "Perform an IRMA session with the wallet",
+	Long: `Perform an IRMA disclosure, signature or issuance session with the wallet, without user interaction.
+
+The session is specified by the JSON contents of its QR code, by a universal link containing those
+(https://irma.app/-/session#...), by the URL of the session at the IRMA server together with
+--action, or by a disclosure or signature request for a session without IRMA server. If the
+argument is -, it is read from standard input.
+
+The wallet consents to the session unless --deny is specified. From each disjunction an option
+of which the wallet has all attributes in non-expired, non-revoked credentials is disclosed. Options
+containing --never-disclose attributes are never chosen, and nothing is disclosed to requestors
+specified by --deny-requestor or --deny-hostname. Of the remaining options, the one that is
+preferred by the first --prefer policy is chosen (newest, fewest-attributes or non-expiring), ties
+being broken by the next --prefer policies and finally by the order of the options in the session
+request. If the session requires pairing, the pairing code is printed to standard error.`,
+	Example: `irma wallet handle '{"u":"http://localhost:8088/irma/session/Ag4vUHnMHrHvgeGZGVPi","irmaqr":"disclosing"}' --pin 12345
+irma session --noqr ... | irma wallet handle -
+irma wallet handle http://localhost:8088/irma/session/Ag4vUHnMHrHvgeGZGVPi --action issuing --pin 12345`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		action, _ := flags.GetString("action")
+		deny, _ := flags.GetBool("deny")
+		pin, _ := flags.GetString("pin")
+
+		request, err := walletSessionRequest(args[0], irma.Action(action))
+		if err != nil {
+			die("failed to parse session", err)
+		}
+
+		policies, err := walletChoicePolicies(cmd)
+		if err != nil {
+			die("failed to parse choice policies", err)
+		}
+
+		client, _ := openWallet(cmd)
+		defer client.Close()
+
+		handler := &walletSessionHandler{
+			client:   client,
+			policies: policies,
+			deny:     deny,
+			pin:      pin,
+			result:   make(chan walletSessionResult, 1),
+		}
+		dismisser := client.NewSession(request, handler)
+		select {
+		case result := <-handler.result:
+			if result.err != nil {
+				die("session failed", result.err)
+			}
+			if deny {
+				fmt.Println("Session refused")
+				return
+			}
+			fmt.Println("Session succeeded")
+			if result.message != "" {
+				fmt.Println(result.message)
+			}
+		case <-walletTimeout(cmd):
+			if dismisser != nil {
+				dismisser.Dismiss()
+			}
+			die("session failed", errors.New("timeout"))
+		}
+	},
+}
+
+func init() {
+	walletCmd.AddCommand(walletHandleCmd)
+
+	flags := walletHandleCmd.Flags()
+	flags.String("pin", "", "keyshare PIN, for sessions involving credentials of schemes with a keyshare server")
+	flags.String("action", string(irma.ActionDisclosing), "session type, if the session is specified by its URL (disclosing, signing, issuing)")
+	flags.Bool("deny", false, "refuse the session instead of consenting to it")
+	flags.StringArray("prefer", nil, "choice preference: newest, fewest-attributes or non-expiring (repeatable, in order of precedence)")
+	flags.StringArray("never-disclose", nil, "never disclose this attribute (repeatable)")
+	flags.StringArray("deny-requestor", nil, "refuse sessions of the requestor with this identifier (repeatable)")
+	flags.StringArray("deny-hostname", nil, "refuse sessions of requestors at this hostname (repeatable)")
+}
+
+// walletSessionRequest returns the session request or QR contents for irmaclient.Client.NewSession
+// from the argument of the handle command.
+func walletSessionRequest(arg string, action irma.Action) (string, error) {
+	if arg == "-" {
+		var err error
+		if arg, err = readSessionLine(os.Stdin); err != nil {
+			return "", err
+		}
+	}
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "{") {
+		return arg, nil
+	}
+
+	u, err := url.Parse(arg)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", errors.New("argument is neither JSON nor a HTTP(S) URL")
+	}
+	if u.Fragment != "" {
+		// Universal link, containing the QR contents in the fragment
+		return u.Fragment, nil
+	}
+	qr, err := json.Marshal(&irma.Qr{URL: arg, Type: action})
+	if err != nil {
+		return "", err
+	}
+	return string(qr), nil
+}
+
+// readSessionLine returns the first line of the input that is a JSON object or a URL, without
+// waiting for the rest of the input, so that the output of commands that print the QR contents
+// and then wait for the session to finish (like irma session --noqr) can be piped into the
+// handle command.
+func readSessionLine(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "{") || strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			return line, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no session found in input")
+}
+
+type walletSessionResult struct {
+	message string
+	err     error
+}
+
+// walletSessionHandler handles an IRMA session of the wallet without user interaction.
+type walletSessionHandler struct {
+	client     *irmaclient.Client
+	policies   []irmaclient.ChoicePolicy
+	deny       bool
+	pin        string
+	pinEntered bool
+	result     chan walletSessionResult
+}
+
+func (h *walletSessionHandler) finish(message string, err error) {
+	select {
+	case h.result <- walletSessionResult{message: message, err: err}:
+	default: // already finished
+	}
+}
+
+func (h *walletSessionHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	logger.Debugf("Session status of %s session: %s", action, status)
+}
+
+func (h *walletSessionHandler) ClientReturnURLSet(clientReturnURL string) {
+	logger.Infof("Client return URL: %s", clientReturnURL)
+}
+
+func (h *walletSessionHandler) PairingRequired(pairingCode string) {
+	fmt.Fprintln(os.Stderr, "Pairing code:", pairingCode)
+}
+
+func (h *walletSessionHandler) Success(result string) {
+	h.finish(result, nil)
+}
+
+func (h *walletSessionHandler) Cancelled() {
+	if h.deny {
+		h.finish("", nil) // we cancelled the session ourselves
+		return
+	}
+	h.finish("", errors.New("session cancelled"))
+}
+
+func (h *walletSessionHandler) Failure(err *irma.SessionError) {
+	h.finish("", err)
+}
+
+func (h *walletSessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish("", errors.Errorf("blocked at keyshare server of %s for %d seconds", manager, duration))
+}
+
+func (h *walletSessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("enrollment at keyshare server of %s is incomplete", manager))
+}
+
+func (h *walletSessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("not enrolled at keyshare server of %s", manager))
+}
+
+func (h *walletSessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("enrollment at keyshare server of %s was deleted", manager))
+}
+
+func (h *walletSessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requestPermission(request, requestorInfo, satisfiable, candidates, callback)
+}
+
+func (h *walletSessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requestPermission(request, requestorInfo, satisfiable, candidates, callback)
+}
+
+func (h *walletSessionHandler) RequestSignaturePermission(request *irma.SignatureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requestPermission(request, requestorInfo, satisfiable, candidates, callback)
+}
+
+func (h *walletSessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(false)
+}
+
+func (h *walletSessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	if h.pin == "" {
+		h.finish("", errors.New("session requires a keyshare PIN, specify it with --pin"))
+		callback(false, "")
+		return
+	}
+	if h.pinEntered {
+		// The PIN we entered before was incorrect; don't waste the remaining attempts
+		h.finish("", errors.Errorf("incorrect PIN, %d attempts remaining", remainingAttempts))
+		callback(false, "")
+		return
+	}
+	h.pinEntered = true
+	callback(true, h.pin)
+}
+
+func (h *walletSessionHandler) requestPermission(
+	request irma.SessionRequest,
+	requestorInfo *irma.RequestorInfo,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	callback irmaclient.PermissionHandler,
+) {
+	if h.deny {
+		callback(false, nil)
+		return
+	}
+	if !satisfiable {
+		h.finish("", errors.New("wallet does not contain the requested attributes"))
+		callback(false, nil)
+		return
+	}
+	choice, explanation, err := h.client.ChooseCandidates(request, requestorInfo, candidates, h.policies...)
+	logger.Debugf("Disclosure choice:\n%s", explanation)
+	if err != nil {
+		h.finish("", errors.Errorf("%v:\n%s", err, strings.TrimSpace(explanation.String())))
+		callback(false, nil)
+		return
+	}
+	callback(true, choice)
+}
+
+// walletChoicePolicies returns the choice policies specified by the flags of the handle command.
+func walletChoicePolicies(cmd *cobra.Command) ([]irmaclient.ChoicePolicy, error) {
+	flags := cmd.Flags()
+	prefer, _ := flags.GetStringArray("prefer")
+	denyRequestors, _ := flags.GetStringArray("deny-requestor")
+	denyHostnames, _ := flags.GetStringArray("deny-hostname")
+	neverDisclose, _ := flags.GetStringArray("never-disclose")
+
+	var policies []irmaclient.ChoicePolicy
+	if len(denyRequestors) > 0 || len(denyHostnames) > 0 {
+		policy := irmaclient.DenyRequestors{Hostnames: denyHostnames}
+		for _, id := range denyRequestors {
+			policy.Requestors = append(policy.Requestors, irma.NewRequestorIdentifier(id))
+		}
+		policies = append(policies, policy)
+	}
+	if len(neverDisclose) > 0 {
+		policy := irmaclient.NeverDisclose{}
+		for _, id := range neverDisclose {
+			policy.Attributes = append(policy.Attributes, irma.NewAttributeTypeIdentifier(id))
+		}
+		policies = append(policies, policy)
+	}
+	for _, p := range prefer {
+		switch p {
+		case "newest":
+			policies = append(policies, irmaclient.PreferNewest{})
+		case "fewest-attributes":
+			policies = append(policies, irmaclient.PreferFewestAttributes{})
+		case "non-expiring":
+			policies = append(policies, irmaclient.PreferNonExpiring{})
+		default:
+			return nil, errors.Errorf("unknown preference %s", p)
+		}
+	}
+	return policies, nil
+}
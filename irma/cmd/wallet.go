@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var walletCmd = &cobra.Command{
+	Use:   "wallet",
+	Short: "Act as an IRMA app, using a wallet stored in a local directory",
+	Long: `Act as an IRMA app, using a wallet stored in a local directory.
+
+The wallet directory (--storage) is created if it does not exist. The schemes from --schemes-path
+are copied into it and are kept up to date within the wallet directory. With --profile, the wallet
+directory contains multiple wallets (profiles) sharing the schemes, of which the named one is used.
+
+The wallet commands are non-interactive, so that they can be used to simulate users in scripts
+and test pipelines against IRMA servers and keyshare servers.`,
+}
+
+var walletInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a new wallet",
+	Long: `Create a new wallet in the wallet directory, with a new secret key and the schemes from
+--schemes-path. Fails if the directory already contains a wallet.`,
+	Example: "irma wallet init --storage /tmp/wallet --schemes-path irma_configuration --developer-mode",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		storagePath, _ := cmd.Flags().GetString("storage")
+		profile, _ := cmd.Flags().GetString("profile")
+		if profile == "" {
+			if _, err := os.Stat(filepath.Join(storagePath, "db")); err == nil {
+				die("wallet already exists in "+storagePath, nil)
+			}
+		} else if _, err := os.Stat(filepath.Join(storagePath, "profiles", profile)); err == nil {
+			die("profile "+profile+" already exists in "+storagePath, nil)
+		}
+		client, _ := openWallet(cmd)
+		defer client.Close()
+		fmt.Println("Created wallet in", storagePath)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(walletCmd)
+	walletCmd.AddCommand(walletInitCmd)
+
+	flags := walletCmd.PersistentFlags()
+	flags.String("storage", defaultWalletPath(), "path to the wallet directory")
+	flags.StringP("schemes-path", "s", irma.DefaultSchemesPath(), "path to irma_configuration to initialize the wallet with")
+	flags.Bool("developer-mode", false, "allow HTTP connections to IRMA servers and keyshare servers (stored in the wallet)")
+	flags.Duration("timeout", time.Minute, "maximum duration of actions involving servers")
+	flags.String("storage-key", "", "hex-encoded 32-byte key with which the wallet storage is encrypted")
+	flags.String("profile", "", "name of the profile within the wallet directory to use")
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+}
+
+func defaultWalletPath() string {
+	p := irma.DefaultDataPath()
+	if p == "" {
+		return ""
+	}
+	return filepath.Join(p, "wallet")
+}
+
+// openWallet opens the wallet specified by the flags of the command.
+func openWallet(cmd *cobra.Command) (*irmaclient.Client, *walletHandler) {
+	flags := cmd.Flags()
+	storagePath, _ := flags.GetString("storage")
+	schemesPath, _ := flags.GetString("schemes-path")
+	verbosity, _ := flags.GetCount("verbose")
+	if storagePath == "" {
+		die("--storage is required", nil)
+	}
+
+	logger.Level = server.Verbosity(verbosity)
+	irma.SetLogger(logger)
+
+	if err := os.MkdirAll(storagePath, 0700); err != nil {
+		die("failed to create wallet directory", err)
+	}
+	var aesKey []byte
+	if key, _ := flags.GetString("storage-key"); key != "" {
+		var err error
+		if aesKey, err = hex.DecodeString(key); err != nil {
+			die("failed to parse --storage-key", err)
+		}
+	}
+
+	handler := &walletHandler{enrollment: make(chan error, 1)}
+	var client *irmaclient.Client
+	var err error
+	if profile, _ := flags.GetString("profile"); profile != "" {
+		client, err = openWalletProfile(storagePath, schemesPath, profile, handler, aesKey)
+	} else {
+		client, err = irmaclient.New(storagePath, schemesPath, handler, aesKey)
+	}
+	if err != nil {
+		die("failed to open wallet", err)
+	}
+	if flags.Changed("developer-mode") {
+		developerMode, _ := flags.GetBool("developer-mode")
+		prefs := client.Preferences
+		prefs.DeveloperMode = developerMode
+		client.SetPreferences(prefs)
+	}
+	return client, handler
+}
+
+// openWalletProfile opens the profile in the wallet directory, creating it if it does not exist.
+func openWalletProfile(storagePath, schemesPath, profile string, handler *walletHandler, aesKey []byte) (*irmaclient.Client, error) {
+	profiles, err := irmaclient.NewProfiles(storagePath, schemesPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := profiles.Open(profile, handler, aesKey)
+	if err == irmaclient.ErrProfileNotFound {
+		client, err = profiles.Create(profile, handler, aesKey)
+	}
+	return client, err
+}
+
+// walletTimeout returns a channel that fires after the --timeout of the command.
+func walletTimeout(cmd *cobra.Command) <-chan time.Time {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	return time.After(timeout)
+}
+
+// walletHandler handles the callbacks of the irmaclient.Client of the wallet commands, which
+// run one action at a time and report its outcome themselves, by logging them. The outcome of
+// keyshare enrollments is also passed to the enrollment channel.
+type walletHandler struct {
+	enrollment chan error
+}
+
+func (h *walletHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
+func (h *walletHandler) UpdateAttributes()                               {}
+
+func (h *walletHandler) Revoked(cred *irma.CredentialIdentifier) {
+	logger.Warnf("Credential %s was revoked", cred.Type)
+}
+
+func (h *walletHandler) ExpiringCredentials(creds []*irmaclient.ExpiringCredential) {
+	for _, cred := range creds {
+		logger.Warnf("Credential %s expires on %s", cred.Identifier(), time.Time(cred.Expires).Format(time.RFC1123))
+	}
+}
+
+func (h *walletHandler) ReportError(err error) {
+	logger.Error(err)
+}
+
+func (h *walletHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {
+	logger.Errorf("Enrollment at keyshare server of %s failed: %v", manager, err)
+	h.enrolled(err)
+}
+
+func (h *walletHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
+	logger.Infof("Enrolled at keyshare server of %s", manager)
+	h.enrolled(nil)
+}
+
+func (h *walletHandler) enrolled(err error) {
+	select {
+	case h.enrollment <- err:
+	default: // nobody is waiting for the outcome
+	}
+}
+
+func (h *walletHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error) {
+	logger.Errorf("Changing PIN at keyshare server of %s failed: %v", manager, err)
+}
+
+func (h *walletHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
+	logger.Infof("Changed PIN at keyshare server of %s", manager)
+}
+
+func (h *walletHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {
+	logger.Errorf("Incorrect PIN for keyshare server of %s, %d attempts remaining", manager, attempts)
+}
+
+func (h *walletHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
+	logger.Errorf("Blocked at keyshare server of %s for %d seconds", manager, timeout)
+}
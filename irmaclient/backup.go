@@ -0,0 +1,308 @@
+package irmaclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file contains the export and import of encrypted backups of the client's storage,
+// with which the wallet can be moved to another device or installation.
+
+// backupVersion is the version of the backup format produced by ExportBackup.
+const backupVersion = 1
+
+// Parameters of the scrypt key derivation from the passphrase, for backupVersion 1.
+const (
+	backupScryptN  = 1 << 15
+	backupScryptR  = 8
+	backupScryptP  = 1
+	backupSaltSize = 32
+)
+
+var (
+	ErrBackupPassphrase = errors.New("backup could not be decrypted: wrong passphrase or corrupted backup")
+	ErrBackupVersion    = errors.New("unsupported backup version")
+)
+
+// backupArchive is the serialized form of a backup. The ciphertext is the AES-GCM encryption,
+// with a key derived from the passphrase, of the JSON-encoded backupContents. The version and
+// salt are authenticated as additional data.
+type backupArchive struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// backupContents contains all buckets of the storage of the client.
+type backupContents struct {
+	Buckets map[string]*backupBucket `json:"buckets"`
+}
+
+type backupBucket struct {
+	Sequence uint64        `json:"sequence"`
+	Entries  []backupEntry `json:"entries"`
+}
+
+type backupEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// ExportBackup returns an archive of all data of the client: its secret key, credentials and their
+// revocation witnesses, keyshare server enrollments, logs and preferences, encrypted with a key
+// derived from the specified passphrase. It can be restored using ImportBackup.
+func (client *Client) ExportBackup(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup passphrase must not be empty")
+	}
+
+	contents, err := client.storage.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := backupArchive{Version: backupVersion, Salt: make([]byte, backupSaltSize)}
+	if _, err = rand.Read(archive.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := archive.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	archive.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(archive.Nonce); err != nil {
+		return nil, err
+	}
+	archive.Ciphertext = aead.Seal(nil, archive.Nonce, plaintext, archive.additionalData())
+
+	return json.Marshal(archive)
+}
+
+// ImportBackup replaces all data of the client by the contents of the specified backup, created
+// by ExportBackup. Before anything is replaced, the signatures of all credentials in the backup are
+// verified against the public keys in the current irma.Configuration of the client; if any of them
+// is invalid or cannot be verified, the backup is not imported.
+func (client *Client) ImportBackup(backup []byte, passphrase string) error {
+	var archive backupArchive
+	if err := json.Unmarshal(backup, &archive); err != nil {
+		return errors.WrapPrefix(err, "failed to parse backup", 0)
+	}
+	if archive.Version != backupVersion {
+		return errors.WrapPrefix(ErrBackupVersion, fmt.Sprintf("version %d", archive.Version), 0)
+	}
+	aead, err := archive.aead(passphrase)
+	if err != nil {
+		return err
+	}
+	if len(archive.Nonce) != aead.NonceSize() {
+		return ErrBackupPassphrase
+	}
+	plaintext, err := aead.Open(nil, archive.Nonce, archive.Ciphertext, archive.additionalData())
+	if err != nil {
+		return ErrBackupPassphrase
+	}
+	var contents backupContents
+	if err = json.Unmarshal(plaintext, &contents); err != nil {
+		return errors.WrapPrefix(err, "failed to parse backup contents", 0)
+	}
+
+	if err = client.verifyBackup(&contents); err != nil {
+		return err
+	}
+
+	err = client.storage.Transaction(func(tx *transaction) error {
+		// The updates that were applied to the storage are those of this client, not of the
+		// client from which the backup was made, so we keep those
+		updates, err := client.storage.TxLoadUpdates(tx)
+		if err != nil {
+			return err
+		}
+		if err = client.storage.TxDeleteAll(tx); err != nil {
+			return err
+		}
+		if err = client.storage.TxStoreAll(tx, &contents); err != nil {
+			return err
+		}
+		return client.storage.TxStoreUpdates(tx, updates)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Load the restored data from storage
+	if err = client.loadUserdata(); err != nil {
+		return err
+	}
+	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
+		return err
+	}
+	client.applyPreferences()
+	client.handler.UpdateAttributes()
+
+	return nil
+}
+
+// verifyBackup checks that the backup contains a secret key, and that the signatures and revocation
+// witnesses of all credentials in the backup are valid.
+func (client *Client) verifyBackup(contents *backupContents) error {
+	var sk secretKey
+	if found, err := contents.load(userdataBucket, skKey, &sk); err != nil {
+		return err
+	} else if !found || sk.Key == nil {
+		return errors.New("backup contains no secret key")
+	}
+
+	attrs, ok := contents.Buckets[attributesBucket]
+	if !ok {
+		return nil
+	}
+	conf := client.Configuration
+	for _, entry := range attrs.Entries {
+		var attrlistlist []*irma.AttributeList
+		if err := json.Unmarshal(entry.Value, &attrlistlist); err != nil {
+			return err
+		}
+		for _, attrlist := range attrlistlist {
+			if attrlist == nil || len(attrlist.Ints) == 0 {
+				return errors.Errorf("backup contains credential of type %s without attributes", string(entry.Key))
+			}
+			attrlist.MetadataAttribute = irma.MetadataFromInt(attrlist.Ints[0], conf)
+			credtype := attrlist.CredentialType()
+			if credtype == nil {
+				return errors.Errorf("backup contains credential of unknown type %s", string(entry.Key))
+			}
+			pk, err := attrlist.PublicKey()
+			if err != nil {
+				return err
+			}
+			if pk == nil {
+				return errors.Errorf("unknown public key of credential of type %s", credtype.Identifier())
+			}
+
+			var sig clSignatureWitness
+			found, err := contents.load(signaturesBucket, attrlist.Hash(), &sig)
+			if err != nil {
+				return err
+			}
+			if !found || sig.CLSignature == nil {
+				return errors.Errorf("backup contains no signature of credential of type %s", credtype.Identifier())
+			}
+			if !sig.CLSignature.Verify(pk, append([]*big.Int{sk.Key}, attrlist.Ints...)) {
+				return errors.Errorf("invalid signature of credential of type %s", credtype.Identifier())
+			}
+			if sig.Witness != nil {
+				revpk, err := conf.Revocation.Keys.PublicKey(credtype.IssuerIdentifier(), sig.Witness.SignedAccumulator.PKCounter)
+				if err != nil {
+					return err
+				}
+				if err = sig.Witness.Verify(revpk); err != nil {
+					return errors.WrapPrefix(err, "invalid revocation witness of credential of type "+credtype.Identifier().String(), 0)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// load unmarshals the value of the specified key in the specified bucket of the backup into dest.
+func (contents *backupContents) load(bucketName, key string, dest interface{}) (bool, error) {
+	bucket, ok := contents.Buckets[bucketName]
+	if !ok {
+		return false, nil
+	}
+	for _, entry := range bucket.Entries {
+		if string(entry.Key) == key {
+			return true, json.Unmarshal(entry.Value, dest)
+		}
+	}
+	return false, nil
+}
+
+func (archive *backupArchive) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), archive.Salt, backupScryptN, backupScryptR, backupScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (archive *backupArchive) additionalData() []byte {
+	return append([]byte(fmt.Sprintf("irmaclient backup %d:", archive.Version)), archive.Salt...)
+}
+
+func (s *storage) LoadAll() (*backupContents, error) {
+	contents := &backupContents{Buckets: map[string]*backupBucket{}}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.ForEachBucket(func(name string, b kvBucket) error {
+			switch name {
+			case encryptionBucket:
+				return nil // the backup is encrypted with its own key
+			case logIndexBucket, logEntryIndexBucket:
+				return nil // rebuilt when importing
+			}
+			sequence, err := b.Sequence()
+			if err != nil {
+				return err
+			}
+			bucket := &backupBucket{Sequence: sequence}
+			contents.Buckets[name] = bucket
+			return b.ForEach(func(k, v []byte) error {
+				// Slices of the storage may only be valid during the transaction, so copy them
+				v, err := s.open(name, k, v)
+				if err != nil {
+					return err
+				}
+				bucket.Entries = append(bucket.Entries, backupEntry{
+					Key:   append([]byte{}, k...),
+					Value: append([]byte{}, v...),
+				})
+				return nil
+			})
+		})
+	})
+	return contents, err
+}
+
+func (s *storage) TxStoreAll(tx *transaction, contents *backupContents) error {
+	for name, bucket := range contents.Buckets {
+		if name == encryptionBucket || name == logIndexBucket || name == logEntryIndexBucket {
+			continue
+		}
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range bucket.Entries {
+			// The backup contains plaintext values, which we encrypt with our storage key, if any
+			value, err := s.seal(name, entry.Key, entry.Value)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(entry.Key, value); err != nil {
+				return err
+			}
+		}
+		if err = b.SetSequence(bucket.Sequence); err != nil {
+			return err
+		}
+	}
+	return s.txRebuildLogIndex(tx, s.encryptionKey())
+}
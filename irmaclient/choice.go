@@ -0,0 +1,280 @@
+package irmaclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains choice policies, with which the options to disclose in a session can be
+// chosen automatically from the candidates returned by Client.Candidates.
+
+// ChoicePolicy evaluates the options of the disjunctions of a session request.
+type ChoicePolicy interface {
+	// Evaluate returns whether the option may be disclosed in the session, and a score of the
+	// option: options with a higher score are preferred over other options of the disjunction.
+	// If the option may not be disclosed, or when it affects the score, the returned reason
+	// explains why.
+	Evaluate(ctx *ChoiceContext, option *ChoiceOption) ChoiceVerdict
+}
+
+// ChoiceContext contains the session in which the options are evaluated.
+type ChoiceContext struct {
+	Request       irma.SessionRequest
+	RequestorInfo *irma.RequestorInfo
+}
+
+// ChoiceOption is an option of a disjunction: attributes that together satisfy the disjunction,
+// and the credentials containing them. The option of an optional disjunction that discloses
+// nothing has no candidates.
+type ChoiceOption struct {
+	Candidates  DisclosureCandidates
+	Credentials []*irma.CredentialInfo
+}
+
+// ChoiceVerdict is the evaluation of an option by a ChoicePolicy.
+type ChoiceVerdict struct {
+	Allowed bool
+	Score   int64
+	Reason  string
+}
+
+var ErrNoChoice = errors.New("no allowed option for a disjunction of the session request")
+
+// ChoiceExplanation explains the choice made by Client.ChooseCandidates, per disjunction.
+type ChoiceExplanation []*DisjunctionExplanation
+
+// DisjunctionExplanation contains the evaluations of the options of a disjunction, in the order of
+// the candidates, and the index of the chosen option, or -1 if no option was allowed.
+type DisjunctionExplanation struct {
+	Chosen  int
+	Options []*OptionExplanation
+}
+
+// OptionExplanation contains the verdicts of the policies, in order, on an option.
+type OptionExplanation struct {
+	Allowed  bool
+	Verdicts []ChoiceVerdict
+}
+
+// ChooseCandidates chooses an option from each disjunction of the candidates, as returned by
+// Client.Candidates for the request, using the specified policies. An option is allowed if it can
+// be disclosed (its credentials are present, not expired and not revoked) and all policies allow
+// it. Of the allowed options, the one with the highest score of the first policy is chosen; ties
+// are broken by the scores of the next policies, and finally by the order of the candidates.
+// If a disjunction has no allowed option, ErrNoChoice is returned along with the explanation.
+func (client *Client) ChooseCandidates(
+	request irma.SessionRequest,
+	requestorInfo *irma.RequestorInfo,
+	candidates [][]DisclosureCandidates,
+	policies ...ChoicePolicy,
+) (*irma.DisclosureChoice, ChoiceExplanation, error) {
+	ctx := &ChoiceContext{Request: request, RequestorInfo: requestorInfo}
+	choice := &irma.DisclosureChoice{}
+	explanation := make(ChoiceExplanation, 0, len(candidates))
+	var err error
+
+	for _, discon := range candidates {
+		disconExplanation := &DisjunctionExplanation{Chosen: -1}
+		explanation = append(explanation, disconExplanation)
+		var chosen []*irma.AttributeIdentifier
+
+		for i, con := range discon {
+			ids, chooseErr := con.Choose()
+			optionExplanation := &OptionExplanation{Allowed: chooseErr == nil}
+			disconExplanation.Options = append(disconExplanation.Options, optionExplanation)
+			if chooseErr != nil {
+				optionExplanation.Verdicts = []ChoiceVerdict{{Reason: chooseErr.Error()}}
+				continue
+			}
+
+			option := &ChoiceOption{Candidates: con, Credentials: client.candidateCredentials(con)}
+			for _, policy := range policies {
+				verdict := policy.Evaluate(ctx, option)
+				optionExplanation.Verdicts = append(optionExplanation.Verdicts, verdict)
+				if !verdict.Allowed {
+					optionExplanation.Allowed = false
+				}
+			}
+			if !optionExplanation.Allowed {
+				continue
+			}
+			if disconExplanation.Chosen == -1 ||
+				optionExplanation.preferredOver(disconExplanation.Options[disconExplanation.Chosen]) {
+				disconExplanation.Chosen = i
+				chosen = ids
+			}
+		}
+
+		if disconExplanation.Chosen == -1 {
+			err = ErrNoChoice
+		} else if chosen == nil {
+			chosen = []*irma.AttributeIdentifier{} // the empty option of an optional disjunction
+		}
+		choice.Attributes = append(choice.Attributes, chosen)
+	}
+
+	if err != nil {
+		return nil, explanation, err
+	}
+	return choice, explanation, nil
+}
+
+// candidateCredentials returns the credentials containing the candidates, without duplicates.
+func (client *Client) candidateCredentials(candidates DisclosureCandidates) []*irma.CredentialInfo {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	var creds []*irma.CredentialInfo
+	seen := map[string]struct{}{}
+	for _, candidate := range candidates {
+		if _, ok := seen[candidate.CredentialHash]; ok {
+			continue
+		}
+		seen[candidate.CredentialHash] = struct{}{}
+		if attrs, _ := client.attributesByHash(candidate.CredentialHash); attrs != nil {
+			creds = append(creds, attrs.CredentialInfo())
+		}
+	}
+	return creds
+}
+
+// preferredOver returns whether the scores of o are higher than those of other, comparing them
+// in the order of the policies.
+func (o *OptionExplanation) preferredOver(other *OptionExplanation) bool {
+	for i := range o.Verdicts {
+		if o.Verdicts[i].Score != other.Verdicts[i].Score {
+			return o.Verdicts[i].Score > other.Verdicts[i].Score
+		}
+	}
+	return false
+}
+
+func (e ChoiceExplanation) String() string {
+	var b strings.Builder
+	for i, discon := range e {
+		if discon.Chosen == -1 {
+			fmt.Fprintf(&b, "disjunction %d: no allowed option\n", i)
+		} else {
+			fmt.Fprintf(&b, "disjunction %d: chose option %d\n", i, discon.Chosen)
+		}
+		for j, option := range discon.Options {
+			var reasons []string
+			for _, verdict := range option.Verdicts {
+				if verdict.Reason != "" {
+					reasons = append(reasons, verdict.Reason)
+				}
+			}
+			status := "allowed"
+			if !option.Allowed {
+				status = "not allowed"
+			}
+			fmt.Fprintf(&b, "  option %d: %s", j, status)
+			if len(reasons) > 0 {
+				fmt.Fprintf(&b, " (%s)", strings.Join(reasons, "; "))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// PreferNewest prefers options of which the credentials were issued most recently. The empty option
+// of an optional disjunction is preferred least.
+type PreferNewest struct{}
+
+func (PreferNewest) Evaluate(_ *ChoiceContext, option *ChoiceOption) ChoiceVerdict {
+	if len(option.Credentials) == 0 {
+		return ChoiceVerdict{Allowed: true}
+	}
+	// An option is as new as its oldest credential
+	oldest := option.Credentials[0].SignedOn
+	for _, cred := range option.Credentials[1:] {
+		if cred.SignedOn.Before(oldest) {
+			oldest = cred.SignedOn
+		}
+	}
+	return ChoiceVerdict{
+		Allowed: true,
+		Score:   time.Time(oldest).Unix(),
+		Reason:  "issued on " + time.Time(oldest).UTC().Format("2006-01-02"),
+	}
+}
+
+// PreferFewestAttributes prefers options that disclose the fewest attributes.
+type PreferFewestAttributes struct{}
+
+func (PreferFewestAttributes) Evaluate(_ *ChoiceContext, option *ChoiceOption) ChoiceVerdict {
+	return ChoiceVerdict{
+		Allowed: true,
+		Score:   -int64(len(option.Candidates)),
+		Reason:  fmt.Sprintf("discloses %d attributes", len(option.Candidates)),
+	}
+}
+
+// PreferNonExpiring prefers options of which the credentials remain valid the longest. The empty
+// option of an optional disjunction is preferred least.
+type PreferNonExpiring struct{}
+
+func (PreferNonExpiring) Evaluate(_ *ChoiceContext, option *ChoiceOption) ChoiceVerdict {
+	if len(option.Credentials) == 0 {
+		return ChoiceVerdict{Allowed: true}
+	}
+	first := option.Credentials[0].Expires
+	for _, cred := range option.Credentials[1:] {
+		if cred.Expires.Before(first) {
+			first = cred.Expires
+		}
+	}
+	return ChoiceVerdict{
+		Allowed: true,
+		Score:   time.Time(first).Unix(),
+		Reason:  "valid until " + time.Time(first).UTC().Format("2006-01-02"),
+	}
+}
+
+// DenyRequestors refuses to disclose anything to the specified requestors, identified by their
+// identifier in a requestor scheme or by their hostname.
+type DenyRequestors struct {
+	Requestors []irma.RequestorIdentifier
+	Hostnames  []string
+}
+
+func (p DenyRequestors) Evaluate(ctx *ChoiceContext, _ *ChoiceOption) ChoiceVerdict {
+	info := ctx.RequestorInfo
+	if info == nil {
+		return ChoiceVerdict{Allowed: true}
+	}
+	for _, id := range p.Requestors {
+		if !info.Unverified && info.ID == id {
+			return ChoiceVerdict{Reason: "requestor " + id.String() + " is denied"}
+		}
+	}
+	for _, hostname := range p.Hostnames {
+		for _, h := range info.Hostnames {
+			if strings.EqualFold(h, hostname) {
+				return ChoiceVerdict{Reason: "hostname " + h + " is denied"}
+			}
+		}
+	}
+	return ChoiceVerdict{Allowed: true}
+}
+
+// NeverDisclose refuses options containing any of the specified attributes.
+type NeverDisclose struct {
+	Attributes []irma.AttributeTypeIdentifier
+}
+
+func (p NeverDisclose) Evaluate(_ *ChoiceContext, option *ChoiceOption) ChoiceVerdict {
+	for _, candidate := range option.Candidates {
+		for _, attr := range p.Attributes {
+			if candidate.Type == attr {
+				return ChoiceVerdict{Reason: "attribute " + attr.String() + " is never disclosed"}
+			}
+		}
+	}
+	return ChoiceVerdict{Allowed: true}
+}
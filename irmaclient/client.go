@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -8,9 +9,11 @@ import (
 
 	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
+	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/rangeproof"
 	"github.com/privacybydesign/gabi/revocation"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -51,8 +54,11 @@ type Client struct {
 
 	lookup map[string]*credLookup
 
+	trustRecords map[string]*TrustRecord
+	trustMutex   sync.Mutex
+
 	// Where we store/load it to/from
-	storage storage
+	storage Storage
 	// Legacy storage needed when client has not updated to the new storage yet
 	fileStorage fileStorage
 
@@ -71,6 +77,15 @@ type Client struct {
 	jobsPause  chan struct{} // sending pauses background jobs
 	jobsPaused bool
 
+	scheduler     *gocron.Scheduler // schedules jobs periodically
+	stopScheduler chan bool
+
+	revocationUpdates revocationUpdater
+
+	// Clients of the profiles of a Profiles share their Configuration
+	confMutex *sync.RWMutex // see readConfiguration
+	profiles  *Profiles     // nil if the client is not a profile
+
 	credMutex sync.Mutex
 }
 
@@ -78,10 +93,31 @@ type Client struct {
 // be part of any backup and syncing solution we implement at a later time
 type Preferences struct {
 	DeveloperMode bool
+
+	// ExpiryWarningLeadTimes are the times before the expiry of credentials at which the
+	// ClientHandler is notified of it. If empty, no notifications are sent.
+	ExpiryWarningLeadTimes []time.Duration
+
+	// LogRetention is the time after which log entries are removed; if 0, they are kept forever.
+	LogRetention time.Duration
+	// MaxLogEntries is the maximum number of log entries that is kept, removing the oldest
+	// entries first; if 0, the number of log entries is unlimited.
+	MaxLogEntries int
+
+	// RevocationUpdates configures the background updating of nonrevocation witnesses.
+	RevocationUpdates RevocationUpdatePolicy
 }
 
 var defaultPreferences = Preferences{
-	DeveloperMode: false,
+	DeveloperMode:          false,
+	ExpiryWarningLeadTimes: []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour},
+	LogRetention:           0,
+	MaxLogEntries:          0,
+	RevocationUpdates: RevocationUpdatePolicy{
+		MaxRequestsPerHour:     0,
+		MeteredRequestsPerHour: 6,
+		ServerSentEvents:       false,
+	},
 }
 
 // KeyshareHandler is used for asking the user for his email address and PIN,
@@ -122,6 +158,8 @@ type credCandidate irma.CredentialIdentifier
 type DisclosureCandidate struct {
 	*irma.AttributeIdentifier
 	Value        irma.TranslatedString
+	Predicate    *irma.AttributePredicate // If set, the attribute is not disclosed but proven to satisfy this
+	Hashed       bool                     // If set, the requestor receives only a salted hash of the attribute
 	Expired      bool
 	Revoked      bool
 	NotRevokable bool
@@ -138,6 +176,12 @@ type secretKey struct {
 // is the path to a (possibly readonly) folder containing irma_configuration;
 // and handler is used for informing the user of new stuff, and when a
 // enrollment to a keyshare server needs to happen.
+// If aesKey is not nil, the values in the database of the client are encrypted
+// with it using AES-GCM (encrypting an existing unencrypted database if necessary),
+// so it must be StorageKeySize bytes long and be kept by the app in a safe place,
+// e.g. in a keystore of the platform. If the database is encrypted, opening it
+// without the key or with a different key fails. The key can be changed later
+// using RotateStorageKey.
 // The client returned by this function has been fully deserialized
 // and is ready for use.
 //
@@ -147,26 +191,54 @@ func New(
 	storagePath string,
 	irmaConfigurationPath string,
 	handler ClientHandler,
+	aesKey []byte,
 ) (*Client, error) {
-	var err error
-	if err = common.AssertPathExists(storagePath); err != nil {
+	if err := common.AssertPathExists(storagePath); err != nil {
 		return nil, err
 	}
-	if err = common.AssertPathExists(irmaConfigurationPath); err != nil {
+	backend, err := OpenBoltStorage(filepath.Join(storagePath, databaseFile))
+	if err != nil {
 		return nil, err
 	}
+	client, err := NewWithStorage(backend, storagePath, irmaConfigurationPath, handler, aesKey)
+	if client == nil {
+		_ = backend.Close()
+	}
+	return client, err
+}
 
-	client := &Client{
-		credentialsCache:      make(map[irma.CredentialTypeIdentifier]map[int]*credential),
-		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*keyshareServer),
-		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
-		irmaConfigurationPath: irmaConfigurationPath,
-		handler:               handler,
-		minVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]},
-		maxVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]},
+// NewWithStorage creates a new Client like New, that stores its data in the specified
+// Storage instead of in a bbolt database in storagePath. The storagePath is still used
+// for the irma_configuration of the client. Closing the client closes the backend.
+func NewWithStorage(
+	backend Storage,
+	storagePath string,
+	irmaConfigurationPath string,
+	handler ClientHandler,
+	aesKey []byte,
+) (*Client, error) {
+	if err := common.AssertPathExists(storagePath); err != nil {
+		return nil, err
+	}
+	conf, schemeMgrErr := parseConfiguration(storagePath, irmaConfigurationPath)
+	if conf == nil {
+		return nil, schemeMgrErr
+	}
+	client, err := newClient(backend, conf, &sync.RWMutex{}, storagePath, irmaConfigurationPath, handler, aesKey)
+	if err != nil {
+		return nil, err
 	}
+	return client, schemeMgrErr
+}
 
-	client.Configuration, err = irma.NewConfiguration(
+// parseConfiguration parses the irma_configuration in storagePath, restoring it from the assets in
+// irmaConfigurationPath if necessary. If a scheme failed to parse, the Configuration is returned
+// along with the *irma.SchemeManagerError.
+func parseConfiguration(storagePath, irmaConfigurationPath string) (*irma.Configuration, error) {
+	if err := common.AssertPathExists(irmaConfigurationPath); err != nil {
+		return nil, err
+	}
+	conf, err := irma.NewConfiguration(
 		filepath.Join(storagePath, "irma_configuration"),
 		irma.ConfigurationOptions{Assets: irmaConfigurationPath, IgnorePrivateKeys: true},
 	)
@@ -174,21 +246,47 @@ func New(
 		return nil, err
 	}
 
-	schemeMgrErr := client.Configuration.ParseOrRestoreFolder()
+	schemeMgrErr := conf.ParseOrRestoreFolder()
 	// If schemMgrErr is of type SchemeManagerError, we continue and
 	// return it at the end; otherwise bail out now
 	_, isSchemeMgrErr := schemeMgrErr.(*irma.SchemeManagerError)
 	if schemeMgrErr != nil && !isSchemeMgrErr {
 		return nil, schemeMgrErr
 	}
+	return conf, schemeMgrErr
+}
 
-	// Ensure storage path exists, and populate it with necessary files
-	client.storage = storage{storagePath: storagePath, Configuration: client.Configuration}
-	if err = client.storage.Open(); err != nil {
+// newClient creates a Client that stores its data in the backend, using the parsed Configuration.
+// The confMutex is shared by all clients using the Configuration (see readConfiguration).
+// Legacy storage files are read from legacyPath.
+func newClient(
+	backend Storage,
+	conf *irma.Configuration,
+	confMutex *sync.RWMutex,
+	legacyPath string,
+	irmaConfigurationPath string,
+	handler ClientHandler,
+	aesKey []byte,
+) (*Client, error) {
+	var err error
+	client := &Client{
+		credentialsCache:      make(map[irma.CredentialTypeIdentifier]map[int]*credential),
+		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*keyshareServer),
+		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
+		Configuration:         conf,
+		confMutex:             confMutex,
+		irmaConfigurationPath: irmaConfigurationPath,
+		handler:               handler,
+		minVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]},
+		maxVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]},
+	}
+
+	client.storage = backend
+	if err = client.storage.Open(client.Configuration, aesKey); err != nil {
 		return nil, err
 	}
 	// Legacy storage does not need ensuring existence
-	client.fileStorage = fileStorage{storagePath: storagePath, Configuration: client.Configuration}
+	client.fileStorage = fileStorage{storagePath: legacyPath, Configuration: client.Configuration}
 
 	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
 		return nil, err
@@ -199,39 +297,78 @@ func New(
 	if err = client.update(); err != nil {
 		return nil, err
 	}
+	// Encrypt existing databases if the app specified a storage key, which it may start doing at any time
+	if err = client.storage.EnsureEncrypted(); err != nil {
+		return nil, err
+	}
 
 	// Load our stuff
-	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+	if err = client.loadUserdata(); err != nil {
 		return nil, err
 	}
+
+	client.sessions = sessions{client: client, sessions: map[string]*session{}}
+
+	client.jobs = make(chan func(), 100)
+	client.scheduler = gocron.NewScheduler()
+	client.initRevocation()
+	client.initExpiryWarnings()
+	client.initLogRetention()
+	client.stopScheduler = client.scheduler.Start()
+	client.StartJobs()
+
+	return client, nil
+}
+
+// loadUserdata loads the secret key, attributes and keyshare enrollments from storage.
+func (client *Client) loadUserdata() error {
+	var err error
+	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+		return err
+	}
 	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
-		return nil, err
+		return err
 	}
 	if client.keyshareServers, err = client.storage.LoadKeyshareServers(); err != nil {
-		return nil, err
+		return err
+	}
+	client.trustMutex.Lock()
+	client.trustRecords, err = client.storage.LoadTrustRecords()
+	client.trustMutex.Unlock()
+	if err != nil {
+		return err
 	}
 
 	if len(client.UnenrolledSchemeManagers()) > 1 {
-		return nil, errors.New("Too many keyshare servers")
+		return errors.New("Too many keyshare servers")
 	}
 
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
 	client.lookup = map[string]*credLookup{}
 	for _, attrlistlist := range client.attributes {
 		for i, attrlist := range attrlistlist {
 			client.lookup[attrlist.Hash()] = &credLookup{id: attrlist.CredentialType().Identifier(), counter: i}
 		}
 	}
-
-	client.sessions = sessions{client: client, sessions: map[string]*session{}}
-
-	client.jobs = make(chan func(), 100)
-	client.initRevocation()
-	client.StartJobs()
-
-	return client, schemeMgrErr
+	return nil
 }
 
+// Close stops the background jobs of the client and closes its storage.
 func (client *Client) Close() error {
+	err := client.close()
+	if client.profiles != nil {
+		client.profiles.closed(client)
+	}
+	return err
+}
+
+func (client *Client) close() error {
+	if client.stopScheduler != nil {
+		client.stopScheduler <- true
+		client.stopScheduler = nil
+	}
+	client.closeRevocationUpdates()
+	client.PauseJobs()
 	return client.storage.Close()
 }
 
@@ -269,7 +406,7 @@ func (client *Client) StartJobs() {
 				return
 			case job := <-client.jobs:
 				irma.Logger.Debug("doing job")
-				job()
+				client.readConfiguration(job)
 				irma.Logger.Debug("job done")
 			}
 		}
@@ -442,6 +579,15 @@ func (client *Client) RemoveCredentialByHash(hash string) error {
 	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
 }
 
+// RotateStorageKey re-encrypts the values in the database of the client with the specified key,
+// which must be StorageKeySize bytes long, or decrypts them if the key is nil. It must not be
+// called while sessions are in progress. Afterwards, the client must be opened using the new key.
+func (client *Client) RotateStorageKey(aesKey []byte) error {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+	return client.storage.SetKey(aesKey)
+}
+
 // Removes all attributes, signatures, logs and userdata
 // Includes the user's secret key, keyshare servers and preferences/updates
 // A fresh secret key is installed.
@@ -453,6 +599,9 @@ func (client *Client) RemoveStorage() error {
 	client.keyshareServers = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
 	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
 	client.lookup = make(map[string]*credLookup)
+	client.trustMutex.Lock()
+	client.trustRecords = make(map[string]*TrustRecord)
+	client.trustMutex.Unlock()
 
 	if err = client.storage.DeleteAll(); err != nil {
 		return err
@@ -709,7 +858,9 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 						Type:           attr.Type,
 						CredentialHash: credopt.Hash,
 					},
-					Value: irma.NewTranslatedString(attr.Value),
+					Value:     irma.NewTranslatedString(attr.Value),
+					Predicate: attr.Predicate,
+					Hashed:    attr.Hash != nil,
 				}
 				if credopt.Present() {
 					attrlist, _ := client.attributesByHash(credopt.Hash)
@@ -812,15 +963,79 @@ func (client *Client) Candidates(request irma.SessionRequest) (
 	return
 }
 
-// attributeGroup points to a credential and some of its attributes which are to be disclosed
+// attributeGroup points to a credential and some of its attributes which are to be disclosed,
+// and the predicates to be proven over some of its undisclosed attributes
 type attributeGroup struct {
-	cred  irma.CredentialIdentifier
-	attrs []int
+	cred       irma.CredentialIdentifier
+	attrs      []int
+	predicates map[int][]*irma.AttributePredicate
+}
+
+// choicePredicates returns for each attribute in the user's choice the predicate that the request
+// asks it to satisfy instead of disclosing it, if any. As the choice does not specify which
+// conjunction of a disjunction it satisfies, of the conjunctions whose predicates the chosen
+// attributes satisfy we use the one having the most predicates, disclosing as little as possible.
+func (client *Client) choicePredicates(choice *irma.DisclosureChoice, request irma.SessionRequest) (
+	[][]*irma.AttributePredicate, error,
+) {
+	condiscon := request.Disclosure().Disclose
+	predicates := make([][]*irma.AttributePredicate, len(choice.Attributes))
+	for i, attrs := range choice.Attributes {
+		predicates[i] = make([]*irma.AttributePredicate, len(attrs))
+		if i >= len(condiscon) {
+			continue
+		}
+		best, unsatisfied := -1, false
+		for _, con := range condiscon[i] {
+			count, matches, satisfied := client.conPredicates(con, attrs)
+			if !matches {
+				continue
+			}
+			if !satisfied {
+				unsatisfied = true
+				continue
+			}
+			if count > best {
+				best = count
+				for j := range con {
+					predicates[i][j] = con[j].Predicate
+				}
+			}
+		}
+		// Never fall back to disclosing attributes for which the request asked only a predicate
+		if best == -1 && unsatisfied {
+			return nil, errors.New("chosen attributes do not satisfy requested predicates")
+		}
+	}
+	return predicates, nil
+}
+
+// conPredicates returns the amount of predicates in the conjunction, whether the conjunction asks
+// for the types of the chosen attributes, and if so, whether the attributes satisfy its predicates.
+func (client *Client) conPredicates(con irma.AttributeCon, attrs []*irma.AttributeIdentifier) (int, bool, bool) {
+	if len(con) != len(attrs) {
+		return 0, false, false
+	}
+	count, satisfied := 0, true
+	for j, attr := range con {
+		if attr.Type != attrs[j].Type {
+			return 0, false, false
+		}
+		if attr.Predicate == nil {
+			continue
+		}
+		count++
+		list, _ := client.attributesByHash(attrs[j].CredentialHash)
+		if list == nil || !attr.Predicate.Satisfy(list.UntranslatedAttribute(attr.Type)) {
+			satisfied = false
+		}
+	}
+	return count, true, satisfied
 }
 
 // Given the user's choice of attributes to be disclosed, group them per credential out of which they
 // are to be disclosed
-func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
+func (client *Client) groupCredentials(choice *irma.DisclosureChoice, predicates [][]*irma.AttributePredicate) (
 	[]attributeGroup, irma.DisclosedAttributeIndices, error,
 ) {
 	if choice == nil || choice.Attributes == nil {
@@ -833,7 +1048,7 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 	attributeIndices := make(irma.DisclosedAttributeIndices, len(choice.Attributes))
 	for i, attributeset := range choice.Attributes {
 		attributeIndices[i] = []*irma.DisclosedAttributeIndex{}
-		for _, attribute := range attributeset {
+		for j, attribute := range attributeset {
 			var credIndex int
 			ici := attribute.CredentialIdentifier()
 			if _, present := credIndices[ici]; !present {
@@ -859,6 +1074,15 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 			// These attribute indices will be used in the []*big.Int at gabi.credential.Attributes,
 			// which doesn't know about the secret key and metadata attribute, so +2
 			attributeIndices[i] = append(attributeIndices[i], &irma.DisclosedAttributeIndex{CredentialIndex: credIndex, AttributeIndex: attrIndex + 2, Identifier: ici})
+			if predicate := predicates[i][j]; predicate != nil {
+				// The attribute is not disclosed, but proven to satisfy the predicate
+				grp := &todisclose[credIndex]
+				if grp.predicates == nil {
+					grp.predicates = map[int][]*irma.AttributePredicate{}
+				}
+				grp.predicates[attrIndex+2] = append(grp.predicates[attrIndex+2], predicate)
+				continue
+			}
 			todisclose[credIndex].attrs = append(todisclose[credIndex].attrs, attrIndex+2)
 		}
 	}
@@ -869,7 +1093,14 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *atum.Timestamp, error) {
-	todisclose, attributeIndices, err := client.groupCredentials(choice)
+	var predicates [][]*irma.AttributePredicate
+	if choice != nil {
+		var err error
+		if predicates, err = client.choicePredicates(choice, request); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	todisclose, attributeIndices, err := client.groupCredentials(choice, predicates)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -884,8 +1115,21 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 		if cred.attrs.Revoked {
 			return nil, nil, nil, revocation.ErrorRevoked
 		}
+		var statements map[int][]*rangeproof.Statement
+		for index, preds := range grp.predicates {
+			if statements == nil {
+				statements = map[int][]*rangeproof.Statement{}
+			}
+			for _, predicate := range preds {
+				s, err := predicate.RangeStatements(cred.attrs.MetadataAttribute.Version())
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				statements[index] = append(statements[index], s...)
+			}
+		}
 		nonrev := request.Base().RequestsRevocation(cred.CredentialType().Identifier())
-		builder, err = cred.CreateDisclosureProofBuilder(grp.attrs, nil, nonrev)
+		builder, err = cred.CreateDisclosureProofBuilder(grp.attrs, statements, nonrev)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -992,6 +1236,19 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *ir
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
 // and credential builders.
 func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
+	return client.constructCredentials(msg, request, builders, nil, nil)
+}
+
+// constructCredentials is ConstructCredentials, replacing the refreshed credential, if not nil,
+// by the first constructed credential of the same type and adding the log entry along with it
+// (see RefreshCredential).
+func (client *Client) constructCredentials(
+	msg []*gabi.IssueSignatureMessage,
+	request *irma.IssuanceRequest,
+	builders gabi.ProofBuilderList,
+	refreshed *irma.AttributeList,
+	log *LogEntry,
+) error {
 	if len(msg) > len(builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
@@ -1042,10 +1299,19 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		if err != nil {
 			return err
 		}
-		if err = client.addCredential(newcred); err != nil {
+		if refreshed != nil && refreshed.CredentialType().Identifier() == newcred.CredentialType().Identifier() {
+			err = client.replaceCredential(refreshed, newcred, log)
+			refreshed = nil
+		} else {
+			err = client.addCredential(newcred)
+		}
+		if err != nil {
 			return err
 		}
 	}
+	if refreshed != nil {
+		return errors.New("refreshed credential was not reissued")
+	}
 
 	return nil
 }
@@ -1115,11 +1381,11 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	// If the session succeeds or fails, the keyshare server is stored to disk or
 	// removed from the client by the keyshareEnrollmentHandler.
 	client.keyshareServers[managerID] = kss
-	client.newQrSession(qr, &keyshareEnrollmentHandler{
+	client.newQrSession(context.Background(), qr, &keyshareEnrollmentHandler{
 		client: client,
 		pin:    pin,
 		kss:    kss,
-	})
+	}, nil)
 
 	return nil
 }
@@ -1160,6 +1426,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
 	message := irma.KeyshareChangePin{
 		Username: kss.Username,
+		DeviceID: kss.DeviceID,
 		OldPin:   kss.HashedPin(oldPin),
 		NewPin:   kss.HashedPin(newPin),
 	}
@@ -1192,6 +1459,73 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	return nil
 }
 
+// KeyshareDeviceLinkCode verifies the specified PIN at the keyshare server of the specified scheme
+// manager and, if it is correct, obtains a one-time code with which another device can be linked
+// to the same keyshare account using KeyshareLinkDevice. If the PIN is incorrect, the code is nil
+// and how many tries are left or for how long the user is blocked is returned instead.
+func (client *Client) KeyshareDeviceLinkCode(pin string, managerID irma.SchemeManagerIdentifier) (
+	*irma.KeyshareDeviceLinkCode, int, int, error) {
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return nil, 0, 0, errors.New("Unknown keyshare server")
+	}
+
+	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	success, tries, blocked, err := verifyPinWorker(pin, kss, transport)
+	if !success || err != nil {
+		return nil, tries, blocked, err
+	}
+
+	kss.setHeaders(transport)
+	code := &irma.KeyshareDeviceLinkCode{}
+	if err = transport.Post("users/devices/code", code, nil); err != nil {
+		return nil, 0, 0, err
+	}
+	return code, 0, 0, nil
+}
+
+// KeyshareLinkDevice links this device to the existing keyshare account with the specified
+// username at the keyshare server of the specified scheme manager, using a code obtained with
+// KeyshareDeviceLinkCode on a device already using the account. Afterwards this device uses
+// the account with the specified PIN, and is known to the keyshare server by the specified name.
+func (client *Client) KeyshareLinkDevice(managerID irma.SchemeManagerIdentifier, username, code, pin, name string) error {
+	manager, ok := client.Configuration.SchemeManagers[managerID]
+	if !ok {
+		return errors.New("Unknown scheme manager")
+	}
+	if len(manager.KeyshareServer) == 0 {
+		return errors.New("Scheme manager has no keyshare server")
+	}
+	if _, enrolled := client.keyshareServers[managerID]; enrolled {
+		return errors.New("Already enrolled at keyshare server")
+	}
+	if len(pin) < 5 {
+		return errors.New("PIN too short, must be at least 5 characters")
+	}
+
+	kss, err := newKeyshareServer(managerID)
+	if err != nil {
+		return err
+	}
+	kss.Username = username
+	message := irma.KeyshareDeviceLink{
+		Username: username,
+		Code:     code,
+		Pin:      kss.HashedPin(pin),
+		Name:     name,
+	}
+
+	transport := irma.NewHTTPTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
+	result := &irma.KeyshareDeviceLinkResult{}
+	if err = transport.Post("client/link", result, message); err != nil {
+		return err
+	}
+	kss.DeviceID = result.DeviceID
+
+	client.keyshareServers[managerID] = kss
+	return client.storage.StoreKeyshareServers(client.keyshareServers)
+}
+
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
 	if _, contains := client.keyshareServers[manager]; !contains {
@@ -1232,7 +1566,51 @@ func (client *Client) SetPreferences(pref Preferences) {
 	client.applyPreferences()
 }
 
-func (client *Client) applyPreferences() {}
+func (client *Client) applyPreferences() {
+	client.updateRevocationSubscriptions()
+}
+
+// readConfiguration calls f while holding confMutex for reading. The Configuration is modified
+// only while holding confMutex, by downloads in sessions and by scheme updates, possibly of other
+// profiles sharing the Configuration; sessions and background jobs read it only through this
+// function. As sessions may download to the Configuration, f must not start sessions, nor call
+// session handlers that might do so.
+func (client *Client) readConfiguration(f func()) {
+	client.confMutex.RLock()
+	defer client.confMutex.RUnlock()
+	f()
+}
+
+// downloadConfiguration downloads the credential types, issuers and public keys of the request
+// that are not yet present in the Configuration, and processes them in all clients using it.
+func (client *Client) downloadConfiguration(request irma.SessionRequest) error {
+	client.confMutex.Lock()
+	downloaded, err := client.Configuration.Download(request)
+	client.confMutex.Unlock()
+	if err != nil || downloaded == nil || downloaded.Empty() {
+		return err
+	}
+
+	clients := []*Client{client}
+	if client.profiles != nil {
+		clients = client.profiles.clients()
+	}
+	return configurationUpdated(clients, downloaded)
+}
+
+// configurationUpdated processes the downloaded identifiers of their Configuration in the clients,
+// and informs their handlers of them.
+func configurationUpdated(clients []*Client, downloaded *irma.IrmaIdentifierSet) error {
+	for _, client := range clients {
+		var err error
+		client.readConfiguration(func() { err = client.ConfigurationUpdated(downloaded) })
+		if err != nil {
+			return err
+		}
+		client.handler.UpdateConfiguration(downloaded)
+	}
+	return nil
+}
 
 // ConfigurationUpdated should be run after Configuration.Download().
 // For any credential type in the updated scheme to which new attributes were added, this function
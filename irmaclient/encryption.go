@@ -0,0 +1,214 @@
+package irmaclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the optional encryption of the values in the storage of the client,
+// with a key supplied by the app through New (e.g. from a keystore of the platform).
+
+// Bucketnames bbolt
+const (
+	encryptionBucket   = "encryption" // Key/value: specified below. The values of this bucket are not encrypted.
+	encryptionCheckKey = "check"      // Value: encryption of checkValue, to detect the use of a wrong key
+)
+
+// StorageKeySize is the size of the keys with which the storage can be encrypted.
+const StorageKeySize = 32
+
+var checkValue = []byte("irmaclient storage")
+
+var (
+	ErrStorageEncrypted = errors.New("storage is encrypted, but no storage key was specified")
+	ErrStorageKey       = errors.New("storage could not be decrypted: wrong storage key")
+)
+
+// newStorageAEAD returns the AES-GCM instance with which the values of the database are
+// encrypted, or nil if key is nil.
+func newStorageAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != StorageKeySize {
+		return nil, errors.Errorf("storage key must be %d bytes", StorageKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadEncryption determines whether the values of the database are encrypted, and if so, checks
+// that they are encrypted with the storage key.
+func (s *storage) loadEncryption() error {
+	aead, err := newStorageAEAD(s.aesKey)
+	if err != nil {
+		return err
+	}
+	return s.db.View(func(tx kvTx) error {
+		b, err := tx.Bucket(encryptionBucket)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			s.aead = nil
+			return nil
+		}
+		if aead == nil {
+			return ErrStorageEncrypted
+		}
+		check, err := b.Get([]byte(encryptionCheckKey))
+		if err != nil {
+			return err
+		}
+		if _, err := openValue(aead, encryptionBucket, []byte(encryptionCheckKey), check); err != nil {
+			return ErrStorageKey
+		}
+		s.aead = aead
+		return nil
+	})
+}
+
+// Encrypted returns whether the values of the database are encrypted.
+func (s *storage) Encrypted() bool {
+	return s.aead != nil
+}
+
+// encryptionKey returns the key with which the values of the database are encrypted, or nil if
+// they are not encrypted.
+func (s *storage) encryptionKey() []byte {
+	if !s.Encrypted() {
+		return nil
+	}
+	return s.aesKey
+}
+
+// EnsureEncrypted encrypts the values of a database that is not yet encrypted, if a storage key
+// was specified.
+func (s *storage) EnsureEncrypted() error {
+	if s.aesKey == nil || s.Encrypted() {
+		return nil
+	}
+	return s.SetKey(s.aesKey)
+}
+
+// SetKey re-encrypts all values of the database with the specified key, or decrypts them if the
+// key is nil, in a single transaction.
+func (s *storage) SetKey(key []byte) error {
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx kvTx) error {
+		err := tx.ForEachBucket(func(name string, b kvBucket) error {
+			switch name {
+			case encryptionBucket, logIndexBucket, logEntryIndexBucket:
+				return nil
+			}
+			return s.reencryptBucket(aead, name, b)
+		})
+		if err != nil {
+			return err
+		}
+		// The tokens in the log index depend on the key
+		if err = s.txRebuildLogIndex(tx, key); err != nil {
+			return err
+		}
+
+		if aead == nil {
+			return tx.DeleteBucket(encryptionBucket)
+		}
+		b, err := tx.CreateBucketIfNotExists(encryptionBucket)
+		if err != nil {
+			return err
+		}
+		check, err := sealValue(aead, encryptionBucket, []byte(encryptionCheckKey), checkValue)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(encryptionCheckKey), check)
+	})
+	if err != nil {
+		return err
+	}
+	s.aesKey, s.aead = key, aead
+	return nil
+}
+
+func (s *storage) reencryptBucket(aead cipher.AEAD, name string, b kvBucket) error {
+	// The bucket must not be modified while iterating over it, so we collect its entries first
+	type entry struct{ key, value []byte }
+	var entries []entry
+	err := b.ForEach(func(k, v []byte) error {
+		plaintext, err := s.open(name, k, v)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{append([]byte{}, k...), plaintext})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		value, err := sealValue(aead, name, e.key, e.value)
+		if err != nil {
+			return err
+		}
+		if err = b.Put(e.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal returns the value to be stored in the database for the specified plaintext, under the
+// specified key in the specified bucket.
+func (s *storage) seal(bucketName string, key, plaintext []byte) ([]byte, error) {
+	return sealValue(s.aead, bucketName, key, plaintext)
+}
+
+// open returns the plaintext of a value stored in the database under the specified key in the
+// specified bucket.
+func (s *storage) open(bucketName string, key, value []byte) ([]byte, error) {
+	return openValue(s.aead, bucketName, key, value)
+}
+
+// sealValue encrypts the plaintext, prepending a random nonce. The bucket name and key are
+// authenticated as additional data, so that values cannot be moved to other keys unnoticed.
+func sealValue(aead cipher.AEAD, bucketName string, key, plaintext []byte) ([]byte, error) {
+	if aead == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData(bucketName, key)), nil
+}
+
+func openValue(aead cipher.AEAD, bucketName string, key, value []byte) ([]byte, error) {
+	if aead == nil {
+		return value, nil
+	}
+	if len(value) < aead.NonceSize() {
+		return nil, errors.Errorf("encrypted value of %q in bucket %s is too short", key, bucketName)
+	}
+	nonce, ciphertext := value[:aead.NonceSize()], value[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(bucketName, key))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("failed to decrypt value of %q in bucket %s", key, bucketName), 0)
+	}
+	return plaintext, nil
+}
+
+func additionalData(bucketName string, key []byte) []byte {
+	return append(append([]byte(bucketName), 0), key...)
+}
@@ -0,0 +1,143 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the background job that warns the user of credentials that are about to
+// expire, at the lead times configured in Preferences.ExpiryWarningLeadTimes.
+
+// expiryCheckInterval is the interval at which the client checks for expiring credentials. As the
+// check only involves the storage when there are credentials to warn about, it is cheap.
+const expiryCheckInterval = 10 * time.Minute
+
+// ExpiryHandler is notified of credentials that are about to expire. It is optional: the client
+// warns of expiring credentials only if its ClientHandler also implements ExpiryHandler.
+type ExpiryHandler interface {
+	// ExpiringCredentials is called when credentials reach one of the expiry warning lead times
+	// configured in the preferences of the client. Each credential is passed once per lead time.
+	ExpiringCredentials(creds []*ExpiringCredential)
+}
+
+// ExpiringCredential is a credential that expires within one of the expiry warning lead times,
+// along with a suggestion for renewing it.
+type ExpiringCredential struct {
+	*irma.CredentialInfo
+	LeadTime time.Duration // the smallest lead time within which the credential expires
+	Renewal  RenewalPath
+}
+
+// RenewalPath contains the ways in which a credential type can be (re)issued according to its
+// scheme: the issue URL of the credential type, the issue wizards that issue it, and whether its
+// issuer offers refreshing credentials using Client.RefreshCredential.
+type RenewalPath struct {
+	IssueURL     *irma.TranslatedString
+	IsULIssueURL bool
+	Wizards      []irma.IssueWizardIdentifier
+	Refreshable  bool
+}
+
+// initExpiryWarnings schedules checking for expiring credentials. The first check is done after
+// expiryCheckInterval, like the periodic revocation updates, so that it does not interfere with
+// what the app does right after starting the client.
+func (client *Client) initExpiryWarnings() {
+	client.scheduler.Every(uint64(expiryCheckInterval.Seconds())).Seconds().Do(func() {
+		client.jobs <- client.checkExpiringCredentials
+	})
+}
+
+// ExpiringCredentials returns the credentials that expire within the largest of the expiry warning
+// lead times of the preferences, whether or not the handler has been notified of them.
+func (client *Client) ExpiringCredentials() []*ExpiringCredential {
+	var expiring []*ExpiringCredential
+	leadTimes := sortedLeadTimes(client.Preferences.ExpiryWarningLeadTimes)
+	now := time.Now()
+	for _, cred := range client.CredentialInfoList() {
+		remaining := time.Time(cred.Expires).Sub(now)
+		if remaining <= 0 {
+			continue // already expired
+		}
+		for _, leadTime := range leadTimes {
+			if remaining <= leadTime {
+				expiring = append(expiring, &ExpiringCredential{
+					CredentialInfo: cred,
+					LeadTime:       leadTime,
+					Renewal:        client.renewalPath(cred.Identifier()),
+				})
+				break
+			}
+		}
+	}
+	return expiring
+}
+
+// checkExpiringCredentials notifies the handler of the credentials that reached an expiry warning
+// lead time of which it was not notified before, if the handler is an ExpiryHandler.
+func (client *Client) checkExpiringCredentials() {
+	handler, ok := client.handler.(ExpiryHandler)
+	if !ok {
+		return
+	}
+	expiring := client.ExpiringCredentials()
+	if len(expiring) == 0 {
+		// Warnings of credentials that no longer exist are pruned the next time there is
+		// something to warn about, so we avoid touching the storage here
+		return
+	}
+	warned, err := client.storage.LoadExpiryWarnings()
+	if err != nil {
+		client.reportError(err)
+		return
+	}
+
+	var notify []*ExpiringCredential
+	current := map[string]time.Duration{}
+	for _, cred := range expiring {
+		current[cred.Hash] = cred.LeadTime
+		if leadTime, ok := warned[cred.Hash]; ok && leadTime <= cred.LeadTime {
+			continue
+		}
+		notify = append(notify, cred)
+	}
+	// Keep only the warnings of credentials that still exist and have not yet expired
+	for hash, leadTime := range warned {
+		if l, ok := current[hash]; ok && leadTime < l {
+			current[hash] = leadTime
+		}
+	}
+
+	if err = client.storage.StoreExpiryWarnings(current); err != nil {
+		client.reportError(err)
+		return
+	}
+	if len(notify) > 0 {
+		handler.ExpiringCredentials(notify)
+	}
+}
+
+func (client *Client) renewalPath(id irma.CredentialTypeIdentifier) RenewalPath {
+	var path RenewalPath
+	if credtype := client.Configuration.CredentialTypes[id]; credtype != nil {
+		path.IssueURL = credtype.IssueURL
+		path.IsULIssueURL = credtype.IsULIssueURL
+		path.Refreshable = credtype.RefreshURL != ""
+	}
+	for wizardID, wizard := range client.Configuration.IssueWizards {
+		if wizard.IssuesCredentialType(id) {
+			path.Wizards = append(path.Wizards, wizardID)
+		}
+	}
+	sort.Slice(path.Wizards, func(i, j int) bool {
+		return path.Wizards[i].String() < path.Wizards[j].String()
+	})
+	return path
+}
+
+func sortedLeadTimes(leadTimes []time.Duration) []time.Duration {
+	sorted := append([]time.Duration{}, leadTimes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
@@ -19,3 +19,56 @@ func TestKeyshareChangePin(t *testing.T) {
 	require.NoError(t, client.keyshareChangePinWorker(irma.NewSchemeManagerIdentifier("test"), "12345", "54321"))
 	require.NoError(t, client.keyshareChangePinWorker(irma.NewSchemeManagerIdentifier("test"), "54321", "12345"))
 }
+
+func TestKeyshareLinkDevice(t *testing.T) {
+	testkeyshare.StartKeyshareServer(t, irma.Logger)
+	defer testkeyshare.StopKeyshareServer(t)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	schemeid := irma.NewSchemeManagerIdentifier("test")
+
+	code, tries, _, err := client.KeyshareDeviceLinkCode("54321", schemeid)
+	require.NoError(t, err)
+	require.Nil(t, code)
+	require.NotZero(t, tries)
+
+	code, _, _, err = client.KeyshareDeviceLinkCode("12345", schemeid)
+	require.NoError(t, err)
+	require.NotNil(t, code)
+
+	// Act as a new device by removing the enrollment of the current one
+	username := client.keyshareServers[schemeid].Username
+	require.NoError(t, client.KeyshareRemove(schemeid))
+	require.NoError(t, client.KeyshareLinkDevice(schemeid, username, code.Code, "67890", "Second phone"))
+	require.NotEmpty(t, client.keyshareServers[schemeid].DeviceID)
+
+	// The code can be used only once
+	kss := client.keyshareServers[schemeid]
+	require.NoError(t, client.KeyshareRemove(schemeid))
+	require.Error(t, client.KeyshareLinkDevice(schemeid, username, code.Code, "67890", "Third phone"))
+	client.keyshareServers[schemeid] = kss
+
+	// The new device has its own PIN
+	success, _, _, err := client.KeyshareVerifyPin("67890", schemeid)
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NoError(t, client.keyshareChangePinWorker(schemeid, "67890", "09876"))
+}
+
+// Keyshare enrollment sessions are started without a disclosure choice (see
+// keyshareEnrollmentHandler.RequestIssuancePermission), which must not break recording them.
+func TestKeyshareEnrollmentSessionInfo(t *testing.T) {
+	credtype := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	session := &session{
+		Action:   irma.ActionIssuing,
+		Hostname: "localhost",
+		request: &irma.IssuanceRequest{
+			Credentials: []*irma.CredentialRequest{{CredentialTypeID: credtype}},
+		},
+	}
+
+	info := session.keyshareSessionInfo()
+	require.Equal(t, irma.ActionIssuing, info.Action)
+	require.Equal(t, "localhost", info.RequestorHostname)
+	require.Equal(t, []irma.CredentialTypeIdentifier{credtype}, info.CredentialTypes)
+}
@@ -1,12 +1,16 @@
 package irmaclient
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi/gabikeys"
 	irma "github.com/privacybydesign/irmago"
@@ -40,16 +44,22 @@ func parseStorage(t *testing.T) (*Client, *TestClientHandler) {
 }
 
 func parseExistingStorage(t *testing.T, storage string) (*Client, *TestClientHandler) {
+	client, handler, err := openStorage(t, storage, nil)
+	require.NoError(t, err)
+	client.SetPreferences(Preferences{DeveloperMode: true})
+	return client, handler
+}
+
+func openStorage(t *testing.T, storage string, aesKey []byte) (*Client, *TestClientHandler, error) {
 	handler := &TestClientHandler{t: t, c: make(chan error), storage: storage}
 	path := test.FindTestdataFolder(t)
 	client, err := New(
 		filepath.Join(storage, "client"),
 		filepath.Join(path, "irma_configuration"),
 		handler,
+		aesKey,
 	)
-	require.NoError(t, err)
-	client.SetPreferences(Preferences{DeveloperMode: true})
-	return client, handler
+	return client, handler, err
 }
 
 func verifyClientIsUnmarshaled(t *testing.T, client *Client) {
@@ -211,6 +221,58 @@ func TestCandidates(t *testing.T) {
 	require.Len(t, attrs, 1)
 }
 
+func TestChooseCandidates(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		{{{Type: studentID}, {Type: level}}, {{Type: email}}},
+		{{}, {{Type: email}}},
+	}
+	candidates, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+
+	chosenTypes := func(choice *irma.DisclosureChoice) [][]irma.AttributeTypeIdentifier {
+		var types [][]irma.AttributeTypeIdentifier
+		for _, attrs := range choice.Attributes {
+			ids := []irma.AttributeTypeIdentifier{}
+			for _, attr := range attrs {
+				ids = append(ids, attr.Type)
+			}
+			types = append(types, ids)
+		}
+		return types
+	}
+
+	// Without policies the first disclosable option is chosen
+	choice, explanation, err := client.ChooseCandidates(request, nil, candidates)
+	require.NoError(t, err)
+	assert.Equal(t, [][]irma.AttributeTypeIdentifier{{studentID, level}, {}}, chosenTypes(choice))
+	require.Len(t, explanation, 2)
+	assert.Equal(t, 0, explanation[0].Chosen)
+
+	choice, _, err = client.ChooseCandidates(request, nil, candidates, PreferNewest{}, PreferFewestAttributes{})
+	require.NoError(t, err)
+	assert.Equal(t, [][]irma.AttributeTypeIdentifier{{email}, {email}}, chosenTypes(choice))
+
+	choice, explanation, err = client.ChooseCandidates(request, nil, candidates,
+		NeverDisclose{Attributes: []irma.AttributeTypeIdentifier{email}}, PreferFewestAttributes{})
+	require.NoError(t, err)
+	assert.Equal(t, [][]irma.AttributeTypeIdentifier{{studentID, level}, {}}, chosenTypes(choice))
+	assert.Contains(t, explanation.String(), "attribute test.test.mijnirma.email is never disclosed")
+
+	requestor := &irma.RequestorInfo{Hostnames: []string{"example.com"}, Unverified: true}
+	_, explanation, err = client.ChooseCandidates(request, requestor, candidates, DenyRequestors{Hostnames: []string{"example.com"}})
+	require.Equal(t, ErrNoChoice, err)
+	assert.Equal(t, -1, explanation[0].Chosen)
+	assert.Contains(t, explanation.String(), "hostname example.com is denied")
+}
+
 func TestCandidateConjunctionOrder(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -270,7 +332,7 @@ func TestCredentialRemoval(t *testing.T) {
 	require.Nil(t, cred)
 
 	// Also check whether credential is removed after reloading the storage
-	err = client.storage.db.Close()
+	err = client.storage.Close()
 	require.NoError(t, err)
 	client, handler = parseExistingStorage(t, handler.storage)
 	cred, err = client.credential(id2, 0)
@@ -337,7 +399,7 @@ func TestKeyshareEnrollmentRemoval(t *testing.T) {
 	err := client.KeyshareRemove(irma.NewSchemeManagerIdentifier("test"))
 	require.NoError(t, err)
 
-	err = client.storage.db.Close()
+	err = client.storage.Close()
 	require.NoError(t, err)
 	client, handler = parseExistingStorage(t, handler.storage)
 
@@ -370,13 +432,13 @@ func TestRemoveStorage(t *testing.T) {
 
 	// Check that buckets exist
 	for name, exists := range bucketsBefore {
-		require.Equal(t, exists, client.storage.BucketExists([]byte(name)), fmt.Sprintf("Bucket \"%s\" exists should be %t", name, exists))
+		require.Equal(t, exists, client.storage.(*storage).BucketExists(name), fmt.Sprintf("Bucket \"%s\" exists should be %t", name, exists))
 	}
 
 	require.NoError(t, client.RemoveStorage())
 
 	for name, exists := range bucketsAfter {
-		require.Equal(t, exists, client.storage.BucketExists([]byte(name)), fmt.Sprintf("Bucket \"%s\" exists should be %t", name, exists))
+		require.Equal(t, exists, client.storage.(*storage).BucketExists(name), fmt.Sprintf("Bucket \"%s\" exists should be %t", name, exists))
 	}
 
 	// Check that the client has a new secret key
@@ -384,17 +446,534 @@ func TestRemoveStorage(t *testing.T) {
 	require.NotEqual(t, old_sk, new_sk)
 }
 
+func TestStorageEncryption(t *testing.T) {
+	client, handler := parseStorage(t)
+	storage := handler.storage
+	defer test.ClearTestStorage(t, storage)
+	require.False(t, client.storage.Encrypted())
+
+	sk := *client.secretkey
+	credentials := client.CredentialInfoList()
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+
+	key := bytes.Repeat([]byte{1}, StorageKeySize)
+	client, _, err = openStorage(t, storage, key)
+	require.NoError(t, err)
+	require.True(t, client.storage.Encrypted())
+	require.Equal(t, sk, *client.secretkey)
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+	encryptedLogs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Equal(t, logs, encryptedLogs)
+	verifyCredentials(t, client)
+
+	// Values are no longer stored as plaintext JSON
+	require.NoError(t, kvStoreOf(client).View(func(tx kvTx) error {
+		b, err := tx.Bucket(attributesBucket)
+		require.NoError(t, err)
+		return b.ForEach(func(k, v []byte) error {
+			require.False(t, json.Valid(v))
+			return nil
+		})
+	}))
+	require.NoError(t, client.Close())
+
+	_, _, err = openStorage(t, storage, nil)
+	require.Equal(t, ErrStorageEncrypted, err)
+	_, _, err = openStorage(t, storage, bytes.Repeat([]byte{2}, StorageKeySize))
+	require.Equal(t, ErrStorageKey, err)
+	_, _, err = openStorage(t, storage, []byte{1})
+	require.Error(t, err)
+
+	// Rotate the key
+	newKey := bytes.Repeat([]byte{3}, StorageKeySize)
+	client, _, err = openStorage(t, storage, key)
+	require.NoError(t, err)
+	require.NoError(t, client.RotateStorageKey(newKey))
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+	require.NoError(t, client.Close())
+
+	_, _, err = openStorage(t, storage, key)
+	require.Equal(t, ErrStorageKey, err)
+	client, _, err = openStorage(t, storage, newKey)
+	require.NoError(t, err)
+	require.Equal(t, sk, *client.secretkey)
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+
+	// Disable encryption
+	require.NoError(t, client.RotateStorageKey(nil))
+	require.False(t, client.storage.Encrypted())
+	require.NoError(t, client.Close())
+	client, _, err = openStorage(t, storage, nil)
+	require.NoError(t, err)
+	require.Equal(t, sk, *client.secretkey)
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+	require.NoError(t, client.Close())
+}
+
+func TestBackup(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	sk := *client.secretkey
+	credentials := client.CredentialInfoList()
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+
+	backup, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+	require.NoError(t, client.RemoveStorage())
+	require.Empty(t, client.CredentialInfoList())
+
+	require.Equal(t, ErrBackupPassphrase, client.ImportBackup(backup, "wrong"))
+	tampered := strings.Replace(string(backup), `"ciphertext":"`, `"ciphertext":"A`, 1)
+	require.Error(t, client.ImportBackup([]byte(tampered), "passphrase"))
+	require.Empty(t, client.CredentialInfoList())
+
+	require.NoError(t, client.ImportBackup(backup, "passphrase"))
+	require.Equal(t, sk, *client.secretkey)
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+	restoredLogs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Equal(t, logs, restoredLogs)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	// New log entries continue after the restored ones
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{}))
+	restoredLogs, err = client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Equal(t, logs[0].ID+1, restoredLogs[0].ID)
+}
+
+func TestBackupInvalidSignature(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// Replace the secret key, so that the signatures of the credentials no longer verify
+	sk, err := generateSecretKey()
+	require.NoError(t, err)
+	require.NoError(t, client.storage.StoreSecretKey(sk))
+	backup, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+
+	credentials := client.CredentialInfoList()
+	err = client.ImportBackup(backup, "passphrase")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid signature")
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+}
+
+func TestBackupWithoutAttributes(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	contents, err := client.storage.LoadAll()
+	require.NoError(t, err)
+	attrs := contents.Buckets[attributesBucket]
+	require.NotEmpty(t, attrs.Entries)
+	for _, value := range []string{`[{"Ints":[]}]`, `[{}]`, `[null]`} {
+		attrs.Entries[0].Value = []byte(value)
+		err = client.verifyBackup(contents)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "without attributes")
+	}
+}
+
+func TestExpiryWarnings(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// The credentials in the test storage expire in 2029
+	day := 24 * time.Hour
+	client.SetPreferences(Preferences{DeveloperMode: true, ExpiryWarningLeadTimes: []time.Duration{20000 * day, 5000 * day}})
+	expiring := client.ExpiringCredentials()
+	require.Len(t, expiring, 2)
+	for _, cred := range expiring {
+		assert.Equal(t, 5000*day, cred.LeadTime)
+	}
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	for _, cred := range expiring {
+		if cred.Identifier() == studentCard {
+			assert.Equal(t, client.Configuration.CredentialTypes[studentCard].IssueURL, cred.Renewal.IssueURL)
+		}
+	}
+
+	// Handlers that do not implement ExpiryHandler are not warned, nor are the warnings recorded
+	client.handler = struct{ ClientHandler }{handler}
+	client.checkExpiringCredentials()
+	client.handler = handler
+
+	client.checkExpiringCredentials()
+	require.Len(t, handler.expiring, 2)
+
+	// We are notified only once per lead time
+	client.checkExpiringCredentials()
+	require.Len(t, handler.expiring, 2)
+
+	client.SetPreferences(Preferences{DeveloperMode: true, ExpiryWarningLeadTimes: []time.Duration{5000 * day, 2000 * day}})
+	client.checkExpiringCredentials()
+	require.Len(t, handler.expiring, 4)
+	assert.Equal(t, 2000*day, handler.expiring[3].LeadTime)
+
+	// Credentials expiring later than all lead times are not reported
+	client.SetPreferences(Preferences{DeveloperMode: true, ExpiryWarningLeadTimes: []time.Duration{day}})
+	require.Empty(t, client.ExpiringCredentials())
+}
+
+func TestRevocationUpdatePolicy(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	var (
+		now       = time.Now()
+		fullName  = irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+		root      = irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+		singleton = irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton")
+		student   = irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+		policy    = RevocationUpdatePolicy{
+			Targets: map[irma.CredentialTypeIdentifier]time.Duration{
+				fullName: time.Hour, root: time.Hour, singleton: time.Hour, student: time.Hour,
+			},
+			MaxRequestsPerHour:     3,
+			MeteredRequestsPerHour: 1,
+		}
+		random = func() (float64, error) { return 0.2, nil }
+	)
+
+	// A witness well past its target is selected, along with the witnesses of the same issuer
+	// that are older than a fourth of their target
+	selected, err := selectRevocationUpdates(client.Configuration, policy, map[irma.CredentialTypeIdentifier]time.Time{
+		fullName:  now.Add(-2 * time.Hour),
+		root:      now.Add(-20 * time.Minute),
+		singleton: now.Add(-time.Minute),
+		student:   now.Add(-5 * time.Minute),
+	}, now, random)
+	require.NoError(t, err)
+	require.Equal(t, map[irma.IssuerIdentifier][]irma.CredentialTypeIdentifier{
+		fullName.IssuerIdentifier(): {fullName, root},
+	}, selected)
+
+	// Without a target, the update speed of the credential type applies
+	policy.Targets = nil
+	selected, err = selectRevocationUpdates(client.Configuration, policy, map[irma.CredentialTypeIdentifier]time.Time{
+		fullName: now.Add(-2 * time.Hour),
+	}, now, random)
+	require.NoError(t, err)
+	require.Empty(t, selected)
+
+	// Requests are limited per hour, and more so on metered networks
+	u := &client.revocationUpdates
+	require.True(t, u.request(policy, now.Add(-time.Hour)))
+	require.True(t, u.request(policy, now))
+	client.SetNetworkMetered(true)
+	require.False(t, u.request(policy, now))
+	client.SetNetworkMetered(false)
+	require.True(t, u.request(policy, now))
+	require.True(t, u.request(policy, now))
+	require.False(t, u.request(policy, now))
+	require.True(t, u.request(policy, now.Add(time.Hour)))
+
+	policy.MeteredRequestsPerHour = 0
+	client.SetNetworkMetered(true)
+	require.False(t, u.budgetLeft(policy, now.Add(2*time.Hour)))
+
+	stats, err := client.RevocationUpdateStats()
+	require.NoError(t, err)
+	require.Equal(t, 5, stats.Requests)
+	require.True(t, stats.NetworkMetered)
+}
+
+// addDisclosureLog performs the proofs of a disclosure session of the studentID attribute,
+// and logs it as a session with a requestor at example.com.
+func addDisclosureLog(t *testing.T, client *Client) *LogEntry {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	candidates, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	choice, _, err := client.ChooseCandidates(request, nil, candidates)
+	require.NoError(t, err)
+	disclosure, _, err := client.Proofs(choice, request)
+	require.NoError(t, err)
+
+	name := "Example"
+	entry := &LogEntry{
+		Type: irma.ActionDisclosing,
+		Time: irma.Timestamp(time.Now()),
+		ServerName: &irma.RequestorInfo{
+			ID:        irma.NewRequestorIdentifier("test-requestors.example"),
+			Name:      irma.NewTranslatedString(&name),
+			Hostnames: []string{"example.com"},
+		},
+		Version:    client.maxVersion,
+		Disclosure: disclosure,
+		request:    request,
+	}
+	require.NoError(t, entry.setSessionRequest())
+	require.NoError(t, client.storage.AddLogEntry(entry))
+	return entry
+}
+
+func logIDs(t *testing.T, client *Client, filter LogFilter, beforeIndex uint64, max int) []uint64 {
+	entries, err := client.SearchLogs(filter, beforeIndex, max)
+	require.NoError(t, err)
+	ids := []uint64{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestSearchLogs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// The test storage contains issuance entries 2, 4 and 5, and removal entries 1 and 3
+	entry := addDisclosureLog(t, client)
+	require.Equal(t, uint64(6), entry.ID)
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, logs, 6)
+
+	issuing := []irma.Action{irma.ActionIssuing}
+	assert.Equal(t, []uint64{6, 5, 4, 3, 2, 1}, logIDs(t, client, LogFilter{}, 0, 100))
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{Types: []irma.Action{irma.ActionDisclosing}}, 0, 100))
+	assert.Equal(t, []uint64{5, 4, 2}, logIDs(t, client, LogFilter{Types: issuing}, 0, 100))
+	assert.Equal(t, []uint64{4, 3}, logIDs(t, client, LogFilter{Types: append(issuing, ActionRemoval)}, 5, 2))
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{Hostname: "EXAMPLE.com"}, 0, 100))
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{Requestor: entry.ServerName.ID}, 0, 100))
+	assert.Empty(t, logIDs(t, client, LogFilter{Hostname: "example.org"}, 0, 100))
+
+	// Search by credential type disclosed, issued or removed
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	ids := logIDs(t, client, LogFilter{CredentialType: studentCard}, 0, 100)
+	require.Contains(t, ids, uint64(6))
+	for _, log := range logs {
+		issued, err := log.GetIssuedCredentials(client.Configuration)
+		require.NoError(t, err)
+		involved := log.ID == 6
+		for _, cred := range issued {
+			involved = involved || cred.Identifier() == studentCard
+		}
+		_, removed := log.Removed[studentCard]
+		assert.Equal(t, involved || removed, containsID(ids, log.ID), "log entry %d", log.ID)
+	}
+
+	// Search by time
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{From: time.Now().Add(-time.Minute)}, 0, 100))
+	entry2 := logs[4]
+	require.Equal(t, uint64(2), entry2.ID)
+	assert.Equal(t, []uint64{2, 1}, logIDs(t, client, LogFilter{Until: time.Time(entry2.Time)}, 0, 100))
+	assert.Equal(t, []uint64{2}, logIDs(t, client, LogFilter{Types: issuing, Until: time.Time(entry2.Time)}, 0, 100))
+	assert.Equal(t, []uint64{2, 1}, logIDs(t, client, LogFilter{From: time.Time(entry2.Time), Until: time.Time(entry2.Time)}, 0, 100))
+	assert.Equal(t, []uint64{6, 5, 4, 3, 2, 1}, logIDs(t, client, LogFilter{From: time.Time(entry2.Time), Until: time.Now()}, 0, 100))
+
+	// The indices remain usable after encrypting the storage
+	require.NoError(t, client.RotateStorageKey(bytes.Repeat([]byte{1}, StorageKeySize)))
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{Hostname: "example.com"}, 0, 100))
+	assert.Equal(t, []uint64{5, 4, 2}, logIDs(t, client, LogFilter{Types: issuing}, 0, 100))
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Now())}))
+	assert.Equal(t, []uint64{7, 3, 1}, logIDs(t, client, LogFilter{Types: []irma.Action{ActionRemoval}}, 0, 100))
+	assert.Equal(t, []uint64{2, 1}, logIDs(t, client, LogFilter{From: time.Time(entry2.Time), Until: time.Time(entry2.Time)}, 0, 100))
+	assert.Equal(t, []uint64{7, 6}, logIDs(t, client, LogFilter{From: time.Now().Add(-time.Minute)}, 0, 100))
+
+	// The times of the log entries are not stored in the clear in the indices
+	for _, v := range bucketValues(t, client, logEntryIndexBucket) {
+		assert.Error(t, json.Unmarshal(v, &logIndexRecord{}))
+	}
+}
+
+// bucketValues returns the values of the keys in the specified bucket of the client storage.
+func bucketValues(t *testing.T, client *Client, name string) map[string][]byte {
+	values := map[string][]byte{}
+	require.NoError(t, kvStoreOf(client).View(func(tx kvTx) error {
+		b, err := tx.Bucket(name)
+		if b == nil || err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	}))
+	return values
+}
+
+func TestTrustRecords(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	verified := &irma.RequestorInfo{ID: irma.NewRequestorIdentifier("test-requestors.example")}
+	unverified := &irma.RequestorInfo{Hostnames: []string{"Example.com"}, Unverified: true}
+	require.Equal(t, ErrUnidentifiedRequestor, client.SetRequestorTrust(&irma.RequestorInfo{Unverified: true}, TrustBlock))
+	require.Error(t, client.SetRequestorTrust(verified, TrustDecision("sometimes")))
+	require.Equal(t, ErrRememberUnverified, client.SetRequestorTrust(unverified, TrustRemember))
+	require.Nil(t, client.TrustRecord(unverified))
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	candidates, _, err := client.Candidates(request)
+	require.NoError(t, err)
+	choice, _, err := client.ChooseCandidates(request, nil, candidates)
+	require.NoError(t, err)
+
+	// Without trust records the user is always asked
+	blocked, remembered := client.trustedPermission(verified, request, candidates)
+	require.False(t, blocked)
+	require.Nil(t, remembered)
+
+	require.NoError(t, client.SetRequestorTrust(verified, TrustRemember))
+	require.NoError(t, client.SetRequestorTrust(unverified, TrustBlock))
+	records := client.TrustRecords()
+	require.Len(t, records, 2)
+	assert.Equal(t, "hostname:example.com", records[0].Key)
+	assert.True(t, records[0].Unverified)
+	assert.Equal(t, "requestor:test-requestors.example", records[1].Key)
+	assert.False(t, records[1].Unverified)
+	assert.Equal(t, irma.NewRequestorSchemeIdentifier("test-requestors"), records[1].Scheme)
+
+	blocked, _ = client.trustedPermission(unverified, request, candidates)
+	require.True(t, blocked)
+
+	// Choices are never remembered for unverified requestors, even if stored earlier
+	client.trustRecords["hostname:example.com"].Decision = TrustRemember
+	require.NoError(t, client.rememberChoice(unverified, request, choice))
+	_, remembered = client.trustedPermission(unverified, request, candidates)
+	require.Nil(t, remembered)
+	require.Empty(t, client.trustRecords["hostname:example.com"].Choices)
+	client.trustRecords["hostname:example.com"].Decision = TrustBlock
+
+	// The choice for the request is remembered, and used for identical requests only
+	_, remembered = client.trustedPermission(verified, request, candidates)
+	require.Nil(t, remembered)
+	require.NoError(t, client.rememberChoice(verified, request, choice))
+	identical := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, remembered = client.trustedPermission(verified, identical, candidates)
+	require.Equal(t, choice, remembered)
+	other := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"))
+	otherCandidates, _, err := client.Candidates(other)
+	require.NoError(t, err)
+	_, remembered = client.trustedPermission(verified, other, otherCandidates)
+	require.Nil(t, remembered)
+
+	// Trust records are persisted
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.Len(t, client.TrustRecords(), 2)
+	_, remembered = client.trustedPermission(verified, identical, candidates)
+	require.Equal(t, choice, remembered)
+
+	// The remembered choice is no longer used when its credential is removed
+	require.NoError(t, client.RemoveCredentialByHash(choice.Attributes[0][0].CredentialHash))
+	candidates, _, err = client.Candidates(request)
+	require.NoError(t, err)
+	_, remembered = client.trustedPermission(verified, request, candidates)
+	require.Nil(t, remembered)
+
+	// Changing the decision forgets the remembered choices
+	require.NoError(t, client.SetRequestorTrust(verified, TrustAlwaysAsk))
+	require.Empty(t, client.TrustRecord(verified).Choices)
+
+	require.NoError(t, client.RemoveTrustRecord("hostname:example.com"))
+	require.Error(t, client.RemoveTrustRecord("hostname:example.com"))
+	require.Nil(t, client.TrustRecord(unverified))
+	require.Len(t, client.TrustRecords(), 1)
+}
+
+func containsID(ids []uint64, id uint64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPruneLogs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	addDisclosureLog(t, client)
+
+	// Nothing is pruned by default
+	require.NoError(t, client.PruneLogs())
+	assert.Equal(t, []uint64{6, 5, 4, 3, 2, 1}, logIDs(t, client, LogFilter{}, 0, 100))
+
+	client.SetPreferences(Preferences{DeveloperMode: true, MaxLogEntries: 4})
+	require.NoError(t, client.PruneLogs())
+	assert.Equal(t, []uint64{6, 5, 4, 3}, logIDs(t, client, LogFilter{}, 0, 100))
+	assert.Equal(t, []uint64{3}, logIDs(t, client, LogFilter{Types: []irma.Action{ActionRemoval}}, 0, 100))
+
+	// The entries of the test storage are from 2019. Their index entries are removed even if the
+	// indexed properties can no longer be determined, e.g. because their scheme has been removed.
+	client.SetPreferences(Preferences{DeveloperMode: true, LogRetention: 24 * time.Hour})
+	s := client.storage.(*storage)
+	conf := s.Configuration
+	s.Configuration = &irma.Configuration{}
+	require.NoError(t, client.PruneLogs())
+	s.Configuration = conf
+	assert.Equal(t, []uint64{6}, logIDs(t, client, LogFilter{}, 0, 100))
+	assert.Empty(t, logIDs(t, client, LogFilter{Types: []irma.Action{irma.ActionIssuing}}, 0, 100))
+	for k := range bucketValues(t, client, logIndexBucket) {
+		assert.Equal(t, uint64(6), binary.BigEndian.Uint64([]byte(k)[len(k)-8:]))
+	}
+	assert.Len(t, bucketValues(t, client, logEntryIndexBucket), 1)
+}
+
+func TestExportLogs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	addDisclosureLog(t, client)
+
+	export, err := client.ExportLogs(LogFilter{})
+	require.NoError(t, err)
+	require.Len(t, export.Entries, 6)
+	bts, err := json.Marshal(export)
+	require.NoError(t, err)
+	export, err = ParseLogExport(bts)
+	require.NoError(t, err)
+
+	disclosure := export.Entries[0]
+	require.Equal(t, irma.ActionDisclosing, disclosure.Type)
+	require.Len(t, disclosure.Disclosed, 1)
+	status, err := disclosure.Verify(client.Configuration)
+	require.NoError(t, err)
+	assert.Equal(t, irma.ProofStatusValid, status)
+
+	issuance := export.Entries[1]
+	require.Equal(t, irma.ActionIssuing, issuance.Type)
+	require.NotEmpty(t, issuance.Issued)
+	_, err = issuance.Verify(client.Configuration)
+	assert.Equal(t, ErrLogEntryUnverifiable, err)
+
+	// Changing the disclosed attributes of the entry invalidates it
+	value := "no"
+	disclosure.Disclosed[0][0].RawValue = &value
+	status, err = disclosure.Verify(client.Configuration)
+	assert.Error(t, err)
+	assert.Equal(t, irma.ProofStatusInvalid, status)
+
+	_, err = ParseLogExport([]byte(`{"version":2,"entries":[]}`))
+	assert.Error(t, err)
+}
+
 // ------
 
 type TestClientHandler struct {
-	t       *testing.T
-	c       chan error
-	storage string
+	t        *testing.T
+	c        chan error
+	storage  string
+	expiring []*ExpiringCredential
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
 func (i *TestClientHandler) UpdateAttributes()                               {}
 func (i *TestClientHandler) Revoked(cred *irma.CredentialIdentifier)         {}
+func (i *TestClientHandler) ExpiringCredentials(creds []*ExpiringCredential) {
+	i.expiring = append(i.expiring, creds...)
+}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -1,11 +1,14 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -42,7 +45,9 @@ type keyshareSession struct {
 	pinRequestor     KeysharePinRequestor
 	builders         gabi.ProofBuilderList
 	session          irma.SessionRequest
+	info             *irma.KeyshareSessionInfo
 	conf             *irma.Configuration
+	confMutex        *sync.RWMutex // see Client.readConfiguration
 	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
 	keyshareServer   *keyshareServer // The one keyshare server in use in case of issuance
 	transports       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
@@ -54,6 +59,7 @@ type keyshareSession struct {
 
 type keyshareServer struct {
 	Username                string `json:"username"`
+	DeviceID                string `json:"device_id,omitempty"` // set if linked to an account registered by another device
 	Nonce                   []byte `json:"nonce"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
 	token                   string
@@ -79,6 +85,15 @@ func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (ks
 	return
 }
 
+// setHeaders sets the headers with which the keyshare server identifies the account and device.
+func (ks *keyshareServer) setHeaders(transport *irma.HTTPTransport) {
+	transport.SetHeader(kssUsernameHeader, ks.Username)
+	if ks.DeviceID != "" {
+		transport.SetHeader(irma.KeyshareDeviceHeader, ks.DeviceID)
+	}
+	transport.SetHeader(kssAuthHeader, ks.token)
+}
+
 func (ks *keyshareServer) HashedPin(pin string) string {
 	hash := sha256.Sum256(append(ks.Nonce, []byte(pin)...))
 	// We must be compatible with the old Android app here,
@@ -92,29 +107,39 @@ func (ks *keyshareServer) HashedPin(pin string) string {
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
 // user cancels; or one of the keyshare servers blocks us.
 // Error, blocked or success of the keyshare session is reported back to the keyshareSessionHandler.
+// Requests to the keyshare servers are aborted when the context is done.
 func startKeyshareSession(
+	ctx context.Context,
 	sessionHandler keyshareSessionHandler,
 	pin KeysharePinRequestor,
 	builders gabi.ProofBuilderList,
 	session irma.SessionRequest,
+	info *irma.KeyshareSessionInfo,
 	issuerProofNonce *big.Int,
 	timestamp *atum.Timestamp,
 	conf *irma.Configuration,
+	confMutex *sync.RWMutex,
 	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer,
 	preferences Preferences,
 ) {
-	ksscount := 0
+	// Afterwards the session only reads the public keys of the keyshare servers from the Configuration
+	schemes := map[irma.SchemeManagerIdentifier]*irma.SchemeManager{}
+	confMutex.RLock()
 	for managerID := range session.Identifiers().SchemeManagers {
-		if conf.SchemeManagers[managerID].Distributed() {
-			ksscount++
-			if _, enrolled := keyshareServers[managerID]; !enrolled {
-				err := errors.New("Not enrolled to keyshare server of scheme manager " + managerID.String())
-				sessionHandler.KeyshareError(&managerID, err)
-				return
-			}
+		if scheme := conf.SchemeManagers[managerID]; scheme.Distributed() {
+			schemes[managerID] = scheme
+		}
+	}
+	confMutex.RUnlock()
+
+	for managerID := range schemes {
+		if _, enrolled := keyshareServers[managerID]; !enrolled {
+			err := errors.New("Not enrolled to keyshare server of scheme manager " + managerID.String())
+			sessionHandler.KeyshareError(&managerID, err)
+			return
 		}
 	}
-	if _, issuing := session.(*irma.IssuanceRequest); issuing && ksscount > 1 {
+	if _, issuing := session.(*irma.IssuanceRequest); issuing && len(schemes) > 1 {
 		err := errors.New("Issuance session involving more than one keyshare servers are not supported")
 		sessionHandler.KeyshareError(nil, err)
 		return
@@ -122,11 +147,13 @@ func startKeyshareSession(
 
 	ks := &keyshareSession{
 		session:          session,
+		info:             info,
 		builders:         builders,
 		sessionHandler:   sessionHandler,
 		transports:       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport{},
 		pinRequestor:     pin,
 		conf:             conf,
+		confMutex:        confMutex,
 		keyshareServers:  keyshareServers,
 		issuerProofNonce: issuerProofNonce,
 		timestamp:        timestamp,
@@ -134,16 +161,10 @@ func startKeyshareSession(
 		preferences:      preferences,
 	}
 
-	for managerID := range session.Identifiers().SchemeManagers {
-		scheme := ks.conf.SchemeManagers[managerID]
-		if !scheme.Distributed() {
-			continue
-		}
-
+	for managerID, scheme := range schemes {
 		ks.keyshareServer = ks.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.preferences.DeveloperMode)
-		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
-		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
+		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.preferences.DeveloperMode).WithContext(ctx)
+		ks.keyshareServer.setHeaders(transport)
 		transport.SetHeader(kssVersionHeader, "2")
 		ks.transports[managerID] = transport
 
@@ -151,7 +172,7 @@ func startKeyshareSession(
 		parser := new(jwt.Parser)
 		parser.SkipClaimsValidation = true // We want to verify expiry on our own below so we can add leeway
 		claims := jwt.StandardClaims{}
-		_, err := parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.conf.KeyshareServerKeyFunc(managerID))
+		_, err := parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.keyFunc(managerID))
 		if err != nil {
 			irma.Logger.Info("Keyshare server token invalid, asking for PIN")
 			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
@@ -175,6 +196,16 @@ func startKeyshareSession(
 	}
 }
 
+// keyFunc returns the function with which the JWTs of the keyshare server of the specified
+// scheme manager are verified, reading its public key from the Configuration.
+func (ks *keyshareSession) keyFunc(managerID irma.SchemeManagerIdentifier) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		ks.confMutex.RLock()
+		defer ks.confMutex.RUnlock()
+		return ks.conf.KeyshareServerKeyFunc(managerID)(t)
+	}
+}
+
 func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error) {
 	serr, ok := err.(*irma.SessionError)
 	if ok {
@@ -228,7 +259,7 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 
 func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransport) (
 	success bool, tries int, blocked int, err error) {
-	pinmsg := irma.KeysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
+	pinmsg := irma.KeysharePinMessage{Username: kss.Username, DeviceID: kss.DeviceID, Pin: kss.HashedPin(pin)}
 	pinresult := &irma.KeysharePinStatus{}
 	err = transport.Post("users/verify/pin", pinresult, pinmsg)
 	if err != nil {
@@ -267,11 +298,7 @@ func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransp
 // If all is ok, success will be true.
 func (ks *keyshareSession) verifyPinAttempt(pin string) (
 	success bool, tries int, blocked int, manager irma.SchemeManagerIdentifier, err error) {
-	for manager = range ks.session.Identifiers().SchemeManagers {
-		if !ks.conf.SchemeManagers[manager].Distributed() {
-			continue
-		}
-
+	for manager = range ks.transports {
 		kss := ks.keyshareServers[manager]
 		transport := ks.transports[manager]
 		success, tries, blocked, err = verifyPinWorker(pin, kss, transport)
@@ -294,7 +321,7 @@ func (ks *keyshareSession) GetCommitments() {
 	for _, builder := range ks.builders {
 		pk := builder.PublicKey()
 		managerID := irma.NewIssuerIdentifier(pk.Issuer).SchemeManagerIdentifier()
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if _, distributed := ks.transports[managerID]; !distributed {
 			continue
 		}
 		if _, contains := pkids[managerID]; !contains {
@@ -306,11 +333,14 @@ func (ks *keyshareSession) GetCommitments() {
 	// Now inform each keyshare server of with respect to which public keys
 	// we want them to send us commitments
 	for managerID := range ks.session.Identifiers().SchemeManagers {
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if _, distributed := ks.transports[managerID]; !distributed {
 			continue
 		}
 
 		transport := ks.transports[managerID]
+		if header := ks.sessionInfoHeader(managerID); header != "" {
+			transport.SetHeader(irma.KeyshareSessionInfoHeader, header)
+		}
 		comms := &irma.ProofPCommitmentMap{}
 		err := transport.Post("prove/getCommitments", comms, pkids[managerID])
 		if err != nil {
@@ -345,6 +375,27 @@ func (ks *keyshareSession) GetCommitments() {
 	ks.GetProofPs()
 }
 
+// sessionInfoHeader returns the session info to send to the keyshare server of the specified
+// scheme manager, restricted to the credential types of that scheme manager.
+func (ks *keyshareSession) sessionInfoHeader(managerID irma.SchemeManagerIdentifier) string {
+	if ks.info == nil {
+		return ""
+	}
+	info := *ks.info
+	info.CredentialTypes = nil
+	for _, credtype := range ks.info.CredentialTypes {
+		if credtype.IssuerIdentifier().SchemeManagerIdentifier() == managerID {
+			info.CredentialTypes = append(info.CredentialTypes, credtype)
+		}
+	}
+	bts, err := json.Marshal(info)
+	if err != nil {
+		irma.Logger.Warn("Could not encode keyshare session info: ", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(bts)
+}
+
 // GetProofPs uses the combined commitments of all keyshare servers and ourself
 // to calculate the challenge, which is sent to the keyshare servers in order to
 // receive their responses (2nd and 3rd message in Schnorr zero-knowledge protocol).
@@ -407,7 +458,7 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 	for i, builder := range ks.builders {
 		// Parse each received JWT
 		managerID := irma.NewIssuerIdentifier(builder.PublicKey().Issuer).SchemeManagerIdentifier()
-		if !ks.conf.SchemeManagers[managerID].Distributed() {
+		if _, distributed := ks.transports[managerID]; !distributed {
 			continue
 		}
 		claims := struct {
@@ -416,7 +467,7 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 		}{}
 		parser := new(jwt.Parser)
 		parser.SkipClaimsValidation = true // no need to abort due to clock drift issues
-		if _, err := parser.ParseWithClaims(responses[managerID], &claims, ks.conf.KeyshareServerKeyFunc(managerID)); err != nil {
+		if _, err := parser.ParseWithClaims(responses[managerID], &claims, ks.keyFunc(managerID)); err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
 		}
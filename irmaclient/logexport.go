@@ -0,0 +1,165 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the export of log entries to a portable format, containing the proofs of the
+// disclosure and signature sessions so that they can be verified independently of the client.
+
+// logExportVersion is the version of the format produced by ExportLogs.
+const logExportVersion = 1
+
+var ErrLogEntryUnverifiable = errors.New("log entry contains no verifiable proofs")
+
+// LogExport contains exported log entries.
+type LogExport struct {
+	Version int                 `json:"version"`
+	Entries []*ExportedLogEntry `json:"entries"`
+}
+
+// ExportedLogEntry is the portable form of a LogEntry. Besides the attributes disclosed and the
+// credentials issued, renewed or removed in the session, it contains the session request and the
+// proofs of disclosure sessions, and the signed message (including its timestamp) of signature
+// sessions.
+type ExportedLogEntry struct {
+	ID        uint64                                                    `json:"id"`
+	Type      irma.Action                                               `json:"type"`
+	Time      irma.Timestamp                                            `json:"time"`
+	Requestor *irma.RequestorInfo                                       `json:"requestor,omitempty"`
+	Request   json.RawMessage                                           `json:"request,omitempty"`
+	Disclosed [][]*irma.DisclosedAttribute                              `json:"disclosed,omitempty"`
+	Issued    irma.CredentialInfoList                                   `json:"issued,omitempty"`
+	Removed   map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"removed,omitempty"`
+	Renewed   map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"renewed,omitempty"`
+
+	Disclosure    *irma.Disclosure    `json:"disclosure,omitempty"`
+	SignedMessage *irma.SignedMessage `json:"signedMessage,omitempty"`
+}
+
+// ExportLogs returns all log entries matching the filter in the portable format of LogExport,
+// sorted from new to old.
+func (client *Client) ExportLogs(filter LogFilter) (*LogExport, error) {
+	export := &LogExport{Version: logExportVersion, Entries: []*ExportedLogEntry{}}
+	err := client.storage.IterateLogs(filter, func(entry *LogEntry) error {
+		exported, err := exportLogEntry(entry, client.Configuration)
+		if err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("failed to export log entry %d", entry.ID), 0)
+		}
+		export.Entries = append(export.Entries, exported)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+func exportLogEntry(entry *LogEntry, conf *irma.Configuration) (*ExportedLogEntry, error) {
+	exported := &ExportedLogEntry{
+		ID:        entry.ID,
+		Type:      entry.Type,
+		Time:      entry.Time,
+		Requestor: entry.ServerName,
+		Request:   entry.Request,
+		Removed:   entry.Removed,
+		Renewed:   entry.Renewed,
+	}
+	if !entry.hasProofs() {
+		return exported, nil
+	}
+
+	var err error
+	if exported.Disclosed, err = entry.GetDisclosedCredentials(conf); err != nil {
+		return nil, err
+	}
+	switch entry.Type {
+	case irma.ActionDisclosing:
+		exported.Disclosure = entry.Disclosure
+	case irma.ActionSigning:
+		if exported.SignedMessage, err = entry.GetSignedMessage(); err != nil {
+			return nil, err
+		}
+	case irma.ActionIssuing:
+		if exported.Issued, err = entry.GetIssuedCredentials(conf); err != nil {
+			return nil, err
+		}
+	}
+	return exported, nil
+}
+
+// Verify verifies the proofs of the exported log entry against its session request, and checks
+// that they disclose the attributes listed in the entry. Signatures are verified at the time of
+// their timestamp, and disclosures at the time of the log entry. Log entries other than those of
+// disclosure and signature sessions cannot be verified, for which ErrLogEntryUnverifiable is returned.
+func (entry *ExportedLogEntry) Verify(conf *irma.Configuration) (irma.ProofStatus, error) {
+	var (
+		disclosed [][]*irma.DisclosedAttribute
+		status    irma.ProofStatus
+		err       error
+	)
+	switch {
+	case entry.Type == irma.ActionDisclosing && entry.Disclosure != nil:
+		request := &irma.DisclosureRequest{}
+		if err = json.Unmarshal(entry.Request, request); err != nil {
+			return irma.ProofStatusInvalid, errors.WrapPrefix(err, "failed to parse session request", 0)
+		}
+		t := time.Time(entry.Time)
+		disclosed, status, err = entry.Disclosure.VerifyAgainstRequest(
+			conf, request, request.GetContext(), request.GetNonce(nil), nil, &t, false,
+		)
+	case entry.Type == irma.ActionSigning && entry.SignedMessage != nil:
+		request := &irma.SignatureRequest{}
+		if err = json.Unmarshal(entry.Request, request); err != nil {
+			return irma.ProofStatusInvalid, errors.WrapPrefix(err, "failed to parse session request", 0)
+		}
+		disclosed, status, err = entry.SignedMessage.Verify(conf, request)
+	default:
+		return "", ErrLogEntryUnverifiable
+	}
+	if err != nil || status != irma.ProofStatusValid {
+		return status, err
+	}
+
+	if !sameDisclosedAttributes(disclosed, entry.Disclosed) {
+		return irma.ProofStatusInvalid, errors.New("disclosed attributes of log entry do not match its proofs")
+	}
+	return status, nil
+}
+
+func sameDisclosedAttributes(a, b [][]*irma.DisclosedAttribute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			x, y := a[i][j], b[i][j]
+			if x.Identifier != y.Identifier || x.Status != y.Status ||
+				(x.RawValue == nil) != (y.RawValue == nil) ||
+				(x.RawValue != nil && *x.RawValue != *y.RawValue) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseLogExport parses a log export produced by ExportLogs.
+func ParseLogExport(bts []byte) (*LogExport, error) {
+	export := &LogExport{}
+	if err := json.Unmarshal(bts, export); err != nil {
+		return nil, err
+	}
+	if export.Version != logExportVersion {
+		return nil, errors.Errorf("unsupported log export version %d", export.Version)
+	}
+	return export, nil
+}
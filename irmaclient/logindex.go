@@ -0,0 +1,618 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the indices over the log entries with which they can be searched, and the
+// retention policy with which old log entries are pruned.
+
+// Bucketnames bbolt
+const (
+	// Key: token of an indexed property (see logIndexToken) followed by the log entry ID, value: empty.
+	logIndexBucket = "logindex"
+	// Key: log entry ID, value: logIndexRecord.
+	logEntryIndexBucket = "logentryindex"
+)
+
+// Indexed properties of log entries
+const (
+	logIndexType       = "type"
+	logIndexRequestor  = "requestor"
+	logIndexHostname   = "hostname"
+	logIndexCredential = "credential"
+	logIndexMonth      = "month"
+)
+
+// logRetentionInterval is the interval at which old log entries are pruned.
+const logRetentionInterval = time.Hour
+
+// LogFilter specifies the log entries returned by Client.SearchLogs. Log entries are returned
+// if they match all nonempty fields of the filter.
+type LogFilter struct {
+	// Types of the log entries, of which the log entries must have any
+	Types []irma.Action
+	// Requestor of the session, as identified in its requestor scheme
+	Requestor irma.RequestorIdentifier
+	// Hostname of the requestor of the session
+	Hostname string
+	// CredentialType of which attributes were disclosed, or which was issued or removed
+	CredentialType irma.CredentialTypeIdentifier
+	// From and Until bound the time of the log entries (both inclusive)
+	From, Until time.Time
+}
+
+func (filter LogFilter) indexed() bool {
+	return len(filter.Types) > 0 || !filter.Requestor.Empty() || filter.Hostname != "" ||
+		!filter.CredentialType.Empty() || !filter.From.IsZero() || !filter.Until.IsZero()
+}
+
+// matchesTime returns whether a time in Unix seconds lies within the From and Until of the filter.
+func (filter LogFilter) matchesTime(seconds uint64) bool {
+	return (filter.From.IsZero() || seconds >= logTimeSeconds(filter.From)) &&
+		(filter.Until.IsZero() || seconds <= logTimeSeconds(filter.Until))
+}
+
+// SearchLogs returns the log entries that match the filter and took place before the log entry
+// with ID beforeIndex, or all matching entries if beforeIndex is 0 (sorted from new to old, the
+// result length is limited to max).
+func (client *Client) SearchLogs(filter LogFilter, beforeIndex uint64, max int) ([]*LogEntry, error) {
+	return client.storage.SearchLogs(filter, beforeIndex, max)
+}
+
+// PruneLogs removes the log entries that are older than the LogRetention of the preferences, and
+// the oldest log entries in excess of MaxLogEntries. It is periodically called in the background.
+func (client *Client) PruneLogs() error {
+	var olderThan time.Time
+	if client.Preferences.LogRetention > 0 {
+		olderThan = time.Now().Add(-client.Preferences.LogRetention)
+	}
+	_, err := client.storage.PruneLogs(olderThan, client.Preferences.MaxLogEntries)
+	return err
+}
+
+func (client *Client) initLogRetention() {
+	client.scheduler.Every(uint64(logRetentionInterval.Seconds())).Seconds().Do(func() {
+		client.jobs <- func() {
+			if err := client.PruneLogs(); err != nil {
+				client.reportError(err)
+			}
+		}
+	})
+}
+
+// logIndexRecord is stored for each indexed log entry. It contains the time of the entry, which
+// the index contains only up to the month, and the keys of the entry in the log index, so that
+// these can be removed even if the indexed properties would now be determined differently
+// (e.g. after a scheme update).
+type logIndexRecord struct {
+	Time uint64   `json:"time"`
+	Keys [][]byte `json:"keys"`
+}
+
+// logIndexer computes the log index with a particular storage key: if the storage is encrypted,
+// the indexed properties and the times of the log entries should not be derivable from the index.
+type logIndexer struct {
+	key  []byte      // with which the tokens of the log index are computed
+	aead cipher.AEAD // with which the logIndexRecords are sealed
+}
+
+func (s *storage) logIndexer() logIndexer {
+	return logIndexer{key: logIndexKeyFrom(s.encryptionKey()), aead: s.aead}
+}
+
+func logIndexKeyFrom(aesKey []byte) []byte {
+	if aesKey == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, aesKey)
+	mac.Write([]byte("irmaclient log index"))
+	return mac.Sum(nil)
+}
+
+// logIndexToken returns the prefix of the keys in the log index of the log entries having the
+// specified value of the specified property.
+func logIndexToken(indexKey []byte, property, value string) []byte {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(property))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// hasProofs returns whether the log entry contains the proofs of a session.
+func (entry *LogEntry) hasProofs() bool {
+	switch entry.Type {
+	case irma.ActionDisclosing, irma.ActionSigning:
+		return entry.Disclosure != nil
+	case irma.ActionIssuing:
+		return entry.IssueCommitment != nil
+	default:
+		return false
+	}
+}
+
+// logIndexMonths returns the months (as indexed under logIndexMonth) from the month of from up to
+// and including the month of until.
+func logIndexMonths(from, until time.Time) []string {
+	var months []string
+	month := time.Unix(int64(logTimeSeconds(from)), 0).UTC()
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for ; !month.After(until); month = month.AddDate(0, 1, 0) {
+		months = append(months, month.Format("2006-01"))
+	}
+	return months
+}
+
+func logTimeSeconds(t time.Time) uint64 {
+	if t.Unix() < 0 {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+// logIndexValues returns the values of the indexed properties of the log entry.
+func logIndexValues(entry *LogEntry, conf *irma.Configuration) map[string][]string {
+	values := map[string][]string{
+		logIndexType:  {string(entry.Type)},
+		logIndexMonth: {time.Time(entry.Time).UTC().Format("2006-01")},
+	}
+	if entry.ServerName != nil {
+		if !entry.ServerName.ID.Empty() {
+			values[logIndexRequestor] = []string{entry.ServerName.ID.String()}
+		}
+		for _, hostname := range entry.ServerName.Hostnames {
+			values[logIndexHostname] = append(values[logIndexHostname], strings.ToLower(hostname))
+		}
+	}
+
+	credtypes := map[irma.CredentialTypeIdentifier]struct{}{}
+	for id := range entry.Removed {
+		credtypes[id] = struct{}{}
+	}
+	for id := range entry.Renewed {
+		credtypes[id] = struct{}{}
+	}
+	if entry.hasProofs() {
+		// Log entries of which the disclosed attributes cannot be determined (e.g. because their
+		// scheme is no longer present) can still be found using the other properties
+		if disclosed, err := entry.GetDisclosedCredentials(conf); err == nil {
+			for _, attrs := range disclosed {
+				for _, attr := range attrs {
+					credtypes[attr.Identifier.CredentialTypeIdentifier()] = struct{}{}
+				}
+			}
+		}
+	}
+	if entry.Type == irma.ActionIssuing {
+		if request, err := entry.SessionRequest(); err == nil {
+			if issuance, ok := request.(*irma.IssuanceRequest); ok {
+				for _, cred := range issuance.Credentials {
+					credtypes[cred.CredentialTypeID] = struct{}{}
+				}
+			}
+		}
+	}
+	for id := range credtypes {
+		values[logIndexCredential] = append(values[logIndexCredential], id.String())
+	}
+	return values
+}
+
+// txIndexLogEntry adds the log entry to the log indices.
+func (s *storage) txIndexLogEntry(tx kvTx, indexer logIndexer, entry *LogEntry) error {
+	index, err := tx.CreateBucketIfNotExists(logIndexBucket)
+	if err != nil {
+		return err
+	}
+	records, err := tx.CreateBucketIfNotExists(logEntryIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	id := s.logEntryKeyToBytes(entry.ID)
+	record := logIndexRecord{Time: logTimeSeconds(time.Time(entry.Time))}
+	for property, values := range logIndexValues(entry, s.Configuration) {
+		for _, value := range values {
+			k := append(logIndexToken(indexer.key, property, value), id...)
+			if err = index.Put(k, []byte{}); err != nil {
+				return err
+			}
+			record.Keys = append(record.Keys, k)
+		}
+	}
+
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if v, err = sealValue(indexer.aead, logEntryIndexBucket, id, v); err != nil {
+		return err
+	}
+	return records.Put(id, v)
+}
+
+// txUnindexLogEntry removes the log entry with the specified ID from the log indices.
+func (s *storage) txUnindexLogEntry(tx kvTx, id uint64) error {
+	records, err := tx.Bucket(logEntryIndexBucket)
+	if records == nil || err != nil {
+		return err
+	}
+	k := s.logEntryKeyToBytes(id)
+	record, err := s.txLoadLogIndexRecord(records, k)
+	if record == nil || err != nil {
+		return err
+	}
+	index, err := tx.Bucket(logIndexBucket)
+	if err != nil {
+		return err
+	}
+	if index != nil {
+		for _, key := range record.Keys {
+			if err = index.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return records.Delete(k)
+}
+
+// txLoadLogIndexRecord returns the logIndexRecord of the log entry with the specified key, or nil
+// if the log entry is not indexed.
+func (s *storage) txLoadLogIndexRecord(records kvBucket, k []byte) (*logIndexRecord, error) {
+	v, err := records.Get(k)
+	if v == nil || err != nil {
+		return nil, err
+	}
+	return s.openLogIndexRecord(k, v)
+}
+
+func (s *storage) openLogIndexRecord(k, v []byte) (*logIndexRecord, error) {
+	v, err := s.open(logEntryIndexBucket, k, v)
+	if err != nil {
+		return nil, err
+	}
+	var record logIndexRecord
+	if err = json.Unmarshal(v, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// txRebuildLogIndex recreates the log indices from the log entries, which are encrypted with the
+// specified storage key (nil if they are not encrypted).
+func (s *storage) txRebuildLogIndex(tx kvTx, aesKey []byte) error {
+	for _, name := range []string{logIndexBucket, logEntryIndexBucket} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	logs, err := tx.Bucket(logsBucket)
+	if logs == nil || err != nil {
+		return err
+	}
+	aead, err := newStorageAEAD(aesKey)
+	if err != nil {
+		return err
+	}
+
+	var entries []*LogEntry
+	err = logs.ForEach(func(k, v []byte) error {
+		v, err := openValue(aead, logsBucket, k, v)
+		if err != nil {
+			return err
+		}
+		var entry LogEntry
+		if err = json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, &entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	indexer := logIndexer{key: logIndexKeyFrom(aesKey), aead: aead}
+	for _, entry := range entries {
+		if err = s.txIndexLogEntry(tx, indexer, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildLogIndex recreates the log indices from the log entries.
+func (s *storage) RebuildLogIndex() error {
+	return s.db.Update(func(tx kvTx) error {
+		return s.txRebuildLogIndex(tx, s.encryptionKey())
+	})
+}
+
+// SearchLogs returns the log entries matching the filter with an ID below beforeIndex (or any ID
+// if beforeIndex is 0), sorted from new to old with a maximum result length of max.
+func (s *storage) SearchLogs(filter LogFilter, beforeIndex uint64, max int) ([]*LogEntry, error) {
+	return s.newLogSearch(filter, beforeIndex).next(max)
+}
+
+// IterateLogs calls f for each log entry matching the filter, sorted from new to old. The log
+// entries are loaded a page at a time, outside of which f is called.
+func (s *storage) IterateLogs(filter LogFilter, f func(entry *LogEntry) error) error {
+	search := s.newLogSearch(filter, 0)
+	for {
+		entries, err := search.next(logSearchPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = f(entry); err != nil {
+				return err
+			}
+		}
+		if len(entries) < logSearchPageSize {
+			return nil
+		}
+	}
+}
+
+// logSearchPageSize is the number of log entries that IterateLogs loads at once.
+const logSearchPageSize = 100
+
+// logSearch returns the log entries matching a filter a page at a time, sorted from new to old.
+// The log index is searched once, for the first page; the later pages continue from the position
+// reached in its results.
+type logSearch struct {
+	s        *storage
+	filter   LogFilter
+	before   uint64   // the next page contains log entries with a lower ID, unless it is 0
+	ids      []uint64 // IDs of the remaining log entries found in the log index
+	searched bool     // whether the log index has been searched
+}
+
+func (s *storage) newLogSearch(filter LogFilter, beforeIndex uint64) *logSearch {
+	return &logSearch{s: s, filter: filter, before: beforeIndex}
+}
+
+// next returns the next page of log entries, with a maximum length of max.
+func (search *logSearch) next(max int) ([]*LogEntry, error) {
+	s := search.s
+	if !search.filter.indexed() {
+		var logs []*LogEntry
+		var err error
+		if search.before == 0 {
+			logs, err = s.LoadNewestLogs(max)
+		} else {
+			logs, err = s.LoadLogsBefore(search.before, max)
+		}
+		if len(logs) > 0 {
+			search.before = logs[len(logs)-1].ID
+		}
+		return logs, err
+	}
+
+	logs := make([]*LogEntry, 0, max)
+	err := s.db.View(func(tx kvTx) error {
+		if !search.searched {
+			ids, err := s.txSearchLogIndex(tx, search.filter)
+			if err != nil {
+				return err
+			}
+			for len(ids) > 0 && search.before != 0 && ids[0] >= search.before {
+				ids = ids[1:]
+			}
+			search.ids, search.searched = ids, true
+		}
+		bucket, err := tx.Bucket(logsBucket)
+		if bucket == nil || err != nil {
+			return err
+		}
+		for len(logs) < max && len(search.ids) > 0 {
+			k := s.logEntryKeyToBytes(search.ids[0])
+			v, err := bucket.Get(k)
+			if err != nil {
+				return err
+			}
+			search.ids = search.ids[1:]
+			if v == nil {
+				continue
+			}
+			v, err = s.open(logsBucket, k, v)
+			if err != nil {
+				return err
+			}
+			var log LogEntry
+			if err = json.Unmarshal(v, &log); err != nil {
+				return err
+			}
+			logs = append(logs, &log)
+		}
+		return nil
+	})
+	return logs, err
+}
+
+// txSearchLogIndex returns the IDs of the log entries matching the filter, sorted from new to old.
+func (s *storage) txSearchLogIndex(tx kvTx, filter LogFilter) ([]uint64, error) {
+	var ids map[uint64]struct{} // nil means that no criterion has been applied yet
+	intersect := func(found map[uint64]struct{}) {
+		if ids == nil {
+			ids = found
+			return
+		}
+		for id := range ids {
+			if _, ok := found[id]; !ok {
+				delete(ids, id)
+			}
+		}
+	}
+
+	index, err := tx.Bucket(logIndexBucket)
+	if err != nil {
+		return nil, err
+	}
+	var c kvCursor
+	if index != nil {
+		if c, err = index.Cursor(); err != nil {
+			return nil, err
+		}
+	}
+	indexKey := s.logIndexer().key
+	lookup := func(property string, values ...string) map[uint64]struct{} {
+		found := map[uint64]struct{}{}
+		if c == nil {
+			return found
+		}
+		for _, value := range values {
+			prefix := logIndexToken(indexKey, property, value)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				found[binary.BigEndian.Uint64(k[len(prefix):])] = struct{}{}
+			}
+		}
+		return found
+	}
+
+	if len(filter.Types) > 0 {
+		types := make([]string, 0, len(filter.Types))
+		for _, t := range filter.Types {
+			types = append(types, string(t))
+		}
+		intersect(lookup(logIndexType, types...))
+	}
+	if !filter.Requestor.Empty() {
+		intersect(lookup(logIndexRequestor, filter.Requestor.String()))
+	}
+	if filter.Hostname != "" {
+		intersect(lookup(logIndexHostname, strings.ToLower(filter.Hostname)))
+	}
+	if !filter.CredentialType.Empty() {
+		intersect(lookup(logIndexCredential, filter.CredentialType.String()))
+	}
+	if !filter.From.IsZero() || !filter.Until.IsZero() {
+		records, err := tx.Bucket(logEntryIndexBucket)
+		if err != nil {
+			return nil, err
+		}
+		// The log index contains only the months of the log entries, so the exact times are
+		// checked using the index records
+		if !filter.From.IsZero() && !filter.Until.IsZero() {
+			intersect(lookup(logIndexMonth, logIndexMonths(filter.From, filter.Until)...))
+			for id := range ids {
+				var record *logIndexRecord
+				if records != nil {
+					if record, err = s.txLoadLogIndexRecord(records, s.logEntryKeyToBytes(id)); err != nil {
+						return nil, err
+					}
+				}
+				if record == nil || !filter.matchesTime(record.Time) {
+					delete(ids, id)
+				}
+			}
+		} else {
+			found := map[uint64]struct{}{}
+			if records != nil {
+				err = records.ForEach(func(k, v []byte) error {
+					record, err := s.openLogIndexRecord(k, v)
+					if err != nil {
+						return err
+					}
+					if filter.matchesTime(record.Time) {
+						found[binary.BigEndian.Uint64(k)] = struct{}{}
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			intersect(found)
+		}
+	}
+
+	sorted := make([]uint64, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	return sorted, nil
+}
+
+// PruneLogs removes the log entries that took place before olderThan (unless it is zero), and the
+// oldest log entries in excess of keep (unless it is 0). It returns the number of removed entries.
+func (s *storage) PruneLogs(olderThan time.Time, keep int) (removed int, err error) {
+	if olderThan.IsZero() && keep <= 0 {
+		return 0, nil
+	}
+
+	err = s.db.Update(func(tx kvTx) error {
+		logs, err := tx.Bucket(logsBucket)
+		if logs == nil || err != nil {
+			return err
+		}
+
+		prune := map[uint64]struct{}{}
+		if !olderThan.IsZero() {
+			records, err := tx.Bucket(logEntryIndexBucket)
+			if err != nil {
+				return err
+			}
+			if records != nil {
+				err = records.ForEach(func(k, v []byte) error {
+					record, err := s.openLogIndexRecord(k, v)
+					if err != nil {
+						return err
+					}
+					if record.Time < logTimeSeconds(olderThan) {
+						prune[binary.BigEndian.Uint64(k)] = struct{}{}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if keep > 0 {
+			var ids []uint64
+			err = logs.ForEach(func(k, _ []byte) error {
+				ids = append(ids, binary.BigEndian.Uint64(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(ids)-keep; i++ {
+				prune[ids[i]] = struct{}{}
+			}
+		}
+
+		for id := range prune {
+			k := s.logEntryKeyToBytes(id)
+			v, err := logs.Get(k)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				continue
+			}
+			if err = s.txUnindexLogEntry(tx, id); err != nil {
+				return err
+			}
+			if err = logs.Delete(k); err != nil {
+				return errors.WrapPrefix(err, "failed to delete log entry", 0)
+			}
+			removed++
+		}
+		return nil
+	})
+	return
+}
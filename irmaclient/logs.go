@@ -26,6 +26,8 @@ type LogEntry struct {
 
 	// Issuance sessions
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
+	// Credentials replaced by the issued credentials when refreshing them
+	Renewed map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"`
 
 	// All session types
 	ServerName *irma.RequestorInfo   `json:",omitempty"`
@@ -0,0 +1,319 @@
+package irmaclient
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// This file contains Profiles, which manages multiple isolated clients (profiles) within one
+// process, e.g. of the members of a family sharing a device. Each profile has its own storage,
+// secret key, credentials, keyshare enrollments, logs and preferences, while the profiles share
+// a single irma.Configuration, including its scheme updates and revocation caches.
+
+// profilesDir is the directory within the storage path of a Profiles containing the directories
+// of the profiles, when they are stored in bbolt databases.
+const profilesDir = "profiles"
+
+var profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var (
+	ErrProfileExists      = errors.New("profile already exists")
+	ErrProfileNotFound    = errors.New("profile not found")
+	ErrProfileOpen        = errors.New("profile is already open")
+	ErrInvalidProfileName = errors.New("profile name must consist of 1 to 64 letters, digits, - or _")
+)
+
+// Profiles manages the profiles of multiple users, each of which is a Client.
+type Profiles struct {
+	Configuration *irma.Configuration
+
+	storagePath           string
+	irmaConfigurationPath string
+	storage               ProfileStorage
+
+	confMutex sync.RWMutex // see Client.readConfiguration
+	mutex     sync.Mutex   // protects open
+	open      map[string]*Client
+}
+
+// ProfileStorage lists, opens and deletes the Storage backends of the profiles of a Profiles.
+type ProfileStorage interface {
+	// Names returns the names of the existing profiles.
+	Names() ([]string, error)
+	// Open opens the storage of the profile, creating it if it does not exist.
+	Open(name string) (Storage, error)
+	// Delete deletes the storage of the profile.
+	Delete(name string) error
+}
+
+type boltProfileStorage struct {
+	path string
+}
+
+type sqlProfileStorage struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewProfiles creates a Profiles, which parses the irma_configuration in the directory
+// storagePath (restoring it from irmaConfigurationPath if necessary, like New) once for all of its
+// profiles. The profiles are stored in the specified ProfileStorage; if it is nil, each profile is
+// stored in a bbolt database within storagePath.
+// Like New, if a scheme failed to parse, NewProfiles returns the Profiles along with the
+// *irma.SchemeManagerError.
+func NewProfiles(storagePath, irmaConfigurationPath string, storage ProfileStorage) (*Profiles, error) {
+	if err := common.AssertPathExists(storagePath); err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		path := filepath.Join(storagePath, profilesDir)
+		if err := common.EnsureDirectoryExists(path); err != nil {
+			return nil, err
+		}
+		storage = &boltProfileStorage{path: path}
+	}
+	conf, schemeMgrErr := parseConfiguration(storagePath, irmaConfigurationPath)
+	if conf == nil {
+		return nil, schemeMgrErr
+	}
+	return &Profiles{
+		Configuration:         conf,
+		storagePath:           storagePath,
+		irmaConfigurationPath: irmaConfigurationPath,
+		storage:               storage,
+		open:                  map[string]*Client{},
+	}, schemeMgrErr
+}
+
+// NewSQLProfileStorage returns a ProfileStorage storing each profile as a wallet in the SQL
+// database, using the profile name as wallet ID (see NewSQLStorage).
+func NewSQLProfileStorage(db *sql.DB, dialect SQLDialect) (ProfileStorage, error) {
+	if err := createSQLStorageTables(db, dialect); err != nil {
+		return nil, err
+	}
+	return &sqlProfileStorage{db: db, dialect: dialect}, nil
+}
+
+// Names returns the names of the existing profiles, sorted.
+func (p *Profiles) Names() ([]string, error) {
+	names, err := p.storage.Names()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Create creates a new profile, and returns its Client. The handler and aesKey are as in New.
+func (p *Profiles) Create(name string, handler ClientHandler, aesKey []byte) (*Client, error) {
+	return p.openProfile(name, handler, aesKey, true)
+}
+
+// Open returns the Client of an existing profile. The handler and aesKey are as in New.
+// A profile can be opened only once at a time; closing its Client allows opening it again.
+func (p *Profiles) Open(name string, handler ClientHandler, aesKey []byte) (*Client, error) {
+	return p.openProfile(name, handler, aesKey, false)
+}
+
+func (p *Profiles) openProfile(name string, handler ClientHandler, aesKey []byte, create bool) (*Client, error) {
+	if !profileNameRegexp.MatchString(name) {
+		return nil, ErrInvalidProfileName
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.open[name]; ok {
+		return nil, ErrProfileOpen
+	}
+	exists, err := p.exists(name)
+	if err != nil {
+		return nil, err
+	}
+	if create && exists {
+		return nil, ErrProfileExists
+	}
+	if !create && !exists {
+		return nil, ErrProfileNotFound
+	}
+
+	backend, err := p.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	p.confMutex.RLock()
+	client, err := newClient(
+		backend,
+		p.Configuration,
+		&p.confMutex,
+		filepath.Join(p.storagePath, profilesDir, name),
+		p.irmaConfigurationPath,
+		handler,
+		aesKey,
+	)
+	p.confMutex.RUnlock()
+	if err != nil {
+		_ = backend.Close()
+		if create {
+			_ = p.storage.Delete(name)
+		}
+		return nil, err
+	}
+	client.profiles = p
+	p.open[name] = client
+	return client, nil
+}
+
+func (p *Profiles) exists(name string) (bool, error) {
+	names, err := p.storage.Names()
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete closes the profile if it is open, and deletes all of its data.
+func (p *Profiles) Delete(name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return ErrInvalidProfileName
+	}
+
+	// Keep holding the lock until the data is deleted, so that the profile cannot be opened again meanwhile
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if client := p.open[name]; client != nil {
+		if err := client.close(); err != nil {
+			return err
+		}
+		delete(p.open, name)
+	}
+	exists, err := p.exists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrProfileNotFound
+	}
+	return p.storage.Delete(name)
+}
+
+// UpdateSchemes updates the schemes of the Configuration of the profiles, and processes the
+// updates in the open profiles. Meanwhile the sessions and background jobs of the profiles wait
+// before reading the Configuration; other methods of the Clients should not be called concurrently.
+func (p *Profiles) UpdateSchemes() error {
+	downloaded := &irma.IrmaIdentifierSet{
+		SchemeManagers:   map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:          map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes:  map[irma.CredentialTypeIdentifier]struct{}{},
+		PublicKeys:       map[irma.IssuerIdentifier][]uint{},
+		AttributeTypes:   map[irma.AttributeTypeIdentifier]struct{}{},
+		RequestorSchemes: map[irma.RequestorSchemeIdentifier]struct{}{},
+	}
+
+	p.confMutex.Lock()
+	err := func() error {
+		for _, scheme := range p.Configuration.SchemeManagers {
+			if err := p.Configuration.UpdateScheme(scheme, downloaded); err != nil {
+				return err
+			}
+		}
+		for _, scheme := range p.Configuration.RequestorSchemes {
+			if err := p.Configuration.UpdateScheme(scheme, downloaded); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	p.confMutex.Unlock()
+
+	if !downloaded.Empty() {
+		if uerr := configurationUpdated(p.clients(), downloaded); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// Close closes the Clients of all open profiles.
+func (p *Profiles) Close() error {
+	var err error
+	for _, client := range p.clients() {
+		if cerr := client.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// clients returns the Clients of the open profiles.
+func (p *Profiles) clients() []*Client {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	clients := make([]*Client, 0, len(p.open))
+	for _, client := range p.open {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// closed is called by Client.Close of the Client of a profile.
+func (p *Profiles) closed(client *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, c := range p.open {
+		if c == client {
+			delete(p.open, name)
+		}
+	}
+}
+
+func (s *boltProfileStorage) Names() ([]string, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if file.IsDir() && profileNameRegexp.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *boltProfileStorage) Open(name string) (Storage, error) {
+	path := filepath.Join(s.path, name)
+	if err := common.EnsureDirectoryExists(path); err != nil {
+		return nil, err
+	}
+	return OpenBoltStorage(filepath.Join(path, databaseFile))
+}
+
+func (s *boltProfileStorage) Delete(name string) error {
+	return os.RemoveAll(filepath.Join(s.path, name))
+}
+
+func (s *sqlProfileStorage) Names() ([]string, error) {
+	return SQLWallets(s.db, s.dialect)
+}
+
+func (s *sqlProfileStorage) Open(name string) (Storage, error) {
+	return NewSQLStorage(s.db, s.dialect, name)
+}
+
+func (s *sqlProfileStorage) Delete(name string) error {
+	return DeleteSQLWallet(s.db, s.dialect, name)
+}
@@ -0,0 +1,93 @@
+package irmaclient
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	handler := &TestClientHandler{t: t, c: make(chan error), storage: storage}
+
+	profiles, err := NewProfiles(
+		filepath.Join(storage, "client"),
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		nil,
+	)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, profiles.Close()) }()
+
+	names, err := profiles.Names()
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	alice, err := profiles.Create("alice", handler, nil)
+	require.NoError(t, err)
+	bob, err := profiles.Create("bob", handler, nil)
+	require.NoError(t, err)
+	_, err = profiles.Create("alice", handler, nil)
+	require.Equal(t, ErrProfileOpen, err)
+	_, err = profiles.Create("../alice", handler, nil)
+	require.Equal(t, ErrInvalidProfileName, err)
+	_, err = profiles.Open("carol", handler, nil)
+	require.Equal(t, ErrProfileNotFound, err)
+
+	names, err = profiles.Names()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob"}, names)
+
+	// The profiles share their Configuration but nothing else
+	require.True(t, alice.Configuration == profiles.Configuration)
+	require.True(t, bob.Configuration == profiles.Configuration)
+	require.NotEqual(t, alice.secretkey.Key, bob.secretkey.Key)
+	alice.SetPreferences(Preferences{DeveloperMode: true})
+	require.False(t, bob.Preferences.DeveloperMode)
+
+	// Reopening a profile after closing it
+	aliceKey := alice.secretkey.Key
+	require.NoError(t, alice.Close())
+	_, err = profiles.Create("alice", handler, nil)
+	require.Equal(t, ErrProfileExists, err)
+	alice, err = profiles.Open("alice", handler, nil)
+	require.NoError(t, err)
+	require.Equal(t, aliceKey, alice.secretkey.Key)
+	require.True(t, alice.Preferences.DeveloperMode)
+
+	// Deleting an open profile closes it
+	require.NoError(t, profiles.Delete("bob"))
+	require.Equal(t, ErrProfileNotFound, profiles.Delete("bob"))
+	names, err = profiles.Names()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice"}, names)
+	require.Len(t, profiles.clients(), 1)
+
+	// A profile with an encrypted storage cannot be opened without its key
+	carol, err := profiles.Create("carol", handler, make([]byte, StorageKeySize))
+	require.NoError(t, err)
+	require.True(t, carol.storage.Encrypted())
+	require.NoError(t, carol.Close())
+	_, err = profiles.Open("carol", handler, nil)
+	require.Equal(t, ErrStorageEncrypted, err)
+
+	// Updating the schemes shared by the profiles waits for the profiles reading them
+	reading, release := make(chan struct{}), make(chan struct{})
+	go alice.readConfiguration(func() {
+		close(reading)
+		<-release
+	})
+	<-reading
+	updated := make(chan error)
+	go func() { updated <- profiles.UpdateSchemes() }()
+	select {
+	case <-updated:
+		t.Fatal("schemes updated while being read")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-updated)
+}
@@ -0,0 +1,156 @@
+package irmaclient
+
+import (
+	"context"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the refreshing (reissuance) of credentials at the refresh endpoint that the
+// issuer advertises in the description of the credential type (irma.CredentialType.RefreshURL).
+// The session started at the refresh endpoint discloses the credential being refreshed and issues
+// its replacement, which takes the place of the old credential in one storage transaction along
+// with the log entry of the session, so that refreshing does not result in duplicate credentials.
+
+// RefreshCredential refreshes the credential with the specified hash, by starting a session at
+// the refresh endpoint of its credential type. That session must be an issuance session that
+// issues a credential of the same type and asks for disclosure of the credential being refreshed
+// (which the user must choose to disclose), and if the credential supports revocation, so must its
+// replacement. Otherwise the session fails with an error of type irma.ErrorRefresh.
+// The replacement takes the place of the old credential, and the session is logged with the old
+// attributes in LogEntry.Renewed.
+func (client *Client) RefreshCredential(hash string, handler Handler) SessionDismisser {
+	attrs, _ := client.attributesByHash(hash)
+	if attrs == nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "unknown credential"})
+		return nil
+	}
+	credtype := attrs.CredentialType()
+	if credtype == nil || credtype.RefreshURL == "" {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "credential type cannot be refreshed"})
+		return nil
+	}
+
+	// The refresh endpoint behaves as the URL of a static QR, i.e. a session pointer of type redirect
+	qr := &irma.Qr{Type: irma.ActionRedirect, URL: credtype.RefreshURL}
+	if err := qr.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorRefresh, Err: err})
+		return nil
+	}
+	return client.startQrSession(context.Background(), qr, handler, nil, hash)
+}
+
+// checkRefresh checks that the issuance request refreshes the credential of the session.
+// The credential is added to the credentials to be removed by the session, so that the user
+// sees which credential is replaced.
+func (session *session) checkRefresh(request *irma.IssuanceRequest) *irma.SessionError {
+	cred, _, err := session.client.credentialByHash(session.refresh)
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err}
+	}
+	if cred == nil {
+		return &irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "credential being refreshed no longer exists"}
+	}
+	id := cred.CredentialType().Identifier()
+
+	var credreq *irma.CredentialRequest
+	for _, cr := range request.Credentials {
+		if cr.CredentialTypeID == id {
+			credreq = cr
+			break
+		}
+	}
+	if credreq == nil {
+		return &irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "session does not issue a credential of type " + id.String()}
+	}
+	if _, ok := request.Disclosure().Identifiers().CredentialTypes[id]; !ok {
+		return &irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "session does not ask for disclosure of the credential being refreshed"}
+	}
+	if cred.NonRevocationWitness != nil && !credreq.RevocationSupported {
+		return &irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "refreshed credential would not support revocation"}
+	}
+
+	for _, info := range request.RemovalCredentialInfoList {
+		if info.Hash == session.refresh {
+			return nil
+		}
+	}
+	request.RemovalCredentialInfoList = append(request.RemovalCredentialInfoList, cred.attrs.Info())
+	return nil
+}
+
+// choiceDiscloses returns whether the choice discloses attributes of the credential with the
+// specified hash.
+func choiceDiscloses(choice *irma.DisclosureChoice, hash string) bool {
+	for _, attrs := range choice.Attributes {
+		for _, attr := range attrs {
+			if attr.CredentialHash == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refreshCredential constructs the credentials issued by the session, replacing the credential
+// being refreshed, and logs the session.
+func (session *session) refreshCredential(msg []*gabi.IssueSignatureMessage, commitments interface{}) error {
+	old, _ := session.client.attributesByHash(session.refresh)
+	if old == nil {
+		return errors.New("credential being refreshed no longer exists")
+	}
+	log, err := session.createLogEntry(commitments)
+	if err != nil {
+		return err
+	}
+	log.Renewed = map[irma.CredentialTypeIdentifier][]irma.TranslatedString{
+		old.CredentialType().Identifier(): old.Strings(),
+	}
+	return session.client.constructCredentials(msg, session.request.(*irma.IssuanceRequest), session.builders, old, log)
+}
+
+// replaceCredential replaces the old credential by the new credential of the same type, taking
+// its place among the credentials of that type, and stores the log entry if it is not nil,
+// all in one transaction.
+func (client *Client) replaceCredential(old *irma.AttributeList, cred *credential, log *LogEntry) error {
+	id := cred.CredentialType().Identifier()
+	list := client.attrs(id)
+	index := -1
+	for i, attrs := range list {
+		if attrs.Hash() == old.Hash() {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return errors.Errorf("Can't replace credential %s: no such credential", old.Hash())
+	}
+
+	list[index] = cred.attrs
+	err := client.storage.Transaction(func(tx *transaction) error {
+		if err := client.storage.TxDeleteSignature(tx, old); err != nil {
+			return err
+		}
+		if err := client.storage.TxStoreSignature(tx, cred); err != nil {
+			return err
+		}
+		if err := client.storage.TxStoreAttributes(tx, id, list); err != nil {
+			return err
+		}
+		if log != nil {
+			return client.storage.TxAddLogEntry(tx, log)
+		}
+		return nil
+	})
+	if err != nil {
+		list[index] = old
+		return err
+	}
+
+	client.creds(id)[index] = cred
+	delete(client.lookup, old.Hash())
+	client.lookup[cred.attrs.Hash()] = &credLookup{id: id, counter: index}
+	return nil
+}
@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 
@@ -32,59 +33,19 @@ func (client *Client) initRevocation() {
 		}
 	}
 
-	// Of each credential supporting revocation, we periodically update its nonrevocation witness
-	// by fetching updates from the issuer's server, such that:
-	// - The time interval between two updates is random so that the server cannot recognize us
-	//   using the update interval,
-	// - Updating happens regularly even if the app is rarely used.
-	// We do this by every 10 seconds updating the credential with a low probability, which
-	// increases over time since the last update.
-	client.Configuration.Scheduler.Every(irma.RevocationParameters.ClientUpdateInterval).Seconds().Do(func() {
-		for id, attrsets := range client.attributes {
-			for i, attrs := range attrsets {
-				if attrs.CredentialType() == nil || !attrs.CredentialType().RevocationSupported() {
-					continue
-				}
-				cred, err := client.credential(id, i)
-				if err != nil {
-					client.reportError(err)
-					continue
-				}
-				if cred.NonRevocationWitness == nil {
-					continue
-				}
-				r, err := randomfloat()
-				if err != nil {
-					client.reportError(err)
-					break
-				}
-				speed := attrs.CredentialType().RevocationUpdateSpeed * 60 * 60
-				p := probability(cred.NonRevocationWitness.Updated, speed)
-				if r < p {
-					irma.Logger.WithFields(logrus.Fields{
-						"random":      r,
-						"prob":        p,
-						"lastupdated": time.Now().Sub(cred.NonRevocationWitness.Updated).Seconds(),
-						"credtype":    id,
-						"hash":        attrs.Hash(),
-					}).Debug("scheduling nonrevocation witness remote update")
-					id := id // copy for closure below (https://golang.org/doc/faq#closures_and_goroutines)
-					client.jobs <- func() {
-						if err = client.NonrevUpdateFromServer(id); err != nil {
-							client.reportError(err)
-							return
-						}
-					}
-				}
-			}
-		}
-	})
+	client.initRevocationUpdates()
 }
 
 // NonrevPrepare updates the revocation state for each credential in the request
 // requiring a nonrevocation proof, using the updates included in the request, or the remote
 // revocation server if those do not suffice.
 func (client *Client) NonrevPrepare(request irma.SessionRequest) error {
+	return client.nonrevPrepare(context.Background(), request)
+}
+
+// nonrevPrepare is NonrevPrepare, aborting requests to the revocation server when the context
+// is done.
+func (client *Client) nonrevPrepare(ctx context.Context, request irma.SessionRequest) error {
 	base := request.Base()
 	var err error
 	var wg sync.WaitGroup
@@ -100,7 +61,7 @@ func (client *Client) NonrevPrepare(request irma.SessionRequest) error {
 		wg.Add(1)
 		id := id // copy for closure below (https://golang.org/doc/faq#closures_and_goroutines)
 		go func() {
-			if e := client.nonrevUpdate(id, base.Revocation[id].Updates); e != nil {
+			if e := client.nonrevUpdate(ctx, id, base.Revocation[id].Updates); e != nil {
 				err = e // overwrites err from previously finished call, if any
 			}
 			wg.Done()
@@ -113,25 +74,10 @@ func (client *Client) NonrevPrepare(request irma.SessionRequest) error {
 // nonrevUpdate updates all contained instances of the specified type, using the specified
 // updates if present and if they suffice, and contacting the issuer's server to download updates
 // otherwise.
-func (client *Client) nonrevUpdate(id irma.CredentialTypeIdentifier, updates map[uint]*revocation.Update) error {
-	lowest := map[uint]uint64{}
-	attrs := client.attrs(id)
-
-	// Per credential and issuer key counter we may possess multiple credential instances.
-	// Of the nonrevocation witnesses of these, take the lowest index.
-	for i := 0; i < len(attrs); i++ {
-		cred, err := client.credential(id, i)
-		if err != nil {
-			return err
-		}
-		if cred.NonRevocationWitness == nil {
-			continue
-		}
-		pkid := cred.Pk.Counter
-		l, present := lowest[pkid]
-		if !present || cred.NonRevocationWitness.SignedAccumulator.Accumulator.Index < l {
-			lowest[pkid] = cred.NonRevocationWitness.SignedAccumulator.Accumulator.Index
-		}
+func (client *Client) nonrevUpdate(ctx context.Context, id irma.CredentialTypeIdentifier, updates map[uint]*revocation.Update) error {
+	lowest, err := client.nonrevLowestIndices(id)
+	if err != nil {
+		return err
 	}
 
 	// For each key counter, get an update message starting at the lowest index computed above,
@@ -147,7 +93,7 @@ func (client *Client) nonrevUpdate(id irma.CredentialTypeIdentifier, updates map
 			u[counter] = update
 		} else {
 			var err error
-			u[counter], err = irma.RevocationClient{Conf: client.Configuration}.
+			u[counter], err = irma.RevocationClient{Conf: client.Configuration, Context: ctx}.
 				FetchUpdateFrom(id, counter, l+1)
 			if err != nil {
 				return err
@@ -164,6 +110,31 @@ func (client *Client) nonrevUpdate(id irma.CredentialTypeIdentifier, updates map
 	return nil
 }
 
+// nonrevLowestIndices returns per issuer key counter the lowest index of the nonrevocation
+// witnesses of the instances of the credential type.
+func (client *Client) nonrevLowestIndices(id irma.CredentialTypeIdentifier) (map[uint]uint64, error) {
+	lowest := map[uint]uint64{}
+	attrs := client.attrs(id)
+
+	// Per credential and issuer key counter we may possess multiple credential instances.
+	// Of the nonrevocation witnesses of these, take the lowest index.
+	for i := 0; i < len(attrs); i++ {
+		cred, err := client.credential(id, i)
+		if err != nil {
+			return nil, err
+		}
+		if cred.NonRevocationWitness == nil {
+			continue
+		}
+		pkid := cred.Pk.Counter
+		l, present := lowest[pkid]
+		if !present || cred.NonRevocationWitness.SignedAccumulator.Accumulator.Index < l {
+			lowest[pkid] = cred.NonRevocationWitness.SignedAccumulator.Accumulator.Index
+		}
+	}
+	return lowest, nil
+}
+
 func (client *Client) nonrevApplyUpdates(id irma.CredentialTypeIdentifier, counter uint, update *revocation.Update) error {
 	client.credMutex.Lock()
 	defer client.credMutex.Unlock()
@@ -215,11 +186,12 @@ func (client *Client) nonrevApplyUpdates(id irma.CredentialTypeIdentifier, count
 			return err
 		}
 	}
+	client.revocationUpdates.check(id)
 	return nil
 }
 
 func (client *Client) NonrevUpdateFromServer(id irma.CredentialTypeIdentifier) error {
-	return client.nonrevUpdate(id, nil)
+	return client.nonrevUpdate(context.Background(), id, nil)
 }
 
 func (client *Client) nonrevPrepareCache(id irma.CredentialTypeIdentifier, index int) error {
@@ -237,8 +209,12 @@ func (client *Client) nonrevPrepareCache(id irma.CredentialTypeIdentifier, index
 // in the request, in background jobs, after the request has finished.
 func (client *Client) nonrevRepopulateCaches(request irma.SessionRequest) {
 	for id := range request.Disclosure().Identifiers().CredentialTypes {
-		credtype := client.Configuration.CredentialTypes[id]
-		if credtype == nil || !credtype.RevocationSupported() {
+		var supported bool
+		client.readConfiguration(func() {
+			credtype := client.Configuration.CredentialTypes[id]
+			supported = credtype != nil && credtype.RevocationSupported()
+		})
+		if !supported {
 			continue
 		}
 		for i := range client.attrs(id) {
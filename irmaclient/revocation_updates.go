@@ -0,0 +1,531 @@
+package irmaclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/gabi/revocation"
+	irma "github.com/privacybydesign/irmago"
+	sseclient "github.com/sietseringers/go-sse"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains the scheduling of the background updates of nonrevocation witnesses (c.f.
+// revocation.go), within the per-credential targets and the request budget configured in
+// Preferences.RevocationUpdates. Credential types of the same issuer are updated together, so that
+// the network is woken up once for all of them, and updates may also be pushed by the revocation
+// servers using server-sent events. The client keeps statistics of the updates, so that the app
+// can show when the revocation status of credentials was last checked.
+
+// revocationBatchFraction determines which credential types of an issuer are updated along with
+// a credential type that is selected for updating: those whose witness is older than this
+// fraction of their target.
+const revocationBatchFraction = 4
+
+// RevocationUpdatePolicy configures the background updating of nonrevocation witnesses.
+type RevocationUpdatePolicy struct {
+	// Targets override the RevocationUpdateSpeed of the specified credential types: the time
+	// after which it becomes very likely that their witnesses are updated.
+	Targets map[irma.CredentialTypeIdentifier]time.Duration
+
+	// MaxRequestsPerHour is the maximum number of background requests to revocation servers per
+	// hour; if 0, the number of requests is unlimited.
+	MaxRequestsPerHour int
+	// MeteredRequestsPerHour is the maximum number of background requests per hour while the
+	// network is metered (see Client.SetNetworkMetered); if 0, no requests are made then.
+	MeteredRequestsPerHour int
+
+	// ServerSentEvents enables receiving updates pushed by the revocation servers of the
+	// credentials while the network is not metered.
+	ServerSentEvents bool
+}
+
+// RevocationUpdateStats contains statistics about the background updates of nonrevocation
+// witnesses since the client was started, and the revocation status of the credentials.
+type RevocationUpdateStats struct {
+	Requests         int // background requests to revocation servers
+	RequestsLastHour int
+	Failures         int // failed background updates
+	PushedUpdates    int // updates received through server-sent events
+	NetworkMetered   bool
+	LastChecked      time.Time // zero if not checked since the client was started
+	Credentials      []*RevocationStatus
+}
+
+// RevocationStatus is the revocation status of a credential supporting revocation.
+type RevocationStatus struct {
+	irma.CredentialIdentifier
+	Revoked bool
+	// LastChecked is when the revocation status of the credential type was last checked with its
+	// revocation server; zero if not checked since the client was started.
+	LastChecked time.Time
+	// Updated is the time of the accumulator of the nonrevocation witness of the credential,
+	// i.e. when the revocation status of the credential was last known to be up to date.
+	Updated time.Time
+}
+
+type revocationUpdater struct {
+	sync.Mutex
+
+	metered  bool
+	requests []time.Time // of the last hour
+	stats    RevocationUpdateStats
+	checked  map[irma.CredentialTypeIdentifier]time.Time
+	queued   map[irma.IssuerIdentifier]struct{}
+
+	subscriptions map[irma.CredentialTypeIdentifier]context.CancelFunc
+	events        chan *sseclient.Event
+	stop          chan struct{}
+}
+
+// SetNetworkMetered informs the client whether the network of the device is metered (e.g. a
+// mobile network), in which case the background updates of nonrevocation witnesses are limited
+// to Preferences.RevocationUpdates.MeteredRequestsPerHour and server-sent events are not used.
+func (client *Client) SetNetworkMetered(metered bool) {
+	client.revocationUpdates.Lock()
+	client.revocationUpdates.metered = metered
+	client.revocationUpdates.Unlock()
+	client.updateRevocationSubscriptions()
+}
+
+// RevocationUpdateStats returns statistics about the background updates of nonrevocation
+// witnesses, and the revocation status of the credentials supporting revocation.
+func (client *Client) RevocationUpdateStats() (*RevocationUpdateStats, error) {
+	u := &client.revocationUpdates
+	u.Lock()
+	stats := u.stats
+	stats.RequestsLastHour = len(u.pruneRequests(time.Now()))
+	stats.NetworkMetered = u.metered
+	checked := make(map[irma.CredentialTypeIdentifier]time.Time, len(u.checked))
+	for id, t := range u.checked {
+		checked[id] = t
+	}
+	u.Unlock()
+
+	for id, attrsets := range client.attributes {
+		credtype := client.Configuration.CredentialTypes[id]
+		if credtype == nil || !credtype.RevocationSupported() {
+			continue
+		}
+		for i, attrs := range attrsets {
+			status := &RevocationStatus{
+				CredentialIdentifier: irma.CredentialIdentifier{Type: id, Hash: attrs.Hash()},
+				Revoked:              attrs.Revoked,
+				LastChecked:          checked[id],
+			}
+			cred, err := client.credential(id, i)
+			if err != nil {
+				return nil, err
+			}
+			if cred.NonRevocationWitness != nil {
+				status.Updated = cred.NonRevocationWitness.Updated
+			}
+			stats.Credentials = append(stats.Credentials, status)
+		}
+	}
+	sort.Slice(stats.Credentials, func(i, j int) bool {
+		a, b := stats.Credentials[i], stats.Credentials[j]
+		if a.Type != b.Type {
+			return a.Type.String() < b.Type.String()
+		}
+		return a.Hash < b.Hash
+	})
+	return &stats, nil
+}
+
+// initRevocationUpdates schedules the background updates of nonrevocation witnesses.
+func (client *Client) initRevocationUpdates() {
+	client.revocationUpdates.checked = map[irma.CredentialTypeIdentifier]time.Time{}
+	client.revocationUpdates.queued = map[irma.IssuerIdentifier]struct{}{}
+	client.revocationUpdates.subscriptions = map[irma.CredentialTypeIdentifier]context.CancelFunc{}
+	client.revocationUpdates.events = make(chan *sseclient.Event)
+	client.revocationUpdates.stop = make(chan struct{})
+	go client.handleRevocationEvents()
+
+	// Of each credential supporting revocation, we periodically update its nonrevocation witness
+	// by fetching updates from the issuer's server, such that:
+	// - The time interval between two updates is random so that the server cannot recognize us
+	//   using the update interval,
+	// - Updating happens regularly even if the app is rarely used.
+	// We do this by every 10 seconds updating the credential with a low probability, which
+	// increases over time since the last update.
+	client.scheduler.Every(irma.RevocationParameters.ClientUpdateInterval).Seconds().Do(func() {
+		client.readConfiguration(client.updateRevocationSubscriptions)
+		client.scheduleRevocationUpdates()
+	})
+}
+
+// closeRevocationUpdates closes the server-sent event subscriptions.
+func (client *Client) closeRevocationUpdates() {
+	u := &client.revocationUpdates
+	u.Lock()
+	defer u.Unlock()
+	if u.stop == nil {
+		return
+	}
+	for id, cancel := range u.subscriptions {
+		cancel()
+		delete(u.subscriptions, id)
+	}
+	close(u.stop)
+	u.stop = nil
+}
+
+// scheduleRevocationUpdates selects the credential types whose witnesses are to be updated, and
+// queues a job for each of their issuers.
+func (client *Client) scheduleRevocationUpdates() {
+	policy := client.Preferences.RevocationUpdates
+	if !client.revocationUpdates.budgetLeft(policy, time.Now()) {
+		return
+	}
+
+	var (
+		selected map[irma.IssuerIdentifier][]irma.CredentialTypeIdentifier
+		err      error
+	)
+	client.readConfiguration(func() {
+		updated := map[irma.CredentialTypeIdentifier]time.Time{}
+		for id := range client.attributes {
+			credtype := client.Configuration.CredentialTypes[id]
+			if credtype == nil || !credtype.RevocationSupported() {
+				continue
+			}
+			t, err := client.nonrevOldestWitness(id)
+			if err != nil {
+				client.reportError(err)
+				continue
+			}
+			if !t.IsZero() {
+				updated[id] = t
+			}
+		}
+		selected, err = selectRevocationUpdates(client.Configuration, policy, updated, time.Now(), randomfloat)
+	})
+	if err != nil {
+		client.reportError(err)
+		return
+	}
+	for issuer, ids := range selected {
+		if !client.revocationUpdates.queue(issuer) {
+			continue
+		}
+		irma.Logger.WithFields(logrus.Fields{
+			"issuer":    issuer,
+			"credtypes": ids,
+		}).Debug("scheduling nonrevocation witness remote update")
+		issuer, ids := issuer, ids // copy for closure below (https://golang.org/doc/faq#closures_and_goroutines)
+		client.jobs <- func() {
+			defer client.revocationUpdates.dequeue(issuer)
+			client.nonrevUpdateInBackground(ids)
+		}
+	}
+}
+
+// selectRevocationUpdates returns per issuer the credential types whose witnesses are to be
+// updated, given the (oldest) update times of the witnesses of the credential types. Each
+// credential type is selected with a probability that increases with the age of its witness,
+// and when one is selected, the other credential types of its issuer are selected too if their
+// witness is older than the fraction revocationBatchFraction of their target.
+func selectRevocationUpdates(
+	conf *irma.Configuration,
+	policy RevocationUpdatePolicy,
+	updated map[irma.CredentialTypeIdentifier]time.Time,
+	now time.Time,
+	random func() (float64, error),
+) (map[irma.IssuerIdentifier][]irma.CredentialTypeIdentifier, error) {
+	candidates := map[irma.IssuerIdentifier][]irma.CredentialTypeIdentifier{}
+	selected := map[irma.IssuerIdentifier]bool{}
+	for id, t := range updated {
+		target := policy.target(conf.CredentialTypes[id])
+		r, err := random()
+		if err != nil {
+			return nil, err
+		}
+		issuer := id.IssuerIdentifier()
+		if r < probability(t, uint64(target.Seconds())) {
+			selected[issuer] = true
+		} else if now.Sub(t) < target/revocationBatchFraction {
+			continue
+		}
+		candidates[issuer] = append(candidates[issuer], id)
+	}
+
+	result := map[irma.IssuerIdentifier][]irma.CredentialTypeIdentifier{}
+	for issuer := range selected {
+		ids := candidates[issuer]
+		sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+		result[issuer] = ids
+	}
+	return result, nil
+}
+
+// nonrevUpdateInBackground updates the witnesses of the specified credential types from the
+// revocation server, as far as the request budget allows.
+func (client *Client) nonrevUpdateInBackground(ids []irma.CredentialTypeIdentifier) {
+	for _, id := range ids {
+		if err := client.nonrevUpdateWithinBudget(id); err != nil {
+			if err == errRevocationBudgetExhausted {
+				irma.Logger.WithField("credtype", id).Debug("revocation update budget exhausted")
+				return
+			}
+			client.revocationUpdates.failed()
+			client.reportError(err)
+		}
+	}
+}
+
+var errRevocationBudgetExhausted = fmt.Errorf("revocation update budget exhausted")
+
+// nonrevUpdateWithinBudget updates all instances of the credential type using the latest update
+// messages of all of its key counters, fetched in one request. Only if those do not suffice for
+// some key counter, the remaining update messages of that key counter are fetched separately.
+func (client *Client) nonrevUpdateWithinBudget(id irma.CredentialTypeIdentifier) error {
+	policy := client.Preferences.RevocationUpdates
+	lowest, err := client.nonrevLowestIndices(id)
+	if err != nil || len(lowest) == 0 {
+		return err
+	}
+
+	rc := irma.RevocationClient{Conf: client.Configuration}
+	if !client.revocationUpdates.request(policy, time.Now()) {
+		return errRevocationBudgetExhausted
+	}
+	updates, err := rc.FetchUpdatesLatest(id, client.Configuration.CredentialTypes[id].RevocationUpdateCount)
+	if err != nil {
+		return err
+	}
+	for counter, l := range lowest {
+		update := updates[counter]
+		if update == nil || len(update.Events) == 0 || update.Events[0].Index > l+1 {
+			if !client.revocationUpdates.request(policy, time.Now()) {
+				return errRevocationBudgetExhausted
+			}
+			if update, err = rc.FetchUpdateFrom(id, counter, l+1); err != nil {
+				return err
+			}
+		}
+		if err = client.nonrevApplyUpdates(id, counter, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nonrevOldestWitness returns the oldest update time of the witnesses of the credential type,
+// or the zero time if none of its instances has a witness.
+func (client *Client) nonrevOldestWitness(id irma.CredentialTypeIdentifier) (time.Time, error) {
+	var oldest time.Time
+	for i := range client.attrs(id) {
+		cred, err := client.credential(id, i)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if cred.NonRevocationWitness == nil {
+			continue
+		}
+		if oldest.IsZero() || cred.NonRevocationWitness.Updated.Before(oldest) {
+			oldest = cred.NonRevocationWitness.Updated
+		}
+	}
+	return oldest, nil
+}
+
+// updateRevocationSubscriptions subscribes to the server-sent events of the revocation servers of
+// the credential types supporting revocation, or unsubscribes from them if the preferences or the
+// network no longer allow them.
+func (client *Client) updateRevocationSubscriptions() {
+	wanted := map[irma.CredentialTypeIdentifier]string{}
+	u := &client.revocationUpdates
+	u.Lock()
+	defer u.Unlock()
+	if u.stop == nil {
+		return // closed
+	}
+	if client.Preferences.RevocationUpdates.ServerSentEvents && !u.metered {
+		for id, attrsets := range client.attributes {
+			credtype := client.Configuration.CredentialTypes[id]
+			if len(attrsets) == 0 || credtype == nil || !credtype.RevocationSupported() {
+				continue
+			}
+			wanted[id] = fmt.Sprintf("%s/revocation/%s/updateevents", credtype.RevocationServers[0], id)
+		}
+	}
+
+	for id, cancel := range u.subscriptions {
+		if _, ok := wanted[id]; !ok {
+			irma.Logger.WithField("credtype", id).Debug("unsubscribing from revocation update events")
+			cancel()
+			delete(u.subscriptions, id)
+		}
+	}
+	for id, url := range wanted {
+		if _, ok := u.subscriptions[id]; ok {
+			continue
+		}
+		irma.Logger.WithField("credtype", id).Debug("subscribing to revocation update events")
+		ctx, cancel := context.WithCancel(context.Background())
+		u.subscriptions[id] = cancel
+		go func(id irma.CredentialTypeIdentifier, url string) {
+			if err := sseclient.Notify(ctx, url, true, u.events); err != nil && ctx.Err() == nil {
+				irma.Logger.WithField("credtype", id).Warn("SSE connection closed: ", err)
+			}
+		}(id, url)
+	}
+}
+
+// handleRevocationEvents applies the updates pushed by revocation servers until the revocation
+// updates are closed.
+func (client *Client) handleRevocationEvents() {
+	u := &client.revocationUpdates
+	events, stop := u.events, u.stop
+	for {
+		select {
+		case event := <-events:
+			segments := strings.Split(event.URI, "/")
+			if len(segments) < 2 {
+				irma.Logger.Warn("malformed SSE URL: ", event.URI)
+				continue
+			}
+			id := irma.NewCredentialTypeIdentifier(segments[len(segments)-2])
+			update := &revocation.Update{}
+			if err := json.Unmarshal(event.Data, update); err != nil {
+				irma.Logger.WithField("credtype", id).Warn("failed to unmarshal pushed update: ", err)
+				continue
+			}
+			job := func() {
+				if err := client.nonrevApplyPushedUpdate(id, update); err != nil {
+					client.reportError(err)
+				}
+			}
+			select {
+			case client.jobs <- job:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// nonrevApplyPushedUpdate applies an update pushed by a revocation server, if it is adjacent to
+// the witnesses of the credential type. Otherwise the witnesses are left to the scheduled updates,
+// which fetch all update messages that are needed.
+func (client *Client) nonrevApplyPushedUpdate(id irma.CredentialTypeIdentifier, update *revocation.Update) error {
+	if update.SignedAccumulator == nil || len(update.Events) == 0 {
+		return nil
+	}
+	lowest, err := client.nonrevLowestIndices(id)
+	if err != nil {
+		return err
+	}
+	counter := update.SignedAccumulator.PKCounter
+	l, ok := lowest[counter]
+	if !ok || update.Events[0].Index > l+1 {
+		return nil
+	}
+	client.revocationUpdates.Lock()
+	client.revocationUpdates.stats.PushedUpdates++
+	client.revocationUpdates.Unlock()
+	return client.nonrevApplyUpdates(id, counter, update)
+}
+
+// target returns the time after which it becomes very likely that the witnesses of the
+// credential type are updated.
+func (policy RevocationUpdatePolicy) target(credtype *irma.CredentialType) time.Duration {
+	if target := policy.Targets[credtype.Identifier()]; target > 0 {
+		return target
+	}
+	return time.Duration(credtype.RevocationUpdateSpeed) * time.Hour
+}
+
+// limit returns the maximum number of requests per hour, or 0 if it is unlimited.
+func (policy RevocationUpdatePolicy) limit(metered bool) int {
+	if !metered {
+		return policy.MaxRequestsPerHour
+	}
+	if policy.MaxRequestsPerHour > 0 && policy.MaxRequestsPerHour < policy.MeteredRequestsPerHour {
+		return policy.MaxRequestsPerHour
+	}
+	return policy.MeteredRequestsPerHour
+}
+
+// pruneRequests removes the requests made more than an hour ago. The caller must hold the lock.
+func (u *revocationUpdater) pruneRequests(now time.Time) []time.Time {
+	i := 0
+	for i < len(u.requests) && now.Sub(u.requests[i]) >= time.Hour {
+		i++
+	}
+	u.requests = u.requests[i:]
+	return u.requests
+}
+
+// budgetLeft returns whether the policy allows a request to be made now.
+func (u *revocationUpdater) budgetLeft(policy RevocationUpdatePolicy, now time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.allowed(policy, now)
+}
+
+// request records a request to be made now, if the policy allows it.
+func (u *revocationUpdater) request(policy RevocationUpdatePolicy, now time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	if !u.allowed(policy, now) {
+		return false
+	}
+	u.requests = append(u.requests, now)
+	u.stats.Requests++
+	return true
+}
+
+// allowed returns whether the policy allows a request to be made now. The caller must hold the
+// lock.
+func (u *revocationUpdater) allowed(policy RevocationUpdatePolicy, now time.Time) bool {
+	limit := policy.limit(u.metered)
+	if u.metered && limit == 0 {
+		return false
+	}
+	return limit == 0 || len(u.pruneRequests(now)) < limit
+}
+
+// check records that the witnesses of the credential type have been brought up to date.
+func (u *revocationUpdater) check(id irma.CredentialTypeIdentifier) {
+	u.Lock()
+	defer u.Unlock()
+	if u.checked == nil {
+		return
+	}
+	now := time.Now()
+	u.checked[id] = now
+	u.stats.LastChecked = now
+}
+
+func (u *revocationUpdater) failed() {
+	u.Lock()
+	defer u.Unlock()
+	u.stats.Failures++
+}
+
+// queue marks a background update of the issuer as queued, returning false if one is queued
+// already.
+func (u *revocationUpdater) queue(issuer irma.IssuerIdentifier) bool {
+	u.Lock()
+	defer u.Unlock()
+	if _, ok := u.queued[issuer]; ok {
+		return false
+	}
+	u.queued[issuer] = struct{}{}
+	return true
+}
+
+func (u *revocationUpdater) dequeue(issuer irma.IssuerIdentifier) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.queued, issuer)
+}
@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -79,6 +80,8 @@ type session struct {
 	client         *Client
 	request        irma.SessionRequest
 	done           <-chan struct{}
+	finished       chan struct{} // closed when the session finishes
+	ctx            context.Context
 	prepRevocation chan error // used when nonrevocation preprocessing is done
 
 	next               *session
@@ -95,6 +98,12 @@ type session struct {
 	Hostname  string
 	ServerURL string
 	transport *irma.HTTPTransport
+
+	// Connection with the verifier of proximity sessions, nil otherwise
+	proximity irma.ProximityConn
+
+	// Hash of the credential refreshed by this session, if any
+	refresh string
 }
 
 type sessions struct {
@@ -121,6 +130,15 @@ var supportedVersions = map[int][]int{
 // NewSession starts a new IRMA session, given (along with a handler to pass feedback to) a session request.
 // When the request is not suitable to start an IRMA session from, it calls the Failure method of the specified Handler.
 func (client *Client) NewSession(sessionrequest string, handler Handler) SessionDismisser {
+	return client.NewSessionContext(context.Background(), sessionrequest, handler)
+}
+
+// NewSessionContext starts a new IRMA session like NewSession, which is aborted when the context
+// is cancelled or its deadline passes: requests to the IRMA server, keyshare servers and revocation
+// servers in progress are aborted, the session is deleted at the IRMA server, and the Failure
+// method of the handler is called with an error of type irma.ErrorCancelled or irma.ErrorTimeout,
+// respectively. (Dismissing the session still results in a call to the Cancelled method.)
+func (client *Client) NewSessionContext(ctx context.Context, sessionrequest string, handler Handler) SessionDismisser {
 	bts := []byte(sessionrequest)
 
 	qr := &irma.Qr{}
@@ -129,7 +147,11 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newQrSession(qr, handler)
+		if qr.IsProximity() {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "proximity session requires a connection"})
+			return nil
+		}
+		return client.newQrSession(ctx, qr, handler, nil)
 	}
 
 	sigRequest := &irma.SignatureRequest{}
@@ -138,7 +160,7 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newManualSession(sigRequest, handler, irma.ActionSigning)
+		return client.newManualSession(ctx, sigRequest, handler, irma.ActionSigning)
 	}
 
 	disclosureRequest := &irma.DisclosureRequest{}
@@ -147,15 +169,32 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newManualSession(disclosureRequest, handler, irma.ActionDisclosing)
+		return client.newManualSession(ctx, disclosureRequest, handler, irma.ActionDisclosing)
 	}
 
 	handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "session request of unsupported type"})
 	return nil
 }
 
+// NewProximitySession starts a new IRMA session with a verifier nearby, given the session pointer
+// that the verifier passed (e.g. as a QR) and the connection over which the messages of the
+// session are exchanged with the verifier. As the verifier cannot be authenticated, its requestor
+// info is always unverified. The connection is not closed when the session finishes.
+func (client *Client) NewProximitySession(sessionrequest string, conn irma.ProximityConn, handler Handler) SessionDismisser {
+	qr := &irma.Qr{}
+	if err := json.Unmarshal([]byte(sessionrequest), qr); err != nil || !qr.IsQr() {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "session request of unsupported type"})
+		return nil
+	}
+	if err := qr.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+		return nil
+	}
+	return client.newQrSession(context.Background(), qr, handler, conn)
+}
+
 // newManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
-func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
+func (client *Client) newManualSession(ctx context.Context, request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
 	client.PauseJobs()
 
 	doneChannel := make(chan struct{}, 1)
@@ -168,20 +207,40 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		Version:        client.minVersion,
 		request:        request,
 		done:           doneChannel,
+		finished:       make(chan struct{}),
+		ctx:            ctx,
 		prepRevocation: make(chan error),
 	}
 	client.sessions.add(session)
+	go session.watchContext()
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusManualStarted)
 
 	session.processSessionInfo()
 	return session
 }
 
-// newQrSession creates and starts a new interactive IRMA session
-func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
+// newQrSession creates and starts a new interactive IRMA session, over the proximity connection
+// if it is not nil.
+func (client *Client) newQrSession(ctx context.Context, qr *irma.Qr, handler Handler, proximity irma.ProximityConn) *session {
+	return client.startQrSession(ctx, qr, handler, proximity, "")
+}
+
+// startQrSession is newQrSession, for a session refreshing the credential with the specified hash
+// if it is not empty (see RefreshCredential).
+func (client *Client) startQrSession(ctx context.Context, qr *irma.Qr, handler Handler, proximity irma.ProximityConn, refresh string) *session {
+	if proximity != nil {
+		// Chained sessions of proximity sessions are pointed to with regular session URLs
+		u, err := irma.ProximityURL(qr.URL)
+		if err != nil {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			return nil
+		}
+		qr = &irma.Qr{Type: qr.Type, URL: u}
+	}
+
 	if qr.Type == irma.ActionRedirect {
 		newqr := &irma.Qr{}
-		transport := irma.NewHTTPTransport("", !client.Preferences.DeveloperMode)
+		transport := client.newTransport("", proximity).WithContext(ctx)
 		if err := transport.Post(qr.URL, newqr, struct{}{}); err != nil {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
 			return nil
@@ -190,27 +249,34 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: errors.New("infinite static QR recursion")})
 			return nil
 		}
-		return client.newQrSession(newqr, handler)
+		return client.startQrSession(ctx, newqr, handler, proximity, refresh)
 	}
 
 	client.PauseJobs()
 
 	u, _ := url.ParseRequestURI(qr.URL) // Qr validator already checked this for errors
+	var requestor *irma.RequestorInfo
+	client.readConfiguration(func() { requestor = requestorInfo(qr.URL, client.Configuration) })
 	doneChannel := make(chan struct{}, 1)
 	doneChannel <- struct{}{}
 	close(doneChannel)
 	session := &session{
 		ServerURL:      qr.URL,
 		Hostname:       u.Hostname(),
-		RequestorInfo:  requestorInfo(qr.URL, client.Configuration),
-		transport:      irma.NewHTTPTransport(qr.URL, !client.Preferences.DeveloperMode),
+		RequestorInfo:  requestor,
+		transport:      client.newTransport(qr.URL, proximity).WithContext(ctx),
+		proximity:      proximity,
 		Action:         qr.Type,
 		Handler:        handler,
 		client:         client,
 		done:           doneChannel,
+		finished:       make(chan struct{}),
+		ctx:            ctx,
 		prepRevocation: make(chan error),
+		refresh:        refresh,
 	}
 	client.sessions.add(session)
+	go session.watchContext()
 
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
 	min := client.minVersion
@@ -293,6 +359,8 @@ func (session *session) handlePairing(pairingCode string) error {
 		} else {
 			return &irma.SessionError{ErrorType: irma.ErrorPairingRejected}
 		}
+	case <-session.ctx.Done():
+		return contextError(session.ctx.Err())
 	case err := <-errorchan:
 		if serr, ok := err.(*irma.SessionError); ok {
 			return serr
@@ -305,12 +373,23 @@ func (session *session) handlePairing(pairingCode string) error {
 	}
 }
 
+func (client *Client) newTransport(serverURL string, proximity irma.ProximityConn) *irma.HTTPTransport {
+	if proximity != nil {
+		return irma.NewProximityTransport(serverURL, proximity)
+	}
+	return irma.NewHTTPTransport(serverURL, !client.Preferences.DeveloperMode)
+}
+
 func requestorInfo(serverURL string, conf *irma.Configuration) *irma.RequestorInfo {
 	if serverURL == "" {
 		return nil
 	}
 	u, _ := url.ParseRequestURI(serverURL) // Qr validator already checked this for errors
 	hostname := u.Hostname()
+	if u.Scheme == irma.ProximityScheme {
+		// Nothing authenticates the hostname of the verifier of a proximity session
+		return irma.NewRequestorInfo(hostname)
+	}
 	info, present := conf.Requestors[hostname]
 
 	if (u.Scheme == "https" || !common.ForceHTTPS) && present &&
@@ -363,31 +442,15 @@ func (session *session) processSessionInfo() {
 	}
 
 	if session.Action == irma.ActionIssuing {
-		ir := session.request.(*irma.IssuanceRequest)
-		issuedAt := time.Now()
-		_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version, issuedAt)
+		var err *irma.SessionError
+		session.client.readConfiguration(func() { err = session.checkIssuance() })
 		if err != nil {
-			if err, ok := err.(*irma.SessionError); ok {
-				session.fail(err)
-			} else {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownIdentifier, Err: err})
-			}
+			session.fail(err)
 			return
 		}
-
-		// Calculate singleton credentials to be removed
-		ir.RemovalCredentialInfoList = irma.CredentialInfoList{}
-		for _, credreq := range ir.Credentials {
-			err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
-			if err != nil {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
-				return
-			}
-			preexistingCredentials := session.client.attrs(credreq.CredentialTypeID)
-			if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValid() && preexistingCredentials[0].CredentialType().IsSingleton {
-				ir.RemovalCredentialInfoList = append(ir.RemovalCredentialInfoList, preexistingCredentials[0].Info())
-			}
-		}
+	} else if session.refresh != "" {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "refresh session is not an issuance session"})
+		return
 	}
 
 	// Prepare and update all revocation state asynchroniously.
@@ -401,7 +464,9 @@ func (session *session) processSessionInfo() {
 	// if it finishes in time, then credentials that have been revoked can be excluded from the
 	// candidate calculation.
 	go func() {
-		session.prepRevocation <- session.client.NonrevPrepare(session.request)
+		var err error
+		session.client.readConfiguration(func() { err = session.client.nonrevPrepare(session.ctx, session.request) })
+		session.prepRevocation <- err
 	}()
 	select {
 	case err := <-session.prepRevocation:
@@ -423,8 +488,47 @@ func (session *session) processSessionInfo() {
 	session.requestPermission()
 }
 
+// checkIssuance checks the credentials to be issued, and calculates the singleton credentials
+// that they replace.
+func (session *session) checkIssuance() *irma.SessionError {
+	ir := session.request.(*irma.IssuanceRequest)
+	issuedAt := time.Now()
+	_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version, issuedAt)
+	if err != nil {
+		if err, ok := err.(*irma.SessionError); ok {
+			return err
+		}
+		return &irma.SessionError{ErrorType: irma.ErrorUnknownIdentifier, Err: err}
+	}
+
+	// Calculate singleton credentials to be removed
+	ir.RemovalCredentialInfoList = irma.CredentialInfoList{}
+	for _, credreq := range ir.Credentials {
+		err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
+		if err != nil {
+			return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err}
+		}
+		preexistingCredentials := session.client.attrs(credreq.CredentialTypeID)
+		if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValid() && preexistingCredentials[0].CredentialType().IsSingleton {
+			ir.RemovalCredentialInfoList = append(ir.RemovalCredentialInfoList, preexistingCredentials[0].Info())
+		}
+	}
+
+	if session.refresh != "" {
+		return session.checkRefresh(ir)
+	}
+	return nil
+}
+
 func (session *session) requestPermission() {
-	candidates, satisfiable, err := session.client.Candidates(session.request)
+	var (
+		candidates  [][]DisclosureCandidates
+		satisfiable bool
+		err         error
+	)
+	session.client.readConfiguration(func() {
+		candidates, satisfiable, err = session.client.Candidates(session.request)
+	})
 	if err != nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 		return
@@ -432,17 +536,37 @@ func (session *session) requestPermission() {
 
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusConnected)
 
+	// Consult the trust record of the requestor: it may be blocked, or the user may already
+	// have chosen what to disclose for this request
+	blocked, choice := session.client.trustedPermission(session.RequestorInfo, session.request, candidates)
+	if blocked {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorRequestorBlocked, Err: errors.New("requestor is blocked")})
+		return
+	}
+	if choice != nil {
+		session.doSession(true, choice)
+		return
+	}
+	callback := func(proceed bool, choice *irma.DisclosureChoice) {
+		if proceed && choice != nil {
+			if err := session.client.rememberChoice(session.RequestorInfo, session.request, choice); err != nil {
+				session.client.reportError(err)
+			}
+		}
+		session.doSession(proceed, choice)
+	}
+
 	// Ask for permission to execute the session
 	switch session.Action {
 	case irma.ActionDisclosing:
 		session.Handler.RequestVerificationPermission(
-			session.request.(*irma.DisclosureRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+			session.request.(*irma.DisclosureRequest), satisfiable, candidates, session.RequestorInfo, callback)
 	case irma.ActionSigning:
 		session.Handler.RequestSignaturePermission(
-			session.request.(*irma.SignatureRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+			session.request.(*irma.SignatureRequest), satisfiable, candidates, session.RequestorInfo, callback)
 	case irma.ActionIssuing:
 		session.Handler.RequestIssuancePermission(
-			session.request.(*irma.IssuanceRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+			session.request.(*irma.IssuanceRequest), satisfiable, candidates, session.RequestorInfo, callback)
 	default:
 		panic("Invalid session type") // does not happen, session.Action has been checked earlier
 	}
@@ -458,6 +582,10 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 		session.cancel()
 		return
 	}
+	if err := session.ctx.Err(); err != nil {
+		session.fail(contextError(err))
+		return
+	}
 
 	// If this is a session in a chain of sessions, also disclose all attributes disclosed in previous sessions
 	if session.implicitDisclosure != nil {
@@ -469,6 +597,10 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorRequiredAttributeMissing, Err: err})
 		return
 	}
+	if session.refresh != "" && !choiceDiscloses(choice, session.refresh) {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorRefresh, Info: "the credential being refreshed must be disclosed"})
+		return
+	}
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
 
 	// wait for revocation preparation to finish
@@ -478,34 +610,78 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 		return
 	}
 
-	if !session.Distributed() {
-		message, err := session.getProof()
-		if err != nil {
-			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
-			return
+	var (
+		distributed bool
+		message     interface{}
+		info        *irma.KeyshareSessionInfo
+	)
+	session.client.readConfiguration(func() {
+		if distributed = session.Distributed(); !distributed {
+			message, err = session.getProof()
+		} else {
+			session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
+			info = session.keyshareSessionInfo()
 		}
+	})
+	if err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return
+	}
+
+	if !distributed {
 		session.sendResponse(message)
 		session.finish(false)
 	} else {
-		var err error
-		session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
-		if err != nil {
-			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
-		}
 		startKeyshareSession(
+			session.ctx,
 			session,
 			session.Handler,
 			session.builders,
 			session.request,
+			info,
 			session.issuerProofNonce,
 			session.timestamp,
 			session.client.Configuration,
+			session.client.confMutex,
 			session.client.keyshareServers,
 			session.client.Preferences,
 		)
 	}
 }
 
+// keyshareSessionInfo returns the details of this session to be recorded by the keyshare server(s):
+// the requestor, and the credential types being disclosed or issued.
+func (session *session) keyshareSessionInfo() *irma.KeyshareSessionInfo {
+	info := &irma.KeyshareSessionInfo{
+		Action:            session.Action,
+		RequestorHostname: session.Hostname,
+	}
+	if session.RequestorInfo != nil {
+		info.RequestorName = session.RequestorInfo.Name
+	}
+
+	seen := map[irma.CredentialTypeIdentifier]struct{}{}
+	add := func(credtype irma.CredentialTypeIdentifier) {
+		if _, ok := seen[credtype]; !ok {
+			seen[credtype] = struct{}{}
+			info.CredentialTypes = append(info.CredentialTypes, credtype)
+		}
+	}
+	if session.Action == irma.ActionIssuing {
+		for _, cred := range session.request.(*irma.IssuanceRequest).Credentials {
+			add(cred.CredentialTypeID)
+		}
+	}
+	if session.choice != nil {
+		for _, attrs := range session.choice.Attributes {
+			for _, attr := range attrs {
+				add(attr.Type.CredentialTypeIdentifier())
+			}
+		}
+	}
+	return info
+}
+
 // sendResponse sends the proofs of knowledge of the hidden attributes and/or the secret key, or the constructed
 // attribute-based signature, to the API server.
 func (session *session) sendResponse(message interface{}) {
@@ -553,20 +729,32 @@ func (session *session) sendResponse(message interface{}) {
 			return
 		}
 		if session.Action == irma.ActionIssuing {
-			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
+			session.client.readConfiguration(func() {
+				if session.refresh != "" {
+					// Replacing the refreshed credential also logs the session
+					err = session.refreshCredential(serverResponse.IssueSignatures, message)
+				} else {
+					err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders)
+				}
+			})
+			if err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 				return
 			}
 		}
 	}
 
-	log, err = session.createLogEntry(message)
-	if err != nil {
-		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to create log entry", 0).ErrorStack())
-		session.client.reportError(err)
-	}
-	if err = session.client.storage.AddLogEntry(log); err != nil {
-		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+	if session.refresh == "" {
+		session.client.readConfiguration(func() {
+			log, err = session.createLogEntry(message)
+			if err != nil {
+				irma.Logger.Warn(errors.WrapPrefix(err, "Failed to create log entry", 0).ErrorStack())
+				session.client.reportError(err)
+			}
+			if err = session.client.storage.AddLogEntry(log); err != nil {
+				irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+			}
+		})
 	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
@@ -574,7 +762,7 @@ func (session *session) sendResponse(message interface{}) {
 	session.finish(false)
 
 	if serverResponse != nil && serverResponse.NextSession != nil {
-		session.next = session.client.newQrSession(serverResponse.NextSession, session.Handler)
+		session.next = session.client.newQrSession(session.ctx, serverResponse.NextSession, session.Handler, session.proximity)
 		session.next.implicitDisclosure = session.choice.Attributes
 	} else {
 		session.Handler.Success(string(messageJson))
@@ -622,39 +810,44 @@ func (session *session) getProof() (interface{}, error) {
 // checkKeyshareEnrollment checks if we are enrolled into all involved keyshare servers,
 // and aborts the session if not
 func (session *session) checkKeyshareEnrollment() bool {
-	for id := range session.request.Identifiers().SchemeManagers {
-		distributed := session.client.Configuration.SchemeManagers[id].Distributed()
-		_, enrolled := session.client.keyshareServers[id]
-		if distributed && !enrolled {
-			session.finish(false)
-			session.Handler.KeyshareEnrollmentMissing(id)
-			return false
+	var missing *irma.SchemeManagerIdentifier
+	session.client.readConfiguration(func() {
+		for id := range session.request.Identifiers().SchemeManagers {
+			distributed := session.client.Configuration.SchemeManagers[id].Distributed()
+			_, enrolled := session.client.keyshareServers[id]
+			if distributed && !enrolled {
+				id := id
+				missing = &id
+				return
+			}
 		}
+	})
+	if missing != nil {
+		session.finish(false)
+		session.Handler.KeyshareEnrollmentMissing(*missing)
+		return false
 	}
 	return true
 }
 
 func (session *session) checkAndUpdateConfiguration() error {
 	// Download missing credential types/issuers/public keys from the scheme manager
-	downloaded, err := session.client.Configuration.Download(session.request)
+	err := session.client.downloadConfiguration(session.request)
 	if uerr, ok := err.(*irma.UnknownIdentifierError); ok {
 		return &irma.SessionError{ErrorType: uerr.ErrorType, Err: uerr}
 	} else if err != nil {
 		return &irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err}
 	}
-	if downloaded != nil && !downloaded.Empty() {
-		if err = session.client.ConfigurationUpdated(downloaded); err != nil {
-			return err
-		}
-		session.client.handler.UpdateConfiguration(downloaded)
-	}
 
 	// Check if we are enrolled into all involved keyshare servers
 	if !session.checkKeyshareEnrollment() {
 		return &irma.SessionError{ErrorType: irma.ErrorKeyshareUnenrolled}
 	}
 
-	if err = session.request.Disclosure().Disclose.Validate(session.client.Configuration); err != nil {
+	session.client.readConfiguration(func() {
+		err = session.request.Disclosure().Disclose.Validate(session.client.Configuration)
+	})
+	if err != nil {
 		return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest}
 	}
 
@@ -730,12 +923,14 @@ func (session *session) finish(delete bool) bool {
 	// will then read that message, whilst all further calls will see the closed channel and know
 	// that no further work is needed.
 	if _, ok := <-session.done; ok {
+		close(session.finished)
 		session.client.sessions.remove(session.token)
 		// Do actual delete in background, since that can take a while in some circumstances, and
 		// precise moment of completion isn't relevant for frontend.
 		go func() {
 			if delete && session.IsInteractive() {
-				_ = session.transport.Delete()
+				// The context of the session may be done, but we still want the server to know
+				_ = session.transport.WithContext(context.Background()).Delete()
 			}
 			session.client.nonrevRepopulateCaches(session.request)
 		}()
@@ -744,7 +939,27 @@ func (session *session) finish(delete bool) bool {
 	return false
 }
 
+// watchContext fails the session when its context is done before the session finishes.
+func (session *session) watchContext() {
+	select {
+	case <-session.ctx.Done():
+		session.fail(contextError(session.ctx.Err()))
+	case <-session.finished:
+	}
+}
+
+func contextError(err error) *irma.SessionError {
+	if err == context.DeadlineExceeded {
+		return &irma.SessionError{ErrorType: irma.ErrorTimeout, Err: err}
+	}
+	return &irma.SessionError{ErrorType: irma.ErrorCancelled, Err: err}
+}
+
 func (session *session) fail(err *irma.SessionError) {
+	// Requests aborted because of the context fail with transport errors; report the reason instead
+	if ctxErr := session.ctx.Err(); ctxErr != nil {
+		err = contextError(ctxErr)
+	}
 	if session.finish(true) && err.ErrorType != irma.ErrorKeyshareUnenrolled {
 		irma.Logger.Warn("client session error: ", err.Error())
 		err.Err = errors.Wrap(err.Err, 0)
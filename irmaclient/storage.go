@@ -1,82 +1,205 @@
 package irmaclient
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"encoding/json"
-	"path/filepath"
 	"time"
 
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/revocation"
 	irma "github.com/privacybydesign/irmago"
-	"github.com/privacybydesign/irmago/internal/common"
 
 	"github.com/go-errors/errors"
-	"go.etcd.io/bbolt"
 )
 
-// This file contains the storage struct and its methods,
-// and some general filesystem functions.
-
-// Storage provider for a Client
+// This file contains the Storage interface, consisting of the operations with which a Client
+// stores and loads its data, and the storage struct implementing it. The storage struct
+// (de)serializes and (de)crypts the data, and maintains the log index, on top of a key/value
+// store (kvStore), so that this is implemented once for all of its implementations: a bbolt
+// database file (storage_bolt.go), memory (storage_memory.go) and an SQL database (storage_sql.go).
+
+// Storage is the storage in which a Client stores its data. It is used by a single Client at a
+// time. A Storage is obtained from OpenBoltStorage, NewMemoryStorage or NewSQLStorage.
+type Storage interface {
+	// Open prepares the storage for use by a client with the specified configuration, with the
+	// specified key with which its contents are encrypted (nil if they are not encrypted).
+	Open(conf *irma.Configuration, aesKey []byte) error
+	Close() error
+
+	// Transaction runs f within a read-write transaction, which is committed if f returns nil,
+	// and rolled back otherwise.
+	Transaction(f func(*transaction) error) error
+
+	TxStoreSecretKey(tx *transaction, sk *secretKey) error
+	TxStoreSignature(tx *transaction, cred *credential) error
+	TxStoreCLSignature(tx *transaction, credHash string, sig *clSignatureWitness) error
+	TxDeleteSignature(tx *transaction, attrs *irma.AttributeList) error
+	TxDeleteAllSignatures(tx *transaction) error
+	TxStoreAttributes(tx *transaction, credTypeID irma.CredentialTypeIdentifier, attrlistlist []*irma.AttributeList) error
+	TxDeleteAllAttributes(tx *transaction) error
+	TxStoreKeyshareServers(tx *transaction, keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error
+	TxAddLogEntry(tx *transaction, entry *LogEntry) error
+	TxStorePreferences(tx *transaction, prefs Preferences) error
+	TxStoreUpdates(tx *transaction, updates []update) error
+	TxLoadUpdates(tx *transaction) ([]update, error)
+	TxDeleteUserdata(tx *transaction) error
+	TxDeleteLogs(tx *transaction) error
+	TxDeleteAll(tx *transaction) error
+	// TxStoreAll stores the contents of a backup (as returned by LoadAll), after which the log
+	// index is rebuilt.
+	TxStoreAll(tx *transaction, contents *backupContents) error
+
+	// The Store* methods and DeleteAll run the corresponding Tx* method in their own transaction
+	StoreSecretKey(sk *secretKey) error
+	StoreSignature(cred *credential) error
+	StoreAttributes(credTypeID irma.CredentialTypeIdentifier, attrlistlist []*irma.AttributeList) error
+	StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error
+	AddLogEntry(entry *LogEntry) error
+	StorePreferences(prefs Preferences) error
+	StoreUpdates(updates []update) error
+	StoreExpiryWarnings(warnings map[string]time.Duration) error
+	StoreTrustRecords(records map[string]*TrustRecord) error
+	DeleteAll() error
+
+	LoadSecretKey() (*secretKey, error)
+	LoadSignature(attrs *irma.AttributeList) (*gabi.CLSignature, *revocation.Witness, error)
+	LoadAttributes() (map[irma.CredentialTypeIdentifier][]*irma.AttributeList, error)
+	LoadKeyshareServers() (map[irma.SchemeManagerIdentifier]*keyshareServer, error)
+	LoadLogsBefore(index uint64, max int) ([]*LogEntry, error)
+	LoadNewestLogs(max int) ([]*LogEntry, error)
+	LoadPreferences() (Preferences, error)
+	LoadUpdates() ([]update, error)
+	LoadExpiryWarnings() (map[string]time.Duration, error)
+	LoadTrustRecords() (map[string]*TrustRecord, error)
+	// LoadAll returns the contents of the storage for a backup, decrypted, and without the log
+	// index which can be rebuilt from the log entries.
+	LoadAll() (*backupContents, error)
+
+	// SearchLogs, IterateLogs, PruneLogs and RebuildLogIndex are documented in logindex.go
+	SearchLogs(filter LogFilter, beforeIndex uint64, max int) ([]*LogEntry, error)
+	IterateLogs(filter LogFilter, f func(entry *LogEntry) error) error
+	PruneLogs(olderThan time.Time, keep int) (removed int, err error)
+	RebuildLogIndex() error
+
+	// Encrypted, EnsureEncrypted and SetKey are documented in encryption.go
+	Encrypted() bool
+	EnsureEncrypted() error
+	SetKey(key []byte) error
+}
+
+// kvStore is a transactional key/value store on which a storage is built, modeled after bbolt.
+// The key/value pairs are grouped in named buckets, in which they are sorted bytewise by key.
+type kvStore interface {
+	// View runs f within a read-only transaction.
+	View(f func(tx kvTx) error) error
+	// Update runs f within a read-write transaction, which is committed if f returns nil, and
+	// rolled back otherwise. Update transactions do not run concurrently.
+	Update(f func(tx kvTx) error) error
+	// Close closes the store.
+	Close() error
+}
+
+// kvTx is a transaction of a kvStore. It, and the buckets and cursors obtained from it,
+// must not be used after the function to which it was passed returns.
+type kvTx interface {
+	// Bucket returns the bucket with the specified name, or nil if it does not exist.
+	Bucket(name string) (kvBucket, error)
+	// CreateBucketIfNotExists returns the bucket with the specified name, creating it if necessary.
+	CreateBucketIfNotExists(name string) (kvBucket, error)
+	// DeleteBucket deletes the bucket with the specified name and its contents, if it exists.
+	DeleteBucket(name string) error
+	// ForEachBucket calls f for each bucket, in order of their names.
+	ForEachBucket(f func(name string, b kvBucket) error) error
+}
+
+// kvBucket is a bucket of key/value pairs within a kvTx. The slices returned by its
+// methods are only valid during the transaction and must not be modified.
+type kvBucket interface {
+	// Get returns the value of the key, or nil if the key does not exist.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value of the key. The value must not be nil.
+	Put(key, value []byte) error
+	// Delete deletes the key, if it exists.
+	Delete(key []byte) error
+	// ForEach calls f for each key/value pair in the bucket, in order of the keys. The bucket must
+	// not be modified by f.
+	ForEach(f func(key, value []byte) error) error
+	// Cursor returns a cursor over the key/value pairs of the bucket.
+	Cursor() (kvCursor, error)
+	// Sequence returns the current value of the sequence of the bucket.
+	Sequence() (uint64, error)
+	// SetSequence sets the value of the sequence of the bucket.
+	SetSequence(seq uint64) error
+	// NextSequence increments the sequence of the bucket, and returns its new value.
+	NextSequence() (uint64, error)
+}
+
+// kvCursor iterates over the key/value pairs of a kvBucket in order of the keys.
+// Its methods return a nil key if there is no such pair.
+type kvCursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	// Seek moves the cursor to the first key that is equal to or greater than the specified key.
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
+
+// storage implements Storage on top of a kvStore.
 type storage struct {
-	storagePath   string
-	db            *bbolt.DB
+	db            kvStore
 	Configuration *irma.Configuration
+	aesKey        []byte      // key with which the values are to be encrypted, nil if none was specified
+	aead          cipher.AEAD // with which the values are encrypted, nil if they are not encrypted
 }
 
 type transaction struct {
-	*bbolt.Tx
+	kvTx
 }
 
-// Filenames
-const databaseFile = "db"
+func newStorage(db kvStore) *storage {
+	return &storage{db: db}
+}
 
-// Bucketnames bbolt
+// Bucketnames
 const (
 	userdataBucket = "userdata"    // Key/value: specified below
 	skKey          = "sk"          // Value: *secretKey
 	preferencesKey = "preferences" // Value: Preferences
 	updatesKey     = "updates"     // Value: []update
 	kssKey         = "kss"         // Value: map[irma.SchemeManagerIdentifier]*keyshareServer
+	expiryKey      = "expiry"      // Value: map[string]time.Duration (credential hash to lead time of last warning)
+	trustKey       = "trust"       // Value: map[string]*TrustRecord
 
 	attributesBucket = "attrs" // Key: irma.CredentialIdentifier, value: []*irma.AttributeList
 	logsBucket       = "logs"  // Key: (auto-increment index), value: *LogEntry
 	signaturesBucket = "sigs"  // Key: credential.attrs.Hash, value: *gabi.CLSignature
 )
 
-func (s *storage) path(p string) string {
-	return filepath.Join(s.storagePath, p)
-}
-
 // Open initializes the credential storage,
 // ensuring that it is in a usable state.
-// Setting it up in a properly protected location (e.g., with automatic
-// backups to iCloud/Google disabled) is the responsibility of the user.
-func (s *storage) Open() error {
-	var err error
-	if err = common.AssertPathExists(s.storagePath); err != nil {
-		return err
-	}
-	s.db, err = bbolt.Open(s.path(databaseFile), 0600, &bbolt.Options{Timeout: 1 * time.Second})
-	return err
+func (s *storage) Open(conf *irma.Configuration, aesKey []byte) error {
+	s.Configuration, s.aesKey = conf, aesKey
+	return s.loadEncryption()
 }
 
 func (s *storage) Close() error {
 	return s.db.Close()
 }
 
-func (s *storage) BucketExists(name []byte) bool {
-	return s.db.View(func(tx *bbolt.Tx) error {
-		if tx.Bucket(name) == nil {
-			return bbolt.ErrBucketNotFound
-		}
-		return nil
-	}) == nil
+func (s *storage) BucketExists(name string) bool {
+	var exists bool
+	_ = s.db.View(func(tx kvTx) error {
+		b, err := tx.Bucket(name)
+		exists = b != nil
+		return err
+	})
+	return exists
 }
 
 func (s *storage) txStore(tx *transaction, bucketName string, key string, value interface{}) error {
-	b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	b, err := tx.CreateBucketIfNotExists(bucketName)
 	if err != nil {
 		return err
 	}
@@ -84,12 +207,15 @@ func (s *storage) txStore(tx *transaction, bucketName string, key string, value
 	if err != nil {
 		return err
 	}
+	if btsValue, err = s.seal(bucketName, []byte(key), btsValue); err != nil {
+		return err
+	}
 
 	return b.Put([]byte(key), btsValue)
 }
 
 func (s *storage) txDelete(tx *transaction, bucketName string, key string) error {
-	b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	b, err := tx.CreateBucketIfNotExists(bucketName)
 	if err != nil {
 		return err
 	}
@@ -98,20 +224,25 @@ func (s *storage) txDelete(tx *transaction, bucketName string, key string) error
 }
 
 func (s *storage) txLoad(tx *transaction, bucketName string, key string, dest interface{}) (found bool, err error) {
-	b := tx.Bucket([]byte(bucketName))
-	if b == nil {
-		return false, nil
+	b, err := tx.Bucket(bucketName)
+	if b == nil || err != nil {
+		return false, err
+	}
+	bts, err := b.Get([]byte(key))
+	if err != nil {
+		return false, err
 	}
-	bts := b.Get([]byte(key))
-	b.Sequence()
 	if bts == nil {
 		return false, nil
 	}
+	if bts, err = s.open(bucketName, []byte(key), bts); err != nil {
+		return true, err
+	}
 	return true, json.Unmarshal(bts, dest)
 }
 
 func (s *storage) load(bucketName string, key string, dest interface{}) (found bool, err error) {
-	err = s.db.View(func(tx *bbolt.Tx) error {
+	err = s.db.View(func(tx kvTx) error {
 		found, err = s.txLoad(&transaction{tx}, bucketName, key, dest)
 		return err
 	})
@@ -119,7 +250,7 @@ func (s *storage) load(bucketName string, key string, dest interface{}) (found b
 }
 
 func (s *storage) Transaction(f func(*transaction) error) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	return s.db.Update(func(tx kvTx) error {
 		return f(&transaction{tx})
 	})
 }
@@ -129,7 +260,7 @@ func (s *storage) TxDeleteSignature(tx *transaction, attrs *irma.AttributeList)
 }
 
 func (s *storage) TxDeleteAllSignatures(tx *transaction) error {
-	return tx.DeleteBucket([]byte(signaturesBucket))
+	return tx.DeleteBucket(signaturesBucket)
 }
 
 type clSignatureWitness struct {
@@ -186,7 +317,7 @@ func (s *storage) TxStoreAttributes(tx *transaction, credTypeID irma.CredentialT
 }
 
 func (s *storage) TxDeleteAllAttributes(tx *transaction) error {
-	return tx.DeleteBucket([]byte(attributesBucket))
+	return tx.DeleteBucket(attributesBucket)
 }
 
 func (s *storage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error {
@@ -200,13 +331,13 @@ func (s *storage) TxStoreKeyshareServers(tx *transaction, keyshareServers map[ir
 }
 
 func (s *storage) AddLogEntry(entry *LogEntry) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
-		return s.TxAddLogEntry(&transaction{tx}, entry)
+	return s.Transaction(func(tx *transaction) error {
+		return s.TxAddLogEntry(tx, entry)
 	})
 }
 
 func (s *storage) TxAddLogEntry(tx *transaction, entry *LogEntry) error {
-	b, err := tx.CreateBucketIfNotExists([]byte(logsBucket))
+	b, err := tx.CreateBucketIfNotExists(logsBucket)
 	if err != nil {
 		return err
 	}
@@ -220,8 +351,14 @@ func (s *storage) TxAddLogEntry(tx *transaction, entry *LogEntry) error {
 	if err != nil {
 		return err
 	}
+	if v, err = s.seal(logsBucket, k, v); err != nil {
+		return err
+	}
+	if err = b.Put(k, v); err != nil {
+		return err
+	}
 
-	return b.Put(k, v)
+	return s.txIndexLogEntry(tx, s.logIndexer(), entry)
 }
 
 func (s *storage) logEntryKeyToBytes(id uint64) []byte {
@@ -240,6 +377,18 @@ func (s *storage) TxStorePreferences(tx *transaction, prefs Preferences) error {
 	return s.txStore(tx, userdataBucket, preferencesKey, prefs)
 }
 
+func (s *storage) StoreExpiryWarnings(warnings map[string]time.Duration) error {
+	return s.Transaction(func(tx *transaction) error {
+		return s.txStore(tx, userdataBucket, expiryKey, warnings)
+	})
+}
+
+func (s *storage) StoreTrustRecords(records map[string]*TrustRecord) error {
+	return s.Transaction(func(tx *transaction) error {
+		return s.txStore(tx, userdataBucket, trustKey, records)
+	})
+}
+
 func (s *storage) StoreUpdates(updates []update) (err error) {
 	return s.Transaction(func(tx *transaction) error {
 		return s.TxStoreUpdates(tx, updates)
@@ -273,7 +422,7 @@ func (s *storage) LoadSignature(attrs *irma.AttributeList) (*gabi.CLSignature, *
 	return sig.CLSignature, sig.Witness, nil
 }
 
-// LoadSecretKey retrieves and returns the secret key from bbolt storage, or if no secret key
+// LoadSecretKey retrieves and returns the secret key from storage, or if no secret key
 // was found in storage, it generates, saves, and returns a new secret key.
 func (s *storage) LoadSecretKey() (*secretKey, error) {
 	sk := &secretKey{}
@@ -296,14 +445,17 @@ func (s *storage) LoadSecretKey() (*secretKey, error) {
 
 func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
 	list = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
-	return list, s.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(attributesBucket))
-		if b == nil {
-			return nil
+	return list, s.db.View(func(tx kvTx) error {
+		b, err := tx.Bucket(attributesBucket)
+		if b == nil || err != nil {
+			return err
 		}
 		return b.ForEach(func(key, value []byte) error {
 			credTypeID := irma.NewCredentialTypeIdentifier(string(key))
 
+			if value, err = s.open(attributesBucket, key, value); err != nil {
+				return err
+			}
 			var attrlistlist []*irma.AttributeList
 			err = json.Unmarshal(value, &attrlistlist)
 			if err != nil {
@@ -330,7 +482,7 @@ func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]
 // Returns all logs stored before log with ID 'index' sorted from new to old with
 // a maximum result length of 'max'.
 func (s *storage) LoadLogsBefore(index uint64, max int) ([]*LogEntry, error) {
-	return s.loadLogs(max, func(c *bbolt.Cursor) (key, value []byte) {
+	return s.loadLogs(max, func(c kvCursor) (key, value []byte) {
 		c.Seek(s.logEntryKeyToBytes(index))
 		return c.Prev()
 	})
@@ -338,26 +490,33 @@ func (s *storage) LoadLogsBefore(index uint64, max int) ([]*LogEntry, error) {
 
 // Returns the latest logs stored sorted from new to old with a maximum result length of 'max'
 func (s *storage) LoadNewestLogs(max int) ([]*LogEntry, error) {
-	return s.loadLogs(max, func(c *bbolt.Cursor) (key, value []byte) {
+	return s.loadLogs(max, func(c kvCursor) (key, value []byte) {
 		return c.Last()
 	})
 }
 
 // Returns the logs stored sorted from new to old with a maximum result length of 'max' where the starting position
-// of the bbolt cursor can be manipulated by the anonymous function 'startAt'. 'startAt' should return
-// the key and the value of the first element from the bbolt database that should be loaded.
-func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []byte)) ([]*LogEntry, error) {
+// of the cursor can be manipulated by the anonymous function 'startAt'. 'startAt' should return
+// the key and the value of the first element from the database that should be loaded.
+func (s *storage) loadLogs(max int, startAt func(kvCursor) (key, value []byte)) ([]*LogEntry, error) {
 	logs := make([]*LogEntry, 0, max)
-	return logs, s.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(logsBucket))
-		if bucket == nil {
-			return nil
+	return logs, s.db.View(func(tx kvTx) error {
+		bucket, err := tx.Bucket(logsBucket)
+		if bucket == nil || err != nil {
+			return err
+		}
+		c, err := bucket.Cursor()
+		if err != nil {
+			return err
 		}
-		c := bucket.Cursor()
 
 		for k, v := startAt(c); k != nil && len(logs) < max; k, v = c.Prev() {
+			v, err := s.open(logsBucket, k, v)
+			if err != nil {
+				return err
+			}
 			var log LogEntry
-			if err := json.Unmarshal(v, &log); err != nil {
+			if err = json.Unmarshal(v, &log); err != nil {
 				return err
 			}
 
@@ -367,12 +526,30 @@ func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []by
 	})
 }
 
+func (s *storage) TxLoadUpdates(tx *transaction) (updates []update, err error) {
+	updates = []update{}
+	_, err = s.txLoad(tx, userdataBucket, updatesKey, &updates)
+	return
+}
+
 func (s *storage) LoadUpdates() (updates []update, err error) {
 	updates = []update{}
 	_, err = s.load(userdataBucket, updatesKey, &updates)
 	return
 }
 
+func (s *storage) LoadExpiryWarnings() (warnings map[string]time.Duration, err error) {
+	warnings = map[string]time.Duration{}
+	_, err = s.load(userdataBucket, expiryKey, &warnings)
+	return
+}
+
+func (s *storage) LoadTrustRecords() (records map[string]*TrustRecord, err error) {
+	records = map[string]*TrustRecord{}
+	_, err = s.load(userdataBucket, trustKey, &records)
+	return
+}
+
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	_, err := s.load(userdataBucket, preferencesKey, &config)
@@ -380,27 +557,29 @@ func (s *storage) LoadPreferences() (Preferences, error) {
 }
 
 func (s *storage) TxDeleteUserdata(tx *transaction) error {
-	return tx.DeleteBucket([]byte(userdataBucket))
+	return tx.DeleteBucket(userdataBucket)
 }
 
 func (s *storage) TxDeleteLogs(tx *transaction) error {
-	return tx.DeleteBucket([]byte(logsBucket))
+	for _, name := range []string{logIndexBucket, logEntryIndexBucket} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return tx.DeleteBucket(logsBucket)
 }
 
 func (s *storage) TxDeleteAll(tx *transaction) error {
-	if err := s.TxDeleteAllAttributes(tx); err != nil && err != bbolt.ErrBucketNotFound {
-		return err
-	}
-	if err := s.TxDeleteAllSignatures(tx); err != nil && err != bbolt.ErrBucketNotFound {
+	if err := s.TxDeleteAllAttributes(tx); err != nil {
 		return err
 	}
-	if err := s.TxDeleteUserdata(tx); err != nil && err != bbolt.ErrBucketNotFound {
+	if err := s.TxDeleteAllSignatures(tx); err != nil {
 		return err
 	}
-	if err := s.TxDeleteLogs(tx); err != nil && err != bbolt.ErrBucketNotFound {
+	if err := s.TxDeleteUserdata(tx); err != nil {
 		return err
 	}
-	return nil
+	return s.TxDeleteLogs(tx)
 }
 
 func (s *storage) DeleteAll() error {
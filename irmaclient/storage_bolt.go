@@ -0,0 +1,127 @@
+package irmaclient
+
+import (
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// This file contains the key/value store of the Storage in a bbolt database file, which is the
+// default Storage.
+
+// Filenames
+const databaseFile = "db"
+
+// boltStore is a kvStore in a bbolt database file.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+type boltBucket struct {
+	b *bbolt.Bucket
+}
+
+// OpenBoltStorage opens the Storage in the bbolt database at the specified path, creating it if it
+// does not exist. Setting it up in a properly protected location (e.g., with automatic
+// backups to iCloud/Google disabled) is the responsibility of the user.
+func OpenBoltStorage(path string) (Storage, error) {
+	store, err := openBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(store), nil
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(f func(tx kvTx) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return f(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Update(f func(tx kvTx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return f(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (tx boltTx) Bucket(name string) (kvBucket, error) {
+	b := tx.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, nil
+	}
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name string) (kvBucket, error) {
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) DeleteBucket(name string) error {
+	if err := tx.tx.DeleteBucket([]byte(name)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+func (tx boltTx) ForEachBucket(f func(name string, b kvBucket) error) error {
+	return tx.tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		return f(string(name), boltBucket{b})
+	})
+}
+
+func (b boltBucket) Get(key []byte) ([]byte, error) {
+	return b.b.Get(key), nil
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) ForEach(f func(key, value []byte) error) error {
+	return b.b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil // nested bucket
+		}
+		return f(k, v)
+	})
+}
+
+func (b boltBucket) Cursor() (kvCursor, error) {
+	return b.b.Cursor(), nil
+}
+
+func (b boltBucket) Sequence() (uint64, error) {
+	return b.b.Sequence(), nil
+}
+
+func (b boltBucket) SetSequence(seq uint64) error {
+	return b.b.SetSequence(seq)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
@@ -0,0 +1,250 @@
+package irmaclient
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the key/value store of a Storage that keeps all data in memory, for tests and
+// for applications that persist nothing.
+
+var (
+	ErrStorageClosed     = errors.New("storage is closed")
+	ErrStorageTxReadOnly = errors.New("storage transaction is read-only")
+)
+
+// memoryStore is a kvStore that keeps its contents in memory. Update transactions operate on a
+// copy of the contents, which replaces the contents when the transaction is committed.
+type memoryStore struct {
+	mutex   sync.RWMutex
+	buckets map[string]*memoryBucket
+	closed  bool
+}
+
+type memoryTx struct {
+	buckets  map[string]*memoryBucket
+	writable bool
+}
+
+type memoryBucket struct {
+	keys     [][]byte // sorted
+	values   map[string][]byte
+	sequence uint64
+	writable bool
+}
+
+type memoryCursor struct {
+	b   *memoryBucket
+	pos int
+}
+
+// NewMemoryStorage returns a new, empty Storage that keeps its contents in memory.
+func NewMemoryStorage() Storage {
+	return newStorage(newMemoryStore())
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryStore) View(f func(tx kvTx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return f(&memoryTx{buckets: s.buckets})
+}
+
+func (s *memoryStore) Update(f func(tx kvTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	buckets := make(map[string]*memoryBucket, len(s.buckets))
+	for name, b := range s.buckets {
+		buckets[name] = b.copy()
+	}
+	tx := &memoryTx{buckets: buckets, writable: true}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, b := range tx.buckets {
+		b.writable = false
+	}
+	s.buckets = tx.buckets
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (tx *memoryTx) Bucket(name string) (kvBucket, error) {
+	if b := tx.buckets[name]; b != nil {
+		return b, nil
+	}
+	return nil, nil
+}
+
+func (tx *memoryTx) CreateBucketIfNotExists(name string) (kvBucket, error) {
+	if b := tx.buckets[name]; b != nil {
+		return b, nil
+	}
+	if !tx.writable {
+		return nil, ErrStorageTxReadOnly
+	}
+	b := &memoryBucket{values: map[string][]byte{}, writable: true}
+	tx.buckets[name] = b
+	return b, nil
+}
+
+func (tx *memoryTx) DeleteBucket(name string) error {
+	if !tx.writable {
+		return ErrStorageTxReadOnly
+	}
+	delete(tx.buckets, name)
+	return nil
+}
+
+func (tx *memoryTx) ForEachBucket(f func(name string, b kvBucket) error) error {
+	names := make([]string, 0, len(tx.buckets))
+	for name := range tx.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f(name, tx.buckets[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) copy() *memoryBucket {
+	c := &memoryBucket{
+		keys:     append([][]byte{}, b.keys...),
+		values:   make(map[string][]byte, len(b.values)),
+		sequence: b.sequence,
+		writable: true,
+	}
+	for k, v := range b.values {
+		c.values[k] = v
+	}
+	return c
+}
+
+// search returns the index of the first key that is equal to or greater than the specified key.
+func (b *memoryBucket) search(key []byte) int {
+	return sort.Search(len(b.keys), func(i int) bool { return bytes.Compare(b.keys[i], key) >= 0 })
+}
+
+func (b *memoryBucket) Get(key []byte) ([]byte, error) {
+	return b.values[string(key)], nil
+}
+
+func (b *memoryBucket) Put(key, value []byte) error {
+	if !b.writable {
+		return ErrStorageTxReadOnly
+	}
+	if value == nil {
+		return errors.New("value must not be nil")
+	}
+	if _, exists := b.values[string(key)]; !exists {
+		i := b.search(key)
+		b.keys = append(b.keys, nil)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = append([]byte{}, key...)
+	}
+	b.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.writable {
+		return ErrStorageTxReadOnly
+	}
+	if _, exists := b.values[string(key)]; !exists {
+		return nil
+	}
+	delete(b.values, string(key))
+	i := b.search(key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	return nil
+}
+
+func (b *memoryBucket) ForEach(f func(key, value []byte) error) error {
+	for _, k := range b.keys {
+		if err := f(k, b.values[string(k)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Cursor() (kvCursor, error) {
+	return &memoryCursor{b: b}, nil
+}
+
+func (b *memoryBucket) Sequence() (uint64, error) {
+	return b.sequence, nil
+}
+
+func (b *memoryBucket) SetSequence(seq uint64) error {
+	if !b.writable {
+		return ErrStorageTxReadOnly
+	}
+	b.sequence = seq
+	return nil
+}
+
+func (b *memoryBucket) NextSequence() (uint64, error) {
+	if !b.writable {
+		return 0, ErrStorageTxReadOnly
+	}
+	b.sequence++
+	return b.sequence, nil
+}
+
+func (c *memoryCursor) at(pos int) ([]byte, []byte) {
+	c.pos = pos
+	if pos < 0 || pos >= len(c.b.keys) {
+		return nil, nil
+	}
+	k := c.b.keys[pos]
+	return k, c.b.values[string(k)]
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memoryCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.b.keys) - 1)
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(c.b.search(seek))
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if c.pos >= len(c.b.keys) {
+		return nil, nil
+	}
+	return c.at(c.pos + 1)
+}
+
+func (c *memoryCursor) Prev() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+	return c.at(c.pos - 1)
+}
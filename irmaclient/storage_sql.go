@@ -0,0 +1,453 @@
+package irmaclient
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strconv"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the key/value store of a Storage in an SQL database, in which the data of multiple clients
+// (wallets) can be stored, each identified by a wallet ID. This allows e.g. custodial wallets on
+// a server to share a single database.
+
+// SQLDialect is an SQL database type supported by NewSQLStorage.
+type SQLDialect string
+
+const (
+	SQLDialectPostgres SQLDialect = "postgres"
+	SQLDialectMySQL    SQLDialect = "mysql"
+)
+
+var ErrUnknownSQLDialect = errors.New("unknown SQL dialect")
+
+// sqlStore is a kvStore in the tables irma_wallet_buckets and irma_wallet_values of an SQL
+// database, containing the data of the wallet with the wallet ID of the sqlStore.
+type sqlStore struct {
+	db       *sql.DB
+	dialect  SQLDialect
+	walletID string
+}
+
+type sqlTx struct {
+	s   *sqlStore
+	tx  *sql.Tx
+	err error // error of a query of a cursor, which is returned when the transaction ends
+}
+
+type sqlBucket struct {
+	tx   *sqlTx
+	name string
+}
+
+// sqlCursorPageSize is the number of key/value pairs that a sqlCursor loads at once.
+const sqlCursorPageSize = 100
+
+// sqlCursor iterates over the key/value pairs of a bucket. It loads a page of consecutive pairs at
+// a time, selected by their keys relative to those of the current page, so that the bucket can be
+// modified while iterating. As kvCursor does not return errors, a failing query ends the
+// iteration, and its error is returned when the transaction ends.
+type sqlCursor struct {
+	b            *sqlBucket
+	keys, values [][]byte // the current page, in order of the keys
+	pos          int      // -1 or len(keys) if before or after the current page
+}
+
+var sqlStorageTables = map[SQLDialect][]string{
+	SQLDialectPostgres: {
+		`CREATE TABLE IF NOT EXISTS irma_wallet_buckets (
+			wallet_id varchar(255) NOT NULL,
+			bucket varchar(64) NOT NULL,
+			sequence bigint NOT NULL DEFAULT 0,
+			PRIMARY KEY (wallet_id, bucket)
+		)`,
+		`CREATE TABLE IF NOT EXISTS irma_wallet_values (
+			wallet_id varchar(255) NOT NULL,
+			bucket varchar(64) NOT NULL,
+			k bytea NOT NULL,
+			v bytea NOT NULL,
+			PRIMARY KEY (wallet_id, bucket, k)
+		)`,
+	},
+	SQLDialectMySQL: {
+		`CREATE TABLE IF NOT EXISTS irma_wallet_buckets (
+			wallet_id varchar(255) NOT NULL,
+			bucket varchar(64) NOT NULL,
+			sequence bigint unsigned NOT NULL DEFAULT 0,
+			PRIMARY KEY (wallet_id, bucket)
+		)`,
+		`CREATE TABLE IF NOT EXISTS irma_wallet_values (
+			wallet_id varchar(255) NOT NULL,
+			bucket varchar(64) NOT NULL,
+			k varbinary(255) NOT NULL,
+			v longblob NOT NULL,
+			PRIMARY KEY (wallet_id, bucket, k)
+		)`,
+	},
+}
+
+// NewSQLStorage returns the Storage of the wallet with the specified ID in the database,
+// creating its tables if they do not exist. The caller must have imported the
+// database/sql driver of the database. Closing the Storage does not close the database.
+func NewSQLStorage(db *sql.DB, dialect SQLDialect, walletID string) (Storage, error) {
+	store, err := newSQLStore(db, dialect, walletID)
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(store), nil
+}
+
+func newSQLStore(db *sql.DB, dialect SQLDialect, walletID string) (*sqlStore, error) {
+	if walletID == "" {
+		return nil, errors.New("wallet ID must not be empty")
+	}
+	if err := createSQLStorageTables(db, dialect); err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: dialect, walletID: walletID}, nil
+}
+
+func createSQLStorageTables(db *sql.DB, dialect SQLDialect) error {
+	tables, ok := sqlStorageTables[dialect]
+	if !ok {
+		return ErrUnknownSQLDialect
+	}
+	for _, table := range tables {
+		if _, err := db.Exec(table); err != nil {
+			return errors.WrapPrefix(err, "failed to create storage tables", 0)
+		}
+	}
+	return nil
+}
+
+// SQLWallets returns the IDs of the wallets in the database.
+func SQLWallets(db *sql.DB, dialect SQLDialect) ([]string, error) {
+	if err := createSQLStorageTables(db, dialect); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT DISTINCT wallet_id FROM irma_wallet_buckets ORDER BY wallet_id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteSQLWallet deletes all data of the wallet with the specified ID from the database.
+func DeleteSQLWallet(db *sql.DB, dialect SQLDialect, walletID string) error {
+	s := &sqlStore{db: db, dialect: dialect, walletID: walletID}
+	return s.Update(func(tx kvTx) error {
+		t := tx.(*sqlTx)
+		if _, err := t.exec("DELETE FROM irma_wallet_values WHERE wallet_id = $1", walletID); err != nil {
+			return err
+		}
+		_, err := t.exec("DELETE FROM irma_wallet_buckets WHERE wallet_id = $1", walletID)
+		return err
+	})
+}
+
+func (s *sqlStore) View(f func(tx kvTx) error) error {
+	return s.transaction(true, f)
+}
+
+func (s *sqlStore) Update(f func(tx kvTx) error) error {
+	return s.transaction(false, f)
+}
+
+func (s *sqlStore) transaction(readOnly bool, f func(tx kvTx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return err
+	}
+	t := &sqlTx{s: s, tx: tx}
+	if err = f(t); err == nil {
+		err = t.err
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	return nil
+}
+
+var sqlPlaceholderRegexp = regexp.MustCompile(`\$\d+`)
+
+// query converts the $1, $2, ... placeholders of the specified query to ? for MySQL.
+// The placeholders must occur in order, each at most once.
+func (tx *sqlTx) query(query string) string {
+	if tx.s.dialect != SQLDialectMySQL {
+		return query
+	}
+	return sqlPlaceholderRegexp.ReplaceAllString(query, "?")
+}
+
+func (tx *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.query(query), args...)
+}
+
+func (tx *sqlTx) Bucket(name string) (kvBucket, error) {
+	var exists int
+	err := tx.tx.QueryRow(
+		tx.query("SELECT 1 FROM irma_wallet_buckets WHERE wallet_id = $1 AND bucket = $2"),
+		tx.s.walletID, name,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBucket{tx: tx, name: name}, nil
+}
+
+func (tx *sqlTx) CreateBucketIfNotExists(name string) (kvBucket, error) {
+	b, err := tx.Bucket(name)
+	if b != nil || err != nil {
+		return b, err
+	}
+	_, err = tx.exec(
+		"INSERT INTO irma_wallet_buckets (wallet_id, bucket, sequence) VALUES ($1, $2, 0)",
+		tx.s.walletID, name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBucket{tx: tx, name: name}, nil
+}
+
+func (tx *sqlTx) DeleteBucket(name string) error {
+	_, err := tx.exec("DELETE FROM irma_wallet_values WHERE wallet_id = $1 AND bucket = $2", tx.s.walletID, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.exec("DELETE FROM irma_wallet_buckets WHERE wallet_id = $1 AND bucket = $2", tx.s.walletID, name)
+	return err
+}
+
+func (tx *sqlTx) ForEachBucket(f func(name string, b kvBucket) error) error {
+	rows, err := tx.tx.Query(
+		tx.query("SELECT bucket FROM irma_wallet_buckets WHERE wallet_id = $1 ORDER BY bucket"),
+		tx.s.walletID,
+	)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err = f(name, &sqlBucket{tx: tx, name: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqlBucket) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.tx.tx.QueryRow(
+		b.tx.query("SELECT v FROM irma_wallet_values WHERE wallet_id = $1 AND bucket = $2 AND k = $3"),
+		b.tx.s.walletID, b.name, key,
+	).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (b *sqlBucket) Put(key, value []byte) error {
+	if value == nil {
+		return errors.New("value must not be nil")
+	}
+	query := "INSERT INTO irma_wallet_values (wallet_id, bucket, k, v) VALUES ($1, $2, $3, $4) "
+	if b.tx.s.dialect == SQLDialectMySQL {
+		query += "ON DUPLICATE KEY UPDATE v = VALUES(v)"
+	} else {
+		query += "ON CONFLICT (wallet_id, bucket, k) DO UPDATE SET v = EXCLUDED.v"
+	}
+	_, err := b.tx.exec(query, b.tx.s.walletID, b.name, key, value)
+	return err
+}
+
+func (b *sqlBucket) Delete(key []byte) error {
+	_, err := b.tx.exec(
+		"DELETE FROM irma_wallet_values WHERE wallet_id = $1 AND bucket = $2 AND k = $3",
+		b.tx.s.walletID, b.name, key,
+	)
+	return err
+}
+
+func (b *sqlBucket) ForEach(f func(key, value []byte) error) error {
+	c := &sqlCursor{b: b}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := f(k, v); err != nil {
+			return err
+		}
+	}
+	return b.tx.err
+}
+
+func (b *sqlBucket) Cursor() (kvCursor, error) {
+	return &sqlCursor{b: b}, nil
+}
+
+// page returns the page of at most sqlCursorPageSize key/value pairs of the bucket, in order of
+// the keys, that satisfy the condition on the key k (if any) and that come first in the order
+// of the keys, or last if desc is true.
+func (b *sqlBucket) page(condition string, key []byte, desc bool) (keys, values [][]byte, err error) {
+	query := "SELECT k, v FROM irma_wallet_values WHERE wallet_id = $1 AND bucket = $2"
+	args := []interface{}{b.tx.s.walletID, b.name}
+	if condition != "" {
+		query += " AND k " + condition + " $3"
+		args = append(args, key)
+	}
+	query += " ORDER BY k"
+	if desc {
+		query += " DESC"
+	}
+	query += " LIMIT " + strconv.Itoa(sqlCursorPageSize)
+
+	rows, err := b.tx.tx.Query(b.tx.query(query), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var k, v []byte
+		if err = rows.Scan(&k, &v); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	if desc {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	return keys, values, rows.Err()
+}
+
+func (b *sqlBucket) Sequence() (uint64, error) {
+	var seq uint64
+	err := b.tx.tx.QueryRow(
+		b.tx.query("SELECT sequence FROM irma_wallet_buckets WHERE wallet_id = $1 AND bucket = $2"),
+		b.tx.s.walletID, b.name,
+	).Scan(&seq)
+	return seq, err
+}
+
+func (b *sqlBucket) SetSequence(seq uint64) error {
+	_, err := b.tx.exec(
+		"UPDATE irma_wallet_buckets SET sequence = $1 WHERE wallet_id = $2 AND bucket = $3",
+		seq, b.tx.s.walletID, b.name,
+	)
+	return err
+}
+
+func (b *sqlBucket) NextSequence() (uint64, error) {
+	_, err := b.tx.exec(
+		"UPDATE irma_wallet_buckets SET sequence = sequence + 1 WHERE wallet_id = $1 AND bucket = $2",
+		b.tx.s.walletID, b.name,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return b.Sequence()
+}
+
+func (c *sqlCursor) at(pos int) ([]byte, []byte) {
+	c.pos = pos
+	if pos < 0 || pos >= len(c.keys) {
+		return nil, nil
+	}
+	return c.keys[pos], c.values[pos]
+}
+
+// load replaces the current page by the specified page, unless the query fails or if the page is
+// empty while keep is true, in which case the current page is kept. It returns whether the page
+// was replaced.
+func (c *sqlCursor) load(condition string, key []byte, desc, keep bool) bool {
+	keys, values, err := c.b.page(condition, key, desc)
+	if err != nil {
+		if c.b.tx.err == nil {
+			c.b.tx.err = err
+		}
+		c.keys, c.values = nil, nil
+		return false
+	}
+	if len(keys) == 0 && keep {
+		return false
+	}
+	c.keys, c.values = keys, values
+	return true
+}
+
+func (c *sqlCursor) First() ([]byte, []byte) {
+	c.load("", nil, false, false)
+	return c.at(0)
+}
+
+func (c *sqlCursor) Last() ([]byte, []byte) {
+	c.load("", nil, true, false)
+	return c.at(len(c.keys) - 1)
+}
+
+func (c *sqlCursor) Seek(seek []byte) ([]byte, []byte) {
+	c.load(">=", seek, false, false)
+	return c.at(0)
+}
+
+func (c *sqlCursor) Next() ([]byte, []byte) {
+	if c.pos >= len(c.keys) {
+		return nil, nil
+	}
+	if c.pos == len(c.keys)-1 {
+		if !c.load(">", c.keys[c.pos], false, true) {
+			return c.at(len(c.keys))
+		}
+		return c.at(0)
+	}
+	return c.at(c.pos + 1)
+}
+
+func (c *sqlCursor) Prev() ([]byte, []byte) {
+	if c.pos < 0 || len(c.keys) == 0 {
+		return c.at(-1)
+	}
+	if c.pos == 0 {
+		if !c.load("<", c.keys[0], true, true) {
+			return c.at(-1)
+		}
+		return c.at(len(c.keys) - 1)
+	}
+	return c.at(c.pos - 1)
+}
@@ -0,0 +1,53 @@
+//+build !local_tests
+
+package irmaclient
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/stdlib"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStorage(t *testing.T) {
+	t.Run("postgres", func(t *testing.T) {
+		testSQLStorage(t, "pgx", test.PostgresTestUrl, SQLDialectPostgres)
+	})
+	t.Run("mysql", func(t *testing.T) {
+		testSQLStorage(t, "mysql", test.MySQLTestUrl, SQLDialectMySQL)
+	})
+}
+
+func testSQLStorage(t *testing.T, driver, url string, dialect SQLDialect) {
+	db, err := sql.Open(driver, url)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	backend, err := newSQLStore(db, dialect, "wallet1")
+	require.NoError(t, err)
+	for _, wallet := range []string{"wallet1", "wallet2"} {
+		require.NoError(t, DeleteSQLWallet(db, dialect, wallet))
+		defer func(wallet string) { require.NoError(t, DeleteSQLWallet(db, dialect, wallet)) }(wallet)
+	}
+	testStorageBackend(t, backend)
+
+	// The wallets in the database are separated from each other
+	backend, err = newSQLStore(db, dialect, "wallet1")
+	require.NoError(t, err)
+	require.NoError(t, backend.Update(func(tx kvTx) error {
+		b, err := tx.CreateBucketIfNotExists("test")
+		require.NoError(t, err)
+		return b.Put([]byte("key"), []byte("value"))
+	}))
+	other, err := newSQLStore(db, dialect, "wallet2")
+	require.NoError(t, err)
+	require.NoError(t, other.View(func(tx kvTx) error {
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		require.Nil(t, b)
+		return nil
+	}))
+}
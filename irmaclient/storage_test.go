@@ -0,0 +1,278 @@
+package irmaclient
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorageBackend(t, newMemoryStore())
+}
+
+func TestBoltStorage(t *testing.T) {
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+
+	backend, err := openBoltStore(filepath.Join(storage, databaseFile))
+	require.NoError(t, err)
+	testStorageBackend(t, backend)
+}
+
+func TestClientMemoryStorage(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	credentials := client.CredentialInfoList()
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+
+	// Copy the contents of the bbolt database to a memoryStore, and open a client on it
+	backend := newMemoryStore()
+	require.NoError(t, copyStorage(kvStoreOf(client), backend))
+	require.NoError(t, client.Close())
+
+	client, err = NewWithStorage(
+		newStorage(backend),
+		filepath.Join(handler.storage, "client"),
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		handler,
+		nil,
+	)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+	memoryLogs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Equal(t, logs, memoryLogs)
+
+	// Encryption works on top of any backend
+	require.NoError(t, client.RotateStorageKey(make([]byte, StorageKeySize)))
+	require.True(t, client.storage.Encrypted())
+	require.ElementsMatch(t, credentials, client.CredentialInfoList())
+
+	require.NoError(t, client.Close())
+	_, err = client.storage.LoadSecretKey()
+	require.Equal(t, ErrStorageClosed, err)
+}
+
+// Errors of the backend are not mistaken for absent values, which for the secret key would
+// result in it being overwritten by a new one.
+func TestStorageLoadError(t *testing.T) {
+	backend := newMemoryStore()
+	s := newStorage(backend)
+	sk, err := s.LoadSecretKey()
+	require.NoError(t, err)
+
+	s.db = &failingGetStorage{backend}
+	_, err = s.LoadSecretKey()
+	require.Equal(t, errFailingGet, err)
+
+	s.db = backend
+	loaded, err := s.LoadSecretKey()
+	require.NoError(t, err)
+	require.Equal(t, sk.Key, loaded.Key)
+}
+
+var errFailingGet = errors.New("get failed")
+
+// failingGetStorage is a kvStore whose buckets fail to get values.
+type failingGetStorage struct{ kvStore }
+type failingGetTx struct{ kvTx }
+type failingGetBucket struct{ kvBucket }
+
+func (s *failingGetStorage) View(f func(tx kvTx) error) error {
+	return s.kvStore.View(func(tx kvTx) error { return f(failingGetTx{tx}) })
+}
+
+func (tx failingGetTx) Bucket(name string) (kvBucket, error) {
+	b, err := tx.kvTx.Bucket(name)
+	if b == nil || err != nil {
+		return b, err
+	}
+	return failingGetBucket{b}, nil
+}
+
+func (failingGetBucket) Get([]byte) ([]byte, error) {
+	return nil, errFailingGet
+}
+
+func copyStorage(from, to kvStore) error {
+	return from.View(func(fromTx kvTx) error {
+		return to.Update(func(toTx kvTx) error {
+			return fromTx.ForEachBucket(func(name string, b kvBucket) error {
+				c, err := toTx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				seq, err := b.Sequence()
+				if err != nil {
+					return err
+				}
+				if err = c.SetSequence(seq); err != nil {
+					return err
+				}
+				return b.ForEach(c.Put)
+			})
+		})
+	})
+}
+
+// testStorageBackend checks that the key/value store behaves as the storage of the client expects.
+func testStorageBackend(t *testing.T, backend kvStore) {
+	defer func() { require.NoError(t, backend.Close()) }()
+
+	// Buckets do not exist until they are created
+	require.NoError(t, backend.View(func(tx kvTx) error {
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		require.Nil(t, b)
+		return nil
+	}))
+
+	require.NoError(t, backend.Update(func(tx kvTx) error {
+		b, err := tx.CreateBucketIfNotExists("test")
+		require.NoError(t, err)
+		for _, k := range []string{"b", "d", "a", "c"} {
+			require.NoError(t, b.Put([]byte(k), []byte("value "+k)))
+		}
+		require.NoError(t, b.Put([]byte("a"), []byte("new value a")))
+		require.NoError(t, b.Delete([]byte("c")))
+		require.NoError(t, b.Delete([]byte("nonexisting")))
+
+		seq, err := b.NextSequence()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), seq)
+		require.NoError(t, b.SetSequence(41))
+		seq, err = b.NextSequence()
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), seq)
+
+		_, err = tx.CreateBucketIfNotExists("other")
+		require.NoError(t, err)
+		return nil
+	}))
+
+	require.NoError(t, backend.View(func(tx kvTx) error {
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		require.NotNil(t, b)
+
+		v, err := b.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new value a"), v)
+		v, err = b.Get([]byte("c"))
+		require.NoError(t, err)
+		require.Nil(t, v)
+		seq, err := b.Sequence()
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), seq)
+
+		// Keys are iterated over in bytewise order
+		var keys []string
+		require.NoError(t, b.ForEach(func(k, v []byte) error {
+			require.True(t, strings.HasSuffix(string(v), "value "+string(k)))
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"a", "b", "d"}, keys)
+
+		c, err := b.Cursor()
+		require.NoError(t, err)
+		k, _ := c.First()
+		require.Equal(t, "a", string(k))
+		k, _ = c.Next()
+		require.Equal(t, "b", string(k))
+		k, _ = c.Seek([]byte("c"))
+		require.Equal(t, "d", string(k))
+		k, _ = c.Next()
+		require.Nil(t, k)
+		k, _ = c.Last()
+		require.Equal(t, "d", string(k))
+		k, _ = c.Prev()
+		require.Equal(t, "b", string(k))
+		k, _ = c.Seek([]byte("e"))
+		require.Nil(t, k)
+
+		var buckets []string
+		require.NoError(t, tx.ForEachBucket(func(name string, _ kvBucket) error {
+			buckets = append(buckets, name)
+			return nil
+		}))
+		require.Equal(t, []string{"other", "test"}, buckets)
+		return nil
+	}))
+
+	// Failing transactions are rolled back
+	require.Error(t, backend.Update(func(tx kvTx) error {
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("a"), []byte("rolled back")))
+		require.NoError(t, tx.DeleteBucket("other"))
+		return fmt.Errorf("rollback")
+	}))
+	require.NoError(t, backend.View(func(tx kvTx) error {
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		v, err := b.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new value a"), v)
+		b, err = tx.Bucket("other")
+		require.NoError(t, err)
+		require.NotNil(t, b)
+		return nil
+	}))
+
+	// Iterating over many keys, in both directions
+	const count = 250
+	require.NoError(t, backend.Update(func(tx kvTx) error {
+		b, err := tx.CreateBucketIfNotExists("many")
+		require.NoError(t, err)
+		for i := 0; i < count; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%03d", i)), []byte("value")))
+		}
+
+		c, err := b.Cursor()
+		require.NoError(t, err)
+		i := 0
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			require.Equal(t, fmt.Sprintf("%03d", i), string(k))
+			i++
+		}
+		require.Equal(t, count, i)
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			i--
+			require.Equal(t, fmt.Sprintf("%03d", i), string(k))
+		}
+		require.Equal(t, 0, i)
+
+		require.NoError(t, b.ForEach(func(k, _ []byte) error {
+			require.Equal(t, fmt.Sprintf("%03d", i), string(k))
+			i++
+			return nil
+		}))
+		require.Equal(t, count, i)
+		return tx.DeleteBucket("many")
+	}))
+
+	// Deleting buckets, also nonexisting ones
+	require.NoError(t, backend.Update(func(tx kvTx) error {
+		require.NoError(t, tx.DeleteBucket("test"))
+		require.NoError(t, tx.DeleteBucket("nonexisting"))
+		b, err := tx.Bucket("test")
+		require.NoError(t, err)
+		require.Nil(t, b)
+		return nil
+	}))
+}
+
+// kvStoreOf returns the key/value store underlying the storage of the client.
+func kvStoreOf(client *Client) kvStore {
+	return client.storage.(*storage).db
+}
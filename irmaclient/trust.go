@@ -0,0 +1,303 @@
+package irmaclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the trust records that the user keeps per requestor, with which requestors
+// can be blocked, and with which the attributes the user chose to disclose to a requestor are
+// remembered, so that identical requests of the requestor are performed without asking again.
+
+// TrustDecision is the decision of the user on how sessions of a requestor are handled.
+type TrustDecision string
+
+const (
+	// TrustAlwaysAsk asks the user for permission in each session, as if no trust record exists.
+	TrustAlwaysAsk = TrustDecision("always-ask")
+	// TrustRemember asks the user for permission once per request: the attributes chosen by the
+	// user are remembered and disclosed again in later sessions with an identical request,
+	// as long as the user still has them. Only allowed for requestors in a requestor scheme.
+	TrustRemember = TrustDecision("remember")
+	// TrustBlock refuses all sessions of the requestor.
+	TrustBlock = TrustDecision("block")
+)
+
+// ErrUnidentifiedRequestor is returned when a trust record is set for a requestor that is neither
+// in a requestor scheme nor has a hostname.
+var ErrUnidentifiedRequestor = errors.New("requestor has no identifier or hostname")
+
+// ErrRememberUnverified is returned when TrustRemember is set for an unverified requestor. Such
+// requestors are identified only by a hostname that they control themselves, e.g. by putting
+// it in a session request, so remembered choices could be used by anyone.
+var ErrRememberUnverified = errors.New("cannot remember choices for unverified requestor")
+
+// TrustRecord contains the trust decision of the user for a requestor. Requestors in a requestor
+// scheme are identified by their identifier in the scheme. Unverified requestors, which are not in
+// a requestor scheme, are identified only by the hostname of the IRMA server that they use.
+type TrustRecord struct {
+	Key        string                         // "requestor:<identifier>" or "hostname:<hostname>"
+	Unverified bool                           // whether the requestor is not in a requestor scheme
+	ID         irma.RequestorIdentifier       `json:",omitempty"`
+	Scheme     irma.RequestorSchemeIdentifier `json:",omitempty"`
+	Hostname   string                         `json:",omitempty"`
+	Name       irma.TranslatedString
+	Decision   TrustDecision
+	Updated    irma.Timestamp
+
+	// Choices remembered with TrustRemember, keyed on the fingerprint of the request
+	Choices map[string]*RememberedChoice `json:",omitempty"`
+}
+
+// RememberedChoice is the choice of the user of attributes to disclose for a session request.
+type RememberedChoice struct {
+	Action irma.Action
+	Choice *irma.DisclosureChoice
+	Time   irma.Timestamp
+}
+
+// trustRecordKey returns the key of the trust record of the requestor, and whether the requestor
+// is unverified, or an empty key if the requestor cannot be identified.
+func trustRecordKey(requestor *irma.RequestorInfo) (key string, unverified bool) {
+	if requestor == nil {
+		return "", true
+	}
+	if !requestor.Unverified && !requestor.ID.Empty() {
+		return "requestor:" + requestor.ID.String(), false
+	}
+	if len(requestor.Hostnames) > 0 {
+		return "hostname:" + strings.ToLower(requestor.Hostnames[0]), true
+	}
+	return "", true
+}
+
+// TrustRecords returns the trust records of all requestors, sorted by key.
+func (client *Client) TrustRecords() []*TrustRecord {
+	client.trustMutex.Lock()
+	defer client.trustMutex.Unlock()
+
+	records := make([]*TrustRecord, 0, len(client.trustRecords))
+	for _, record := range client.trustRecords {
+		records = append(records, record.copy())
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+// TrustRecord returns the trust record of the requestor, or nil if there is none.
+func (client *Client) TrustRecord(requestor *irma.RequestorInfo) *TrustRecord {
+	client.trustMutex.Lock()
+	defer client.trustMutex.Unlock()
+
+	key, _ := trustRecordKey(requestor)
+	if record := client.trustRecords[key]; record != nil {
+		return record.copy()
+	}
+	return nil
+}
+
+func (record *TrustRecord) copy() *TrustRecord {
+	c := *record
+	if record.Choices != nil {
+		c.Choices = make(map[string]*RememberedChoice, len(record.Choices))
+		for fingerprint, choice := range record.Choices {
+			c.Choices[fingerprint] = choice
+		}
+	}
+	return &c
+}
+
+// SetRequestorTrust sets the trust decision of the user for the requestor. Choices remembered
+// earlier are forgotten if the decision is not TrustRemember.
+func (client *Client) SetRequestorTrust(requestor *irma.RequestorInfo, decision TrustDecision) error {
+	switch decision {
+	case TrustAlwaysAsk, TrustRemember, TrustBlock:
+	default:
+		return errors.Errorf("unknown trust decision %s", decision)
+	}
+	key, unverified := trustRecordKey(requestor)
+	if key == "" {
+		return ErrUnidentifiedRequestor
+	}
+	if unverified && decision == TrustRemember {
+		return ErrRememberUnverified
+	}
+
+	client.trustMutex.Lock()
+	defer client.trustMutex.Unlock()
+
+	record := client.trustRecords[key]
+	if record == nil {
+		record = &TrustRecord{Key: key, Unverified: unverified}
+		if unverified {
+			record.Hostname = strings.ToLower(requestor.Hostnames[0])
+		} else {
+			record.ID = requestor.ID
+			record.Scheme = requestor.ID.RequestorSchemeIdentifier()
+		}
+		client.trustRecords[key] = record
+	}
+	record.Name = requestor.Name
+	record.Decision = decision
+	record.Updated = irma.Timestamp(time.Now())
+	if decision != TrustRemember {
+		record.Choices = nil
+	}
+	return client.storage.StoreTrustRecords(client.trustRecords)
+}
+
+// RemoveTrustRecord removes the trust record with the specified key, including its remembered
+// choices, so that the user is asked for permission again in the sessions of the requestor.
+func (client *Client) RemoveTrustRecord(key string) error {
+	client.trustMutex.Lock()
+	defer client.trustMutex.Unlock()
+
+	if _, ok := client.trustRecords[key]; !ok {
+		return errors.Errorf("no trust record with key %s", key)
+	}
+	delete(client.trustRecords, key)
+	return client.storage.StoreTrustRecords(client.trustRecords)
+}
+
+// trustedPermission consults the trust record of the requestor of the session. It returns whether
+// the session is blocked, and the remembered choice for the session request, if any, provided
+// that it is one of the current candidates.
+func (client *Client) trustedPermission(
+	requestor *irma.RequestorInfo,
+	request irma.SessionRequest,
+	candidates [][]DisclosureCandidates,
+) (blocked bool, choice *irma.DisclosureChoice) {
+	record := client.TrustRecord(requestor)
+	if record == nil {
+		return false, nil
+	}
+	switch record.Decision {
+	case TrustBlock:
+		return true, nil
+	case TrustRemember:
+		if record.Unverified {
+			return false, nil
+		}
+		fingerprint, err := requestFingerprint(request)
+		if err != nil {
+			return false, nil
+		}
+		remembered := record.Choices[fingerprint]
+		if remembered == nil || !choiceIsCandidate(remembered.Choice, candidates) {
+			return false, nil
+		}
+		return false, copyChoice(remembered.Choice)
+	default:
+		return false, nil
+	}
+}
+
+// rememberChoice stores the choice of the user for the session request, if the decision of the
+// trust record of the requestor is TrustRemember.
+func (client *Client) rememberChoice(requestor *irma.RequestorInfo, request irma.SessionRequest, choice *irma.DisclosureChoice) error {
+	key, _ := trustRecordKey(requestor)
+	client.trustMutex.Lock()
+	defer client.trustMutex.Unlock()
+
+	record := client.trustRecords[key]
+	if record == nil || record.Unverified || record.Decision != TrustRemember {
+		return nil
+	}
+	fingerprint, err := requestFingerprint(request)
+	if err != nil {
+		return err
+	}
+	if record.Choices == nil {
+		record.Choices = map[string]*RememberedChoice{}
+	}
+	record.Choices[fingerprint] = &RememberedChoice{
+		Action: request.Action(),
+		Choice: copyChoice(choice),
+		Time:   irma.Timestamp(time.Now()),
+	}
+	return client.storage.StoreTrustRecords(client.trustRecords)
+}
+
+// requestFingerprint returns a hash over the contents of the session request that determine
+// whether two requests are identical, i.e., excluding the nonce, context and other fields that
+// differ per session.
+func requestFingerprint(request irma.SessionRequest) (string, error) {
+	type credential struct {
+		Type       irma.CredentialTypeIdentifier
+		Attributes map[string]string
+	}
+	contents := struct {
+		Action      irma.Action
+		Disclose    irma.AttributeConDisCon
+		Message     string       `json:",omitempty"`
+		Credentials []credential `json:",omitempty"`
+	}{
+		Action:   request.Action(),
+		Disclose: request.Disclosure().Disclose,
+	}
+	switch r := request.(type) {
+	case *irma.SignatureRequest:
+		contents.Message = r.Message
+	case *irma.IssuanceRequest:
+		for _, cred := range r.Credentials {
+			contents.Credentials = append(contents.Credentials, credential{cred.CredentialTypeID, cred.Attributes})
+		}
+	}
+	bts, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bts)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// choiceIsCandidate returns whether the choice chooses one of the disclosable options of each
+// disjunction of the candidates.
+func choiceIsCandidate(choice *irma.DisclosureChoice, candidates [][]DisclosureCandidates) bool {
+	if choice == nil || len(choice.Attributes) != len(candidates) {
+		return false
+	}
+	for i, discon := range candidates {
+		found := false
+		for _, con := range discon {
+			ids, err := con.Choose()
+			if err == nil && sameAttributeIdentifiers(ids, choice.Attributes[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func sameAttributeIdentifiers(a, b []*irma.AttributeIdentifier) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || a[i].CredentialHash != b[i].CredentialHash {
+			return false
+		}
+	}
+	return true
+}
+
+// copyChoice returns a copy of the choice, so that the remembered choices are not affected by
+// changes to the choice of a session (e.g. by adding the attributes of chained sessions).
+func copyChoice(choice *irma.DisclosureChoice) *irma.DisclosureChoice {
+	c := &irma.DisclosureChoice{Attributes: make([][]*irma.AttributeIdentifier, 0, len(choice.Attributes))}
+	for _, attrs := range choice.Attributes {
+		c.Attributes = append(c.Attributes, append([]*irma.AttributeIdentifier{}, attrs...))
+	}
+	return c
+}
@@ -146,6 +146,11 @@ var clientUpdates = []func(client *Client) error{
 		})
 	},
 
+	// 9: Index the existing log entries, so that they can be searched
+	func(client *Client) error {
+		return client.storage.RebuildLogIndex()
+	},
+
 	// TODO: Maybe delete preferences file to start afresh
 }
 
@@ -2,8 +2,11 @@ package irma
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -635,6 +638,130 @@ func TestConDisconSingletons(t *testing.T) {
 	}
 }
 
+func TestAttributePredicates(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	// Validation of bounds
+	require.NoError(t, (&AttributePredicate{GreaterOrEqual: str("18")}).Validate())
+	require.NoError(t, (&AttributePredicate{LessOrEqual: str("2008-10-18")}).Validate())
+	require.NoError(t, (&AttributePredicate{GreaterOrEqual: str("0"), LessOrEqual: str("9")}).Validate())
+	require.Error(t, (&AttributePredicate{}).Validate())
+	require.Error(t, (&AttributePredicate{GreaterOrEqual: str("018")}).Validate())
+	require.Error(t, (&AttributePredicate{GreaterOrEqual: str("-1")}).Validate())
+	require.Error(t, (&AttributePredicate{GreaterOrEqual: str("2008-13-01")}).Validate())
+	require.Error(t, (&AttributePredicate{GreaterOrEqual: str("18"), LessOrEqual: str("2008-10-18")}).Validate())
+	require.Error(t, (&AttributePredicate{GreaterOrEqual: str("100"), LessOrEqual: str("99")}).Validate())
+
+	// Values compare numerically or chronologically, and values of another kind never satisfy
+	range18to99 := &AttributePredicate{GreaterOrEqual: str("18"), LessOrEqual: str("99")}
+	require.True(t, range18to99.Satisfy(str("18")))
+	require.True(t, range18to99.Satisfy(str("99")))
+	require.False(t, range18to99.Satisfy(str("9")))
+	require.False(t, range18to99.Satisfy(str("100")))
+	require.False(t, range18to99.Satisfy(str("018")))
+	require.False(t, range18to99.Satisfy(nil))
+	before := &AttributePredicate{LessOrEqual: str("2008-10-18")}
+	require.True(t, before.Satisfy(str("1999-12-31")))
+	require.False(t, before.Satisfy(str("2008-10-19")))
+	require.False(t, before.Satisfy(str("20")))
+
+	// The encoding of attributes preserves the order of values of the same kind
+	for _, pair := range [][2]string{{"9", "10"}, {"99", "100"}, {"1999-12-31", "2000-01-01"}} {
+		require.Equal(t, -1, encodeAttribute(pair[0], 3).Cmp(encodeAttribute(pair[1], 3)))
+	}
+
+	// Upper bounds are accompanied by a statement excluding absent attributes
+	statements, err := before.RangeStatements(3)
+	require.NoError(t, err)
+	require.Len(t, statements, 2)
+	statements, err = range18to99.RangeStatements(3)
+	require.NoError(t, err)
+	require.Len(t, statements, 2)
+
+	// Predicates survive JSON (un)marshaling of attribute requests
+	request := AttributeRequest{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), Predicate: range18to99}
+	bts, err := json.Marshal(&request)
+	require.NoError(t, err)
+	var parsed AttributeRequest
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Equal(t, request, parsed)
+
+	// Predicates are not allowed together with values, or on random blind attributes
+	conf := parseConfiguration(t)
+	tests := []struct {
+		request AttributeRequest
+		allowed bool
+	}{
+		{request, true},
+		{AttributeRequest{Type: request.Type, Value: str("456"), Predicate: range18to99}, false},
+		{AttributeRequest{Type: NewAttributeTypeIdentifier("irma-demo.stemmen.stempas.votingnumber"), Predicate: range18to99}, false},
+		{AttributeRequest{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard"), Predicate: range18to99}, false},
+	}
+	for _, args := range tests {
+		err := AttributeConDisCon{AttributeDisCon{AttributeCon{args.request}}}.Validate(conf)
+		if args.allowed {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestAttributeHashes(t *testing.T) {
+	salt := []byte("salt")
+	val := "456"
+	expected := sha256.Sum256([]byte("456salt"))
+	hash := &AttributeHash{Salt: salt, Expected: expected[:]}
+	require.NoError(t, hash.Validate())
+	require.Equal(t, expected[:], hash.Sum(&val))
+	require.Nil(t, hash.Sum(nil))
+	require.Error(t, (&AttributeHash{}).Validate())
+	require.Error(t, (&AttributeHash{Salt: salt, Expected: []byte("short")}).Validate())
+
+	// The value of hashed attributes is replaced by whether its hash matches
+	conf, request, disclosure := parseDisclosure(t)
+	request.Disclose[0][0][0].Hash = hash
+	_, attrs, err := disclosure.DisclosedAttributes(conf, request.Disclose, nil)
+	require.NoError(t, err)
+	attr := attrs[0][0]
+	require.Equal(t, AttributeProofStatusHashed, attr.Status)
+	require.Nil(t, attr.RawValue)
+	require.Nil(t, attr.Value)
+	require.Nil(t, attr.Hash)
+	require.NotNil(t, attr.Match)
+	require.True(t, *attr.Match)
+
+	// or by its hash if no hash is expected
+	request.Disclose[0][0][0].Hash = &AttributeHash{Salt: salt}
+	_, attrs, err = disclosure.DisclosedAttributes(conf, request.Disclose, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected[:], attrs[0][0].Hash)
+	require.Nil(t, attrs[0][0].Match)
+
+	// A hash sent by the client instead of the attribute is not accepted, as it is not proven
+	request.Disclose[0][0][0].Hash = hash
+	delete(disclosure.Proofs[0].(*gabi.ProofD).ADisclosed, 4)
+	forged := fmt.Sprintf(`[[{"cred":0,"attr":4,"hash":"%s"}]]`, base64.StdEncoding.EncodeToString(expected[:]))
+	require.NoError(t, json.Unmarshal([]byte(forged), &disclosure.Indices))
+	complete, attrs, err := disclosure.DisclosedAttributes(conf, request.Disclose, nil)
+	require.NoError(t, err)
+	require.False(t, complete)
+	for _, con := range attrs {
+		for _, attr := range con {
+			require.NotEqual(t, AttributeProofStatusHashed, attr.Status)
+			require.Nil(t, attr.Match)
+		}
+	}
+
+	// Signature requests cannot require hashing
+	sigrequest := NewSignatureRequest("message")
+	sigrequest.Disclose = request.Disclose
+	require.Error(t, sigrequest.Validate())
+	require.Error(t, AttributeConDisCon{AttributeDisCon{AttributeCon{
+		{Type: request.Disclose[0][0][0].Type, Value: &val, Hash: hash},
+	}}}.Validate(conf))
+}
+
 func parseDisclosure(t *testing.T) (*Configuration, *DisclosureRequest, *Disclosure) {
 	conf := parseConfiguration(t)
 
@@ -269,6 +269,14 @@ const (
 	ErrorPanic = ErrorType("panic")
 	// Error involving random blind attributes
 	ErrorRandomBlind = ErrorType("randomblind")
+	// The user blocked the requestor of the session
+	ErrorRequestorBlocked = ErrorType("requestorBlocked")
+	// The context of the session was cancelled
+	ErrorCancelled = ErrorType("cancelled")
+	// The deadline of the context of the session passed
+	ErrorTimeout = ErrorType("timeout")
+	// The session does not refresh the credential that was to be refreshed
+	ErrorRefresh = ErrorType("refresh")
 )
 
 type Disclosure struct {
@@ -305,6 +313,7 @@ type KeyshareEnrollment struct {
 
 type KeyshareChangePin struct {
 	Username string `json:"id"`
+	DeviceID string `json:"device_id,omitempty"`
 	OldPin   string `json:"oldpin"`
 	NewPin   string `json:"newpin"`
 }
@@ -314,14 +323,53 @@ type KeyshareAuthorization struct {
 	Candidates []string `json:"candidates"`
 }
 
+// KeyshareSessionInfoHeader is the HTTP header in which the client sends a KeyshareSessionInfo,
+// base64url-encoded JSON, to the keyshare server along with the commitments request.
+const KeyshareSessionInfoHeader = "X-IRMA-Keyshare-Session"
+
+// KeyshareSessionInfo describes the IRMA session in which the keyshare protocol is run, so that the
+// keyshare server can record it in the user's log and users can spot sessions they don't recognise.
+type KeyshareSessionInfo struct {
+	Action            Action                     `json:"action"`
+	RequestorHostname string                     `json:"requestor_hostname,omitempty"`
+	RequestorName     TranslatedString           `json:"requestor_name,omitempty"`
+	CredentialTypes   []CredentialTypeIdentifier `json:"credential_types"`
+}
+
 type KeysharePinMessage struct {
 	Username string `json:"id"`
+	DeviceID string `json:"device_id,omitempty"`
+	Pin      string `json:"pin"`
+}
+
+// KeyshareDeviceHeader is the HTTP header in which a device that was linked to an existing keyshare
+// account sends its device ID, alongside the username of the account.
+const KeyshareDeviceHeader = "X-IRMA-Keyshare-Device"
+
+// KeyshareDeviceLinkCode is a one-time code, obtained on a device already registered at the
+// keyshare server, with which another device can be linked to the same keyshare account.
+type KeyshareDeviceLinkCode struct {
+	Code   string `json:"code"`
+	Expiry int64  `json:"expiry"`
+}
+
+type KeyshareDeviceLink struct {
+	Username string `json:"id"`
+	Code     string `json:"code"`
 	Pin      string `json:"pin"`
+	Name     string `json:"name"`
+}
+
+type KeyshareDeviceLinkResult struct {
+	DeviceID string `json:"device_id"`
 }
 
 type KeysharePinStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// Locked is set along with the "error" status when the account is locked after too many failed
+	// PIN attempts, until it is unblocked in MyIRMA or by the keyshare server operator.
+	Locked bool `json:"locked,omitempty"`
 }
 
 type ProofPCommitmentMap struct {
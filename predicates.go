@@ -0,0 +1,155 @@
+package irma
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/rangeproof"
+)
+
+// This file contains attribute predicates: requirements in disclosure requests that an integer or
+// date attribute is at least and/or at most a given bound, which the client proves using range
+// proofs over the attribute without disclosing it.
+//
+// Range proofs compare attributes as they are encoded in credentials, i.e. as the big-endian
+// integer of the bytes of the value. For canonical values of one kind (non-negative integers
+// without leading zeroes, or dates formatted as YYYY-MM-DD) this order coincides with the
+// numerical or chronological order, so predicates are meaningful only on attributes that the
+// issuer issues in such a canonical form.
+
+var (
+	predicateIntegerRegexp = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+	predicateDateRegexp    = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+type predicateKind int
+
+const (
+	predicateKindInvalid predicateKind = iota
+	predicateKindInteger
+	predicateKindDate
+)
+
+// AttributePredicate requires an attribute to be at least GreaterOrEqual and/or at most
+// LessOrEqual, both inclusive. The bounds must be non-negative integers without leading zeroes,
+// or dates formatted as YYYY-MM-DD; if both are specified they must be of the same kind.
+type AttributePredicate struct {
+	GreaterOrEqual *string `json:"gte,omitempty"`
+	LessOrEqual    *string `json:"lte,omitempty"`
+}
+
+func predicateValueKind(val string) predicateKind {
+	if predicateIntegerRegexp.MatchString(val) {
+		return predicateKindInteger
+	}
+	if predicateDateRegexp.MatchString(val) {
+		if _, err := time.Parse("2006-01-02", val); err == nil {
+			return predicateKindDate
+		}
+	}
+	return predicateKindInvalid
+}
+
+// kind returns the kind of the bounds of the predicate, or predicateKindInvalid if it has no
+// bounds or if they are invalid or of different kinds.
+func (p *AttributePredicate) kind() predicateKind {
+	kind := predicateKindInvalid
+	for _, bound := range []*string{p.GreaterOrEqual, p.LessOrEqual} {
+		if bound == nil {
+			continue
+		}
+		k := predicateValueKind(*bound)
+		if k == predicateKindInvalid || (kind != predicateKindInvalid && k != kind) {
+			return predicateKindInvalid
+		}
+		kind = k
+	}
+	return kind
+}
+
+// Validate checks that the predicate has at least one bound, that its bounds are valid and of
+// the same kind, and that it is satisfiable.
+func (p *AttributePredicate) Validate() error {
+	if p.GreaterOrEqual == nil && p.LessOrEqual == nil {
+		return errors.New("Attribute predicate has no bounds")
+	}
+	if p.kind() == predicateKindInvalid {
+		return errors.New("Attribute predicate bounds must be non-negative integers without leading zeroes or dates formatted as YYYY-MM-DD, both of the same kind")
+	}
+	if p.GreaterOrEqual != nil && p.LessOrEqual != nil && comparePredicateValues(*p.GreaterOrEqual, *p.LessOrEqual) > 0 {
+		return errors.New("Attribute predicate has an empty range")
+	}
+	return nil
+}
+
+// Satisfy indicates whether the given attribute value satisfies the predicate. Values that are
+// not of the same kind as the bounds of the predicate never satisfy it.
+func (p *AttributePredicate) Satisfy(val *string) bool {
+	kind := p.kind()
+	if val == nil || kind == predicateKindInvalid || predicateValueKind(*val) != kind {
+		return false
+	}
+	return (p.GreaterOrEqual == nil || comparePredicateValues(*val, *p.GreaterOrEqual) >= 0) &&
+		(p.LessOrEqual == nil || comparePredicateValues(*val, *p.LessOrEqual) <= 0)
+}
+
+// RangeStatements returns the range proof statements that together prove the predicate for an
+// attribute of a credential with the specified metadata version.
+func (p *AttributePredicate) RangeStatements(metadataVersion byte) ([]*rangeproof.Statement, error) {
+	var statements []*rangeproof.Statement
+	add := func(typ rangeproof.StatementType, bound *big.Int) error {
+		statement, err := rangeproof.NewStatement(typ, bound)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, statement)
+		return nil
+	}
+
+	if p.GreaterOrEqual != nil {
+		if err := add(rangeproof.GreaterOrEqual, encodeAttribute(*p.GreaterOrEqual, metadataVersion)); err != nil {
+			return nil, err
+		}
+	}
+	if p.LessOrEqual != nil {
+		if err := add(rangeproof.LesserOrEqual, encodeAttribute(*p.LessOrEqual, metadataVersion)); err != nil {
+			return nil, err
+		}
+		// Absent attributes are encoded as 0 which is less than any bound, so if there is no lower
+		// bound we additionally prove that the attribute is present
+		if p.GreaterOrEqual == nil && metadataVersion >= 3 {
+			if err := add(rangeproof.GreaterOrEqual, big.NewInt(1)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return statements, nil
+}
+
+// provedBy returns whether the range proofs over an attribute of a credential with the specified
+// metadata version prove the predicate. The proofs must have been verified.
+func (p *AttributePredicate) provedBy(proofs []*rangeproof.Proof, metadataVersion byte) bool {
+	statements, err := p.RangeStatements(metadataVersion)
+	if err != nil || len(statements) == 0 {
+		return false
+	}
+	for _, statement := range statements {
+		proved := false
+		for _, proof := range proofs {
+			if proof != nil && proof.Proves(statement) {
+				proved = true
+				break
+			}
+		}
+		if !proved {
+			return false
+		}
+	}
+	return true
+}
+
+func comparePredicateValues(a, b string) int {
+	return encodeAttribute(a, 0).Cmp(encodeAttribute(b, 0))
+}
@@ -0,0 +1,255 @@
+package irma
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// This file contains the proximity mode of the IRMA protocol, in which the IRMA app and the
+// IRMA server of a verifier nearby exchange the messages of the protocol over a connection that
+// the host app provides (e.g. BLE, NFC or a local socket) instead of over HTTP. The HTTP requests
+// and responses of the protocol are tunneled over the connection as they are, so that both
+// parties use their usual session state machines and message encodings.
+
+// ProximityScheme is the URL scheme of the session pointers of proximity sessions.
+const ProximityScheme = "irma-proximity"
+
+// proximityHost is the host of the URLs of proximity sessions of servers that have no URL.
+const proximityHost = "localhost"
+
+// ProximityConn is a connection between the IRMA app and a verifier nearby, implemented by the
+// host app. Send and Receive transfer whole messages. Messages are not encrypted before being sent:
+// if the messages require confidentiality or integrity, the connection must provide it.
+type ProximityConn interface {
+	// Send sends a message to the other party.
+	Send(message []byte) error
+	// Receive blocks until a message of the other party is received, returning io.EOF if the
+	// connection was closed.
+	Receive() ([]byte, error)
+	// Close closes the connection.
+	Close() error
+}
+
+// ProximityRequest is a HTTP request of the IRMA protocol, sent over a ProximityConn.
+type ProximityRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// ProximityResponse is the response to a ProximityRequest.
+type ProximityResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// ProximityURL converts the URL of a session (as in the irma.Qr of a session) into the URL of
+// the same session in proximity mode.
+func ProximityURL(sessionURL string) (string, error) {
+	u, err := url.Parse(sessionURL)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = ProximityScheme
+	if u.Host == "" {
+		u.Host = proximityHost
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return u.String(), nil
+}
+
+// IsProximity returns whether the session pointer is of a proximity session.
+func (qr *Qr) IsProximity() bool {
+	return strings.HasPrefix(qr.URL, ProximityScheme+"://")
+}
+
+// NewProximityTransport returns a HTTPTransport that performs its requests over the connection.
+// The path of the request URLs is sent to the other party; their scheme and host are ignored.
+// As a response that arrives after its request has been given up on would be mistaken for the
+// response to the next request, the transport does not time out or retry: Receive of the
+// connection should return an error when the other party is no longer reachable.
+func NewProximityTransport(serverURL string, conn ProximityConn) *HTTPTransport {
+	transport := NewHTTPTransport(serverURL, false)
+	transport.client = &retryablehttp.Client{
+		Logger:     transportlogger,
+		RetryMax:   0,
+		CheckRetry: retryablehttp.DefaultRetryPolicy,
+		HTTPClient: &http.Client{Transport: &proximityRoundTripper{conn: conn}},
+	}
+	return transport
+}
+
+// proximityRoundTripper is a http.RoundTripper that performs requests over a ProximityConn, one
+// at a time.
+type proximityRoundTripper struct {
+	conn  ProximityConn
+	mutex sync.Mutex
+}
+
+func (rt *proximityRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	message := &ProximityRequest{
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+		Header: req.Header,
+	}
+	if req.Body != nil {
+		var err error
+		if message.Body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+	bts, err := MarshalBinary(message)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if err = rt.conn.Send(bts); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to send proximity message", 0)
+	}
+	if bts, err = rt.conn.Receive(); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to receive proximity message", 0)
+	}
+
+	response := &ProximityResponse{}
+	if err = UnmarshalBinary(bts, response); err != nil {
+		return nil, err
+	}
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+	return &http.Response{
+		Status:        http.StatusText(response.Status),
+		StatusCode:    response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(response.Body)),
+		ContentLength: int64(len(response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// ServeProximity serves the requests received over the connection with the handler, until
+// the connection is closed.
+func ServeProximity(conn ProximityConn, handler http.Handler) error {
+	for {
+		bts, err := conn.Receive()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		request := &ProximityRequest{}
+		if err = UnmarshalBinary(bts, request); err != nil {
+			return errors.WrapPrefix(err, "failed to parse proximity message", 0)
+		}
+		req, err := http.NewRequest(request.Method, request.Path, bytes.NewReader(request.Body))
+		if err != nil {
+			return err
+		}
+		if request.Header != nil {
+			req.Header = request.Header
+		}
+		req.RemoteAddr = ProximityScheme
+
+		w := &proximityResponseWriter{header: http.Header{}}
+		handler.ServeHTTP(w, req)
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		bts, err = MarshalBinary(&ProximityResponse{Status: w.status, Header: w.header, Body: w.body.Bytes()})
+		if err != nil {
+			return err
+		}
+		if err = conn.Send(bts); err != nil {
+			return err
+		}
+	}
+}
+
+// proximityResponseWriter is a http.ResponseWriter that buffers the response to a request
+// received over a ProximityConn.
+type proximityResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *proximityResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *proximityResponseWriter) Write(bts []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(bts)
+}
+
+func (w *proximityResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// NewLoopbackProximityConn returns the two ends of a ProximityConn within this process, for
+// testing. Closing either end closes both.
+func NewLoopbackProximityConn() (ProximityConn, ProximityConn) {
+	a, b := make(chan []byte, 1), make(chan []byte, 1)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	return &loopbackProximityConn{in: a, out: b, closed: closed, once: once},
+		&loopbackProximityConn{in: b, out: a, closed: closed, once: once}
+}
+
+type loopbackProximityConn struct {
+	in, out chan []byte
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+func (c *loopbackProximityConn) Send(message []byte) error {
+	select {
+	case <-c.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.out <- append([]byte{}, message...):
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *loopbackProximityConn) Receive() ([]byte, error) {
+	select {
+	case message := <-c.in:
+		return message, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *loopbackProximityConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
@@ -207,11 +207,15 @@ type DisclosureChoice struct {
 }
 
 // An AttributeRequest asks for an instance of an attribute type, possibly requiring it to have
-// a specified value, in a session request.
+// a specified value, in a session request. If a Predicate is specified, the attribute is not
+// disclosed; instead the client proves that it satisfies the predicate. If a Hash is specified,
+// the session result contains only a salted hash of the attribute instead of its value.
 type AttributeRequest struct {
-	Type    AttributeTypeIdentifier `json:"type"`
-	Value   *string                 `json:"value,omitempty"`
-	NotNull bool                    `json:"notNull,omitempty"`
+	Type      AttributeTypeIdentifier `json:"type"`
+	Value     *string                 `json:"value,omitempty"`
+	NotNull   bool                    `json:"notNull,omitempty"`
+	Predicate *AttributePredicate     `json:"predicate,omitempty"`
+	Hash      *AttributeHash          `json:"hash,omitempty"`
 }
 
 type PairingMethod string
@@ -404,7 +408,7 @@ func (ar *AttributeRequest) UnmarshalJSON(bts []byte) error {
 }
 
 func (ar *AttributeRequest) MarshalJSON() ([]byte, error) {
-	if !ar.NotNull && ar.Value == nil {
+	if !ar.NotNull && ar.Value == nil && ar.Predicate == nil && ar.Hash == nil {
 		return json.Marshal(ar.Type)
 	}
 	return json.Marshal((*jsonAttributeRequest)(ar))
@@ -414,7 +418,22 @@ func (ar *AttributeRequest) MarshalJSON() ([]byte, error) {
 func (ar *AttributeRequest) Satisfy(attr AttributeTypeIdentifier, val *string) bool {
 	return ar.Type == attr &&
 		(!ar.NotNull || val != nil) &&
-		(ar.Value == nil || (val != nil && *ar.Value == *val))
+		(ar.Value == nil || (val != nil && *ar.Value == *val)) &&
+		(ar.Predicate == nil || ar.Predicate.Satisfy(val))
+}
+
+func (ar *AttributeRequest) validatePredicate(conf *Configuration) error {
+	if ar.Value != nil {
+		return errors.New("Attribute request cannot require both a value and a predicate")
+	}
+	attrtype := conf.AttributeTypes[ar.Type]
+	if ar.Type.IsCredential() || attrtype == nil {
+		return errors.Errorf("Cannot request predicate over %s: not a known attribute type", ar.Type)
+	}
+	if attrtype.RandomBlind || attrtype.RevocationAttribute {
+		return errors.Errorf("Cannot request predicate over %s", ar.Type)
+	}
+	return ar.Predicate.Validate()
 }
 
 // Satisfy returns if each of the attributes specified by proofs and indices satisfies each of
@@ -430,6 +449,20 @@ func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttribu
 
 	for j := range c {
 		index := indices[j]
+		if c[j].Predicate != nil {
+			attr, err := extractPredicate(proofs, index, revocation[index.CredentialIndex], &c[j], conf)
+			if err != nil {
+				return false, nil, err
+			}
+			if attr == nil {
+				return false, nil, nil
+			}
+			attrs = append(attrs, attr)
+			continue
+		}
+		if !attributeDisclosed(proofs, index) {
+			return false, nil, nil
+		}
 		attr, val, err := extractAttribute(proofs, index, revocation[index.CredentialIndex], conf)
 		if err != nil {
 			return false, nil, err
@@ -437,6 +470,9 @@ func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttribu
 		if !c[j].Satisfy(attr.Identifier, val) {
 			return false, nil, nil
 		}
+		if c[j].Hash != nil {
+			c[j].Hash.apply(attr, val)
+		}
 		attrs = append(attrs, attr)
 	}
 	return true, attrs, nil
@@ -475,6 +511,16 @@ func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 		for _, con := range discon {
 			var nonsingleton *CredentialTypeIdentifier
 			for _, attr := range con {
+				if attr.Predicate != nil {
+					if err := attr.validatePredicate(conf); err != nil {
+						return err
+					}
+				}
+				if attr.Hash != nil {
+					if err := attr.validateHash(); err != nil {
+						return err
+					}
+				}
 				typ := attr.Type.CredentialTypeIdentifier()
 				if !conf.CredentialTypes[typ].IsSingleton {
 					if nonsingleton != nil && *nonsingleton != typ {
@@ -721,14 +767,10 @@ func (cr *CredentialRequest) AttributeList(
 		if attrtype.RevocationAttribute || attrtype.RandomBlind {
 			continue
 		}
-		attrs[i+1] = new(big.Int)
 		if str, present := cr.Attributes[attrtype.ID]; present {
-			// Set attribute to str << 1 + 1
-			attrs[i+1].SetBytes([]byte(str))
-			if meta.Version() >= 0x03 {
-				attrs[i+1].Lsh(attrs[i+1], 1)             // attr <<= 1
-				attrs[i+1].Add(attrs[i+1], big.NewInt(1)) // attr += 1
-			}
+			attrs[i+1] = encodeAttribute(str, meta.Version())
+		} else {
+			attrs[i+1] = new(big.Int)
 		}
 	}
 
@@ -855,7 +897,13 @@ func (sr *SignatureRequest) Validate() error {
 			return err
 		}
 	}
-	return nil
+	// The signature contains the disclosed attributes, so hashing them would be pointless
+	return sr.Disclose.Iterate(func(attr *AttributeRequest) error {
+		if attr.Hash != nil {
+			return errors.New("Signature request cannot require attribute hashing")
+		}
+		return nil
+	})
 }
 
 // Check if Timestamp is before other Timestamp. Used for checking expiry of attributes
@@ -51,7 +51,9 @@ type (
 	RevocationClient struct {
 		Conf     *Configuration
 		Settings RevocationSettings
-		http     *HTTPTransport
+		// Context aborts the requests of the client when done, if not nil
+		Context context.Context
+		http    *HTTPTransport
 	}
 
 	// RevocationKeys contains helper functions for retrieving revocation private and public keys
@@ -981,6 +983,9 @@ func (client RevocationClient) transport(forceHTTPS bool) *HTTPTransport {
 	if client.http == nil {
 		client.http = NewHTTPTransport("", forceHTTPS)
 		client.http.Binary = true
+		if client.Context != nil {
+			client.http = client.http.WithContext(client.Context)
+		}
 	}
 	return client.http
 }
@@ -9,6 +9,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/bsm/redislock"
@@ -397,6 +399,40 @@ func (s *Server) PairingCompleted(requestorToken irma.RequestorToken) (err error
 	return
 }
 
+// StartProximitySession starts an IRMA session like StartSession, of which the IRMA app performs
+// its side over a proximity connection served by ServeProximity, instead of over HTTP. The URL
+// of the returned session pointer has the irma.ProximityScheme.
+func StartProximitySession(request interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.StartProximitySession(request, handler)
+}
+func (s *Server) StartProximitySession(req interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	qr, token, frontendRequest, err := s.StartSession(req, handler)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if qr.URL, err = irma.ProximityURL(qr.URL); err != nil {
+		return nil, "", nil, err
+	}
+	return qr, token, frontendRequest, nil
+}
+
+// ServeProximity handles the IRMA protocol with an IRMA app over the proximity connection, as
+// HandlerFunc does over HTTP, until the connection is closed.
+func ServeProximity(conn irma.ProximityConn) error {
+	return s.ServeProximity(conn)
+}
+func (s *Server) ServeProximity(conn irma.ProximityConn) error {
+	var handler http.Handler = s.HandlerFunc()
+	// The paths of the requests include the path of the URL of the server, which the router
+	// does not expect
+	if u, err := url.Parse(s.conf.URL); err == nil && strings.Trim(u.Path, "/") != "" {
+		handler = http.StripPrefix(strings.TrimSuffix(u.Path, "/"), handler)
+	}
+	return irma.ServeProximity(conn, handler)
+}
+
 // Revoke revokes the earlier issued credential specified by key. (Can only be used if this server
 // is the revocation server for the specified credential type and if the corresponding
 // issuer private key is present in the server configuration.)
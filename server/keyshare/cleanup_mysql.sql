@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS email_queue;
+DROP TABLE IF EXISTS device_link_codes;
+DROP TABLE IF EXISTS emails;
+DROP TABLE IF EXISTS email_login_tokens;
+DROP TABLE IF EXISTS email_verification_tokens;
+DROP TABLE IF EXISTS log_entry_records;
+DROP TABLE IF EXISTS devices;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS schema_migrations;
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/go-errors/errors"
+	"github.com/go-sql-driver/mysql"
 	"github.com/privacybydesign/irmago/internal/common"
 )
 
@@ -13,6 +14,18 @@ type DB struct {
 	*sql.DB
 }
 
+// MySQLConnStr adds the options required by the keyshare components to a MySQL connection string.
+// In particular, clientFoundRows makes MySQL count rows matched by an UPDATE as affected, also
+// when they did not change, as PostgreSQL does; ExecUser relies on this.
+func MySQLConnStr(connstr string) (string, error) {
+	conf, err := mysql.ParseDSN(connstr)
+	if err != nil {
+		return "", err
+	}
+	conf.ClientFoundRows = true
+	return conf.FormatDSN(), nil
+}
+
 func (db *DB) ExecCount(query string, args ...interface{}) (int64, error) {
 	res, err := db.Exec(query, args...)
 	if err != nil {
@@ -2,11 +2,13 @@ package keyshare
 
 import (
 	"bytes"
+	"database/sql"
 	"html/template"
 	"net/smtp"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
 )
 
 type EmailConfiguration struct {
@@ -14,6 +16,44 @@ type EmailConfiguration struct {
 	EmailFrom       string `json:"email_from" mapstructure:"email_from"`
 	DefaultLanguage string `json:"default_language" mapstructure:"default_language"`
 	EmailAuth       smtp.Auth
+
+	// Mailer used to deliver emails (smtp, file or log), and directory to write emails to for the file mailer
+	EmailMailer MailerType `json:"email_mailer" mapstructure:"email_mailer"`
+	EmailDir    string     `json:"email_dir" mapstructure:"email_dir"`
+	// If enabled, emails are stored in the database and delivered (with retries) by the keyshare tasks
+	EmailQueue bool `json:"email_queue" mapstructure:"email_queue"`
+
+	// Provide a prepared mailer (useful for testing)
+	Mailer Mailer `json:"-"`
+}
+
+// EmailEnabled returns whether sending emails is configured.
+func (conf EmailConfiguration) EmailEnabled() bool {
+	switch conf.EmailMailer {
+	case MailerTypeSMTP, "":
+		return conf.Mailer != nil || conf.EmailServer != ""
+	default:
+		return true
+	}
+}
+
+// SetupMailer initializes the mailer used by SendEmail, unless a mailer was already provided.
+// When the email queue is enabled, emails are stored in the given database of the given dialect,
+// which may be nil otherwise.
+func (conf *EmailConfiguration) SetupMailer(db *sql.DB, dialect Dialect, logger *logrus.Logger) error {
+	if conf.Mailer != nil || !conf.EmailEnabled() {
+		return nil
+	}
+	if conf.EmailQueue {
+		if db == nil {
+			return errors.New("email queue requires a postgres or mysql database")
+		}
+		conf.Mailer = NewQueueMailer(db, dialect)
+		return nil
+	}
+	var err error
+	conf.Mailer, err = NewMailer(conf.EmailMailer, *conf, logger)
+	return err
 }
 
 func ParseEmailTemplates(files, subjects map[string]string, defaultLanguage string) (map[string]*template.Template, error) {
@@ -64,20 +104,24 @@ func (conf EmailConfiguration) SendEmail(
 	lang string,
 ) error {
 	var msg bytes.Buffer
-	err := conf.translateTemplate(templates, lang).Execute(&msg, templateData)
+	tmpl := conf.translateTemplate(templates, lang)
+	err := tmpl.Execute(&msg, templateData)
 	if err != nil {
 		server.Logger.WithField("error", err).Error("Could not generate email from template")
 		return err
 	}
 
-	err = sendHTMLEmail(
-		conf.EmailServer,
-		conf.EmailAuth,
-		conf.EmailFrom,
-		email,
-		conf.TranslateString(subjects, lang),
-		msg.Bytes(),
-	)
+	mailer := conf.Mailer
+	if mailer == nil {
+		mailer = smtpMailer{server: conf.EmailServer, auth: conf.EmailAuth}
+	}
+	err = mailer.SendEmail(Email{
+		From:     conf.EmailFrom,
+		To:       email,
+		Subject:  conf.TranslateString(subjects, lang),
+		Body:     msg.Bytes(),
+		Template: tmpl.Name(),
+	})
 	if err != nil {
 		server.Logger.WithField("error", err).Error("Could not send email")
 		return err
@@ -87,7 +131,7 @@ func (conf EmailConfiguration) SendEmail(
 }
 
 func (conf EmailConfiguration) VerifyEmailServer() error {
-	if conf.EmailServer == "" {
+	if conf.EmailServer == "" || (conf.EmailMailer != MailerTypeSMTP && conf.EmailMailer != "") {
 		return nil
 	}
 
@@ -105,13 +149,3 @@ func (conf EmailConfiguration) VerifyEmailServer() error {
 	}
 	return nil
 }
-
-func sendHTMLEmail(addr string, a smtp.Auth, from, to, subject string, msg []byte) error {
-	headers := []byte("To: " + to + "\r\n" +
-		"From: " + from + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"Content-Type: text/html; charset=UTF-8\r\n" +
-		"Content-Transfer-Encoding: binary\r\n" +
-		"\r\n")
-	return smtp.SendMail(addr, a, from, []string{to}, append(headers, msg...))
-}
@@ -0,0 +1,28 @@
+package keyshare
+
+import (
+	"database/sql"
+	"time"
+)
+
+// queueMailer stores emails in the email queue (outbox) in the database. The keyshare tasks
+// deliver them from there, retrying delivery if it fails.
+type queueMailer struct {
+	db      DB
+	dialect Dialect
+}
+
+func NewQueueMailer(db *sql.DB, dialect Dialect) Mailer {
+	return queueMailer{db: DB{DB: db}, dialect: dialect}
+}
+
+func (m queueMailer) SendEmail(email Email) error {
+	now := time.Now().Unix()
+	query, args := m.dialect.Query(
+		`INSERT INTO irma.email_queue (sender, recipient, subject, body, created, attempts, next_attempt)
+		 VALUES ($1, $2, $3, $4, $5, 0, $5)`,
+		email.From, email.To, email.Subject, email.Body, now,
+	)
+	_, err := m.db.Exec(query, args...)
+	return err
+}
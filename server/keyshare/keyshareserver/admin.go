@@ -0,0 +1,232 @@
+package keyshareserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminLogsAmountDefault = 20
+	adminLogsAmountMax     = 100
+)
+
+func (s *Server) adminHandler(router chi.Router) {
+	router.Use(s.adminMiddleware)
+
+	router.Get("/users", s.handleAdminFindUsers)
+	router.Route("/users/{username}", func(router chi.Router) {
+		router.Use(s.adminUserMiddleware)
+		router.Get("/", s.handleAdminUserStatus)
+		router.Get("/logs", s.handleAdminUserLogs)
+		router.Post("/unblock", s.handleAdminUnblock)
+		router.Post("/cancel-deletion", s.handleAdminCancelDeletion)
+	})
+}
+
+// GET /admin/users?username=...
+// GET /admin/users?email=...
+func (s *Server) handleAdminFindUsers(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(string)
+	username, email := r.URL.Query().Get("username"), r.URL.Query().Get("email")
+	if (username == "") == (email == "") {
+		server.WriteError(w, server.ErrorInvalidRequest, "specify either username or email")
+		return
+	}
+
+	usernames := []string{username}
+	if email != "" {
+		var err error
+		usernames, err = s.db.usernamesByEmail(email)
+		if err != nil {
+			s.conf.Logger.WithField("error", err).Error("Could not look up users by email address")
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+	}
+
+	result := []*UserStatus{}
+	for _, username := range usernames {
+		user, err := s.db.adminUser(username)
+		if err == keyshare.ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			s.conf.Logger.WithField("error", err).Error("Could not fetch user")
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+		status, err := s.adminUserStatus(admin, user)
+		if err != nil {
+			// already logged
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+		result = append(result, status)
+	}
+
+	server.WriteJson(w, result)
+}
+
+// GET /admin/users/{username}
+func (s *Server) handleAdminUserStatus(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(string)
+	user := r.Context().Value("user").(*User)
+
+	status, err := s.adminUserStatus(admin, user)
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, status)
+}
+
+func (s *Server) adminUserStatus(admin string, user *User) (*UserStatus, error) {
+	status, err := s.db.userStatus(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not fetch user status")
+		return nil, err
+	}
+	if status.Emails == nil {
+		status.Emails = []UserEmail{}
+	} // Ensure we never send nil in place of an empty list
+	status.Locked = s.conf.PinPolicy.locked(status.PinCounter)
+
+	if err = s.adminLog(admin, user, eventTypeAdminLookup); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// GET /admin/users/{username}/logs?offset=...&amount=...
+func (s *Server) handleAdminUserLogs(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(string)
+	user := r.Context().Value("user").(*User)
+
+	offset, amount := 0, adminLogsAmountDefault
+	var err error
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			server.WriteError(w, server.ErrorInvalidRequest, "malformed offset")
+			return
+		}
+	}
+	if a := r.URL.Query().Get("amount"); a != "" {
+		if amount, err = strconv.Atoi(a); err != nil || amount <= 0 || amount > adminLogsAmountMax {
+			server.WriteError(w, server.ErrorInvalidRequest, "malformed amount")
+			return
+		}
+	}
+
+	entries, err := s.db.userLogs(user, offset, amount)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not load log entries")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	if err = s.adminLog(admin, user, eventTypeAdminLogsViewed); err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	if entries == nil {
+		entries = []LogEntry{}
+	} // Ensure we never send nil in place of an empty list
+	server.WriteJson(w, entries)
+}
+
+// POST /admin/users/{username}/unblock
+func (s *Server) handleAdminUnblock(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(string)
+	user := r.Context().Value("user").(*User)
+
+	if err := s.db.unblockUser(user); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	if err := s.adminLog(admin, user, eventTypeAdminPinUnblocked); err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/users/{username}/cancel-deletion
+func (s *Server) handleAdminCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("admin").(string)
+	user := r.Context().Value("user").(*User)
+
+	err := s.db.cancelUserRemoval(user)
+	if err == errNoDeletionToCancel {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not cancel user removal")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	if err = s.adminLog(admin, user, eventTypeAdminDeletionCanceled); err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminLog records an action of an operator in the log of the user, so that the user can see it in MyIRMA.
+func (s *Server) adminLog(admin string, user *User, eventType eventType) error {
+	s.conf.Logger.WithFields(logrus.Fields{"admin": admin, "username": user.Username, "event": eventType}).
+		Info("Admin action on user account")
+	err := s.db.addLog(user, eventType, admin)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+	}
+	return err
+}
+
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(r.Header.Get("Authorization"))
+		admin := ""
+		for name, t := range s.conf.AdminTokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				admin = name
+			}
+		}
+		if admin == "" {
+			s.conf.Logger.Warn("Admin API request with invalid authorization")
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "admin", admin)))
+	})
+}
+
+func (s *Server) adminUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		user, err := s.db.adminUser(username)
+		if err == keyshare.ErrUserNotFound {
+			server.WriteError(w, server.ErrorUserNotRegistered, "")
+			return
+		}
+		if err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Error("Could not fetch user")
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	})
+}
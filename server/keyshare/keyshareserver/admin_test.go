@@ -0,0 +1,90 @@
+package keyshareserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type logRecordingDB struct {
+	DB
+	events []eventType
+	params []interface{}
+}
+
+func (db *logRecordingDB) addLog(user *User, eventType eventType, param interface{}) error {
+	db.events = append(db.events, eventType)
+	db.params = append(db.params, param)
+	return db.DB.addLog(user, eventType, param)
+}
+
+func TestAdminAPI(t *testing.T) {
+	db := &logRecordingDB{DB: createDB(t)}
+	conf := testConfiguration(t, db, "")
+	conf.AdminTokens = map[string]string{"alice": "alicetoken"}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	auth := func() http.Header { return http.Header{"Authorization": []string{"alicetoken"}} }
+
+	// Authorization is required
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername", nil, 403, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername",
+		http.Header{"Authorization": []string{"wrongtoken"}}, 403, nil)
+	assert.Empty(t, db.events)
+
+	var status UserStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername", auth(), 200, &status)
+	assert.Equal(t, "testusername", status.Username)
+	assert.NotNil(t, status.Emails)
+
+	var statuses []UserStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users?username=testusername", auth(), 200, &statuses)
+	assert.Len(t, statuses, 1)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users?username=doesnotexist", auth(), 200, &statuses)
+	assert.Len(t, statuses, 0)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users", auth(), 400, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/doesnotexist", auth(), 403, nil)
+
+	var logs []LogEntry
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername/logs?offset=0&amount=10", auth(), 200, &logs)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername/logs?amount=1000", auth(), 400, nil)
+
+	// Unblocking resets the PIN attempts of all devices of the user
+	policy := &PinPolicy{}
+	policy.setDefaults()
+	device, err := db.user("testusername")
+	require.NoError(t, err)
+	require.NoError(t, db.addDevice(device, "testdevice", "Test phone", device.Secrets))
+	_, err = db.reservePinTry(policy, device)
+	require.NoError(t, err)
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/users/testusername/unblock", "", auth(), 204, nil)
+	try, err := db.reservePinTry(policy, device)
+	require.NoError(t, err)
+	assert.Equal(t, policy.FreeAttempts-1, try.tries)
+
+	// The memory database never schedules users for deletion
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/users/testusername/cancel-deletion", "", auth(), 400, nil)
+
+	// All admin actions end up in the user's log, along with the name of the operator
+	assert.Equal(t, []eventType{
+		eventTypeAdminLookup,
+		eventTypeAdminLookup,
+		eventTypeAdminLogsViewed,
+		eventTypeAdminPinUnblocked,
+	}, db.events)
+	for _, param := range db.params {
+		assert.Equal(t, "alice", param)
+	}
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, createDB(t), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/testusername",
+		http.Header{"Authorization": []string{""}}, 404, nil)
+}
@@ -23,6 +23,7 @@ var errUnknownDBType = errors.New("Unknown database type")
 const (
 	DBTypeMemory   DBType = "memory"
 	DBTypePostgres DBType = "postgres"
+	DBTypeMySQL    DBType = "mysql"
 )
 
 // Configuration contains configuration for the irmaserver library and irmad.
@@ -58,6 +59,20 @@ type Configuration struct {
 	registrationEmailTemplates map[string]*template.Template
 
 	VerificationURL map[string]string `json:"verification_url" mapstructure:"verification_url"`
+
+	// Security notifications sent to the user's email addresses (each is disabled if its files are not present)
+	PinBlockedEmailFiles     map[string]string `json:"pin_blocked_email_files" mapstructure:"pin_blocked_email_files"`
+	PinBlockedEmailSubjects  map[string]string `json:"pin_blocked_email_subjects" mapstructure:"pin_blocked_email_subjects"`
+	PinChangedEmailFiles     map[string]string `json:"pin_changed_email_files" mapstructure:"pin_changed_email_files"`
+	PinChangedEmailSubjects  map[string]string `json:"pin_changed_email_subjects" mapstructure:"pin_changed_email_subjects"`
+	pinBlockedEmailTemplates map[string]*template.Template
+	pinChangedEmailTemplates map[string]*template.Template
+
+	// Tokens of operators allowed to use the admin API, by operator name (admin API is disabled if empty)
+	AdminTokens map[string]string `json:"admin_tokens" mapstructure:"admin_tokens"`
+
+	// Policy determining the number of PIN attempts and the blocking of accounts after failed attempts
+	PinPolicy PinPolicy `json:"pin_policy" mapstructure:"pin_policy"`
 }
 
 func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
@@ -78,7 +93,7 @@ func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
 func validateConf(conf *Configuration) error {
 	// Setup email templates
 	var err error
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		conf.registrationEmailTemplates, err = keyshare.ParseEmailTemplates(
 			conf.RegistrationEmailFiles,
 			conf.RegistrationEmailSubjects,
@@ -90,6 +105,26 @@ func validateConf(conf *Configuration) error {
 		if _, ok := conf.VerificationURL[conf.DefaultLanguage]; !ok {
 			return server.LogError(errors.Errorf("Missing verification base url for default language"))
 		}
+		if len(conf.PinBlockedEmailFiles) > 0 {
+			conf.pinBlockedEmailTemplates, err = keyshare.ParseEmailTemplates(
+				conf.PinBlockedEmailFiles,
+				conf.PinBlockedEmailSubjects,
+				conf.DefaultLanguage,
+			)
+			if err != nil {
+				return server.LogError(err)
+			}
+		}
+		if len(conf.PinChangedEmailFiles) > 0 {
+			conf.pinChangedEmailTemplates, err = keyshare.ParseEmailTemplates(
+				conf.PinChangedEmailFiles,
+				conf.PinChangedEmailSubjects,
+				conf.DefaultLanguage,
+			)
+			if err != nil {
+				return server.LogError(err)
+			}
+		}
 	}
 
 	if err = conf.VerifyEmailServer(); err != nil {
@@ -104,6 +139,17 @@ func validateConf(conf *Configuration) error {
 		return server.LogError(errors.Errorf("Failed to load private key of keyshare attribute: %v", err))
 	}
 
+	for name, token := range conf.AdminTokens {
+		if name == "" || token == "" {
+			return server.LogError(errors.Errorf("Admin tokens must have a nonempty name and token"))
+		}
+	}
+
+	conf.PinPolicy.setDefaults()
+	if err = conf.PinPolicy.validate(); err != nil {
+		return server.LogError(err)
+	}
+
 	// Setup IRMA session server url for in QR code
 	if !strings.HasSuffix(conf.URL, "/") {
 		conf.URL += "/"
@@ -124,6 +170,12 @@ func setupDatabase(conf *Configuration) (DB, error) {
 		if err != nil {
 			return nil, server.LogError(err)
 		}
+	case DBTypeMySQL:
+		var err error
+		db, err = newMySQLDB(conf.DBConnStr)
+		if err != nil {
+			return nil, server.LogError(err)
+		}
 	default:
 		return nil, server.LogError(errUnknownDBType)
 	}
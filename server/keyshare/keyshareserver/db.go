@@ -1,14 +1,18 @@
 package keyshareserver
 
 import (
+	"fmt"
+
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 
 	"github.com/go-errors/errors"
 )
 
 var (
-	errUserAlreadyExists = errors.New("Cannot create user, username already taken")
-	errInvalidRecord     = errors.New("Invalid record in database")
+	errUserAlreadyExists  = errors.New("Cannot create user, username already taken")
+	errInvalidRecord      = errors.New("Invalid record in database")
+	errNoDeletionToCancel = errors.New("No cancellable deletion scheduled for user")
+	errInvalidLinkCode    = errors.New("Unknown or expired device link code")
 )
 
 type eventType string
@@ -18,30 +22,38 @@ const (
 	eventTypePinCheckSuccess eventType = "PIN_CHECK_SUCCESS"
 	eventTypePinCheckFailed  eventType = "PIN_CHECK_FAILED"
 	eventTypePinCheckBlocked eventType = "PIN_CHECK_BLOCKED"
+	eventTypePinCheckLocked  eventType = "PIN_CHECK_LOCKED"
 	eventTypeIRMASession     eventType = "IRMA_SESSION"
+	eventTypeDeviceLinkCode  eventType = "DEVICE_LINK_CODE"
+	eventTypeDeviceLinked    eventType = "DEVICE_LINKED"
+
+	eventTypeAdminLookup           eventType = "ADMIN_LOOKUP"
+	eventTypeAdminLogsViewed       eventType = "ADMIN_LOGS_VIEWED"
+	eventTypeAdminPinUnblocked     eventType = "ADMIN_PIN_UNBLOCKED"
+	eventTypeAdminDeletionCanceled eventType = "ADMIN_DELETION_CANCELED"
 )
 
 // DB is an interface used by server to manage data storage.
 // There are multiple implementations of this, currently:
 //  - memorydb (memorydb.go) storing all data in memory (forgets everything after reboot)
 //  - postgresdb (postgresdb.go) storing all data in a postgres database
+//  - mysqldb (mysqldb.go) storing all data in a MySQL or MariaDB database
 type DB interface {
 	AddUser(user *User) error
 	user(username string) (*User, error)
 	updateUser(user *User) error
 
-	// reservePinTry reserves a pin check attempt, and additionally it returns:
-	//  - allowed is whether the user is allowed to do the pin check (false if user is blocked)
-	//  - tries is how many tries are remaining, after this pin check
-	//  - wait is how long the user must wait before the next attempt is allowed if tries is 0
-	// resetPinTries increases the user's try count and (if applicable) the date when the user
-	// is unblocked again in the database, regardless of if the pin check succeeds after this
-	// invocation.
-	reservePinTry(user *User) (allowed bool, tries int, wait int64, err error)
+	// reservePinTry reserves a pin check attempt according to the specified PIN policy. It increases
+	// the user's try count and (if applicable) the date when the user is unblocked again in the
+	// database, regardless of if the pin check succeeds after this invocation.
+	reservePinTry(policy *PinPolicy, user *User) (pinTry, error)
 
 	// resetPinTries resets the user's pin count and unblock date fields in the database to their
 	// default values (0 past attempts, no unblock date).
 	resetPinTries(user *User) error
+	// unblockUser resets the PIN attempt state of the user and of all devices linked to the
+	// user's account, regardless of the device that user applies to.
+	unblockUser(user *User) error
 
 	// User activity registration.
 	// setSeen calls are used to track when a users account was last active, for deleting old accounts.
@@ -50,6 +62,35 @@ type DB interface {
 
 	// Store email verification tokens on registration
 	addEmailVerification(user *User, emailAddress, token string) error
+	// emailAddresses returns the user's email addresses that are not scheduled for deletion,
+	// to which security notifications are sent.
+	emailAddresses(user *User) ([]string, error)
+
+	// Operator administration.
+	// adminUser fetches a user also when her account is scheduled for deletion, in which case
+	// the returned user may not have any secrets.
+	adminUser(username string) (*User, error)
+	usernamesByEmail(email string) ([]string, error)
+	userStatus(user *User) (*UserStatus, error)
+	userLogs(user *User, offset, amount int) ([]LogEntry, error)
+
+	// Devices.
+	// The installation that registered the account uses the secrets stored with the user; other
+	// devices linked to the account have their own secrets and PIN attempt state.
+	// loadDevice replaces the secrets of the user by those of the specified device of the user,
+	// so that subsequent operations on the user apply to that device.
+	loadDevice(user *User, deviceID string) error
+	addDeviceLinkCode(user *User, code string, expiry int64) error
+	// consumeDeviceLinkCode removes the specified unexpired link code if it belongs to the user with
+	// the specified username, returning the user.
+	consumeDeviceLinkCode(username, code string) (*User, error)
+	// addDevice adds a device with the specified secrets to the user's account, and loads it into user.
+	addDevice(user *User, deviceID, name string, secrets keysharecore.UserSecrets) error
+
+	// cancelUserRemoval undoes a scheduled deletion of the user's account. This is only possible
+	// when the account was scheduled for deletion because of inactivity: if the user deleted her
+	// account herself then her secrets are already gone.
+	cancelUserRemoval(user *User) error
 }
 
 // User represents a user of this server.
@@ -58,4 +99,39 @@ type User struct {
 	Language string
 	Secrets  keysharecore.UserSecrets
 	id       int64
+	// Database id of the device of the user this instance applies to, or 0 for the device
+	// that registered the account
+	device int64
+}
+
+// key uniquely identifies the device of the user that this instance applies to.
+func (user *User) key() string {
+	if user.device == 0 {
+		return user.Username
+	}
+	return fmt.Sprintf("%s/%d", user.Username, user.device)
+}
+
+// UserStatus contains the information on a user that is shown to operators through the admin API.
+type UserStatus struct {
+	Username     string      `json:"username"`
+	Language     string      `json:"language"`
+	LastSeen     int64       `json:"last_seen"`
+	PinCounter   int         `json:"pin_counter"`
+	BlockedUntil int64       `json:"blocked_until"`
+	Locked       bool        `json:"locked"` // too many failed PIN attempts, account must be unblocked
+	DeleteOn     *int64      `json:"delete_on,omitempty"`
+	Deleted      bool        `json:"deleted"` // user deleted her account herself, so it cannot be restored
+	Emails       []UserEmail `json:"emails"`
+}
+
+type UserEmail struct {
+	Email    string `json:"email"`
+	DeleteOn *int64 `json:"delete_on,omitempty"`
+}
+
+type LogEntry struct {
+	Timestamp int64   `json:"timestamp"`
+	Event     string  `json:"event"`
+	Param     *string `json:"param,omitempty"`
 }
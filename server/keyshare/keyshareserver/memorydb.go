@@ -2,6 +2,7 @@ package keyshareserver
 
 import (
 	"sync"
+	"time"
 
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server/keyshare"
@@ -13,11 +14,35 @@ import (
 
 type memoryDB struct {
 	sync.Mutex
-	users map[string]keysharecore.UserSecrets
+	users     map[string]keysharecore.UserSecrets
+	pins      map[string]memoryPinState
+	devices   map[string]memoryDevice
+	linkCodes map[string]memoryLinkCode
+}
+
+type memoryDevice struct {
+	id       int64
+	username string
+	secrets  keysharecore.UserSecrets
+}
+
+type memoryLinkCode struct {
+	username string
+	expiry   int64
+}
+
+type memoryPinState struct {
+	failed    int
+	blockDate int64
 }
 
 func NewMemoryDB() DB {
-	return &memoryDB{users: map[string]keysharecore.UserSecrets{}}
+	return &memoryDB{
+		users:     map[string]keysharecore.UserSecrets{},
+		pins:      map[string]memoryPinState{},
+		devices:   map[string]memoryDevice{},
+		linkCodes: map[string]memoryLinkCode{},
+	}
 }
 
 func (db *memoryDB) user(username string) (*User, error) {
@@ -57,17 +82,54 @@ func (db *memoryDB) updateUser(user *User) error {
 	if !exists {
 		return keyshare.ErrUserNotFound
 	}
+	if user.device != 0 {
+		for deviceID, device := range db.devices {
+			if device.id == user.device {
+				device.secrets = user.Secrets
+				db.devices[deviceID] = device
+				return nil
+			}
+		}
+		return keyshare.ErrUserNotFound
+	}
 	db.users[user.Username] = user.Secrets
 	return nil
 }
 
-func (db *memoryDB) reservePinTry(user *User) (bool, int, int64, error) {
-	// Since this is a testing DB, implementing anything more than always allow creates hastle
-	return true, 1, 0, nil
+func (db *memoryDB) reservePinTry(policy *PinPolicy, user *User) (pinTry, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return pinTry{}, keyshare.ErrUserNotFound
+	}
+	key := user.key()
+	state := db.pins[key]
+	try, blockDate := policy.reserve(state.failed, state.blockDate, time.Now().Unix())
+	if try.allowed {
+		db.pins[key] = memoryPinState{failed: state.failed + 1, blockDate: blockDate}
+	}
+	return try, nil
 }
 
 func (db *memoryDB) resetPinTries(user *User) error {
-	// Since this is a testing DB, implementing anything more than always allow creates hastle
+	db.Lock()
+	defer db.Unlock()
+
+	delete(db.pins, user.key())
+	return nil
+}
+
+func (db *memoryDB) unblockUser(user *User) error {
+	db.Lock()
+	defer db.Unlock()
+
+	delete(db.pins, user.Username)
+	for _, device := range db.devices {
+		if device.username == user.Username {
+			delete(db.pins, (&User{Username: user.Username, device: device.id}).key())
+		}
+	}
 	return nil
 }
 
@@ -85,3 +147,94 @@ func (db *memoryDB) addEmailVerification(user *User, emailAddress, token string)
 	// We don't need to do anything here, as this information cannot be extracted locally
 	return nil
 }
+
+func (db *memoryDB) emailAddresses(user *User) ([]string, error) {
+	// Email addresses are not stored locally
+	return nil, nil
+}
+
+func (db *memoryDB) adminUser(username string) (*User, error) {
+	return db.user(username)
+}
+
+func (db *memoryDB) usernamesByEmail(email string) ([]string, error) {
+	// Email addresses are not stored locally, so we cannot find any users
+	return nil, nil
+}
+
+func (db *memoryDB) userStatus(user *User) (*UserStatus, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return nil, keyshare.ErrUserNotFound
+	}
+	// Of the status only the username and PIN attempts are tracked locally
+	return &UserStatus{
+		Username:     user.Username,
+		Language:     user.Language,
+		PinCounter:   db.pins[user.Username].failed,
+		BlockedUntil: db.pins[user.Username].blockDate,
+	}, nil
+}
+
+func (db *memoryDB) userLogs(user *User, offset, amount int) ([]LogEntry, error) {
+	// Log entries are not stored locally
+	return nil, nil
+}
+
+func (db *memoryDB) loadDevice(user *User, deviceID string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	device, ok := db.devices[deviceID]
+	if !ok || device.username != user.Username {
+		return keyshare.ErrUserNotFound
+	}
+	user.device = device.id
+	user.Secrets = device.secrets
+	return nil
+}
+
+func (db *memoryDB) addDeviceLinkCode(user *User, code string, expiry int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.linkCodes[code] = memoryLinkCode{username: user.Username, expiry: expiry}
+	return nil
+}
+
+func (db *memoryDB) consumeDeviceLinkCode(username, code string) (*User, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	linkCode, ok := db.linkCodes[code]
+	if !ok || linkCode.username != username || linkCode.expiry < time.Now().Unix() {
+		return nil, errInvalidLinkCode
+	}
+	delete(db.linkCodes, code)
+	secrets, ok := db.users[linkCode.username]
+	if !ok {
+		return nil, errInvalidLinkCode
+	}
+	return &User{Username: linkCode.username, Secrets: secrets}, nil
+}
+
+func (db *memoryDB) addDevice(user *User, deviceID, name string, secrets keysharecore.UserSecrets) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return keyshare.ErrUserNotFound
+	}
+	device := memoryDevice{id: int64(len(db.devices) + 1), username: user.Username, secrets: secrets}
+	db.devices[deviceID] = device
+	user.device = device.id
+	user.Secrets = secrets
+	return nil
+}
+
+func (db *memoryDB) cancelUserRemoval(user *User) error {
+	// Users are never scheduled for deletion in this database
+	return errNoDeletionToCancel
+}
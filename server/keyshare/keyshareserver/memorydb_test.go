@@ -35,11 +35,13 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	err = db.addLog(nuser, eventTypePinCheckSuccess, nil)
 	assert.NoError(t, err)
 
-	ok, tries, wait, err := db.reservePinTry(nuser)
+	policy := &PinPolicy{}
+	policy.setDefaults()
+	try, err := db.reservePinTry(policy, nuser)
 	assert.NoError(t, err)
-	assert.True(t, ok)
-	assert.True(t, tries > 0)
-	assert.Equal(t, int64(0), wait)
+	assert.True(t, try.allowed)
+	assert.True(t, try.tries > 0)
+	assert.Equal(t, int64(0), try.wait)
 
 	err = db.setSeen(nuser)
 	assert.NoError(t, err)
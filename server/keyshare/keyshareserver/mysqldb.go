@@ -0,0 +1,395 @@
+package keyshareserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
+	"github.com/privacybydesign/irmago/server/keyshare"
+)
+
+// mysqlDB provides a MySQL/MariaDB-backed implementation of DB. Its tables reside in the database
+// specified in the connection string.
+
+type mysqlDB struct {
+	db keyshare.DB
+}
+
+// MySQL error number of duplicate entries in unique indices
+const mysqlErrDuplicateEntry = 1062
+
+func newMySQLDB(connstring string) (DB, error) {
+	connstring, err := keyshare.MySQLConnStr(connstring)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", connstring)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		return nil, errors.Errorf("failed to connect to database: %v", err)
+	}
+	if _, err = keyshare.MigrateUp(db, keyshare.DialectMySQL); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to migrate database", 0)
+	}
+	return &mysqlDB{
+		db: keyshare.DB{DB: db},
+	}, nil
+}
+
+func (db *mysqlDB) AddUser(user *User) error {
+	res, err := db.db.Exec("INSERT INTO users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES (?, ?, ?, ?, 0, 0)",
+		user.Username,
+		user.Language,
+		user.Secrets,
+		time.Now().Unix())
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return errUserAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.id = id
+	return nil
+}
+
+func (db *mysqlDB) user(username string) (*User, error) {
+	var result User
+	err := db.db.QueryUser(
+		"SELECT id, username, language, coredata FROM users WHERE username = ? AND coredata IS NOT NULL",
+		[]interface{}{&result.id, &result.Username, &result.Language, &result.Secrets},
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (db *mysqlDB) updateUser(user *User) error {
+	if user.device != 0 {
+		err := db.db.ExecUser("UPDATE devices SET coredata = ? WHERE id = ?", user.Secrets, user.device)
+		if err != nil {
+			return err
+		}
+		return db.db.ExecUser(
+			"UPDATE users SET username = ?, language = ? WHERE id = ?",
+			user.Username,
+			user.Language,
+			user.id,
+		)
+	}
+	return db.db.ExecUser(
+		"UPDATE users SET username = ?, language = ?, coredata = ? WHERE id = ?",
+		user.Username,
+		user.Language,
+		user.Secrets,
+		user.id,
+	)
+}
+
+// pinRecord returns the table, row id and liveness condition of the record containing the PIN
+// attempt state of the user's device.
+func (db *mysqlDB) pinRecord(user *User) (string, int64, string) {
+	if user.device != 0 {
+		return "devices", user.device, "revoked_on IS NULL"
+	}
+	return "users", user.id, "coredata IS NOT NULL"
+}
+
+func (db *mysqlDB) reservePinTry(policy *PinPolicy, user *User) (pinTry, error) {
+	// Lock the user's row while we determine and store the outcome of the attempt, so that
+	// concurrent attempts cannot both use the same try
+	tx, err := db.db.Begin()
+	if err != nil {
+		return pinTry{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var (
+		failed    int
+		blockDate int64
+		now       = time.Now().Unix()
+	)
+	table, id, live := db.pinRecord(user)
+	err = tx.QueryRow("SELECT pin_counter, pin_block_date FROM "+table+" WHERE id = ? AND "+live+" FOR UPDATE", id).
+		Scan(&failed, &blockDate)
+	if err == sql.ErrNoRows {
+		return pinTry{}, keyshare.ErrUserNotFound
+	}
+	if err != nil {
+		return pinTry{}, err
+	}
+
+	try, blockDate := policy.reserve(failed, blockDate, now)
+	if try.allowed {
+		_, err = tx.Exec("UPDATE "+table+" SET pin_counter = ?, pin_block_date = ? WHERE id = ?", failed+1, blockDate, id)
+		if err != nil {
+			return pinTry{}, err
+		}
+	}
+	return try, tx.Commit()
+}
+
+func (db *mysqlDB) resetPinTries(user *User) error {
+	table, id, _ := db.pinRecord(user)
+	return db.db.ExecUser(
+		"UPDATE "+table+" SET pin_counter = 0, pin_block_date = 0 WHERE id = ?",
+		id,
+	)
+}
+
+func (db *mysqlDB) unblockUser(user *User) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET pin_counter = 0, pin_block_date = 0 WHERE id = ?", user.id)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	if _, err = tx.Exec("UPDATE devices SET pin_counter = 0, pin_block_date = 0 WHERE user_id = ?", user.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *mysqlDB) setSeen(user *User) error {
+	if user.device != 0 {
+		err := db.db.ExecUser("UPDATE devices SET last_seen = ? WHERE id = ?", time.Now().Unix(), user.device)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If the user is scheduled for deletion (delete_on is not null), undo that by resetting
+	// delete_on back to null, but only if the user did not explicitly delete her account herself
+	// in the myIRMA website, in which case coredata is null.
+	return db.db.ExecUser(
+		`UPDATE users
+		 SET last_seen = ?,
+		     delete_on = CASE
+		         WHEN coredata IS NOT NULL THEN NULL
+		         ELSE delete_on
+		     END
+		 WHERE id = ?`,
+		time.Now().Unix(), user.id,
+	)
+}
+
+func (db *mysqlDB) addLog(user *User, eventType eventType, param interface{}) error {
+	var encodedParamString *string
+	if param != nil {
+		encodedParam, err := json.Marshal(param)
+		if err != nil {
+			return err
+		}
+		encodedParams := string(encodedParam)
+		encodedParamString = &encodedParams
+	}
+
+	_, err := db.db.Exec("INSERT INTO log_entry_records (time, event, param, user_id, device_id) VALUES (?, ?, ?, ?, ?)",
+		time.Now().Unix(),
+		eventType,
+		encodedParamString,
+		user.id,
+		sql.NullInt64{Int64: user.device, Valid: user.device != 0})
+	return err
+}
+
+func (db *mysqlDB) addEmailVerification(user *User, emailAddress, token string) error {
+	_, err := db.db.Exec("INSERT INTO email_verification_tokens (token, email, user_id, expiry) VALUES (?, ?, ?, ?)",
+		token,
+		emailAddress,
+		user.id,
+		time.Now().Add(emailTokenValidity*time.Hour).Unix())
+	return err
+}
+
+func (db *mysqlDB) emailAddresses(user *User) ([]string, error) {
+	var emails []string
+	err := db.db.QueryIterate(
+		"SELECT email FROM emails WHERE user_id = ? AND delete_on IS NULL ORDER BY email",
+		func(rows *sql.Rows) error {
+			var email string
+			err := rows.Scan(&email)
+			emails = append(emails, email)
+			return err
+		},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (db *mysqlDB) loadDevice(user *User, deviceID string) error {
+	return db.db.QueryUser(
+		"SELECT id, coredata FROM devices WHERE device_id = ? AND user_id = ? AND revoked_on IS NULL",
+		[]interface{}{&user.device, &user.Secrets},
+		deviceID, user.id,
+	)
+}
+
+func (db *mysqlDB) addDeviceLinkCode(user *User, code string, expiry int64) error {
+	_, err := db.db.Exec("INSERT INTO device_link_codes (code, user_id, expiry) VALUES (?, ?, ?)",
+		code, user.id, expiry)
+	return err
+}
+
+func (db *mysqlDB) consumeDeviceLinkCode(username, code string) (*User, error) {
+	var result User
+	err := db.db.QueryUser(
+		`SELECT users.id, username, language, coredata FROM users
+		 INNER JOIN device_link_codes ON users.id = device_link_codes.user_id
+		 WHERE username = ? AND code = ? AND expiry >= ? AND coredata IS NOT NULL`,
+		[]interface{}{&result.id, &result.Username, &result.Language, &result.Secrets},
+		username, code, time.Now().Unix(),
+	)
+	if err == keyshare.ErrUserNotFound {
+		return nil, errInvalidLinkCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the caller that actually removes the code may use it
+	aff, err := db.db.ExecCount("DELETE FROM device_link_codes WHERE code = ?", code)
+	if err != nil {
+		return nil, err
+	}
+	if aff != 1 {
+		return nil, errInvalidLinkCode
+	}
+	return &result, nil
+}
+
+func (db *mysqlDB) addDevice(user *User, deviceID, name string, secrets keysharecore.UserSecrets) error {
+	now := time.Now().Unix()
+	res, err := db.db.Exec(
+		`INSERT INTO devices (user_id, device_id, name, coredata, pin_counter, pin_block_date, created, last_seen)
+		 VALUES (?, ?, ?, ?, 0, 0, ?, ?)`,
+		user.id, deviceID, name, secrets, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.device = id
+	user.Secrets = secrets
+	return nil
+}
+
+func (db *mysqlDB) adminUser(username string) (*User, error) {
+	var result User
+	err := db.db.QueryUser(
+		"SELECT id, username, language, coredata FROM users WHERE username = ?",
+		[]interface{}{&result.id, &result.Username, &result.Language, &result.Secrets},
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (db *mysqlDB) usernamesByEmail(email string) ([]string, error) {
+	var usernames []string
+	err := db.db.QueryIterate(
+		"SELECT username FROM users INNER JOIN emails ON users.id = emails.user_id WHERE emails.email = ? ORDER BY username",
+		func(rows *sql.Rows) error {
+			var username string
+			err := rows.Scan(&username)
+			usernames = append(usernames, username)
+			return err
+		},
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func (db *mysqlDB) userStatus(user *User) (*UserStatus, error) {
+	status := &UserStatus{}
+	err := db.db.QueryUser(
+		`SELECT username, language, last_seen, pin_counter, pin_block_date, delete_on, (coredata IS NULL) AS deleted
+		 FROM users WHERE id = ?`,
+		[]interface{}{&status.Username, &status.Language, &status.LastSeen, &status.PinCounter,
+			&status.BlockedUntil, &status.DeleteOn, &status.Deleted},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.db.QueryIterate(
+		"SELECT email, delete_on FROM emails WHERE user_id = ? ORDER BY email",
+		func(rows *sql.Rows) error {
+			var email UserEmail
+			err := rows.Scan(&email.Email, &email.DeleteOn)
+			status.Emails = append(status.Emails, email)
+			return err
+		},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (db *mysqlDB) userLogs(user *User, offset, amount int) ([]LogEntry, error) {
+	var result []LogEntry
+	err := db.db.QueryIterate(
+		"SELECT time, event, param FROM log_entry_records WHERE user_id = ? ORDER BY time DESC, id DESC LIMIT ? OFFSET ?",
+		func(rows *sql.Rows) error {
+			var entry LogEntry
+			err := rows.Scan(&entry.Timestamp, &entry.Event, &entry.Param)
+			result = append(result, entry)
+			return err
+		},
+		user.id, amount, offset)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *mysqlDB) cancelUserRemoval(user *User) error {
+	// Also update last_seen, otherwise the expiry task would schedule the account for deletion again
+	aff, err := db.db.ExecCount(
+		"UPDATE users SET delete_on = NULL, last_seen = ? WHERE id = ? AND delete_on IS NOT NULL AND coredata IS NOT NULL",
+		time.Now().Unix(),
+		user.id,
+	)
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errNoDeletionToCancel
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package keyshareserver
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// PinPolicy determines how many PIN attempts users get, and for how long their accounts are
+// blocked after too many failed attempts.
+type PinPolicy struct {
+	// Number of consecutive failed PIN attempts allowed before the account is blocked
+	FreeAttempts int `json:"free_attempts" mapstructure:"free_attempts"`
+	// Duration in seconds of the first block
+	BackoffBase int64 `json:"backoff_base" mapstructure:"backoff_base"`
+	// Factor by which the duration of each subsequent block is multiplied
+	BackoffMultiplier int64 `json:"backoff_multiplier" mapstructure:"backoff_multiplier"`
+	// Maximum duration of a block in seconds, 0 for no maximum
+	MaxBlockDuration int64 `json:"max_block_duration" mapstructure:"max_block_duration"`
+	// If nonzero, the account is locked after this many blocks, until it is unblocked by the user
+	// in MyIRMA or by an operator using the admin API
+	LockAfterBlocks int `json:"lock_after_blocks" mapstructure:"lock_after_blocks"`
+}
+
+const (
+	PinFreeAttemptsDefault      = 3
+	PinBackoffBaseDefault       = 60 // seconds
+	PinBackoffMultiplierDefault = 2
+)
+
+// Upper bound for block durations in seconds (about 30 years), preventing overflows when no
+// maximum block duration is configured.
+const pinBlockDurationLimit int64 = 1 << 30
+
+// pinTry is the outcome of reserving a PIN attempt. As the attempt is reserved before the PIN is
+// verified, the fields other than allowed describe the situation after the attempt has failed.
+type pinTry struct {
+	// Whether the attempt is allowed (false if the account is blocked or locked)
+	allowed bool
+	// Number of attempts remaining
+	tries int
+	// Number of seconds until the next attempt is allowed, if tries is 0 and the account is not locked
+	wait int64
+	// Whether the account is locked until it is unblocked by the user or an operator, in which
+	// case there is no time after which the next attempt is allowed
+	locked bool
+}
+
+func (p *PinPolicy) setDefaults() {
+	if p.FreeAttempts == 0 {
+		p.FreeAttempts = PinFreeAttemptsDefault
+	}
+	if p.BackoffBase == 0 {
+		p.BackoffBase = PinBackoffBaseDefault
+	}
+	if p.BackoffMultiplier == 0 {
+		p.BackoffMultiplier = PinBackoffMultiplierDefault
+	}
+}
+
+func (p *PinPolicy) validate() error {
+	if p.FreeAttempts < 1 {
+		return errors.New("PIN policy: free attempts must be at least 1")
+	}
+	if p.BackoffBase < 1 {
+		return errors.New("PIN policy: backoff base must be at least 1 second")
+	}
+	if p.BackoffMultiplier < 1 {
+		return errors.New("PIN policy: backoff multiplier must be at least 1")
+	}
+	if p.MaxBlockDuration < 0 {
+		return errors.New("PIN policy: maximum block duration must not be negative")
+	}
+	if p.MaxBlockDuration != 0 && p.MaxBlockDuration < p.BackoffBase {
+		return errors.New("PIN policy: maximum block duration must not be smaller than backoff base")
+	}
+	if p.LockAfterBlocks < 0 {
+		return errors.New("PIN policy: lock after blocks must not be negative")
+	}
+	return nil
+}
+
+// tries returns the number of attempts remaining after the specified number of consecutive failed attempts.
+func (p *PinPolicy) tries(failed int) int {
+	if failed >= p.FreeAttempts {
+		return 0
+	}
+	return p.FreeAttempts - failed
+}
+
+// blockDuration returns how many seconds the account is blocked after the specified number of
+// consecutive failed attempts.
+func (p *PinPolicy) blockDuration(failed int) int64 {
+	if failed < p.FreeAttempts {
+		return 0
+	}
+	duration := p.BackoffBase
+	for i := p.FreeAttempts; i < failed && duration < pinBlockDurationLimit; i++ {
+		duration *= p.BackoffMultiplier
+	}
+	if duration > pinBlockDurationLimit {
+		duration = pinBlockDurationLimit
+	}
+	if p.MaxBlockDuration != 0 && duration > p.MaxBlockDuration {
+		duration = p.MaxBlockDuration
+	}
+	return duration
+}
+
+// locked returns whether the account is locked after the specified number of consecutive failed attempts.
+func (p *PinPolicy) locked(failed int) bool {
+	blocks := failed - p.FreeAttempts + 1
+	return p.LockAfterBlocks > 0 && blocks >= p.LockAfterBlocks
+}
+
+// reserve computes the outcome of reserving a PIN attempt for a user with the specified number of
+// consecutive failed attempts, and who is blocked until the specified unix timestamp. If the attempt
+// is allowed, the new block date that the database should store along with the incremented counter
+// is returned as well. Locked accounts are reported as such, without a wait, as they stay blocked
+// until they are unblocked.
+func (p *PinPolicy) reserve(failed int, blockDate, now int64) (pinTry, int64) {
+	if p.locked(failed) {
+		return pinTry{locked: true}, 0
+	}
+	if blockDate > now {
+		return pinTry{wait: blockDate - now}, 0
+	}
+
+	failed++
+	if p.locked(failed) {
+		return pinTry{allowed: true, locked: true}, now
+	}
+	wait := p.blockDuration(failed)
+	return pinTry{
+		allowed: true,
+		tries:   p.tries(failed),
+		wait:    wait,
+	}, now + wait
+}
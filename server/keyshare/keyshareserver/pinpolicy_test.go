@@ -0,0 +1,107 @@
+package keyshareserver
+
+import (
+	"strconv"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy PinPolicy
+		valid  bool
+	}{
+		{"defaults", PinPolicy{}, true},
+		{"single attempt", PinPolicy{FreeAttempts: 1}, true},
+		{"no attempts", PinPolicy{FreeAttempts: -1}, false},
+		{"negative base", PinPolicy{BackoffBase: -1}, false},
+		{"negative multiplier", PinPolicy{BackoffMultiplier: -2}, false},
+		{"negative max", PinPolicy{MaxBlockDuration: -1}, false},
+		{"max below base", PinPolicy{BackoffBase: 60, MaxBlockDuration: 30}, false},
+		{"max equals base", PinPolicy{BackoffBase: 60, MaxBlockDuration: 60}, true},
+		{"negative lock", PinPolicy{LockAfterBlocks: -1}, false},
+		{"lock", PinPolicy{LockAfterBlocks: 5}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.setDefaults()
+			err := tt.policy.validate()
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPinPolicyBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PinPolicy
+		failed   int
+		tries    int
+		duration int64
+		locked   bool
+	}{
+		{"first attempt", PinPolicy{}, 0, 3, 0, false},
+		{"last free attempt", PinPolicy{}, 2, 1, 0, false},
+		{"first block", PinPolicy{}, 3, 0, 60, false},
+		{"second block", PinPolicy{}, 4, 0, 120, false},
+		{"third block", PinPolicy{}, 5, 0, 240, false},
+		{"constant backoff", PinPolicy{BackoffMultiplier: 1}, 10, 0, 60, false},
+		{"capped", PinPolicy{MaxBlockDuration: 100}, 5, 0, 100, false},
+		{"overflow", PinPolicy{}, 1000, 0, pinBlockDurationLimit, false},
+		{"before lock", PinPolicy{LockAfterBlocks: 2}, 3, 0, 60, false},
+		{"lock", PinPolicy{LockAfterBlocks: 2}, 4, 0, 120, true},
+		{"lock on first block", PinPolicy{LockAfterBlocks: 1}, 3, 0, 60, true},
+		{"custom", PinPolicy{FreeAttempts: 5, BackoffBase: 10, BackoffMultiplier: 3}, 7, 0, 90, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.setDefaults()
+			assert.Equal(t, tt.tries, tt.policy.tries(tt.failed))
+			assert.Equal(t, tt.duration, tt.policy.blockDuration(tt.failed))
+			assert.Equal(t, tt.locked, tt.policy.locked(tt.failed))
+		})
+	}
+}
+
+func TestPinPolicyReserve(t *testing.T) {
+	const now = 1000
+	tests := []struct {
+		name         string
+		policy       PinPolicy
+		failed       int
+		blockDate    int64
+		try          pinTry
+		newBlockDate int64
+	}{
+		{"first attempt", PinPolicy{}, 0, 0, pinTry{allowed: true, tries: 2}, now},
+		{"last free attempt", PinPolicy{}, 2, 0, pinTry{allowed: true, wait: 60}, now + 60},
+		{"blocked", PinPolicy{}, 3, now + 30, pinTry{wait: 30}, 0},
+		{"block expired", PinPolicy{}, 3, now, pinTry{allowed: true, wait: 120}, now + 120},
+		{"becomes locked", PinPolicy{LockAfterBlocks: 2}, 3, now - 1, pinTry{allowed: true, locked: true}, now},
+		{"locked", PinPolicy{LockAfterBlocks: 2}, 4, now - 1, pinTry{locked: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.setDefaults()
+			try, blockDate := tt.policy.reserve(tt.failed, tt.blockDate, now)
+			assert.Equal(t, tt.try, try)
+			assert.Equal(t, tt.newBlockDate, blockDate)
+		})
+	}
+}
+
+func TestPinBlockedStatus(t *testing.T) {
+	assert.Equal(t, irma.KeysharePinStatus{Status: "error", Message: "30"}, pinBlockedStatus(pinTry{wait: 30}))
+
+	// Clients unaware of locking see locked accounts as blocked for as long as possible
+	status := pinBlockedStatus(pinTry{locked: true})
+	assert.True(t, status.Locked)
+	assert.Equal(t, strconv.FormatInt(pinBlockDurationLimit, 10), status.Message)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/go-errors/errors"
 	_ "github.com/jackc/pgx/stdlib"
 	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
@@ -19,13 +20,8 @@ type postgresDB struct {
 	db keyshare.DB
 }
 
-const maxPinTries = 3         // Number of tries allowed on pin before we start with exponential backoff
 const emailTokenValidity = 24 // amount of time user's email validation token is valid (in hours)
 
-// Initial amount of time user is forced to back off when having multiple pin failures (in seconds).
-// var so that tests may change it.
-var backoffStart int64 = 60
-
 func newPostgresDB(connstring string) (DB, error) {
 	db, err := sql.Open("pgx", connstring)
 	if err != nil {
@@ -34,6 +30,9 @@ func newPostgresDB(connstring string) (DB, error) {
 	if err = db.Ping(); err != nil {
 		return nil, errors.Errorf("failed to connect to database: %v", err)
 	}
+	if _, err = keyshare.MigrateUp(db, keyshare.DialectPostgres); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to migrate database", 0)
+	}
 	return &postgresDB{
 		db: keyshare.DB{DB: db},
 	}, nil
@@ -78,6 +77,18 @@ func (db *postgresDB) user(username string) (*User, error) {
 }
 
 func (db *postgresDB) updateUser(user *User) error {
+	if user.device != 0 {
+		err := db.db.ExecUser("UPDATE irma.devices SET coredata = $1 WHERE id = $2", user.Secrets, user.device)
+		if err != nil {
+			return err
+		}
+		return db.db.ExecUser(
+			"UPDATE irma.users SET username = $1, language = $2 WHERE id = $3",
+			user.Username,
+			user.Language,
+			user.id,
+		)
+	}
 	return db.db.ExecUser(
 		"UPDATE irma.users SET username = $1, language = $2, coredata = $3 WHERE id=$4",
 		user.Username,
@@ -87,81 +98,89 @@ func (db *postgresDB) updateUser(user *User) error {
 	)
 }
 
-func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
-	// Check that account is not blocked already, and if not,
-	//  update pinCounter and pinBlockDate
-	uprows, err := db.db.Query(`
-		UPDATE irma.users
-		SET pin_counter = pin_counter+1,
-			pin_block_date = $1 + CASE WHEN pin_counter-$3 < 0 THEN 0
-			                           ELSE $2*2^GREATEST(0, pin_counter-$3)
-			                      END
-		WHERE id=$4 AND pin_block_date<=$1 AND coredata IS NOT NULL
-		RETURNING pin_counter, pin_block_date`,
-		time.Now().Unix(),
-		backoffStart,
-		maxPinTries-1,
-		user.id)
+// pinRecord returns the table, row id and liveness condition of the record containing the PIN
+// attempt state of the user's device.
+func (db *postgresDB) pinRecord(user *User) (string, int64, string) {
+	if user.device != 0 {
+		return "irma.devices", user.device, "revoked_on IS NULL"
+	}
+	return "irma.users", user.id, "coredata IS NOT NULL"
+}
+
+func (db *postgresDB) reservePinTry(policy *PinPolicy, user *User) (pinTry, error) {
+	// Lock the user's row while we determine and store the outcome of the attempt, so that
+	// concurrent attempts cannot both use the same try
+	tx, err := db.db.Begin()
 	if err != nil {
-		return false, 0, 0, err
+		return pinTry{}, err
 	}
-	defer common.Close(uprows)
+	defer func() { _ = tx.Rollback() }()
 
 	var (
-		allowed bool
-		wait    int64
-		tries   int
+		failed    int
+		blockDate int64
+		now       = time.Now().Unix()
 	)
-	if !uprows.Next() {
-		if err = uprows.Err(); err != nil {
-			return false, 0, 0, err
-		}
-		// if no results, then account either does not exist (which would be weird here) or is blocked
-		// so request wait timeout
-		pinrows, err := db.db.Query("SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
-		if err != nil {
-			return false, 0, 0, err
-		}
-		defer common.Close(pinrows)
-		if !pinrows.Next() {
-			if err = pinrows.Err(); err != nil {
-				return false, 0, 0, err
-			}
-			return false, 0, 0, keyshare.ErrUserNotFound
-		}
-		err = pinrows.Scan(&wait)
-		if err != nil {
-			return false, 0, 0, err
-		}
-	} else {
-		// Pin check is allowed (implied since there is a result, so pinBlockDate <= now)
-		//  calculate tries remaining and wait time
-		allowed = true
-		err = uprows.Scan(&tries, &wait)
-		if err != nil {
-			return false, 0, 0, err
-		}
-		tries = maxPinTries - tries
-		if tries < 0 {
-			tries = 0
-		}
+	table, id, live := db.pinRecord(user)
+	err = tx.QueryRow("SELECT pin_counter, pin_block_date FROM "+table+" WHERE id = $1 AND "+live+" FOR UPDATE", id).
+		Scan(&failed, &blockDate)
+	if err == sql.ErrNoRows {
+		return pinTry{}, keyshare.ErrUserNotFound
+	}
+	if err != nil {
+		return pinTry{}, err
 	}
 
-	wait = wait - time.Now().Unix()
-	if wait < 0 {
-		wait = 0
+	try, blockDate := policy.reserve(failed, blockDate, now)
+	if try.allowed {
+		_, err = tx.Exec("UPDATE "+table+" SET pin_counter = $2, pin_block_date = $3 WHERE id = $1", id, failed+1, blockDate)
+		if err != nil {
+			return pinTry{}, err
+		}
 	}
-	return allowed, tries, wait, nil
+	return try, tx.Commit()
 }
 
 func (db *postgresDB) resetPinTries(user *User) error {
+	table, id, _ := db.pinRecord(user)
 	return db.db.ExecUser(
-		"UPDATE irma.users SET pin_counter = 0, pin_block_date = 0 WHERE id = $1",
-		user.id,
+		"UPDATE "+table+" SET pin_counter = 0, pin_block_date = 0 WHERE id = $1",
+		id,
 	)
 }
 
+func (db *postgresDB) unblockUser(user *User) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE irma.users SET pin_counter = 0, pin_block_date = 0 WHERE id = $1", user.id)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	if _, err = tx.Exec("UPDATE irma.devices SET pin_counter = 0, pin_block_date = 0 WHERE user_id = $1", user.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *postgresDB) setSeen(user *User) error {
+	if user.device != 0 {
+		err := db.db.ExecUser("UPDATE irma.devices SET last_seen = $1 WHERE id = $2", time.Now().Unix(), user.device)
+		if err != nil {
+			return err
+		}
+	}
+
 	// If the user is scheduled for deletion (delete_on is not null), undo that by resetting
 	// delete_on back to null, but only if the user did not explicitly delete her account herself
 	// in the myIRMA website, in which case coredata is null.
@@ -188,11 +207,12 @@ func (db *postgresDB) addLog(user *User, eventType eventType, param interface{})
 		encodedParamString = &encodedParams
 	}
 
-	_, err := db.db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id) VALUES ($1, $2, $3, $4)",
+	_, err := db.db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id, device_id) VALUES ($1, $2, $3, $4, $5)",
 		time.Now().Unix(),
 		eventType,
 		encodedParamString,
-		user.id)
+		user.id,
+		sql.NullInt64{Int64: user.device, Valid: user.device != 0})
 	return err
 }
 
@@ -204,3 +224,172 @@ func (db *postgresDB) addEmailVerification(user *User, emailAddress, token strin
 		time.Now().Add(emailTokenValidity*time.Hour).Unix())
 	return err
 }
+
+func (db *postgresDB) emailAddresses(user *User) ([]string, error) {
+	var emails []string
+	err := db.db.QueryIterate(
+		"SELECT email FROM irma.emails WHERE user_id = $1 AND delete_on IS NULL ORDER BY email",
+		func(rows *sql.Rows) error {
+			var email string
+			err := rows.Scan(&email)
+			emails = append(emails, email)
+			return err
+		},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (db *postgresDB) loadDevice(user *User, deviceID string) error {
+	return db.db.QueryUser(
+		"SELECT id, coredata FROM irma.devices WHERE device_id = $1 AND user_id = $2 AND revoked_on IS NULL",
+		[]interface{}{&user.device, &user.Secrets},
+		deviceID, user.id,
+	)
+}
+
+func (db *postgresDB) addDeviceLinkCode(user *User, code string, expiry int64) error {
+	_, err := db.db.Exec("INSERT INTO irma.device_link_codes (code, user_id, expiry) VALUES ($1, $2, $3)",
+		code, user.id, expiry)
+	return err
+}
+
+func (db *postgresDB) consumeDeviceLinkCode(username, code string) (*User, error) {
+	var result User
+	err := db.db.QueryUser(
+		`SELECT users.id, username, language, coredata FROM irma.users
+		 INNER JOIN irma.device_link_codes ON users.id = device_link_codes.user_id
+		 WHERE username = $1 AND code = $2 AND expiry >= $3 AND coredata IS NOT NULL`,
+		[]interface{}{&result.id, &result.Username, &result.Language, &result.Secrets},
+		username, code, time.Now().Unix(),
+	)
+	if err == keyshare.ErrUserNotFound {
+		return nil, errInvalidLinkCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the caller that actually removes the code may use it
+	aff, err := db.db.ExecCount("DELETE FROM irma.device_link_codes WHERE code = $1", code)
+	if err != nil {
+		return nil, err
+	}
+	if aff != 1 {
+		return nil, errInvalidLinkCode
+	}
+	return &result, nil
+}
+
+func (db *postgresDB) addDevice(user *User, deviceID, name string, secrets keysharecore.UserSecrets) error {
+	now := time.Now().Unix()
+	var id int64
+	err := db.db.QueryScan(
+		`INSERT INTO irma.devices (user_id, device_id, name, coredata, pin_counter, pin_block_date, created, last_seen)
+		 VALUES ($1, $2, $3, $4, 0, 0, $5, $5) RETURNING id`,
+		[]interface{}{&id},
+		user.id, deviceID, name, secrets, now,
+	)
+	if err != nil {
+		return err
+	}
+	user.device = id
+	user.Secrets = secrets
+	return nil
+}
+
+func (db *postgresDB) adminUser(username string) (*User, error) {
+	var result User
+	err := db.db.QueryUser(
+		"SELECT id, username, language, coredata FROM irma.users WHERE username = $1",
+		[]interface{}{&result.id, &result.Username, &result.Language, &result.Secrets},
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (db *postgresDB) usernamesByEmail(email string) ([]string, error) {
+	var usernames []string
+	err := db.db.QueryIterate(
+		"SELECT username FROM irma.users INNER JOIN irma.emails ON users.id = emails.user_id WHERE emails.email = $1 ORDER BY username",
+		func(rows *sql.Rows) error {
+			var username string
+			err := rows.Scan(&username)
+			usernames = append(usernames, username)
+			return err
+		},
+		email,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func (db *postgresDB) userStatus(user *User) (*UserStatus, error) {
+	status := &UserStatus{}
+	err := db.db.QueryUser(
+		`SELECT username, language, last_seen, pin_counter, pin_block_date, delete_on, (coredata IS NULL) AS deleted
+		 FROM irma.users WHERE id = $1`,
+		[]interface{}{&status.Username, &status.Language, &status.LastSeen, &status.PinCounter,
+			&status.BlockedUntil, &status.DeleteOn, &status.Deleted},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.db.QueryIterate(
+		"SELECT email, delete_on FROM irma.emails WHERE user_id = $1 ORDER BY email",
+		func(rows *sql.Rows) error {
+			var email UserEmail
+			err := rows.Scan(&email.Email, &email.DeleteOn)
+			status.Emails = append(status.Emails, email)
+			return err
+		},
+		user.id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (db *postgresDB) userLogs(user *User, offset, amount int) ([]LogEntry, error) {
+	var result []LogEntry
+	err := db.db.QueryIterate(
+		"SELECT time, event, param FROM irma.log_entry_records WHERE user_id = $1 ORDER BY time DESC, id DESC OFFSET $2 LIMIT $3",
+		func(rows *sql.Rows) error {
+			var entry LogEntry
+			err := rows.Scan(&entry.Timestamp, &entry.Event, &entry.Param)
+			result = append(result, entry)
+			return err
+		},
+		user.id, offset, amount)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *postgresDB) cancelUserRemoval(user *User) error {
+	// Also update last_seen, otherwise the expiry task would schedule the account for deletion again
+	aff, err := db.db.ExecCount(
+		"UPDATE irma.users SET delete_on = NULL, last_seen = $2 WHERE id = $1 AND delete_on IS NOT NULL AND coredata IS NOT NULL",
+		user.id,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errNoDeletionToCancel
+	}
+	return nil
+}
@@ -2,9 +2,15 @@ package keyshareserver
 
 import (
 	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -19,6 +25,7 @@ import (
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/keyshare"
 
 	"github.com/go-chi/chi"
 )
@@ -38,9 +45,18 @@ type Server struct {
 
 	// Session data, keeping track of current keyshare protocol session state for each user
 	store sessionStore
+
+	// Security notification emails being sent in the background
+	sendingEmails sync.WaitGroup
 }
 
-var errMissingCommitment = errors.New("missing previous call to getCommitments")
+// deviceLinkCodeValidity is how long a device link code can be used after it was generated.
+const deviceLinkCodeValidity = 10 * time.Minute
+
+var (
+	errMissingCommitment  = errors.New("missing previous call to getCommitments")
+	errInvalidSessionInfo = errors.New("invalid session info")
+)
 
 func New(conf *Configuration) (*Server, error) {
 	var err error
@@ -69,6 +85,19 @@ func New(conf *Configuration) (*Server, error) {
 			return nil, err
 		}
 	}
+	var (
+		sqldb   *sql.DB
+		dialect keyshare.Dialect
+	)
+	switch db := s.db.(type) {
+	case *postgresDB:
+		sqldb, dialect = db.db.DB, keyshare.DialectPostgres
+	case *mysqlDB:
+		sqldb, dialect = db.db.DB, keyshare.DialectMySQL
+	}
+	if err = conf.SetupMailer(sqldb, dialect, conf.Logger); err != nil {
+		return nil, server.LogError(err)
+	}
 	s.core, err = setupCore(conf)
 	if err != nil {
 		return nil, err
@@ -95,6 +124,7 @@ func New(conf *Configuration) (*Server, error) {
 func (s *Server) Stop() {
 	s.stopScheduler <- true
 	s.irmaserv.Stop()
+	s.sendingEmails.Wait()
 }
 
 func (s *Server) Handler() http.Handler {
@@ -109,6 +139,7 @@ func (s *Server) Handler() http.Handler {
 
 		// Registration
 		router.Post("/client/register", s.handleRegister)
+		router.Post("/client/link", s.handleLinkDevice)
 
 		// Pin logic
 		router.Post("/users/verify/pin", s.handleVerifyPin)
@@ -120,9 +151,24 @@ func (s *Server) Handler() http.Handler {
 			router.Use(s.authorizationMiddleware)
 			router.Post("/prove/getCommitments", s.handleCommitments)
 			router.Post("/prove/getResponse", s.handleResponse)
+			router.Post("/users/devices/code", s.handleDeviceLinkCode)
 		})
 	})
 
+	// Admin API for operators, only available when admin tokens are configured
+	if len(s.conf.AdminTokens) > 0 {
+		router.Route("/admin", func(router chi.Router) {
+			router.Use(server.SizeLimitMiddleware)
+			router.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+
+			// Don't log headers, as these contain the admin token
+			opts := server.LogOptions{Response: true, Headers: false, From: false, EncodeBinary: true}
+			router.Use(server.LogMiddleware("keyshareserver-admin", opts))
+
+			s.adminHandler(router)
+		})
+	}
+
 	// IRMA server for issuing myirma credential during registration
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 	return router
@@ -167,7 +213,14 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commitments, err := s.generateCommitments(user, authorization, keys)
+	info, err := s.parseSessionInfo(r.Header.Get(irma.KeyshareSessionInfoHeader), keys)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Info("Malformed request: invalid session info")
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	commitments, err := s.generateCommitments(user, authorization, keys, info)
 	if err != nil && (err == keysharecore.ErrInvalidChallenge || err == keysharecore.ErrInvalidJWT) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -181,7 +234,57 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, commitments)
 }
 
-func (s *Server) generateCommitments(user *User, authorization string, keys []irma.PublicKeyIdentifier) (*irma.ProofPCommitmentMap, error) {
+// parseSessionInfo decodes the session info sent by the client, if any, and checks that the
+// credential types it mentions are consistent with the public keys of the commitments request.
+// Older clients don't send session info, in which case nil is returned.
+func (s *Server) parseSessionInfo(header string, keys []irma.PublicKeyIdentifier) (*irma.KeyshareSessionInfo, error) {
+	if header == "" {
+		return nil, nil
+	}
+	bts, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return nil, errInvalidSessionInfo
+	}
+	info := &irma.KeyshareSessionInfo{}
+	if err = json.Unmarshal(bts, info); err != nil {
+		return nil, errInvalidSessionInfo
+	}
+
+	switch info.Action {
+	case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing:
+	default:
+		return nil, errors.WrapPrefix(errInvalidSessionInfo, "unsupported action", 0)
+	}
+
+	// Each credential type must be issued by one of the issuers of the keys, and vice versa
+	issuers := map[irma.IssuerIdentifier]bool{}
+	for _, key := range keys {
+		issuers[key.Issuer] = false
+	}
+	for _, credtype := range info.CredentialTypes {
+		if s.conf.IrmaConfiguration.CredentialTypes[credtype] == nil {
+			return nil, errors.WrapPrefix(errInvalidSessionInfo, "unknown credential type "+credtype.String(), 0)
+		}
+		if _, ok := issuers[credtype.IssuerIdentifier()]; !ok {
+			return nil, errors.WrapPrefix(errInvalidSessionInfo, "no key for credential type "+credtype.String(), 0)
+		}
+		issuers[credtype.IssuerIdentifier()] = true
+	}
+	for issuer, used := range issuers {
+		if !used {
+			return nil, errors.WrapPrefix(errInvalidSessionInfo, "no credential type for key of "+issuer.String(), 0)
+		}
+	}
+
+	return info, nil
+}
+
+func (s *Server) generateCommitments(
+	user *User,
+	authorization string,
+	keys []irma.PublicKeyIdentifier,
+	info *irma.KeyshareSessionInfo,
+) (*irma.ProofPCommitmentMap, error) {
 	// Generate commitments
 	commitments, commitID, err := s.core.GenerateCommitments(user.Secrets, authorization, keys)
 	if err != nil {
@@ -200,9 +303,10 @@ func (s *Server) generateCommitments(user *User, authorization string, keys []ir
 	// the user comes back later to retrieve her response. gabi.ProofP.P will depend on this public
 	// key, which is used only during issuance. Thus, this assumes that during issuance, the user
 	// puts the key ID of the credential(s) being issued at index 0.
-	s.store.add(user.Username, &session{
+	s.store.add(user.key(), &session{
 		KeyID:    keys[0],
 		CommitID: commitID,
+		Info:     info,
 	})
 
 	// And send response
@@ -249,7 +353,7 @@ func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) generateResponse(user *User, authorization string, challenge *big.Int) (string, error) {
 	// Get data from session
-	sessionData := s.store.get(user.Username)
+	sessionData := s.store.get(user.key())
 	if sessionData == nil {
 		s.conf.Logger.Warn("Request for response without previous call to get commitments")
 		return "", errMissingCommitment
@@ -262,8 +366,12 @@ func (s *Server) generateResponse(user *User, authorization string, challenge *b
 		// Do not send to user
 	}
 
-	// Make log entry
-	err = s.db.addLog(user, eventTypeIRMASession, nil)
+	// Make log entry, including the session details if the client sent them
+	var param interface{}
+	if sessionData.Info != nil {
+		param = sessionData.Info
+	}
+	err = s.db.addLog(user, eventTypeIRMASession, param)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
 		return "", err
@@ -288,9 +396,8 @@ func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch user
-	user, err := s.db.user(msg.Username)
+	user, err := s.fetchUser(msg.Username, msg.DeviceID)
 	if err != nil {
-		s.conf.Logger.WithFields(logrus.Fields{"username": msg.Username, "error": err}).Warn("Could not find user in db")
 		server.WriteError(w, server.ErrorUserNotRegistered, "")
 		return
 	}
@@ -308,12 +415,12 @@ func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) verifyPin(user *User, pin string) (irma.KeysharePinStatus, error) {
 	// Check whether pin check is currently allowed
-	ok, tries, wait, err := s.reservePinCheck(user)
+	try, err := s.reservePinCheck(user)
 	if err != nil {
 		return irma.KeysharePinStatus{}, err
 	}
-	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+	if !try.allowed {
+		return pinBlockedStatus(try), nil
 	}
 
 	// At this point, we are allowed to do an actual check (we have successfully reserved a spot for it), so do it.
@@ -326,20 +433,29 @@ func (s *Server) verifyPin(user *User, pin string) (irma.KeysharePinStatus, erro
 
 	if err == keysharecore.ErrInvalidPin {
 		// Handle invalid pin
-		err = s.db.addLog(user, eventTypePinCheckFailed, tries)
+		err = s.db.addLog(user, eventTypePinCheckFailed, try.tries)
 		if err != nil {
 			s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
 			return irma.KeysharePinStatus{}, err
 		}
-		if tries == 0 {
-			err = s.db.addLog(user, eventTypePinCheckBlocked, wait)
+		if try.locked {
+			err = s.db.addLog(user, eventTypePinCheckLocked, nil)
+			if err != nil {
+				s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+				return irma.KeysharePinStatus{}, err
+			}
+			s.sendPinBlockedEmails(user, try)
+			return pinBlockedStatus(try), nil
+		} else if try.tries == 0 {
+			err = s.db.addLog(user, eventTypePinCheckBlocked, try.wait)
 			if err != nil {
 				s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
 				return irma.KeysharePinStatus{}, err
 			}
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			s.sendPinBlockedEmails(user, try)
+			return pinBlockedStatus(try), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", try.tries)}, nil
 		}
 	}
 
@@ -373,9 +489,8 @@ func (s *Server) handleChangePin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch user
-	user, err := s.db.user(msg.Username)
+	user, err := s.fetchUser(msg.Username, msg.DeviceID)
 	if err != nil {
-		s.conf.Logger.WithFields(logrus.Fields{"username": msg.Username, "error": err}).Warn("Could not find user in db")
 		server.WriteError(w, server.ErrorUserNotRegistered, "")
 		return
 	}
@@ -391,21 +506,21 @@ func (s *Server) handleChangePin(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) updatePin(user *User, oldPin, newPin string) (irma.KeysharePinStatus, error) {
 	// Check whether pin check is currently allowed
-	ok, tries, wait, err := s.reservePinCheck(user)
+	try, err := s.reservePinCheck(user)
 	if err != nil {
 		return irma.KeysharePinStatus{}, err
 	}
-	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+	if !try.allowed {
+		return pinBlockedStatus(try), nil
 	}
 
 	// Try to do the update
 	user.Secrets, err = s.core.ChangePin(user.Secrets, oldPin, newPin)
 	if err == keysharecore.ErrInvalidPin {
-		if tries == 0 {
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		if try.tries == 0 || try.locked {
+			return pinBlockedStatus(try), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", try.tries)}, nil
 		}
 	} else if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not change pin")
@@ -426,6 +541,8 @@ func (s *Server) updatePin(user *User, oldPin, newPin string) (irma.KeysharePinS
 		return irma.KeysharePinStatus{}, err
 	}
 
+	s.sendSecurityEmails(user, s.conf.pinChangedEmailTemplates, s.conf.PinChangedEmailSubjects, nil)
+
 	return irma.KeysharePinStatus{Status: "success"}, nil
 }
 
@@ -469,7 +586,7 @@ func (s *Server) register(msg irma.KeyshareEnrollment) (*irma.Qr, error) {
 	}
 
 	// Send email if user specified email address
-	if msg.Email != nil && *msg.Email != "" && s.conf.EmailServer != "" {
+	if msg.Email != nil && *msg.Email != "" && s.conf.EmailEnabled() {
 		err = s.sendRegistrationEmail(user, msg.Language, *msg.Email)
 		if err != nil {
 			// already logged in sendRegistrationEmail
@@ -493,6 +610,92 @@ func (s *Server) register(msg irma.KeyshareEnrollment) (*irma.Qr, error) {
 	return sessionptr, nil
 }
 
+// /users/devices/code
+func (s *Server) handleDeviceLinkCode(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	user := r.Context().Value("user").(*User)
+
+	// verify access
+	if !r.Context().Value("hasValidAuthorization").(bool) {
+		s.conf.Logger.Warn("Could not generate device link code due to invalid authorization")
+		server.WriteError(w, server.ErrorInvalidRequest, "Invalid authorization")
+		return
+	}
+
+	code, err := s.generateDeviceLinkCode(user)
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, code)
+}
+
+func (s *Server) generateDeviceLinkCode(user *User) (*irma.KeyshareDeviceLinkCode, error) {
+	code := &irma.KeyshareDeviceLinkCode{
+		Code:   common.NewSessionToken(),
+		Expiry: time.Now().Add(deviceLinkCodeValidity).Unix(),
+	}
+	err := s.db.addDeviceLinkCode(user, code.Code, code.Expiry)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not store device link code")
+		return nil, err
+	}
+	err = s.db.addLog(user, eventTypeDeviceLinkCode, nil)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+		return nil, err
+	}
+	return code, nil
+}
+
+// /client/link
+func (s *Server) handleLinkDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract request
+	var msg irma.KeyshareDeviceLink
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	result, err := s.linkDevice(msg)
+	if err != nil && (err == errInvalidLinkCode || err == keysharecore.ErrPinTooLong) {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, result)
+}
+
+func (s *Server) linkDevice(msg irma.KeyshareDeviceLink) (*irma.KeyshareDeviceLinkResult, error) {
+	user, err := s.db.consumeDeviceLinkCode(msg.Username, msg.Code)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Could not consume device link code")
+		return nil, err
+	}
+
+	secrets, err := s.core.NewDeviceSecrets(user.Secrets, msg.Pin)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not generate device secrets")
+		return nil, err
+	}
+	deviceID := common.NewSessionToken()
+	if err = s.db.addDevice(user, deviceID, msg.Name, secrets); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not store new device in database")
+		return nil, err
+	}
+	if err = s.db.addLog(user, eventTypeDeviceLinked, msg.Name); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+		return nil, err
+	}
+
+	return &irma.KeyshareDeviceLinkResult{DeviceID: deviceID}, nil
+}
+
 func (s *Server) sendRegistrationEmail(user *User, language, email string) error {
 	// Generate token
 	token := common.NewSessionToken()
@@ -514,15 +717,67 @@ func (s *Server) sendRegistrationEmail(user *User, language, email string) error
 	)
 }
 
+func (s *Server) sendPinBlockedEmails(user *User, try pinTry) {
+	s.sendSecurityEmails(user, s.conf.pinBlockedEmailTemplates, s.conf.PinBlockedEmailSubjects, map[string]string{
+		"Duration": strconv.FormatInt(try.wait, 10),
+		"Locked":   strconv.FormatBool(try.locked),
+	})
+}
+
+// sendSecurityEmails notifies the user of a security-relevant event on all of their email addresses,
+// if notifications for the event are configured. The templates receive the username along with the
+// specified data. The emails are sent in the background, so that the request that caused them does
+// not wait for the email server; failures are only logged, as they should not affect the request.
+func (s *Server) sendSecurityEmails(user *User, templates map[string]*template.Template, subjects, data map[string]string) {
+	if templates == nil || !s.conf.EmailEnabled() {
+		return
+	}
+
+	emails, err := s.db.emailAddresses(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not fetch email addresses of user")
+		return
+	}
+
+	templateData := map[string]string{"Username": user.Username}
+	for k, v := range data {
+		templateData[k] = v
+	}
+	language := user.Language
+	s.sendingEmails.Add(1)
+	go func() {
+		defer s.sendingEmails.Done()
+		for _, email := range emails {
+			// already logged
+			_ = s.conf.SendEmail(templates, subjects, templateData, email, language)
+		}
+	}()
+}
+
+// fetchUser fetches the specified user from the database and, if a device ID is specified,
+// loads the secrets of that device of the user.
+func (s *Server) fetchUser(username, deviceID string) (*User, error) {
+	user, err := s.db.user(username)
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find user in db")
+		return nil, err
+	}
+	if deviceID == "" {
+		return user, nil
+	}
+	if err = s.db.loadDevice(user, deviceID); err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find device of user in db")
+		return nil, err
+	}
+	return user, nil
+}
+
 func (s *Server) userMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract username from request
+		// Extract username and device from request, and fetch its information
 		username := r.Header.Get("X-IRMA-Keyshare-Username")
-
-		// and fetch its information
-		user, err := s.db.user(username)
+		user, err := s.fetchUser(username, r.Header.Get(irma.KeyshareDeviceHeader))
 		if err != nil {
-			s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find user in db")
 			server.WriteError(w, server.ErrorUserNotRegistered, err.Error())
 			return
 		}
@@ -553,19 +808,29 @@ func (s *Server) authorizationMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) reservePinCheck(user *User) (bool, int, int64, error) {
-	ok, tries, wait, err := s.db.reservePinTry(user)
+func (s *Server) reservePinCheck(user *User) (pinTry, error) {
+	try, err := s.db.reservePinTry(&s.conf.PinPolicy, user)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not reserve pin check slot")
-		return false, 0, 0, err
+		return pinTry{}, err
 	}
-	if !ok {
+	if !try.allowed {
 		err = s.db.addLog(user, eventTypePinCheckRefused, nil)
 		if err != nil {
 			s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-			return false, 0, 0, err
+			return pinTry{}, err
 		}
-		return false, tries, wait, nil
 	}
-	return true, tries, wait, nil
+	return try, nil
+}
+
+// pinBlockedStatus returns the status to send to the client when its account is blocked or locked.
+// Clients unaware of Locked expect the number of seconds that the account is blocked as message, so
+// to them a locked account is reported as blocked for the longest possible duration.
+func pinBlockedStatus(try pinTry) irma.KeysharePinStatus {
+	wait := try.wait
+	if try.locked {
+		wait = pinBlockDurationLimit
+	}
+	return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait), Locked: try.locked}
 }
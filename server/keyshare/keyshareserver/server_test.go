@@ -74,6 +74,28 @@ func TestServerHandleRegister(t *testing.T) {
 	)
 }
 
+func TestServerRegistrationEmailMailer(t *testing.T) {
+	mailer := &keyshare.RecordingMailer{}
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.Mailer = mailer
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","email":"test@test.com","language":"en"}`, nil,
+		200, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en"}`, nil,
+		200, nil,
+	)
+
+	require.Len(t, mailer.Emails(), 1)
+	assert.Equal(t, "test@test.com", mailer.Emails()[0].To)
+	assert.Equal(t, "testsubject", mailer.Emails()[0].Subject)
+	assert.Contains(t, string(mailer.Emails()[0].Body), "http://example.com/verify/")
+}
+
 func TestPinTries(t *testing.T) {
 	db := createDB(t)
 	keyshareServer, httpServer := StartKeyshareServer(t, &testDB{db: db, ok: true, tries: 1, wait: 0, err: nil}, "")
@@ -126,6 +148,40 @@ func TestPinNoRemainingTries(t *testing.T) {
 	}
 }
 
+func TestPinSecurityEmails(t *testing.T) {
+	testdataPath := test.FindTestdataFolder(t)
+	mailer := &keyshare.RecordingMailer{}
+	conf := testConfiguration(t, &testDB{db: createDB(t), ok: true, tries: 0, wait: 5, emails: []string{"test@example.com"}}, "")
+	conf.Mailer = mailer
+	conf.PinBlockedEmailFiles = map[string]string{"en": filepath.Join(testdataPath, "emailtemplate.html")}
+	conf.PinBlockedEmailSubjects = map[string]string{"en": "pinblocked"}
+	conf.PinChangedEmailFiles = map[string]string{"en": filepath.Join(testdataPath, "emailtemplate.html")}
+	conf.PinChangedEmailSubjects = map[string]string{"en": "pinchanged"}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "error", jwtMsg.Status)
+	keyshareServer.sendingEmails.Wait() // the emails are sent in the background
+	require.Len(t, mailer.Emails(), 1)
+	assert.Equal(t, "test@example.com", mailer.Emails()[0].To)
+	assert.Equal(t, "pinblocked", mailer.Emails()[0].Subject)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"testusername","oldpin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n","newpin":"ljaksdfj;alkf"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	keyshareServer.sendingEmails.Wait()
+	require.Len(t, mailer.Emails(), 2)
+	assert.Equal(t, "test@example.com", mailer.Emails()[1].To)
+	assert.Equal(t, "pinchanged", mailer.Emails()[1].Subject)
+}
+
 func TestMissingUser(t *testing.T) {
 	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
 	defer StopKeyshareServer(t, keyshareServer, httpServer)
@@ -224,9 +280,155 @@ func TestKeyshareSessions(t *testing.T) {
 	)
 }
 
+type sessionLogDB struct {
+	DB
+	params []interface{}
+}
+
+func (db *sessionLogDB) addLog(user *User, eventType eventType, param interface{}) error {
+	if eventType == eventTypeIRMASession {
+		db.params = append(db.params, param)
+	}
+	return db.DB.addLog(user, eventType, param)
+}
+
+func TestKeyshareSessionInfo(t *testing.T) {
+	db := &sessionLogDB{DB: createDB(t)}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+
+	header := func(info string) http.Header {
+		return http.Header{
+			"X-IRMA-Keyshare-Username":     []string{"testusername"},
+			"Authorization":                []string{jwtMsg.Message},
+			irma.KeyshareSessionInfoHeader: []string{base64.RawURLEncoding.EncodeToString([]byte(info))},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		info   string
+		status int
+	}{
+		{"not json", `{`, 400},
+		{"unknown action", `{"action":"test","credential_types":["test.test.mijnirma"]}`, 400},
+		{"unknown credential type", `{"action":"disclosing","credential_types":["test.test.unknown"]}`, 400},
+		{"credential type without key", `{"action":"disclosing","credential_types":["test.test.mijnirma","irma-demo.RU.studentCard"]}`, 400},
+		{"key without credential type", `{"action":"disclosing","credential_types":[]}`, 400},
+		{"valid", `{"action":"disclosing","requestor_hostname":"example.com","credential_types":["test.test.mijnirma","test.test.email"]}`, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments",
+				`["test.test-3"]`, header(tt.info), tt.status, nil,
+			)
+		})
+	}
+
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse",
+		"12345678", header(""), 200, nil,
+	)
+	require.Len(t, db.params, 1)
+	assert.Equal(t, &irma.KeyshareSessionInfo{
+		Action:            irma.ActionDisclosing,
+		RequestorHostname: "example.com",
+		CredentialTypes: []irma.CredentialTypeIdentifier{
+			irma.NewCredentialTypeIdentifier("test.test.mijnirma"),
+			irma.NewCredentialTypeIdentifier("test.test.email"),
+		},
+	}, db.params[0])
+
+	// Clients that don't send session info still get a log entry, without details
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments",
+		`["test.test-3"]`, http.Header{
+			"X-IRMA-Keyshare-Username": []string{"testusername"},
+			"Authorization":            []string{jwtMsg.Message},
+		},
+		200, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse",
+		"12345678", header(""), 200, nil,
+	)
+	require.Len(t, db.params, 2)
+	assert.Nil(t, db.params[1])
+}
+
+func TestDeviceLinking(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, createDB(t), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	header := func(jwt, device string) http.Header {
+		h := http.Header{
+			"X-IRMA-Keyshare-Username": []string{"testusername"},
+			"Authorization":            []string{jwt},
+		}
+		if device != "" {
+			h.Set(irma.KeyshareDeviceHeader, device)
+		}
+		return h
+	}
+
+	// Generating a link code requires authorization
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/code", "", header("fakeauthorization", ""), 400, nil)
+	var code irma.KeyshareDeviceLinkCode
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/code", "", header(jwtMsg.Message, ""), 200, &code)
+	require.NotEmpty(t, code.Code)
+
+	// The code links a device once
+	var result irma.KeyshareDeviceLinkResult
+	link := func(username, code string) string {
+		return `{"id":"` + username + `","code":"` + code + `","pin":"newdevicepin","name":"Second phone"}`
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/client/link", link("testusername", "wrongcode"), nil, 400, nil)
+	// A code used with another username is rejected, without being consumed
+	test.HTTPPost(t, nil, "http://localhost:8080/client/link", link("otherusername", code.Code), nil, 400, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/link", link("testusername", code.Code), nil, 200, &result)
+	require.NotEmpty(t, result.DeviceID)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/link", link("testusername", code.Code), nil, 400, nil)
+
+	// The device has its own PIN and authorization
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","device_id":"`+result.DeviceID+`","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "failure", jwtMsg.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","device_id":"`+result.DeviceID+`","pin":"newdevicepin"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments",
+		`["test.test-3"]`, header(jwtMsg.Message, result.DeviceID), 200, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse",
+		"12345678", header(jwtMsg.Message, result.DeviceID), 200, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments",
+		`["test.test-3"]`, header(jwtMsg.Message, "unknowndevice"), 403, nil,
+	)
+}
+
 func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *http.Server) {
+	return startKeyshareServer(t, testConfiguration(t, db, emailserver))
+}
+
+func testConfiguration(t *testing.T, db DB, emailserver string) *Configuration {
 	testdataPath := test.FindTestdataFolder(t)
-	s, err := New(&Configuration{
+	return &Configuration{
 		Configuration: &server.Configuration{
 			SchemesPath:           filepath.Join(testdataPath, "irma_configuration"),
 			IssuerPrivateKeysPath: filepath.Join(testdataPath, "privatekeys"),
@@ -251,7 +453,11 @@ func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *htt
 		VerificationURL: map[string]string{
 			"en": "http://example.com/verify/",
 		},
-	})
+	}
+}
+
+func startKeyshareServer(t *testing.T, conf *Configuration) (*Server, *http.Server) {
+	s, err := New(conf)
 	require.NoError(t, err)
 
 	serv := &http.Server{
@@ -278,11 +484,16 @@ func StopKeyshareServer(t *testing.T, keyshareServer *Server, httpServer *http.S
 }
 
 type testDB struct {
-	db    DB
-	ok    bool
-	tries int
-	wait  int64
-	err   error
+	db     DB
+	ok     bool
+	tries  int
+	wait   int64
+	err    error
+	emails []string
+}
+
+func (db *testDB) emailAddresses(_ *User) ([]string, error) {
+	return db.emails, nil
 }
 
 func (db *testDB) AddUser(user *User) error {
@@ -297,14 +508,18 @@ func (db *testDB) updateUser(user *User) error {
 	return db.db.updateUser(user)
 }
 
-func (db *testDB) reservePinTry(_ *User) (bool, int, int64, error) {
-	return db.ok, db.tries, db.wait, db.err
+func (db *testDB) reservePinTry(_ *PinPolicy, _ *User) (pinTry, error) {
+	return pinTry{allowed: db.ok, tries: db.tries, wait: db.wait}, db.err
 }
 
 func (db *testDB) resetPinTries(user *User) error {
 	return db.db.resetPinTries(user)
 }
 
+func (db *testDB) unblockUser(user *User) error {
+	return db.db.unblockUser(user)
+}
+
 func (db *testDB) setSeen(user *User) error {
 	return db.db.setSeen(user)
 }
@@ -317,6 +532,42 @@ func (db *testDB) addEmailVerification(user *User, email, token string) error {
 	return db.db.addEmailVerification(user, email, token)
 }
 
+func (db *testDB) adminUser(username string) (*User, error) {
+	return db.db.adminUser(username)
+}
+
+func (db *testDB) usernamesByEmail(email string) ([]string, error) {
+	return db.db.usernamesByEmail(email)
+}
+
+func (db *testDB) userStatus(user *User) (*UserStatus, error) {
+	return db.db.userStatus(user)
+}
+
+func (db *testDB) userLogs(user *User, offset, amount int) ([]LogEntry, error) {
+	return db.db.userLogs(user, offset, amount)
+}
+
+func (db *testDB) cancelUserRemoval(user *User) error {
+	return db.db.cancelUserRemoval(user)
+}
+
+func (db *testDB) loadDevice(user *User, deviceID string) error {
+	return db.db.loadDevice(user, deviceID)
+}
+
+func (db *testDB) addDeviceLinkCode(user *User, code string, expiry int64) error {
+	return db.db.addDeviceLinkCode(user, code, expiry)
+}
+
+func (db *testDB) consumeDeviceLinkCode(username, code string) (*User, error) {
+	return db.db.consumeDeviceLinkCode(username, code)
+}
+
+func (db *testDB) addDevice(user *User, deviceID, name string, secrets keysharecore.UserSecrets) error {
+	return db.db.addDevice(user, deviceID, name, secrets)
+}
+
 func createDB(t *testing.T) DB {
 	db := NewMemoryDB()
 	err := db.AddUser(&User{
@@ -10,6 +10,7 @@ import (
 type session struct {
 	KeyID    irma.PublicKeyIdentifier // last used key, used in signing the issuance message
 	CommitID uint64
+	Info     *irma.KeyshareSessionInfo // details of the IRMA session as sent by the client, if any
 	expiry   time.Time
 }
 
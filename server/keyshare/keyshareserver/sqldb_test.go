@@ -0,0 +1,333 @@
+//+build !local_tests
+
+package keyshareserver
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDBUserManagement(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db DB, exec execFunc) {
+		var err error
+
+		user := &User{Username: "testuser", Secrets: []byte{123}}
+		err = db.AddUser(user)
+		require.NoError(t, err)
+		assert.Equal(t, "testuser", user.Username)
+
+		nuser, err := db.user("testuser")
+		require.NoError(t, err)
+		assert.Equal(t, user, nuser)
+
+		_, err = db.user("notexist")
+		assert.Error(t, err)
+
+		err = db.updateUser(nuser)
+		assert.NoError(t, err)
+
+		user = &User{Username: "testuser", Secrets: []byte{123}}
+		err = db.AddUser(user)
+		assert.Error(t, err)
+
+		err = db.addLog(nuser, eventTypePinCheckFailed, 15)
+		assert.NoError(t, err)
+
+		err = db.addEmailVerification(nuser, "test@example.com", "testtoken")
+		assert.NoError(t, err)
+
+		err = db.setSeen(nuser)
+		assert.NoError(t, err)
+	})
+}
+
+func TestSQLDBPinReservation(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db DB, exec execFunc) {
+		var err error
+		policy := &PinPolicy{FreeAttempts: 3, BackoffBase: 2, BackoffMultiplier: 2}
+
+		user := &User{Username: "testuser", Secrets: []byte{123}}
+		err = db.AddUser(user)
+		require.NoError(t, err)
+
+		// reservePinTry sets user fields in the database as if the attempt was wrong. If the attempt
+		// was in fact correct, then these fields are cleared again later by the keyshare server by
+		// invoking db.resetPinTries(user). So below we may think of reservePinTry invocations as
+		// wrong pin attempts.
+
+		try, err := db.reservePinTry(policy, user)
+		require.NoError(t, err)
+		assert.True(t, try.allowed)
+		assert.Equal(t, policy.FreeAttempts-1, try.tries)
+		assert.Equal(t, int64(0), try.wait)
+
+		// Try until we have no tries left
+		for try.tries != 0 {
+			try, err = db.reservePinTry(policy, user)
+			require.NoError(t, err)
+			assert.True(t, try.allowed)
+		}
+
+		assert.Equal(t, policy.BackoffBase, try.wait) // next attempt after first timeout
+
+		// We have used all tries; we are now blocked. Wait till just before block end
+		time.Sleep(time.Duration(try.wait-1) * time.Second)
+
+		// Try again, not yet allowed
+		try, err = db.reservePinTry(policy, user)
+		assert.NoError(t, err)
+		assert.False(t, try.allowed)
+		assert.Equal(t, 0, try.tries)
+		assert.Equal(t, int64(1), try.wait)
+
+		// Wait till just after block end
+		time.Sleep(2 * time.Second)
+
+		// Trying is now allowed
+		try, err = db.reservePinTry(policy, user)
+		assert.NoError(t, err)
+		assert.True(t, try.allowed)
+		assert.Equal(t, 0, try.tries)
+		assert.Equal(t, 2*policy.BackoffBase, try.wait) // next attempt after doubled timeout
+
+		// Since we just used another attempt we are now blocked again
+		try, err = db.reservePinTry(policy, user)
+		assert.NoError(t, err)
+		assert.False(t, try.allowed)
+		assert.Equal(t, 0, try.tries)
+		assert.Equal(t, 2*policy.BackoffBase, try.wait)
+
+		// Wait to be unblocked again
+		time.Sleep(time.Duration(try.wait+1) * time.Second)
+
+		// Try a final time
+		try, err = db.reservePinTry(policy, user)
+		assert.NoError(t, err)
+		assert.True(t, try.allowed)
+		assert.Equal(t, 0, try.tries)
+		assert.Equal(t, 4*policy.BackoffBase, try.wait) // next attempt after again a doubled timeout
+
+		err = db.resetPinTries(user)
+		assert.NoError(t, err)
+
+		try, err = db.reservePinTry(policy, user)
+		assert.NoError(t, err)
+		assert.True(t, try.allowed)
+		assert.True(t, try.tries > 0)
+		assert.Equal(t, int64(0), try.wait)
+
+		// With a lock policy, the account is locked after using up the tries until reset
+		require.NoError(t, db.resetPinTries(user))
+		policy.LockAfterBlocks = 1
+		for i := 0; i < policy.FreeAttempts; i++ {
+			try, err = db.reservePinTry(policy, user)
+			require.NoError(t, err)
+			assert.True(t, try.allowed)
+		}
+		assert.True(t, try.locked)
+		try, err = db.reservePinTry(policy, user)
+		require.NoError(t, err)
+		assert.False(t, try.allowed)
+		assert.True(t, try.locked)
+
+		require.NoError(t, db.resetPinTries(user))
+		try, err = db.reservePinTry(policy, user)
+		require.NoError(t, err)
+		assert.True(t, try.allowed)
+		assert.False(t, try.locked)
+	})
+}
+
+func TestSQLDBAdmin(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db DB, exec execFunc) {
+		var err error
+		policy := &PinPolicy{}
+		policy.setDefaults()
+
+		user := &User{Username: "testuser", Language: "en", Secrets: []byte{123}}
+		require.NoError(t, db.AddUser(user))
+		_, err = exec("INSERT INTO irma.emails (user_id, email) VALUES ($1, 'test@example.com')", user.id)
+		require.NoError(t, err)
+
+		emails, err := db.emailAddresses(user)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"test@example.com"}, emails)
+
+		usernames, err := db.usernamesByEmail("test@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"testuser"}, usernames)
+		usernames, err = db.usernamesByEmail("other@example.com")
+		require.NoError(t, err)
+		assert.Empty(t, usernames)
+
+		_, err = db.adminUser("notexist")
+		assert.Error(t, err)
+		auser, err := db.adminUser("testuser")
+		require.NoError(t, err)
+		assert.Equal(t, user, auser)
+
+		// Block the user
+		for i := 0; i < policy.FreeAttempts; i++ {
+			_, err = db.reservePinTry(policy, user)
+			require.NoError(t, err)
+		}
+		status, err := db.userStatus(user)
+		require.NoError(t, err)
+		assert.Equal(t, "testuser", status.Username)
+		assert.Equal(t, policy.FreeAttempts, status.PinCounter)
+		assert.True(t, status.BlockedUntil > time.Now().Unix())
+		assert.Nil(t, status.DeleteOn)
+		assert.False(t, status.Deleted)
+		assert.Equal(t, []UserEmail{{Email: "test@example.com"}}, status.Emails)
+
+		require.NoError(t, db.resetPinTries(user))
+		status, err = db.userStatus(user)
+		require.NoError(t, err)
+		assert.Equal(t, 0, status.PinCounter)
+
+		require.NoError(t, db.addLog(user, eventTypeAdminPinUnblocked, "admin"))
+		logs, err := db.userLogs(user, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, string(eventTypeAdminPinUnblocked), logs[0].Event)
+		assert.Equal(t, `"admin"`, *logs[0].Param)
+
+		// Nothing to cancel yet
+		assert.Equal(t, errNoDeletionToCancel, db.cancelUserRemoval(user))
+
+		// Cancel deletion because of inactivity
+		_, err = exec("UPDATE irma.users SET delete_on = $2 WHERE id = $1", user.id, time.Now().Unix()+3600)
+		require.NoError(t, err)
+		require.NoError(t, db.cancelUserRemoval(user))
+		status, err = db.userStatus(user)
+		require.NoError(t, err)
+		assert.Nil(t, status.DeleteOn)
+
+		// Deletion by the user cannot be canceled
+		_, err = exec("UPDATE irma.users SET coredata = NULL, delete_on = $2 WHERE id = $1", user.id, time.Now().Unix()+3600)
+		require.NoError(t, err)
+		auser, err = db.adminUser("testuser")
+		require.NoError(t, err)
+		assert.Nil(t, auser.Secrets)
+		assert.Equal(t, errNoDeletionToCancel, db.cancelUserRemoval(auser))
+		status, err = db.userStatus(auser)
+		require.NoError(t, err)
+		assert.True(t, status.Deleted)
+		assert.NotNil(t, status.DeleteOn)
+	})
+}
+
+func TestSQLDBDevices(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db DB, exec execFunc) {
+		var err error
+		policy := &PinPolicy{}
+		policy.setDefaults()
+
+		user := &User{Username: "testuser", Secrets: []byte{123}}
+		require.NoError(t, db.AddUser(user))
+
+		// Link codes can be used once, and only before they expire
+		require.NoError(t, db.addDeviceLinkCode(user, "expiredcode", time.Now().Unix()-1))
+		_, err = db.consumeDeviceLinkCode("testuser", "expiredcode")
+		assert.Equal(t, errInvalidLinkCode, err)
+		require.NoError(t, db.addDeviceLinkCode(user, "testcode", time.Now().Unix()+60))
+		_, err = db.consumeDeviceLinkCode("otheruser", "testcode")
+		assert.Equal(t, errInvalidLinkCode, err)
+		linkUser, err := db.consumeDeviceLinkCode("testuser", "testcode")
+		require.NoError(t, err)
+		assert.Equal(t, user, linkUser)
+		_, err = db.consumeDeviceLinkCode("testuser", "testcode")
+		assert.Equal(t, errInvalidLinkCode, err)
+
+		require.NoError(t, db.addDevice(linkUser, "testdevice", "Test phone", []byte{45}))
+		assert.NotZero(t, linkUser.device)
+		assert.Equal(t, []byte{45}, []byte(linkUser.Secrets))
+
+		device, err := db.user("testuser")
+		require.NoError(t, err)
+		assert.Error(t, db.loadDevice(device, "notexist"))
+		require.NoError(t, db.loadDevice(device, "testdevice"))
+		assert.Equal(t, linkUser, device)
+
+		// Devices have their own secrets and PIN attempt state
+		device.Secrets = []byte{67}
+		require.NoError(t, db.updateUser(device))
+		nuser, err := db.user("testuser")
+		require.NoError(t, err)
+		assert.Equal(t, []byte{123}, []byte(nuser.Secrets))
+
+		try, err := db.reservePinTry(policy, device)
+		require.NoError(t, err)
+		assert.Equal(t, policy.FreeAttempts-1, try.tries)
+		try, err = db.reservePinTry(policy, nuser)
+		require.NoError(t, err)
+		assert.Equal(t, policy.FreeAttempts-1, try.tries)
+		require.NoError(t, db.resetPinTries(device))
+		require.NoError(t, db.setSeen(device))
+
+		// Unblocking the user resets the PIN attempt state of all of the user's devices
+		_, err = db.reservePinTry(policy, device)
+		require.NoError(t, err)
+		require.NoError(t, db.unblockUser(nuser))
+		try, err = db.reservePinTry(policy, device)
+		require.NoError(t, err)
+		assert.Equal(t, policy.FreeAttempts-1, try.tries)
+		try, err = db.reservePinTry(policy, nuser)
+		require.NoError(t, err)
+		assert.Equal(t, policy.FreeAttempts-1, try.tries)
+
+		require.NoError(t, db.addLog(device, eventTypeDeviceLinked, "Test phone"))
+
+		// Revoked devices cannot be used
+		_, err = exec("UPDATE irma.devices SET revoked_on = $1", time.Now().Unix())
+		require.NoError(t, err)
+		assert.Error(t, db.loadDevice(nuser, "testdevice"))
+	})
+}
+
+// execFunc executes a PostgreSQL query on the database under test, converting it to MySQL if necessary.
+type execFunc func(query string, args ...interface{}) (sql.Result, error)
+
+// testSQLDBs runs the specified test against both the PostgreSQL and the MySQL implementation.
+func testSQLDBs(t *testing.T, f func(t *testing.T, db DB, exec execFunc)) {
+	t.Run("postgres", func(t *testing.T) {
+		SetupDatabase(t)
+		defer TeardownDatabase(t)
+
+		db, err := newPostgresDB(test.PostgresTestUrl)
+		require.NoError(t, err)
+		f(t, db, db.(*postgresDB).db.Exec)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", true)
+		defer test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", false)
+
+		db, err := newMySQLDB(test.MySQLTestUrl)
+		require.NoError(t, err)
+		f(t, db, func(query string, args ...interface{}) (sql.Result, error) {
+			query, args = test.MySQLQuery(query, args...)
+			return db.(*mysqlDB).db.Exec(query, args...)
+		})
+	})
+}
+
+func SetupDatabase(t *testing.T) {
+	test.RunScriptOnDB(t, "../cleanup.sql", true)
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+	_, err = keyshare.MigrateUp(db, keyshare.DialectPostgres)
+	require.NoError(t, err)
+}
+
+func TeardownDatabase(t *testing.T) {
+	test.RunScriptOnDB(t, "../cleanup.sql", false)
+}
@@ -0,0 +1,136 @@
+package keyshare
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Email is a single HTML email message.
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Body    []byte
+
+	// Name of the template from which the email was generated, if any, used only for logging
+	Template string
+}
+
+// Mailer delivers emails. There are multiple implementations of this, currently:
+//   - smtpMailer sending emails to an SMTP server
+//   - fileMailer writing each email to an .eml file in a directory, for testing and for relay by other systems
+//   - logMailer only logging emails
+//   - queueMailer storing emails in a database outbox, from which they are delivered by the keyshare tasks
+//   - RecordingMailer recording emails, for testing
+type Mailer interface {
+	SendEmail(email Email) error
+}
+
+type MailerType string
+
+const (
+	MailerTypeSMTP MailerType = "smtp"
+	MailerTypeFile MailerType = "file"
+	MailerTypeLog  MailerType = "log"
+)
+
+var errUnknownMailerType = errors.New("Unknown mailer type")
+
+// Bytes returns the email in RFC 5322 format, including headers.
+func (email Email) Bytes() []byte {
+	headers := []byte("To: " + email.To + "\r\n" +
+		"From: " + email.From + "\r\n" +
+		"Subject: " + email.Subject + "\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: binary\r\n" +
+		"\r\n")
+	return append(headers, email.Body...)
+}
+
+type smtpMailer struct {
+	server string
+	auth   smtp.Auth
+}
+
+func (m smtpMailer) SendEmail(email Email) error {
+	return smtp.SendMail(m.server, m.auth, email.From, []string{email.To}, email.Bytes())
+}
+
+type fileMailer struct {
+	dir string
+}
+
+func (m fileMailer) SendEmail(email Email) error {
+	// Write to a temporary file first and then rename it, so that relaying systems watching the
+	// directory never see partially written emails
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), common.NewRandomString(8, common.AlphanumericChars))
+	tmp := filepath.Join(m.dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, email.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, name+".eml"))
+}
+
+type logMailer struct {
+	logger *logrus.Logger
+}
+
+// SendEmail logs only the recipient and template of the email, as its contents may be sensitive
+// (e.g. containing login or verification links).
+func (m logMailer) SendEmail(email Email) error {
+	m.logger.WithFields(logrus.Fields{"to": email.To, "template": email.Template}).
+		Info("Email not sent, as the log mailer is configured")
+	return nil
+}
+
+// RecordingMailer records emails instead of delivering them, for testing. It is safe for concurrent use.
+type RecordingMailer struct {
+	sync.Mutex
+	emails []Email
+}
+
+func (m *RecordingMailer) SendEmail(email Email) error {
+	m.Lock()
+	defer m.Unlock()
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+// Emails returns the emails sent so far.
+func (m *RecordingMailer) Emails() []Email {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Email(nil), m.emails...)
+}
+
+// NewMailer returns a mailer that delivers emails directly, i.e. without queueing them.
+func NewMailer(typ MailerType, conf EmailConfiguration, logger *logrus.Logger) (Mailer, error) {
+	switch typ {
+	case MailerTypeSMTP, "":
+		if conf.EmailServer == "" {
+			return nil, errors.New("smtp mailer requires an email server")
+		}
+		return smtpMailer{server: conf.EmailServer, auth: conf.EmailAuth}, nil
+	case MailerTypeFile:
+		if conf.EmailDir == "" {
+			return nil, errors.New("file mailer requires an email directory")
+		}
+		if err := common.AssertPathExists(conf.EmailDir); err != nil {
+			return nil, errors.WrapPrefix(err, "email directory", 0)
+		}
+		return fileMailer{dir: conf.EmailDir}, nil
+	case MailerTypeLog:
+		return logMailer{logger: logger}, nil
+	default:
+		return nil, errUnknownMailerType
+	}
+}
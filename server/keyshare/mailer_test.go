@@ -0,0 +1,108 @@
+package keyshare
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMailer(t *testing.T) {
+	logger := logrus.New()
+
+	_, err := NewMailer(MailerTypeSMTP, EmailConfiguration{}, logger)
+	assert.Error(t, err)
+	_, err = NewMailer(MailerTypeFile, EmailConfiguration{}, logger)
+	assert.Error(t, err)
+	_, err = NewMailer(MailerTypeFile, EmailConfiguration{EmailDir: "/nonexisting"}, logger)
+	assert.Error(t, err)
+	_, err = NewMailer("nonexisting", EmailConfiguration{}, logger)
+	assert.Error(t, err)
+
+	m, err := NewMailer("", EmailConfiguration{EmailServer: "localhost:1025"}, logger)
+	require.NoError(t, err)
+	assert.IsType(t, smtpMailer{}, m)
+	m, err = NewMailer(MailerTypeLog, EmailConfiguration{}, logger)
+	require.NoError(t, err)
+	assert.NoError(t, m.SendEmail(Email{To: "test@example.com", Body: []byte("body")}))
+}
+
+// The log mailer does not log the contents of emails, as these may be sensitive.
+func TestLogMailer(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	m, err := NewMailer(MailerTypeLog, EmailConfiguration{}, logger)
+	require.NoError(t, err)
+	require.NoError(t, m.SendEmail(Email{To: "test@example.com", Subject: "secret subject", Body: []byte("secret body"), Template: "template.html"}))
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.Fields{"to": "test@example.com", "template": "template.html"}, entry.Data)
+	assert.NotContains(t, entry.Message, "secret")
+}
+
+func TestEmailEnabled(t *testing.T) {
+	assert.False(t, EmailConfiguration{}.EmailEnabled())
+	assert.True(t, EmailConfiguration{EmailServer: "localhost:1025"}.EmailEnabled())
+	assert.True(t, EmailConfiguration{EmailMailer: MailerTypeLog}.EmailEnabled())
+	assert.True(t, EmailConfiguration{Mailer: &RecordingMailer{}}.EmailEnabled())
+
+	conf := EmailConfiguration{EmailServer: "localhost:1025", EmailQueue: true}
+	assert.Error(t, conf.SetupMailer(nil, "", logrus.New()))
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	conf := EmailConfiguration{EmailMailer: MailerTypeFile, EmailDir: dir, EmailFrom: "from@example.com", DefaultLanguage: "en"}
+	require.NoError(t, conf.SetupMailer(nil, "", logrus.New()))
+
+	templates, err := ParseEmailTemplates(
+		map[string]string{"en": filepath.Join(test.FindTestdataFolder(t), "emailtemplate.html")},
+		map[string]string{"en": "subject"},
+		"en",
+	)
+	require.NoError(t, err)
+	require.NoError(t, conf.SendEmail(templates, map[string]string{"en": "subject"},
+		map[string]string{"VerificationURL": "123"}, "to@example.com", "en"))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".eml"))
+	bts, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(bts), "To: to@example.com\r\n")
+	assert.Contains(t, string(bts), "Subject: subject\r\n")
+	assert.True(t, strings.HasSuffix(string(bts), "\r\n\r\nThis is a test template 123"))
+}
+
+func TestSendEmailMailer(t *testing.T) {
+	mailer := &RecordingMailer{}
+	conf := EmailConfiguration{EmailFrom: "from@example.com", DefaultLanguage: "en", Mailer: mailer}
+	templates, err := ParseEmailTemplates(
+		map[string]string{"en": filepath.Join(test.FindTestdataFolder(t), "emailtemplate.html")},
+		map[string]string{"en": "subject"},
+		"en",
+	)
+	require.NoError(t, err)
+
+	// Unknown languages fall back to the default language
+	require.NoError(t, conf.SendEmail(templates, map[string]string{"en": "subject"},
+		map[string]string{"TokenURL": "456"}, "to@example.com", "nonexistinglanguage"))
+	assert.Equal(t, []Email{{
+		From:     "from@example.com",
+		To:       "to@example.com",
+		Subject:  "subject",
+		Body:     []byte("This is a test template 456"),
+		Template: "emailtemplate.html",
+	}}, mailer.Emails())
+}
@@ -0,0 +1,405 @@
+package keyshare
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Migration is a versioned change of the keyshare database schema. Migrations are applied in order
+// of their versions, which are consecutive and start at 1. In PostgreSQL, each migration is applied
+// or reverted within the same transaction as the update of the schema_migrations table. MySQL does
+// not support transactional schema changes, so there a failing migration may be partially applied.
+//
+// Once released, existing migrations must never be changed: add a new migration instead.
+// Migrations of the different dialects must be kept in sync, i.e. have the same versions.
+// Up and Down consist of separate statements, which are executed in order, as not all database
+// drivers support multiple statements in one query.
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// MigrationStatus is the state of a migration in a database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedOn int64 // unix timestamp, 0 if not applied
+}
+
+// Dialect is an SQL database type supported by the keyshare components.
+type Dialect string
+
+const (
+	DialectPostgres Dialect = "postgres"
+	DialectMySQL    Dialect = "mysql"
+)
+
+var (
+	ErrSchemaTooNew   = errors.New("database schema is newer than supported by this version of irma; please upgrade")
+	ErrUnknownDialect = errors.New("Unknown database dialect")
+)
+
+// Key of the postgres advisory lock held while migrating, so that concurrently starting instances
+// of the keyshare components don't migrate simultaneously.
+const migrationLockKey int64 = 0x69726d6d // "irmm"
+
+// Name of the MySQL named lock with the same purpose.
+const migrationLockName = "irma_schema_migrations"
+
+// execer is implemented by both *sql.Tx and *sql.Conn.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// DriverName returns the name of the database/sql driver for the dialect, or "" if the dialect is unknown.
+func (d Dialect) DriverName() string {
+	switch d {
+	case DialectPostgres:
+		return "pgx"
+	case DialectMySQL:
+		return "mysql"
+	default:
+		return ""
+	}
+}
+
+func (d Dialect) migrations() ([]Migration, error) {
+	switch d {
+	case DialectPostgres:
+		return postgresMigrations, nil
+	case DialectMySQL:
+		return mysqlMigrations, nil
+	default:
+		return nil, ErrUnknownDialect
+	}
+}
+
+func (d Dialect) migrationsTable() string {
+	if d == DialectMySQL {
+		return "schema_migrations"
+	}
+	return "irma.schema_migrations"
+}
+
+// placeholders converts the $1, $2, ... placeholders of the specified query to ? for MySQL.
+// The placeholders must occur in order, each at most once.
+func (d Dialect) placeholders(query string) string {
+	if d != DialectMySQL {
+		return query
+	}
+	query, _ = toMySQL(query, nil)
+	return query
+}
+
+// Query converts a query on tables in the irma schema, using the $1, $2, ... placeholders of
+// PostgreSQL, to the dialect, returning the converted query and the accordingly ordered arguments.
+// For MySQL, the irma schema is removed from the table names and the placeholders are replaced by ?,
+// so that the placeholders may occur in any order, also more than once.
+func (d Dialect) Query(query string, args ...interface{}) (string, []interface{}) {
+	if d != DialectMySQL {
+		return query, args
+	}
+	return toMySQL(query, args)
+}
+
+// toMySQL removes the irma schema from the table names in the query and replaces its $1, $2, ...
+// placeholders by ?, returning the arguments in the order of the placeholders. String literals and
+// quoted identifiers are left alone, as is irma. when it is part of a longer identifier.
+func toMySQL(query string, args []interface{}) (string, []interface{}) {
+	var (
+		b         strings.Builder
+		mysqlArgs []interface{}
+	)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Copy the quoted literal or identifier up to and including its closing quote. Within
+			// it, a doubled quote, or in a string literal a backslash, escapes the next character.
+			end := i + 1
+			for end < len(query) {
+				if query[end] == '\\' && c != '`' {
+					end += 2
+					continue
+				}
+				if query[end] == c {
+					if end+1 < len(query) && query[end+1] == c {
+						end += 2
+						continue
+					}
+					end++
+					break
+				}
+				end++
+			}
+			if end > len(query) {
+				end = len(query)
+			}
+			b.WriteString(query[i:end])
+			i = end
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			end := i + 1
+			for end < len(query) && isDigit(query[end]) {
+				end++
+			}
+			if args != nil {
+				n, _ := strconv.Atoi(query[i+1 : end])
+				mysqlArgs = append(mysqlArgs, args[n-1])
+			}
+			b.WriteByte('?')
+			i = end
+		case strings.HasPrefix(query[i:], "irma.") && (i == 0 || !isIdentifierChar(query[i-1])):
+			i += len("irma.")
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), mysqlArgs
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c == '.'
+}
+
+// LatestSchemaVersion returns the version of the latest migration known to this version of irma.
+func LatestSchemaVersion() int {
+	return postgresMigrations[len(postgresMigrations)-1].Version
+}
+
+// MigrateUp applies all pending migrations, returning the migrations that were applied.
+// It returns ErrSchemaTooNew if the database has migrations applied that are unknown to us.
+func MigrateUp(db *sql.DB, dialect Dialect) ([]Migration, error) {
+	migrations, err := dialect.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	err = migrate(db, dialect, func(ctx context.Context, e execer, version int) error {
+		for _, m := range migrations[version:] {
+			if err := execStatements(ctx, e, m.Up); err != nil {
+				return errors.WrapPrefix(err, "failed to apply migration "+m.Description, 0)
+			}
+			_, err := e.ExecContext(ctx,
+				dialect.placeholders("INSERT INTO "+dialect.migrationsTable()+" (version, description, applied_on) VALUES ($1, $2, $3)"),
+				m.Version, m.Description, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the specified amount of most recently applied migrations, returning the
+// migrations that were reverted.
+func MigrateDown(db *sql.DB, dialect Dialect, steps int) ([]Migration, error) {
+	migrations, err := dialect.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	err = migrate(db, dialect, func(ctx context.Context, e execer, version int) error {
+		for i := version - 1; i >= 0 && i >= version-steps; i-- {
+			m := migrations[i]
+			if err := execStatements(ctx, e, m.Down); err != nil {
+				return errors.WrapPrefix(err, "failed to revert migration "+m.Description, 0)
+			}
+			_, err := e.ExecContext(ctx,
+				dialect.placeholders("DELETE FROM "+dialect.migrationsTable()+" WHERE version = $1"),
+				m.Version)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// MigrationStatuses returns the status of all migrations known to us.
+func MigrationStatuses(db *sql.DB, dialect Dialect) ([]MigrationStatus, error) {
+	migrations, err := dialect.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedOn := map[int]int64{}
+	err = migrate(db, dialect, func(ctx context.Context, e execer, _ int) error {
+		rows, err := e.QueryContext(ctx, "SELECT version, applied_on FROM "+dialect.migrationsTable())
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var version int
+			var on int64
+			if err = rows.Scan(&version, &on); err != nil {
+				return err
+			}
+			appliedOn[version] = on
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		on, applied := appliedOn[m.Version]
+		statuses = append(statuses, MigrationStatus{Migration: m, Applied: applied, AppliedOn: on})
+	}
+	return statuses, nil
+}
+
+// execStatements executes the statements one by one.
+func execStatements(ctx context.Context, e execer, statements []string) error {
+	for _, stmt := range statements {
+		if _, err := e.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate runs f while holding the migration lock, passing the current schema version.
+func migrate(db *sql.DB, dialect Dialect, f func(ctx context.Context, e execer, version int) error) error {
+	switch dialect {
+	case DialectPostgres:
+		return migratePostgres(db, f)
+	case DialectMySQL:
+		return migrateMySQL(db, f)
+	default:
+		return ErrUnknownDialect
+	}
+}
+
+func migratePostgres(db *sql.DB, f func(ctx context.Context, e execer, version int) error) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	version, err := postgresSchemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return ErrSchemaTooNew
+	}
+	if err = f(ctx, tx, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateMySQL(db *sql.DB, f func(ctx context.Context, e execer, version int) error) error {
+	// Named locks are bound to the connection, so use a single connection throughout
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLockName).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("timeout acquiring migration lock")
+	}
+	defer func() {
+		var released sql.NullInt64
+		_ = conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLockName).Scan(&released)
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version int PRIMARY KEY,
+    description varchar(255) NOT NULL,
+    applied_on bigint NOT NULL
+)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	if err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return ErrSchemaTooNew
+	}
+	return f(ctx, conn, version)
+}
+
+// postgresSchemaVersion returns the current schema version, creating the irma.schema_migrations
+// table if it does not yet exist.
+func postgresSchemaVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	var exists, legacy bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT to_regclass('irma.schema_migrations') IS NOT NULL, to_regclass('irma.users') IS NOT NULL",
+	).Scan(&exists, &legacy)
+	if err != nil {
+		return 0, err
+	}
+
+	if !exists {
+		err = execStatements(ctx, tx, []string{
+			`CREATE SCHEMA IF NOT EXISTS irma`,
+			`CREATE TABLE irma.schema_migrations
+(
+    version int PRIMARY KEY,
+    description text NOT NULL,
+    applied_on bigint NOT NULL
+)`,
+		})
+		if err != nil {
+			return 0, err
+		}
+		// Databases created from the former static schema.sql already contain the initial schema
+		if legacy {
+			m := postgresMigrations[0]
+			_, err = tx.ExecContext(ctx, "INSERT INTO irma.schema_migrations (version, description, applied_on) VALUES ($1, $2, $3)",
+				m.Version, m.Description, time.Now().Unix())
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM irma.schema_migrations").Scan(&version)
+	return version, err
+}
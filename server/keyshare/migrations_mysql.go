@@ -0,0 +1,133 @@
+package keyshare
+
+// In MySQL, the tables are created in the database specified in the connection string, instead
+// of in a separate irma schema as in PostgreSQL.
+var mysqlMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Up: []string{
+			`CREATE TABLE users
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    username varchar(255) NOT NULL,
+    language varchar(64) NOT NULL,
+    coredata blob,
+    last_seen bigint NOT NULL,
+    pin_counter int NOT NULL,
+    pin_block_date bigint NOT NULL,
+    delete_on bigint
+)`,
+			`CREATE UNIQUE INDEX username_index ON users (username)`,
+			`CREATE TABLE log_entry_records
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    time bigint NOT NULL,
+    event varchar(255) NOT NULL,
+    param text,
+    user_id int NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)`,
+			`CREATE INDEX log_entry_records_user_id_index ON log_entry_records (user_id, time)`,
+			`CREATE TABLE email_verification_tokens
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    token varchar(255) NOT NULL,
+    email varchar(255) NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)`,
+			`CREATE UNIQUE INDEX email_verification_token_index ON email_verification_tokens (token)`,
+			`CREATE TABLE email_login_tokens
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    token varchar(255) NOT NULL,
+    email varchar(255) NOT NULL,
+    expiry bigint NOT NULL
+)`,
+			`CREATE UNIQUE INDEX email_login_token_index ON email_login_tokens (token)`,
+			`CREATE TABLE emails
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    user_id int NOT NULL,
+    email varchar(255) NOT NULL,
+    delete_on bigint,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)`,
+			`CREATE INDEX email_index ON emails (email)`,
+			`CREATE UNIQUE INDEX email_constraint_index ON emails (user_id, email)`,
+		},
+		Down: []string{
+			`DROP TABLE emails`,
+			`DROP TABLE email_login_tokens`,
+			`DROP TABLE email_verification_tokens`,
+			`DROP TABLE log_entry_records`,
+			`DROP TABLE users`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "email queue",
+		Up: []string{
+			`CREATE TABLE email_queue
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    sender varchar(255) NOT NULL,
+    recipient varchar(255) NOT NULL,
+    subject text NOT NULL,
+    body mediumblob NOT NULL,
+    created bigint NOT NULL,
+    attempts int NOT NULL,
+    next_attempt bigint NOT NULL,
+    last_error text
+)`,
+			`CREATE INDEX email_queue_next_attempt_index ON email_queue (next_attempt)`,
+		},
+		Down: []string{`DROP TABLE email_queue`},
+	},
+	{
+		Version:     3,
+		Description: "devices",
+		Up: []string{
+			`CREATE TABLE devices
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    user_id int NOT NULL,
+    device_id varchar(255) NOT NULL,
+    name varchar(255) NOT NULL,
+    coredata blob NOT NULL,
+    pin_counter int NOT NULL,
+    pin_block_date bigint NOT NULL,
+    created bigint NOT NULL,
+    last_seen bigint NOT NULL,
+    revoked_on bigint,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)`,
+			`CREATE UNIQUE INDEX device_id_index ON devices (device_id)`,
+			`CREATE TABLE device_link_codes
+(
+    id int AUTO_INCREMENT PRIMARY KEY,
+    code varchar(255) NOT NULL,
+    user_id int NOT NULL,
+    expiry bigint NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)`,
+			`CREATE UNIQUE INDEX device_link_code_index ON device_link_codes (code)`,
+			`ALTER TABLE log_entry_records ADD COLUMN device_id int,
+    ADD CONSTRAINT log_entry_records_device_fk FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE SET NULL`,
+		},
+		Down: []string{
+			`ALTER TABLE log_entry_records DROP FOREIGN KEY log_entry_records_device_fk`,
+			`ALTER TABLE log_entry_records DROP COLUMN device_id`,
+			`DROP TABLE device_link_codes`,
+			`DROP TABLE devices`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "log filtering",
+		Up:          []string{`CREATE INDEX log_entry_records_user_id_event_index ON log_entry_records (user_id, event, time)`},
+		Down:        []string{`DROP INDEX log_entry_records_user_id_event_index ON log_entry_records`},
+	},
+}
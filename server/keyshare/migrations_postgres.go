@@ -0,0 +1,127 @@
+package keyshare
+
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Up: []string{
+			`CREATE TABLE irma.users
+(
+    id serial PRIMARY KEY,
+    username text NOT NULL,
+    language text NOT NULL,
+    coredata bytea,
+    last_seen bigint NOT NULL,
+    pin_counter int NOT NULL,
+    pin_block_date bigint NOT NULL,
+    delete_on bigint
+)`,
+			`CREATE UNIQUE INDEX username_index ON irma.users (username)`,
+			`CREATE TABLE irma.log_entry_records
+(
+    id serial PRIMARY KEY,
+    time bigint NOT NULL,
+    event text NOT NULL,
+    param text,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+)`,
+			`CREATE INDEX log_entry_records_user_id_index ON irma.log_entry_records (user_id, time)`,
+			`CREATE TABLE irma.email_verification_tokens
+(
+    id serial PRIMARY KEY,
+    token text NOT NULL,
+    email text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+)`,
+			`CREATE UNIQUE INDEX email_verification_token_index ON irma.email_verification_tokens (token)`,
+			`CREATE TABLE irma.email_login_tokens
+(
+    id serial PRIMARY KEY,
+    token text NOT NULL,
+    email text NOT NULL,
+    expiry bigint NOT NULL
+)`,
+			`CREATE UNIQUE INDEX email_login_token_index ON irma.email_login_tokens (token)`,
+			`CREATE TABLE irma.emails
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    email text NOT NULL,
+    delete_on bigint
+)`,
+			`CREATE INDEX email_index ON irma.emails (email)`,
+			`CREATE INDEX email_userid_index ON irma.emails (user_id)`,
+			`CREATE UNIQUE INDEX email_constraint_index ON irma.emails (user_id, email)`,
+		},
+		Down: []string{
+			`DROP TABLE irma.emails`,
+			`DROP TABLE irma.email_login_tokens`,
+			`DROP TABLE irma.email_verification_tokens`,
+			`DROP TABLE irma.log_entry_records`,
+			`DROP TABLE irma.users`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "email queue",
+		// Databases created from the former static schema.sql may already contain this table
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS irma.email_queue
+(
+    id serial PRIMARY KEY,
+    sender text NOT NULL,
+    recipient text NOT NULL,
+    subject text NOT NULL,
+    body bytea NOT NULL,
+    created bigint NOT NULL,
+    attempts int NOT NULL,
+    next_attempt bigint NOT NULL,
+    last_error text
+)`,
+			`CREATE INDEX IF NOT EXISTS email_queue_next_attempt_index ON irma.email_queue (next_attempt)`,
+		},
+		Down: []string{`DROP TABLE irma.email_queue`},
+	},
+	{
+		Version:     3,
+		Description: "devices",
+		Up: []string{
+			`CREATE TABLE irma.devices
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    device_id text NOT NULL,
+    name text NOT NULL,
+    coredata bytea NOT NULL,
+    pin_counter int NOT NULL,
+    pin_block_date bigint NOT NULL,
+    created bigint NOT NULL,
+    last_seen bigint NOT NULL,
+    revoked_on bigint
+)`,
+			`CREATE UNIQUE INDEX device_id_index ON irma.devices (device_id)`,
+			`CREATE INDEX devices_user_id_index ON irma.devices (user_id)`,
+			`CREATE TABLE irma.device_link_codes
+(
+    id serial PRIMARY KEY,
+    code text NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    expiry bigint NOT NULL
+)`,
+			`CREATE UNIQUE INDEX device_link_code_index ON irma.device_link_codes (code)`,
+			`ALTER TABLE irma.log_entry_records ADD COLUMN device_id int REFERENCES irma.devices (id) ON DELETE SET NULL`,
+		},
+		Down: []string{
+			`ALTER TABLE irma.log_entry_records DROP COLUMN device_id`,
+			`DROP TABLE irma.device_link_codes`,
+			`DROP TABLE irma.devices`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "log filtering",
+		Up:          []string{`CREATE INDEX log_entry_records_user_id_event_index ON irma.log_entry_records (user_id, event, time)`},
+		Down:        []string{`DROP INDEX irma.log_entry_records_user_id_event_index`},
+	},
+}
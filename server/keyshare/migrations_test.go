@@ -0,0 +1,112 @@
+//+build !local_tests
+
+package keyshare
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/stdlib"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	t.Run("postgres", func(t *testing.T) {
+		test.RunScriptOnDB(t, "cleanup.sql", true)
+		defer test.RunScriptOnDB(t, "cleanup.sql", false)
+		testMigrations(t, DialectPostgres, test.PostgresTestUrl)
+	})
+	t.Run("mysql", func(t *testing.T) {
+		test.RunScriptOnMySQLDB(t, "cleanup_mysql.sql", true)
+		defer test.RunScriptOnMySQLDB(t, "cleanup_mysql.sql", false)
+		testMigrations(t, DialectMySQL, test.MySQLTestUrl)
+	})
+}
+
+func testMigrations(t *testing.T, dialect Dialect, url string) {
+	db, err := sql.Open(dialect.DriverName(), url)
+	require.NoError(t, err)
+	defer common.Close(db)
+	migrations, err := dialect.migrations()
+	require.NoError(t, err)
+
+	applied, err := MigrateUp(db, dialect)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+	applied, err = MigrateUp(db, dialect)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	reverted, err := MigrateDown(db, dialect, 1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	assert.Equal(t, LatestSchemaVersion(), reverted[0].Version)
+
+	statuses, err := MigrationStatuses(db, dialect)
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrations))
+	assert.True(t, statuses[0].Applied)
+	assert.NotZero(t, statuses[0].AppliedOn)
+	assert.False(t, statuses[len(statuses)-1].Applied)
+
+	// Reverting more migrations than applied reverts all of them
+	reverted, err = MigrateDown(db, dialect, 100)
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(migrations)-1)
+	applied, err = MigrateUp(db, dialect)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+
+	// Refuse to work with schemas newer than we know
+	_, err = db.Exec("INSERT INTO " + dialect.migrationsTable() + " (version, description, applied_on) VALUES (1000, 'future', 0)")
+	require.NoError(t, err)
+	_, err = MigrateUp(db, dialect)
+	assert.Equal(t, ErrSchemaTooNew, err)
+}
+
+func TestMigrationsLegacySchema(t *testing.T) {
+	test.RunScriptOnDB(t, "cleanup.sql", true)
+	defer test.RunScriptOnDB(t, "cleanup.sql", false)
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+
+	// Databases created with the former static schema are recognized as having the initial schema
+	_, err = db.Exec("CREATE SCHEMA irma")
+	require.NoError(t, err)
+	for _, stmt := range postgresMigrations[0].Up {
+		_, err = db.Exec(stmt)
+		require.NoError(t, err)
+	}
+	applied, err := MigrateUp(db, DialectPostgres)
+	require.NoError(t, err)
+	require.Len(t, applied, len(postgresMigrations)-1)
+	assert.Equal(t, 2, applied[0].Version)
+}
+
+func TestMigrationDialectsInSync(t *testing.T) {
+	require.Equal(t, len(postgresMigrations), len(mysqlMigrations))
+	for i := range postgresMigrations {
+		assert.Equal(t, i+1, postgresMigrations[i].Version)
+		assert.Equal(t, postgresMigrations[i].Version, mysqlMigrations[i].Version)
+		assert.Equal(t, postgresMigrations[i].Description, mysqlMigrations[i].Description)
+	}
+}
+
+func TestDialectQuery(t *testing.T) {
+	query := `UPDATE irma.users SET language = $2 WHERE username = $1 AND coredata <> 'irma.$1' AND email = 'it''s $2 irma.' AND id IN (SELECT user_id FROM irma.emails WHERE email = $1 AND x = 'a\'irma.' AND myirma.y = $3)`
+	converted, args := DialectMySQL.Query(query, "alice", "en", 3)
+	assert.Equal(t,
+		`UPDATE users SET language = ? WHERE username = ? AND coredata <> 'irma.$1' AND email = 'it''s $2 irma.' AND id IN (SELECT user_id FROM emails WHERE email = ? AND x = 'a\'irma.' AND myirma.y = ?)`,
+		converted)
+	assert.Equal(t, []interface{}{"en", "alice", "alice", 3}, args)
+
+	converted, args = DialectPostgres.Query(query, "alice", "en", 3)
+	assert.Equal(t, query, converted)
+	assert.Equal(t, []interface{}{"alice", "en", 3}, args)
+}
@@ -1,6 +1,7 @@
 package myirmaserver
 
 import (
+	"database/sql"
 	"html/template"
 	"net/url"
 	"strings"
@@ -19,6 +20,7 @@ var errUnknownDBType = errors.New("Unknown database type")
 const (
 	DBTypeMemory   DBType = "memory"
 	DBTypePostgres DBType = "postgres"
+	DBTypeMySQL    DBType = "mysql"
 
 	SessionLifetimeDefault = 15 * 60 // seconds
 )
@@ -61,9 +63,14 @@ type Configuration struct {
 	DeleteAccountFiles    map[string]string `json:"delete_account_files" mapstructure:"delete_account_files"`
 	DeleteAccountSubjects map[string]string `json:"delete_account_subjects" mapstructure:"delete_account_subjects"`
 
+	// Security notification sent to the user's email addresses when one is added (disabled if not present)
+	EmailAddedFiles    map[string]string `json:"email_added_files" mapstructure:"email_added_files"`
+	EmailAddedSubjects map[string]string `json:"email_added_subjects" mapstructure:"email_added_subjects"`
+
 	loginEmailTemplates    map[string]*template.Template
 	deleteEmailTemplates   map[string]*template.Template
 	deleteAccountTemplates map[string]*template.Template
+	emailAddedTemplates    map[string]*template.Template
 }
 
 // Process a passed configuration to ensure all field values are valid and initialized
@@ -93,7 +100,7 @@ func processConfiguration(conf *Configuration) error {
 
 	// Setup email templates
 	var err error
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		if conf.loginEmailTemplates, err = keyshare.ParseEmailTemplates(
 			conf.LoginEmailFiles,
 			conf.LoginEmailSubjects,
@@ -115,6 +122,15 @@ func processConfiguration(conf *Configuration) error {
 		); err != nil {
 			return server.LogError(err)
 		}
+		if len(conf.EmailAddedFiles) > 0 {
+			if conf.emailAddedTemplates, err = keyshare.ParseEmailTemplates(
+				conf.EmailAddedFiles,
+				conf.EmailAddedSubjects,
+				conf.DefaultLanguage,
+			); err != nil {
+				return server.LogError(err)
+			}
+		}
 		if _, ok := conf.LoginURL[conf.DefaultLanguage]; !ok {
 			return server.LogError(errors.Errorf("Missing login email base url for default language"))
 		}
@@ -128,6 +144,11 @@ func processConfiguration(conf *Configuration) error {
 			if err != nil {
 				return err
 			}
+		case DBTypeMySQL:
+			conf.DB, err = newMySQLDB(conf.DBConnStr)
+			if err != nil {
+				return err
+			}
 		case DBTypeMemory:
 			conf.DB = newMemoryDB()
 		default:
@@ -135,6 +156,20 @@ func processConfiguration(conf *Configuration) error {
 		}
 	}
 
+	var (
+		sqldb   *sql.DB
+		dialect keyshare.Dialect
+	)
+	switch db := conf.DB.(type) {
+	case *postgresDB:
+		sqldb, dialect = db.db.DB, keyshare.DialectPostgres
+	case *mysqlDB:
+		sqldb, dialect = db.db.DB, keyshare.DialectMySQL
+	}
+	if err = conf.SetupMailer(sqldb, dialect, conf.Logger); err != nil {
+		return server.LogError(err)
+	}
+
 	if err = conf.VerifyEmailServer(); err != nil {
 		return server.LogError(err)
 	}
@@ -1,9 +1,87 @@
 package myirmaserver
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
+// Log entry event types recorded for actions of the user in MyIRMA
+const (
+	eventTypePinUnblocked  = "PIN_UNBLOCKED"
+	eventTypeDeviceRevoked = "DEVICE_REVOKED"
+	eventTypeEmailAdded    = "EMAIL_ADDED"
+	eventTypeEmailRemoved  = "EMAIL_REMOVED"
+)
+
+// logTypes maps the types of log entries by which users can filter their logs to the event types
+// of the entries, recorded either by MyIRMA or by the keyshare server.
+var logTypes = map[string][]string{
+	"pin": {
+		"PIN_CHECK_SUCCESS", "PIN_CHECK_FAILED", "PIN_CHECK_REFUSED", "PIN_CHECK_BLOCKED", "PIN_CHECK_LOCKED",
+		eventTypePinUnblocked,
+	},
+	"session": {"IRMA_SESSION"},
+	"email":   {eventTypeEmailAdded, eventTypeEmailRemoved},
+	"device":  {"DEVICE_LINK_CODE", "DEVICE_LINKED", eventTypeDeviceRevoked},
+}
+
+// logFilter selects log entries by event type and time. Zero values do not restrict the selection.
+type logFilter struct {
+	Events []string
+	From   int64 // inclusive
+	Until  int64 // exclusive
+}
+
+func (f logFilter) matches(entry logEntry) bool {
+	if f.From != 0 && entry.Timestamp < f.From {
+		return false
+	}
+	if f.Until != 0 && entry.Timestamp >= f.Until {
+		return false
+	}
+	if len(f.Events) == 0 {
+		return true
+	}
+	for _, event := range f.Events {
+		if entry.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// where returns the SQL conditions on the columns of log_entry_records for the filter, and its
+// arguments. The placeholder function returns the placeholder of the i-th argument.
+func (f logFilter) where(placeholder func(i int) string, firstArg int) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(firstArg + len(args) - 1)
+	}
+
+	if len(f.Events) > 0 {
+		var placeholders []string
+		for _, event := range f.Events {
+			placeholders = append(placeholders, arg(event))
+		}
+		conditions = append(conditions, fmt.Sprintf("event IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	if f.From != 0 {
+		conditions = append(conditions, "time >= "+arg(f.From))
+	}
+	if f.Until != 0 {
+		conditions = append(conditions, "time < "+arg(f.Until))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
+
 type db interface {
 	user(id int64) (user, error)
 
@@ -13,11 +91,18 @@ type db interface {
 	verifyLoginToken(token, username string) (int64, error)
 
 	scheduleUserRemoval(id int64, delay time.Duration) error
+	unblockPin(id int64) error
+
+	// devices returns the devices linked to the user's account, besides the one that registered it.
+	devices(id int64) ([]device, error)
+	revokeDevice(id int64, deviceID int64) error
 
 	addLoginToken(email, token string) error
 	loginUserCandidates(token string) ([]loginCandidate, error)
 
-	logs(id int64, offset int, amount int) ([]logEntry, error)
+	// logs returns the log entries of the user that are selected by the filter.
+	logs(id int64, filter logFilter, offset int, amount int) ([]logEntry, error)
+	logCount(id int64, filter logFilter) (int, error)
 
 	addEmail(id int64, email string) error
 	scheduleEmailRemoval(id int64, email string, delay time.Duration) error
@@ -25,6 +110,19 @@ type db interface {
 	setSeen(id int64) error
 }
 
+// encodeLogParam encodes the parameter of a log entry as the keyshare server does, as JSON.
+func encodeLogParam(param interface{}) (*string, error) {
+	if param == nil {
+		return nil, nil
+	}
+	bts, err := json.Marshal(param)
+	if err != nil {
+		return nil, err
+	}
+	encoded := string(bts)
+	return &encoded, nil
+}
+
 type userEmail struct {
 	Email            string `json:"email"`
 	DeleteInProgress bool   `json:"delete_in_progress"`
@@ -42,8 +140,17 @@ type loginCandidate struct {
 	LastActive int64  `json:"last_active"`
 }
 
+type device struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"last_seen"`
+	RevokedOn *int64 `json:"revoked_on,omitempty"`
+}
+
 type logEntry struct {
 	Timestamp int64   `json:"timestamp"`
 	Event     string  `json:"event"`
 	Param     *string `json:"param,omitempty"`
+	Device    *string `json:"device,omitempty"` // name of the device that performed the action, if not the registering one
 }
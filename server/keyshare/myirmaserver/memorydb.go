@@ -1,6 +1,7 @@
 package myirmaserver
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -11,6 +12,7 @@ type memoryUserData struct {
 	id         int64
 	email      []string
 	logEntries []logEntry
+	devices    []device
 	lastActive time.Time
 }
 
@@ -52,6 +54,51 @@ func (db *memoryDB) scheduleUserRemoval(id int64, _ time.Duration) error {
 	return keyshare.ErrUserNotFound
 }
 
+func (db *memoryDB) unblockPin(id int64) error {
+	db.Lock()
+	defer db.Unlock()
+	for username, user := range db.userData {
+		if user.id == id {
+			user.logEntries = append(user.logEntries, logEntry{Timestamp: time.Now().Unix(), Event: eventTypePinUnblocked})
+			db.userData[username] = user
+			return nil
+		}
+	}
+	return keyshare.ErrUserNotFound
+}
+
+func (db *memoryDB) devices(id int64) ([]device, error) {
+	db.Lock()
+	defer db.Unlock()
+	for _, user := range db.userData {
+		if user.id == id {
+			return user.devices, nil
+		}
+	}
+	return nil, keyshare.ErrUserNotFound
+}
+
+func (db *memoryDB) revokeDevice(id int64, deviceID int64) error {
+	db.Lock()
+	defer db.Unlock()
+	for username, user := range db.userData {
+		if user.id != id {
+			continue
+		}
+		for i, d := range user.devices {
+			if d.ID == deviceID && d.RevokedOn == nil {
+				now := time.Now().Unix()
+				user.devices[i].RevokedOn = &now
+				user.logEntries = append(user.logEntries, logEntry{Timestamp: now, Event: eventTypeDeviceRevoked, Device: &d.Name})
+				db.userData[username] = user
+				return nil
+			}
+		}
+		return errDeviceNotFound
+	}
+	return keyshare.ErrUserNotFound
+}
+
 func (db *memoryDB) verifyEmailToken(token string) (int64, error) {
 	db.Lock()
 	defer db.Unlock()
@@ -113,6 +160,7 @@ func (db *memoryDB) loginUserCandidates(token string) ([]loginCandidate, error)
 			}
 		}
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
 	return result, nil
 }
 
@@ -169,23 +217,55 @@ func min(a, b int) int {
 	}
 }
 
-func (db *memoryDB) logs(id int64, offset, amount int) ([]logEntry, error) {
+func (db *memoryDB) logs(id int64, filter logFilter, offset, amount int) ([]logEntry, error) {
+	entries, err := db.filteredLogs(id, filter)
+	if err != nil {
+		return nil, err
+	}
+	return entries[min(len(entries), offset):min(len(entries), offset+amount)], nil
+}
+
+func (db *memoryDB) logCount(id int64, filter logFilter) (int, error) {
+	entries, err := db.filteredLogs(id, filter)
+	return len(entries), err
+}
+
+func (db *memoryDB) filteredLogs(id int64, filter logFilter) ([]logEntry, error) {
 	db.Lock()
 	defer db.Unlock()
 	for _, user := range db.userData {
 		if user.id == id {
-			return user.logEntries[min(len(user.logEntries), offset):min(len(user.logEntries), offset+amount)], nil
+			var entries []logEntry
+			for _, entry := range user.logEntries {
+				if filter.matches(entry) {
+					entries = append(entries, entry)
+				}
+			}
+			return entries, nil
 		}
 	}
 	return nil, keyshare.ErrUserNotFound
 }
 
+// addLog adds a log entry to the specified user, who must be locked by the caller.
+func (db *memoryDB) addLog(user *memoryUserData, event string, param interface{}) error {
+	encodedParam, err := encodeLogParam(param)
+	if err != nil {
+		return err
+	}
+	user.logEntries = append(user.logEntries, logEntry{Timestamp: time.Now().Unix(), Event: event, Param: encodedParam})
+	return nil
+}
+
 func (db *memoryDB) addEmail(id int64, email string) error {
 	db.Lock()
 	defer db.Unlock()
 	for username, user := range db.userData {
 		if user.id == id {
 			user.email = append(user.email, email)
+			if err := db.addLog(&user, eventTypeEmailAdded, email); err != nil {
+				return err
+			}
 			db.userData[username] = user
 			return nil
 		}
@@ -202,6 +282,9 @@ func (db *memoryDB) scheduleEmailRemoval(id int64, email string, _ time.Duration
 				if emailv == email {
 					copy(user.email[i:], user.email[i+1:])
 					user.email = user.email[:len(user.email)-1]
+					if err := db.addLog(&user, eventTypeEmailRemoved, email); err != nil {
+						return err
+					}
 					db.userData[username] = user
 					return nil
 				}
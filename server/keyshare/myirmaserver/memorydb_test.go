@@ -138,7 +138,7 @@ func TestMemoryDBUserInfo(t *testing.T) {
 	_, err = db.user(1231)
 	assert.Error(t, err)
 
-	entries, err := db.logs(15, 0, 2)
+	entries, err := db.logs(15, logFilter{}, 0, 2)
 	assert.NoError(t, err)
 	assert.Equal(t, []logEntry{
 		{
@@ -153,19 +153,19 @@ func TestMemoryDBUserInfo(t *testing.T) {
 		},
 	}, entries)
 
-	entries, err = db.logs(15, 0, 1)
+	entries, err = db.logs(15, logFilter{}, 0, 1)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(entries))
 
-	entries, err = db.logs(15, 1, 15)
+	entries, err = db.logs(15, logFilter{}, 1, 15)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(entries))
 
-	entries, err = db.logs(15, 100, 20)
+	entries, err = db.logs(15, logFilter{}, 100, 20)
 	assert.NoError(t, err)
 	assert.Equal(t, 0, len(entries))
 
-	_, err = db.logs(20, 100, 20)
+	_, err = db.logs(20, logFilter{}, 100, 20)
 	assert.Error(t, err)
 
 	err = db.addEmail(17, "test@test.com")
@@ -191,3 +191,41 @@ func TestMemoryDBUserInfo(t *testing.T) {
 	err = db.scheduleEmailRemoval(20, "bl@bla.com", 0)
 	assert.Error(t, err)
 }
+
+func TestMemoryDBLogFilter(t *testing.T) {
+	db := &memoryDB{
+		userData: map[string]memoryUserData{
+			"testuser": {
+				id: 15,
+				logEntries: []logEntry{
+					{Timestamp: 110, Event: "PIN_CHECK_SUCCESS"},
+					{Timestamp: 120, Event: "IRMA_SESSION"},
+					{Timestamp: 130, Event: "PIN_CHECK_FAILED"},
+				},
+			},
+		},
+	}
+
+	filter := logFilter{Events: logTypes["pin"]}
+	count, err := db.logCount(15, filter)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	entries, err := db.logs(15, filter, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []logEntry{{Timestamp: 130, Event: "PIN_CHECK_FAILED"}}, entries)
+
+	count, err = db.logCount(15, logFilter{From: 120, Until: 130})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = db.logCount(20, logFilter{})
+	assert.Error(t, err)
+
+	require.NoError(t, db.addEmail(15, "test@test.com"))
+	require.NoError(t, db.scheduleEmailRemoval(15, "test@test.com", 0))
+	entries, err = db.logs(15, logFilter{Events: logTypes["email"]}, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, eventTypeEmailAdded, entries[0].Event)
+	assert.Equal(t, `"test@test.com"`, *entries[1].Param)
+}
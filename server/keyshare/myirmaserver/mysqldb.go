@@ -0,0 +1,353 @@
+package myirmaserver
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
+)
+
+// mysqlDB provides a MySQL/MariaDB-backed implementation of db. Its tables reside in the database
+// specified in the connection string.
+type mysqlDB struct {
+	db keyshare.DB
+}
+
+func newMySQLDB(connstring string) (db, error) {
+	connstring, err := keyshare.MySQLConnStr(connstring)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", connstring)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		return nil, errors.Errorf("failed to connect to database: %v", err)
+	}
+	if _, err = keyshare.MigrateUp(db, keyshare.DialectMySQL); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to migrate database", 0)
+	}
+	return &mysqlDB{
+		db: keyshare.DB{DB: db},
+	}, nil
+}
+
+func (db *mysqlDB) userIDByUsername(username string) (int64, error) {
+	var id int64
+	return id, db.db.QueryUser("SELECT id FROM users WHERE username = ?", []interface{}{&id}, username)
+}
+
+func (db *mysqlDB) verifyEmailToken(token string) (int64, error) {
+	var email string
+	var id int64
+	err := db.db.QueryScan(
+		"SELECT user_id, email FROM email_verification_tokens WHERE token = ? AND expiry >= ?",
+		[]interface{}{&id, &email},
+		token, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return 0, errTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.addEmail(id, email)
+	if err != nil {
+		return 0, err
+	}
+
+	// Beyond this point, errors are no longer relevant for frontend, so only log
+	aff, err := db.db.ExecCount("DELETE FROM email_verification_tokens WHERE token = ?", token)
+	if err != nil {
+		_ = server.LogError(err)
+		return id, nil
+	}
+	if aff != 1 {
+		_ = server.LogError(errors.Errorf("Unexpected number of deleted records %d for token", aff))
+		return id, nil
+	}
+	return id, nil
+}
+
+func (db *mysqlDB) scheduleUserRemoval(id int64, delay time.Duration) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET coredata = NULL, delete_on = ? WHERE id = ? AND coredata IS NOT NULL",
+		time.Now().Add(delay).Unix(),
+		id)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	// The secrets of the other devices of the user must go as well
+	if _, err = tx.Exec("DELETE FROM devices WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *mysqlDB) unblockPin(id int64) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET pin_counter = 0, pin_block_date = 0 WHERE id = ? AND coredata IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	if _, err = tx.Exec("UPDATE devices SET pin_counter = 0, pin_block_date = 0 WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO log_entry_records (time, event, user_id) VALUES (?, ?, ?)",
+		time.Now().Unix(), eventTypePinUnblocked, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *mysqlDB) devices(id int64) ([]device, error) {
+	var result []device
+	err := db.db.QueryIterate(
+		"SELECT id, name, created, last_seen, revoked_on FROM devices WHERE user_id = ? ORDER BY created",
+		func(rows *sql.Rows) error {
+			var d device
+			err := rows.Scan(&d.ID, &d.Name, &d.Created, &d.LastSeen, &d.RevokedOn)
+			result = append(result, d)
+			return err
+		},
+		id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *mysqlDB) revokeDevice(id int64, deviceID int64) error {
+	aff, err := db.db.ExecCount("UPDATE devices SET revoked_on = ? WHERE id = ? AND user_id = ? AND revoked_on IS NULL",
+		time.Now().Unix(), deviceID, id)
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errDeviceNotFound
+	}
+	_, err = db.db.Exec("INSERT INTO log_entry_records (time, event, param, user_id, device_id) VALUES (?, ?, NULL, ?, ?)",
+		time.Now().Unix(), eventTypeDeviceRevoked, id, deviceID)
+	return err
+}
+
+func (db *mysqlDB) addLoginToken(email, token string) error {
+	// Check if email address exists in database
+	err := db.db.QueryScan("SELECT 1 FROM emails WHERE email = ? AND (delete_on >= ? OR delete_on IS NULL) LIMIT 1",
+		nil, email, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return errEmailNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// insert and verify
+	aff, err := db.db.ExecCount("INSERT INTO email_login_tokens (token, email, expiry) VALUES (?, ?, ?)",
+		token,
+		email,
+		time.Now().Add(emailTokenValidity*time.Minute).Unix())
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errors.Errorf("Unexpected number of affected rows %d on token insert", aff)
+	}
+
+	return nil
+}
+
+func (db *mysqlDB) loginUserCandidates(token string) ([]loginCandidate, error) {
+	var candidates []loginCandidate
+	now := time.Now().Unix()
+	err := db.db.QueryIterate(
+		`SELECT username, last_seen FROM users INNER JOIN emails ON users.id = emails.user_id WHERE
+		     (emails.delete_on >= ? OR emails.delete_on is NULL) AND
+		          emails.email = (SELECT email FROM email_login_tokens WHERE token = ? AND expiry >= ?)
+		 ORDER BY username`,
+		func(rows *sql.Rows) error {
+			candidate := loginCandidate{}
+			err := rows.Scan(&candidate.Username, &candidate.LastActive)
+			candidates = append(candidates, candidate)
+			return err
+		},
+		now, token, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, keyshare.ErrUserNotFound
+	}
+	return candidates, nil
+}
+
+func (db *mysqlDB) verifyLoginToken(token, username string) (int64, error) {
+	var id int64
+	now := time.Now().Unix()
+	err := db.db.QueryUser(
+		`SELECT users.id FROM users INNER JOIN emails ON users.id = emails.user_id WHERE
+		     username = ? AND (emails.delete_on >= ? OR emails.delete_on IS NULL) AND
+		     email = (SELECT email FROM email_login_tokens WHERE token = ? AND expiry >= ?)`,
+		[]interface{}{&id}, username, now, token, now)
+	if err != nil {
+		return 0, err
+	}
+
+	aff, err := db.db.ExecCount("DELETE FROM email_login_tokens WHERE token = ?", token)
+	if err != nil {
+		return 0, err
+	}
+	if aff != 1 {
+		return 0, errors.Errorf("Unexpected number of affected rows %d for token removal", aff)
+	}
+	return id, nil
+}
+
+func (db *mysqlDB) user(id int64) (user, error) {
+	var result user
+
+	// fetch username
+	err := db.db.QueryUser("SELECT username, language, (coredata IS NULL) AS delete_in_progress FROM users WHERE id = ?",
+		[]interface{}{&result.Username, &result.language, &result.DeleteInProgress},
+		id)
+	if err != nil {
+		return user{}, err
+	}
+
+	// fetch email addresses
+	err = db.db.QueryIterate(
+		"SELECT email, (delete_on IS NOT NULL) AS delete_in_progress FROM emails WHERE user_id = ? AND (delete_on >= ? OR delete_on IS NULL)",
+		func(rows *sql.Rows) error {
+			var email userEmail
+			err = rows.Scan(&email.Email, &email.DeleteInProgress)
+			result.Emails = append(result.Emails, email)
+			return err
+		},
+		id, time.Now().Unix())
+	if err != nil {
+		return user{}, err
+	}
+	return result, nil
+}
+
+func (db *mysqlDB) logs(id int64, filter logFilter, offset, amount int) ([]logEntry, error) {
+	where, args := filter.where(mysqlPlaceholder, 2)
+	var result []logEntry
+	err := db.db.QueryIterate(
+		`SELECT time, event, param, devices.name FROM log_entry_records
+		 LEFT JOIN devices ON devices.id = log_entry_records.device_id
+		 WHERE log_entry_records.user_id = ?`+where+` ORDER BY time DESC, log_entry_records.id DESC LIMIT ? OFFSET ?`,
+		func(rows *sql.Rows) error {
+			var curEntry logEntry
+			err := rows.Scan(&curEntry.Timestamp, &curEntry.Event, &curEntry.Param, &curEntry.Device)
+			result = append(result, curEntry)
+			return err
+		},
+		append(append([]interface{}{id}, args...), amount, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *mysqlDB) logCount(id int64, filter logFilter) (int, error) {
+	where, args := filter.where(mysqlPlaceholder, 2)
+	var count int
+	err := db.db.QueryScan(
+		"SELECT COUNT(*) FROM log_entry_records WHERE user_id = ?"+where,
+		[]interface{}{&count},
+		append([]interface{}{id}, args...)...)
+	return count, err
+}
+
+func mysqlPlaceholder(int) string {
+	return "?"
+}
+
+func (db *mysqlDB) addLog(id int64, event string, param interface{}) error {
+	encodedParam, err := encodeLogParam(param)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("INSERT INTO log_entry_records (time, event, param, user_id) VALUES (?, ?, ?, ?)",
+		time.Now().Unix(), event, encodedParam, id)
+	return err
+}
+
+func (db *mysqlDB) addEmail(id int64, email string) error {
+	// Try to restore email in process of deletion
+	aff, err := db.db.ExecCount("UPDATE emails SET delete_on = NULL WHERE user_id = ? AND email = ?", id, email)
+	if err != nil {
+		return err
+	}
+	if aff > 1 {
+		return errors.Errorf("Unexpected number of affected rows %d for email adding", aff)
+	}
+	if aff == 0 {
+		// Fall back to adding new one
+		_, err = db.db.Exec("INSERT INTO emails (user_id, email) VALUES (?, ?)", id, email)
+		if err != nil {
+			return err
+		}
+	}
+	return db.addLog(id, eventTypeEmailAdded, email)
+}
+
+func (db *mysqlDB) scheduleEmailRemoval(id int64, email string, delay time.Duration) error {
+	aff, err := db.db.ExecCount("UPDATE emails SET delete_on = ? WHERE user_id = ? AND email = ? AND delete_on IS NULL",
+		time.Now().Add(delay).Unix(),
+		id,
+		email)
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errors.Errorf("Unexpected number of affected rows %d for email removal", aff)
+	}
+	return db.addLog(id, eventTypeEmailRemoved, email)
+}
+
+func (db *mysqlDB) setSeen(id int64) error {
+	// If the user is scheduled for deletion (delete_on is not null), undo that by resetting
+	// delete_on back to null, but only if the user did not explicitly delete her account herself
+	// in the myIRMA website, in which case coredata is null.
+	return db.db.ExecUser(
+		`UPDATE users
+		 SET last_seen = ?,
+		     delete_on = CASE
+		         WHEN coredata IS NOT NULL THEN NULL
+		         ELSE delete_on
+		     END
+		 WHERE id = ?`,
+		time.Now().Unix(), id,
+	)
+}
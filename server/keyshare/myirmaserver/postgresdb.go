@@ -2,6 +2,7 @@ package myirmaserver
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -17,8 +18,9 @@ type postgresDB struct {
 const emailTokenValidity = 60 // amount of time an email login token is valid (in minutes)
 
 var (
-	errEmailNotFound = errors.New("Email address not found")
-	errTokenNotFound = errors.New("Token not found")
+	errEmailNotFound  = errors.New("Email address not found")
+	errTokenNotFound  = errors.New("Token not found")
+	errDeviceNotFound = errors.New("Device not found")
 )
 
 func newPostgresDB(connstring string) (db, error) {
@@ -29,6 +31,9 @@ func newPostgresDB(connstring string) (db, error) {
 	if err = db.Ping(); err != nil {
 		return nil, errors.Errorf("failed to connect to database: %v", err)
 	}
+	if _, err = keyshare.MigrateUp(db, keyshare.DialectPostgres); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to migrate database", 0)
+	}
 	return &postgresDB{
 		db: keyshare.DB{DB: db},
 	}, nil
@@ -72,9 +77,90 @@ func (db *postgresDB) verifyEmailToken(token string) (int64, error) {
 }
 
 func (db *postgresDB) scheduleUserRemoval(id int64, delay time.Duration) error {
-	return db.db.ExecUser("UPDATE irma.users SET coredata = NULL, delete_on = $2 WHERE id = $1 AND coredata IS NOT NULL",
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE irma.users SET coredata = NULL, delete_on = $2 WHERE id = $1 AND coredata IS NOT NULL",
 		id,
 		time.Now().Add(delay).Unix())
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	// The secrets of the other devices of the user must go as well
+	if _, err = tx.Exec("DELETE FROM irma.devices WHERE user_id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *postgresDB) unblockPin(id int64) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE irma.users SET pin_counter = 0, pin_block_date = 0 WHERE id = $1 AND coredata IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return keyshare.ErrUserNotFound
+	}
+	if _, err = tx.Exec("UPDATE irma.devices SET pin_counter = 0, pin_block_date = 0 WHERE user_id = $1", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO irma.log_entry_records (time, event, user_id) VALUES ($1, $2, $3)",
+		time.Now().Unix(), eventTypePinUnblocked, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *postgresDB) devices(id int64) ([]device, error) {
+	var result []device
+	err := db.db.QueryIterate(
+		"SELECT id, name, created, last_seen, revoked_on FROM irma.devices WHERE user_id = $1 ORDER BY created",
+		func(rows *sql.Rows) error {
+			var d device
+			err := rows.Scan(&d.ID, &d.Name, &d.Created, &d.LastSeen, &d.RevokedOn)
+			result = append(result, d)
+			return err
+		},
+		id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (db *postgresDB) revokeDevice(id int64, deviceID int64) error {
+	aff, err := db.db.ExecCount("UPDATE irma.devices SET revoked_on = $3 WHERE id = $2 AND user_id = $1 AND revoked_on IS NULL",
+		id, deviceID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errDeviceNotFound
+	}
+	_, err = db.db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id, device_id) VALUES ($1, $2, NULL, $3, $4)",
+		time.Now().Unix(), eventTypeDeviceRevoked, id, deviceID)
+	return err
 }
 
 func (db *postgresDB) addLoginToken(email, token string) error {
@@ -108,7 +194,8 @@ func (db *postgresDB) loginUserCandidates(token string) ([]loginCandidate, error
 	err := db.db.QueryIterate(
 		`SELECT username, last_seen FROM irma.users INNER JOIN irma.emails ON users.id = emails.user_id WHERE
 		     (emails.delete_on >= $2 OR emails.delete_on is NULL) AND
-		          emails.email = (SELECT email FROM irma.email_login_tokens WHERE token = $1 AND expiry >= $2);`,
+		          emails.email = (SELECT email FROM irma.email_login_tokens WHERE token = $1 AND expiry >= $2)
+		 ORDER BY username`,
 		func(rows *sql.Rows) error {
 			candidate := loginCandidate{}
 			err := rows.Scan(&candidate.Username, &candidate.LastActive)
@@ -173,23 +260,53 @@ func (db *postgresDB) user(id int64) (user, error) {
 	return result, nil
 }
 
-func (db *postgresDB) logs(id int64, offset, amount int) ([]logEntry, error) {
+func (db *postgresDB) logs(id int64, filter logFilter, offset, amount int) ([]logEntry, error) {
+	where, args := filter.where(postgresPlaceholder, 2)
 	var result []logEntry
 	err := db.db.QueryIterate(
-		"SELECT time, event, param FROM irma.log_entry_records WHERE user_id = $1 ORDER BY time DESC OFFSET $2 LIMIT $3",
+		fmt.Sprintf(
+			`SELECT time, event, param, irma.devices.name FROM irma.log_entry_records
+			 LEFT JOIN irma.devices ON irma.devices.id = irma.log_entry_records.device_id
+			 WHERE irma.log_entry_records.user_id = $1%s ORDER BY time DESC, irma.log_entry_records.id DESC OFFSET $%d LIMIT $%d`,
+			where, len(args)+2, len(args)+3,
+		),
 		func(rows *sql.Rows) error {
 			var curEntry logEntry
-			err := rows.Scan(&curEntry.Timestamp, &curEntry.Event, &curEntry.Param)
+			err := rows.Scan(&curEntry.Timestamp, &curEntry.Event, &curEntry.Param, &curEntry.Device)
 			result = append(result, curEntry)
 			return err
 		},
-		id, offset, amount)
+		append(append([]interface{}{id}, args...), offset, amount)...)
 	if err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+func (db *postgresDB) logCount(id int64, filter logFilter) (int, error) {
+	where, args := filter.where(postgresPlaceholder, 2)
+	var count int
+	err := db.db.QueryScan(
+		"SELECT COUNT(*) FROM irma.log_entry_records WHERE user_id = $1"+where,
+		[]interface{}{&count},
+		append([]interface{}{id}, args...)...)
+	return count, err
+}
+
+func postgresPlaceholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
+func (db *postgresDB) addLog(id int64, event string, param interface{}) error {
+	encodedParam, err := encodeLogParam(param)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id) VALUES ($1, $2, $3, $4)",
+		time.Now().Unix(), event, encodedParam, id)
+	return err
+}
+
 func (db *postgresDB) addEmail(id int64, email string) error {
 	// Try to restore email in process of deletion
 	aff, err := db.db.ExecCount("UPDATE irma.emails SET delete_on = NULL WHERE user_id = $1 AND email = $2", id, email)
@@ -199,13 +316,14 @@ func (db *postgresDB) addEmail(id int64, email string) error {
 	if aff > 1 {
 		return errors.Errorf("Unexpected number of affected rows %d for email adding", aff)
 	}
-	if aff == 1 {
-		return nil
+	if aff == 0 {
+		// Fall back to adding new one
+		_, err = db.db.Exec("INSERT INTO irma.emails (user_id, email) VALUES ($1, $2)", id, email)
+		if err != nil {
+			return err
+		}
 	}
-
-	// Fall back to adding new one
-	_, err = db.db.Exec("INSERT INTO irma.emails (user_id, email) VALUES ($1, $2)", id, email)
-	return err
+	return db.addLog(id, eventTypeEmailAdded, email)
 }
 
 func (db *postgresDB) scheduleEmailRemoval(id int64, email string, delay time.Duration) error {
@@ -219,7 +337,7 @@ func (db *postgresDB) scheduleEmailRemoval(id int64, email string, delay time.Du
 	if aff != 1 {
 		return errors.Errorf("Unexpected number of affected rows %d for email removal", aff)
 	}
-	return nil
+	return db.addLog(id, eventTypeEmailRemoved, email)
 }
 
 func (db *postgresDB) setSeen(id int64) error {
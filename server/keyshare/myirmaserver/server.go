@@ -2,8 +2,10 @@ package myirmaserver
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -105,8 +107,13 @@ func (s *Server) Handler() http.Handler {
 
 			// User account data
 			router.Get("/user", s.handleUserInfo)
+			router.Get("/user/logs", s.handleSearchLogs)
+			router.Get("/user/logs/export", s.handleExportLogs)
 			router.Get("/user/logs/{offset}", s.handleGetLogs)
 			router.Post("/user/delete", s.handleDeleteUser)
+			router.Post("/user/unblock", s.handleUnblockPin)
+			router.Get("/user/devices", s.handleGetDevices)
+			router.Post("/user/devices/revoke", s.handleRevokeDevice)
 
 			// Email address management
 			router.Post("/email/add", s.handleAddEmail)
@@ -163,7 +170,7 @@ func (s *Server) sendDeleteEmails(session *session) error {
 		// the user account, even if one or more notification mails could not be sent.
 		_ = s.conf.SendEmail(
 			s.conf.deleteAccountTemplates,
-			s.conf.DeleteAccountFiles,
+			s.conf.DeleteAccountSubjects,
 			map[string]string{"Username": user.Username, "Email": email.Email, "Delay": strconv.Itoa(s.conf.DeleteDelay)},
 			email.Email,
 			user.language,
@@ -177,7 +184,7 @@ func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 
 	// First, send emails
-	if s.conf.EmailServer != "" {
+	if s.conf.EmailEnabled() {
 		err := s.sendDeleteEmails(session)
 		if err != nil {
 			//already logged
@@ -198,6 +205,62 @@ func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) handleUnblockPin(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*session)
+
+	err := s.db.unblockPin(*session.userID)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Problem unblocking pin")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*session)
+	devices, err := s.db.devices(*session.userID)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not load devices")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	session.expiry = time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second)
+	s.setCookie(w, session.token, s.conf.SessionLifetime)
+
+	if devices == nil {
+		devices = []device{}
+	} // Ensure we never send an nil as empty list
+	server.WriteJson(w, devices)
+}
+
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	var deviceID int64
+	if err := server.ParseBody(r, &deviceID); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	session := r.Context().Value("session").(*session)
+	err := s.db.revokeDevice(*session.userID, deviceID)
+	if err == errDeviceNotFound {
+		server.WriteError(w, server.ErrorInvalidRequest, "Not a valid device for user")
+		return
+	}
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Problem revoking device")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	session.expiry = time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second)
+	s.setCookie(w, session.token, s.conf.SessionLifetime)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) setCookie(w http.ResponseWriter, token string, maxage int) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session",
@@ -236,7 +299,7 @@ func (s *Server) sendLoginEmail(request emailLoginRequest) error {
 }
 
 func (s *Server) handleEmailLogin(w http.ResponseWriter, r *http.Request) {
-	if s.conf.EmailServer == "" {
+	if !s.conf.EmailEnabled() {
 		server.WriteError(w, server.ErrorInternal, "not enabled in configuration")
 		return
 	}
@@ -476,7 +539,7 @@ func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	session := r.Context().Value("session").(*session)
-	entries, err := s.db.logs(*session.userID, offset, 11)
+	entries, err := s.db.logs(*session.userID, logFilter{}, offset, 11)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not load log entries")
 		server.WriteError(w, server.ErrorInternal, err.Error())
@@ -492,6 +555,216 @@ func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, entries)
 }
 
+// Default and maximum amount of log entries returned by handleSearchLogs
+const (
+	defaultLogAmount = 11
+	maxLogAmount     = 100
+)
+
+func (s *Server) handleSearchLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Info("Malformed log filter")
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		s.conf.Logger.WithField("error", err).Info("Malformed offset")
+		server.WriteError(w, server.ErrorInvalidRequest, "malformed offset")
+		return
+	}
+	amount, err := queryInt(query.Get("amount"), defaultLogAmount)
+	if err != nil || amount <= 0 || amount > maxLogAmount {
+		s.conf.Logger.WithField("error", err).Info("Malformed amount")
+		server.WriteError(w, server.ErrorInvalidRequest, "malformed amount")
+		return
+	}
+
+	session := r.Context().Value("session").(*session)
+	total, err := s.db.logCount(*session.userID, filter)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not count log entries")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	entries, err := s.db.logs(*session.userID, filter, offset, amount)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not load log entries")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	session.expiry = time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second)
+	s.setCookie(w, session.token, s.conf.SessionLifetime)
+
+	if entries == nil {
+		entries = []logEntry{}
+	} // Ensure we never send an nil as empty list
+	server.WriteJson(w, logSearchResult{Total: total, Entries: entries})
+}
+
+func (s *Server) handleExportLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Info("Malformed log filter")
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		server.WriteError(w, server.ErrorInvalidRequest, "unsupported export format")
+		return
+	}
+
+	// The entries are loaded and written a page at a time. Entries logged after the export started
+	// are excluded, so that they do not shift the pages.
+	if now := time.Now().Unix() + 1; filter.Until == 0 || filter.Until > now {
+		filter.Until = now
+	}
+	session := r.Context().Value("session").(*session)
+	entries, err := s.db.logs(*session.userID, filter, 0, exportLogPageSize)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not load log entries")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	session.expiry = time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second)
+	s.setCookie(w, session.token, s.conf.SessionLifetime)
+
+	w.Header().Set("Content-Disposition", "attachment; filename=\"irma-activity."+format+"\"")
+	export := newLogExport(w, format)
+	for offset := 0; ; offset += exportLogPageSize {
+		if offset > 0 {
+			if entries, err = s.db.logs(*session.userID, filter, offset, exportLogPageSize); err != nil {
+				// The response has already started, so all we can do is to end it prematurely
+				s.conf.Logger.WithField("error", err).Error("Could not load log entries")
+				return
+			}
+		}
+		for _, entry := range entries {
+			export.write(entry)
+		}
+		if len(entries) < exportLogPageSize {
+			break
+		}
+	}
+	if err = export.finish(); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not write log export")
+	}
+}
+
+// Amount of log entries loaded at once by handleExportLogs
+const exportLogPageSize = 1000
+
+// logExport writes log entries to a response as a JSON array or as CSV. Write errors are
+// returned by finish.
+type logExport struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer // nil for JSON
+	written int
+	err     error
+}
+
+func newLogExport(w http.ResponseWriter, format string) *logExport {
+	export := &logExport{w: w}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		export.csv = csv.NewWriter(w)
+		export.err = export.csv.Write([]string{"timestamp", "event", "param", "device"})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		_, export.err = w.Write([]byte("["))
+	}
+	return export
+}
+
+func (e *logExport) write(entry logEntry) {
+	if e.err != nil {
+		return
+	}
+	defer func() { e.written++ }()
+
+	if e.csv != nil {
+		var param, device string
+		if entry.Param != nil {
+			param = *entry.Param
+		}
+		if entry.Device != nil {
+			device = *entry.Device
+		}
+		e.err = e.csv.Write([]string{strconv.FormatInt(entry.Timestamp, 10), entry.Event, param, device})
+		return
+	}
+
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		e.err = err
+		return
+	}
+	if e.written > 0 {
+		bts = append([]byte(","), bts...)
+	}
+	_, e.err = e.w.Write(bts)
+}
+
+func (e *logExport) finish() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	_, err := e.w.Write([]byte("]"))
+	return err
+}
+
+type logSearchResult struct {
+	Total   int        `json:"total"`
+	Entries []logEntry `json:"entries"`
+}
+
+// parseLogFilter parses the type, from and until query parameters of the log endpoints.
+func parseLogFilter(query url.Values) (logFilter, error) {
+	var filter logFilter
+	for _, t := range query["type"] {
+		events, ok := logTypes[t]
+		if !ok {
+			return logFilter{}, errors.Errorf("unknown log type %s", t)
+		}
+		filter.Events = append(filter.Events, events...)
+	}
+	var err error
+	if filter.From, err = queryInt64(query.Get("from"), 0); err != nil {
+		return logFilter{}, errors.New("malformed from")
+	}
+	if filter.Until, err = queryInt64(query.Get("until"), 0); err != nil {
+		return logFilter{}, errors.New("malformed until")
+	}
+	return filter, nil
+}
+
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func queryInt64(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
 func (s *Server) processRemoveEmail(session *session, email string) error {
 	user, err := s.db.user(*session.userID)
 	if err != nil {
@@ -509,7 +782,7 @@ func (s *Server) processRemoveEmail(session *session, email string) error {
 		return errInvalidEmail
 	}
 
-	if s.conf.EmailServer != "" {
+	if s.conf.EmailEnabled() {
 		err = s.conf.SendEmail(
 			s.conf.deleteEmailTemplates,
 			s.conf.DeleteEmailSubjects,
@@ -586,9 +859,38 @@ func (s *Server) processAddEmailIrmaSessionResult(session *session) (server.Erro
 		return server.ErrorInternal, err.Error()
 	}
 
+	s.sendEmailAddedEmails(*session.userID, email)
+
 	return server.Error{}, ""
 }
 
+// sendEmailAddedEmails notifies all email addresses of the user, including the new one, that an
+// email address was added to their account. Failures are only logged.
+func (s *Server) sendEmailAddedEmails(id int64, email string) {
+	if s.conf.emailAddedTemplates == nil || !s.conf.EmailEnabled() {
+		return
+	}
+
+	user, err := s.db.user(id)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not fetch user information")
+		return
+	}
+	for _, e := range user.Emails {
+		if e.DeleteInProgress {
+			continue
+		}
+		// already logged
+		_ = s.conf.SendEmail(
+			s.conf.emailAddedTemplates,
+			s.conf.EmailAddedSubjects,
+			map[string]string{"Username": user.Username, "Email": email},
+			e.Email,
+			user.language,
+		)
+	}
+}
+
 func (s *Server) handleAddEmail(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 
@@ -2,6 +2,7 @@ package myirmaserver
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
 	"testing"
@@ -198,15 +199,208 @@ func TestServerUserData(t *testing.T) {
 
 	var logs []logEntry
 	test.HTTPGet(t, client, "http://localhost:8081/user/logs/0", nil, 200, &logs)
+	require.Len(t, logs, 3)
 	assert.Equal(t, []logEntry{
 		{Timestamp: 110, Event: "test", Param: &strEmpty},
 		{Timestamp: 120, Event: "test2", Param: &str15},
-	}, logs)
+	}, logs[:2])
+	assert.Equal(t, eventTypeEmailRemoved, logs[2].Event)
+	require.NotNil(t, logs[2].Param)
+	assert.Equal(t, `"test@test.com"`, *logs[2].Param)
 
+	logs = nil
 	test.HTTPGet(t, client, "http://localhost:8081/user/logs/1", nil, 200, &logs)
+	require.Len(t, logs, 2)
+	assert.Equal(t, logEntry{Timestamp: 120, Event: "test2", Param: &str15}, logs[0])
+
+	test.HTTPPost(t, client, "http://localhost:8081/user/unblock", "", nil, 204, nil)
+	logs = nil
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/3", nil, 200, &logs)
+	require.Len(t, logs, 1)
+	assert.Equal(t, eventTypePinUnblocked, logs[0].Event)
+}
+
+func TestServerDevices(t *testing.T) {
+	db := &memoryDB{
+		userData: map[string]memoryUserData{
+			"testuser": {
+				id:         15,
+				lastActive: time.Unix(0, 0),
+				email:      []string{"test@test.com"},
+				devices:    []device{{ID: 3, Name: "Second phone", Created: 100, LastSeen: 200}},
+			},
+		},
+		loginEmailTokens: map[string]string{
+			"testtoken": "test@test.com",
+		},
+	}
+	myirmaServer, httpServer := StartMyIrmaServer(t, db, "")
+	defer StopMyIrmaServer(t, myirmaServer, httpServer)
+
+	client := test.NewHTTPClient()
+	test.HTTPGet(t, client, "http://localhost:8081/user/devices", nil, 400, nil)
+	test.HTTPPost(t, client, "http://localhost:8081/login/token", `{"username":"testuser", "token":"testtoken"}`, nil, 204, nil)
+
+	var devices []device
+	test.HTTPGet(t, client, "http://localhost:8081/user/devices", nil, 200, &devices)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "Second phone", devices[0].Name)
+	assert.Nil(t, devices[0].RevokedOn)
+
+	test.HTTPPost(t, client, "http://localhost:8081/user/devices/revoke", "4", nil, 400, nil)
+	test.HTTPPost(t, client, "http://localhost:8081/user/devices/revoke", "3", nil, 204, nil)
+	test.HTTPPost(t, client, "http://localhost:8081/user/devices/revoke", "3", nil, 400, nil)
+
+	test.HTTPGet(t, client, "http://localhost:8081/user/devices", nil, 200, &devices)
+	require.Len(t, devices, 1)
+	assert.NotNil(t, devices[0].RevokedOn)
+
+	var logs []logEntry
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/0", nil, 200, &logs)
+	require.Len(t, logs, 1)
+	assert.Equal(t, eventTypeDeviceRevoked, logs[0].Event)
+	require.NotNil(t, logs[0].Device)
+	assert.Equal(t, "Second phone", *logs[0].Device)
+}
+
+func TestServerSearchLogs(t *testing.T) {
+	db := &memoryDB{
+		userData: map[string]memoryUserData{
+			"testuser": {
+				id:         15,
+				lastActive: time.Unix(0, 0),
+				email:      []string{"test@test.com"},
+				logEntries: []logEntry{
+					{Timestamp: 110, Event: "PIN_CHECK_SUCCESS"},
+					{Timestamp: 120, Event: "IRMA_SESSION", Param: &str15},
+					{Timestamp: 130, Event: "PIN_CHECK_FAILED"},
+					{Timestamp: 140, Event: eventTypeEmailAdded},
+				},
+			},
+		},
+		loginEmailTokens: map[string]string{
+			"testtoken": "test@test.com",
+		},
+	}
+	myirmaServer, httpServer := StartMyIrmaServer(t, db, "")
+	defer StopMyIrmaServer(t, myirmaServer, httpServer)
+
+	client := test.NewHTTPClient()
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs", nil, 400, nil)
+	test.HTTPPost(t, client, "http://localhost:8081/login/token", `{"username":"testuser", "token":"testtoken"}`, nil, 204, nil)
+
+	var result logSearchResult
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs", nil, 200, &result)
+	assert.Equal(t, 4, result.Total)
+	assert.Len(t, result.Entries, 4)
+
+	result = logSearchResult{}
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?type=pin&amount=1", nil, 200, &result)
+	assert.Equal(t, 2, result.Total)
+	assert.Equal(t, []logEntry{{Timestamp: 110, Event: "PIN_CHECK_SUCCESS"}}, result.Entries)
+
+	result = logSearchResult{}
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?type=pin&type=session&from=120&until=140", nil, 200, &result)
+	assert.Equal(t, 2, result.Total)
 	assert.Equal(t, []logEntry{
-		{Timestamp: 120, Event: "test2", Param: &str15},
-	}, logs)
+		{Timestamp: 120, Event: "IRMA_SESSION", Param: &str15},
+		{Timestamp: 130, Event: "PIN_CHECK_FAILED"},
+	}, result.Entries)
+
+	result = logSearchResult{}
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?type=device", nil, 200, &result)
+	assert.Equal(t, 0, result.Total)
+	assert.Equal(t, []logEntry{}, result.Entries)
+
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?type=unknown", nil, 400, nil)
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?from=abc", nil, 400, nil)
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs?amount=1000", nil, 400, nil)
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?format=xml", nil, 400, nil)
+
+	var entries []logEntry
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?type=email", nil, 200, &entries)
+	assert.Equal(t, []logEntry{{Timestamp: 140, Event: eventTypeEmailAdded}}, entries)
+
+	res, err := client.Get("http://localhost:8081/user/logs/export?format=csv&type=session")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Disposition"), "attachment")
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "timestamp,event,param,device\n120,IRMA_SESSION,15,\n", string(body))
+}
+
+func TestServerExportLogsPages(t *testing.T) {
+	logEntries := make([]logEntry, 2*exportLogPageSize+1)
+	for i := range logEntries {
+		logEntries[i] = logEntry{Timestamp: int64(i + 1), Event: "PIN_CHECK_SUCCESS"}
+	}
+	db := &memoryDB{
+		userData: map[string]memoryUserData{
+			"testuser": {
+				id:         15,
+				lastActive: time.Unix(0, 0),
+				email:      []string{"test@test.com"},
+				logEntries: logEntries,
+			},
+		},
+		loginEmailTokens: map[string]string{
+			"testtoken": "test@test.com",
+		},
+	}
+	myirmaServer, httpServer := StartMyIrmaServer(t, db, "")
+	defer StopMyIrmaServer(t, myirmaServer, httpServer)
+
+	client := test.NewHTTPClient()
+	test.HTTPPost(t, client, "http://localhost:8081/login/token", `{"username":"testuser", "token":"testtoken"}`, nil, 204, nil)
+
+	var entries []logEntry
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?type=pin", nil, 200, &entries)
+	assert.Equal(t, logEntries, entries)
+
+	entries = nil
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?type=device", nil, 200, &entries)
+	assert.Equal(t, []logEntry{}, entries)
+}
+
+func TestServerEmailAddedEmails(t *testing.T) {
+	testdataPath := test.FindTestdataFolder(t)
+	db := &memoryDB{
+		userData: map[string]memoryUserData{
+			"testuser": {id: 15, email: []string{"old@example.com", "new@example.com"}},
+		},
+	}
+	templates, err := keyshare.ParseEmailTemplates(
+		map[string]string{"en": filepath.Join(testdataPath, "emailtemplate.html")},
+		map[string]string{"en": "emailadded"},
+		"en",
+	)
+	require.NoError(t, err)
+	mailer := &keyshare.RecordingMailer{}
+	s := &Server{
+		db: db,
+		conf: &Configuration{
+			Configuration: &server.Configuration{Logger: irma.Logger},
+			EmailConfiguration: keyshare.EmailConfiguration{
+				Mailer:          mailer,
+				DefaultLanguage: "en",
+			},
+			EmailAddedSubjects:  map[string]string{"en": "emailadded"},
+			emailAddedTemplates: templates,
+		},
+	}
+
+	s.sendEmailAddedEmails(15, "new@example.com")
+	require.Len(t, mailer.Emails(), 2)
+	assert.Equal(t, "old@example.com", mailer.Emails()[0].To)
+	assert.Equal(t, "new@example.com", mailer.Emails()[1].To)
+	assert.Equal(t, "emailadded", mailer.Emails()[0].Subject)
+
+	// Nothing is sent when the notification is not configured
+	s.conf.emailAddedTemplates = nil
+	s.sendEmailAddedEmails(15, "new@example.com")
+	assert.Len(t, mailer.Emails(), 2)
 }
 
 func StartMyIrmaServer(t *testing.T, db db, emailserver string) (*Server, *http.Server) {
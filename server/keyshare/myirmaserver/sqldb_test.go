@@ -0,0 +1,354 @@
+//+build !local_tests
+
+package myirmaserver
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDBUserManagement(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db db, exec execFunc) {
+		var err error
+
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 0, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec("INSERT INTO irma.email_verification_tokens (token, email, expiry, user_id) VALUES ('testtoken', 'test@test.com', $1, 15)", time.Now().Unix())
+		require.NoError(t, err)
+
+		id, err := db.userIDByUsername("testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(15), id)
+
+		user, err := db.user(id)
+		assert.NoError(t, err)
+		assert.Equal(t, []userEmail(nil), user.Emails)
+
+		id, err = db.verifyEmailToken("testtoken")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(15), id)
+
+		user, err = db.user(id)
+		assert.NoError(t, err)
+		assert.Equal(t, []userEmail{{Email: "test@test.com", DeleteInProgress: false}}, user.Emails)
+
+		_, err = db.verifyEmailToken("testtoken")
+		assert.Error(t, err)
+
+		_, err = db.userIDByUsername("DNE")
+		assert.Error(t, err)
+
+		err = db.setSeen(15)
+		assert.NoError(t, err)
+
+		err = db.setSeen(123456)
+		assert.Error(t, err)
+
+		_, err = exec("UPDATE irma.users SET pin_counter = 5, pin_block_date = $1 WHERE id = 15", time.Now().Unix()+3600)
+		require.NoError(t, err)
+		err = db.unblockPin(15)
+		assert.NoError(t, err)
+		logs, err := db.logs(15, logFilter{}, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, eventTypePinUnblocked, logs[0].Event)
+
+		err = db.unblockPin(123456)
+		assert.Error(t, err)
+
+		err = db.scheduleUserRemoval(15, 0)
+		assert.NoError(t, err)
+
+		user, err = db.user(15)
+		require.NoError(t, err)
+		require.True(t, user.DeleteInProgress)
+
+		err = db.scheduleUserRemoval(15, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestSQLDBLoginToken(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db db, exec execFunc) {
+		var err error
+
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 0, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (17, 'noemail', 0, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec("INSERT INTO irma.emails (user_id, email) VALUES (15, 'test@test.com')")
+		require.NoError(t, err)
+
+		err = db.addLoginToken("test2@test.com", "test2token")
+		assert.Error(t, err)
+
+		err = db.addLoginToken("test@test.com", "testtoken")
+		require.NoError(t, err)
+
+		cand, err := db.loginUserCandidates("testtoken")
+		assert.NoError(t, err)
+		assert.Equal(t, []loginCandidate{{Username: "testuser", LastActive: 0}}, cand)
+
+		currenttime := time.Now().Unix()
+		require.NoError(t, db.setSeen(int64(15)))
+		cand, err = db.loginUserCandidates("testtoken")
+		assert.NoError(t, err)
+		assert.Equal(t, []loginCandidate{{Username: "testuser", LastActive: currenttime}}, cand)
+
+		_, err = db.loginUserCandidates("DNE")
+		assert.Error(t, err)
+
+		_, err = db.verifyLoginToken("testtoken", "DNE")
+		assert.Error(t, err)
+
+		_, err = db.verifyLoginToken("testtoken", "noemail")
+		assert.Error(t, err)
+
+		id, err := db.verifyLoginToken("testtoken", "testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(15), id)
+
+		_, err = db.verifyLoginToken("testtoken", "testuser")
+		assert.Error(t, err)
+
+		assert.NoError(t, db.addEmail(17, "test@test.com"))
+		assert.NoError(t, db.addLoginToken("test@test.com", "testtoken"))
+		cand, err = db.loginUserCandidates("testtoken")
+		assert.NoError(t, err)
+		assert.Equal(t, []loginCandidate{
+			{Username: "testuser", LastActive: currenttime},
+			{Username: "noemail", LastActive: 0},
+		}, cand)
+	})
+}
+
+func TestSQLDBUserInfo(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db db, exec execFunc) {
+		var err error
+
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (17, 'noemail', 20, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec("INSERT INTO irma.emails (user_id, email) VALUES (15, 'test@test.com')")
+		require.NoError(t, err)
+		_, err = exec(
+			`INSERT INTO irma.log_entry_records (time, event, param, user_id)
+			 VALUES (110, 'test', '', 15), (120, 'test2', '15', 15), (130, 'test3', NULL, 15)`)
+		require.NoError(t, err)
+
+		info, err := db.user(15)
+		assert.NoError(t, err)
+		assert.Equal(t, user{
+			Username:         "testuser",
+			Emails:           []userEmail{{Email: "test@test.com", DeleteInProgress: false}},
+			language:         "",
+			DeleteInProgress: false,
+		}, info)
+
+		info, err = db.user(17)
+		assert.NoError(t, err)
+		assert.Equal(t, "noemail", info.Username)
+		assert.Equal(t, []userEmail(nil), info.Emails)
+
+		_, err = db.user(1231)
+		assert.Error(t, err)
+
+		entries, err := db.logs(15, logFilter{}, 0, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []logEntry{
+			{
+				Timestamp: 130,
+				Event:     "test3",
+				Param:     nil,
+			},
+			{
+				Timestamp: 120,
+				Event:     "test2",
+				Param:     &str15,
+			},
+			{
+				Timestamp: 110,
+				Event:     "test",
+				Param:     &strEmpty,
+			},
+		}, entries)
+
+		entries, err = db.logs(15, logFilter{}, 0, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(entries))
+
+		entries, err = db.logs(15, logFilter{}, 1, 15)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(entries))
+
+		entries, err = db.logs(15, logFilter{}, 100, 20)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(entries))
+
+		entries, err = db.logs(20, logFilter{}, 100, 20)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(entries))
+
+		err = db.addEmail(17, "test@test.com")
+		assert.NoError(t, err)
+
+		info, err = db.user(17)
+		assert.NoError(t, err)
+		assert.Equal(t, []userEmail{{Email: "test@test.com", DeleteInProgress: false}}, info.Emails)
+
+		err = db.addEmail(20, "bla@bla.com")
+		assert.Error(t, err)
+
+		err = db.scheduleEmailRemoval(17, "test@test.com", 0)
+		assert.NoError(t, err)
+
+		info, err = db.user(17)
+		assert.NoError(t, err)
+		assert.Equal(t, []userEmail{{Email: "test@test.com", DeleteInProgress: true}}, info.Emails)
+
+		// Need sleep here to ensure time has passed since delete
+		time.Sleep(1 * time.Second)
+
+		info, err = db.user(17)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(info.Emails))
+
+		err = db.scheduleEmailRemoval(17, "bla@bla.com", 0)
+		assert.Error(t, err)
+
+		err = db.scheduleEmailRemoval(20, "bl@bla.com", 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestSQLDBLogFilter(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db db, exec execFunc) {
+		_, err := exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec(
+			`INSERT INTO irma.log_entry_records (time, event, param, user_id)
+			 VALUES (110, 'PIN_CHECK_SUCCESS', NULL, 15), (120, 'IRMA_SESSION', NULL, 15), (130, 'PIN_CHECK_FAILED', NULL, 15)`)
+		require.NoError(t, err)
+
+		filter := logFilter{Events: logTypes["pin"]}
+		count, err := db.logCount(15, filter)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		entries, err := db.logs(15, filter, 1, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []logEntry{{Timestamp: 110, Event: "PIN_CHECK_SUCCESS"}}, entries)
+
+		filter = logFilter{Events: logTypes["pin"], From: 120, Until: 140}
+		entries, err = db.logs(15, filter, 0, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []logEntry{{Timestamp: 130, Event: "PIN_CHECK_FAILED"}}, entries)
+
+		count, err = db.logCount(15, logFilter{Until: 120})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		require.NoError(t, db.addEmail(15, "test@test.com"))
+		require.NoError(t, db.scheduleEmailRemoval(15, "test@test.com", time.Hour))
+		count, err = db.logCount(15, logFilter{Events: logTypes["email"]})
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+}
+
+func TestSQLDBDevices(t *testing.T) {
+	testSQLDBs(t, func(t *testing.T, db db, exec execFunc) {
+		var err error
+
+		_, err = exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+		require.NoError(t, err)
+		_, err = exec(
+			`INSERT INTO irma.devices (id, user_id, device_id, name, coredata, pin_counter, pin_block_date, created, last_seen)
+			 VALUES (3, 15, 'testdevice', 'Second phone', '', 5, $1, 100, 200)`, time.Now().Unix()+3600)
+		require.NoError(t, err)
+		_, err = exec(
+			`INSERT INTO irma.log_entry_records (time, event, param, user_id, device_id)
+			 VALUES (110, 'test', NULL, 15, NULL), (120, 'test2', NULL, 15, 3)`)
+		require.NoError(t, err)
+
+		devices, err := db.devices(15)
+		require.NoError(t, err)
+		assert.Equal(t, []device{{ID: 3, Name: "Second phone", Created: 100, LastSeen: 200}}, devices)
+
+		entries, err := db.logs(15, logFilter{}, 0, 2)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.NotNil(t, entries[0].Device)
+		assert.Equal(t, "Second phone", *entries[0].Device)
+		assert.Nil(t, entries[1].Device)
+
+		// Unblocking the PIN also unblocks the devices
+		require.NoError(t, db.unblockPin(15))
+		res, err := exec("UPDATE irma.devices SET pin_block_date = 1 WHERE id = 3 AND pin_counter = 0")
+		require.NoError(t, err)
+		aff, err := res.RowsAffected()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), aff)
+
+		assert.Equal(t, errDeviceNotFound, db.revokeDevice(17, 3))
+		require.NoError(t, db.revokeDevice(15, 3))
+		assert.Equal(t, errDeviceNotFound, db.revokeDevice(15, 3))
+		devices, err = db.devices(15)
+		require.NoError(t, err)
+		require.Len(t, devices, 1)
+		assert.NotNil(t, devices[0].RevokedOn)
+
+		// Deleting the account removes the devices along with their secrets
+		require.NoError(t, db.scheduleUserRemoval(15, time.Hour))
+		devices, err = db.devices(15)
+		require.NoError(t, err)
+		assert.Empty(t, devices)
+	})
+}
+
+// execFunc executes a PostgreSQL query on the database under test, converting it to MySQL if necessary.
+type execFunc func(query string, args ...interface{}) (sql.Result, error)
+
+// testSQLDBs runs the specified test against both the PostgreSQL and the MySQL implementation.
+func testSQLDBs(t *testing.T, f func(t *testing.T, db db, exec execFunc)) {
+	t.Run("postgres", func(t *testing.T) {
+		SetupDatabase(t)
+		defer TeardownDatabase(t)
+
+		db, err := newPostgresDB(test.PostgresTestUrl)
+		require.NoError(t, err)
+		f(t, db, db.(*postgresDB).db.Exec)
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", true)
+		defer test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", false)
+
+		db, err := newMySQLDB(test.MySQLTestUrl)
+		require.NoError(t, err)
+		f(t, db, func(query string, args ...interface{}) (sql.Result, error) {
+			query, args = test.MySQLQuery(query, args...)
+			return db.(*mysqlDB).db.Exec(query, args...)
+		})
+	})
+}
+
+func SetupDatabase(t *testing.T) {
+	test.RunScriptOnDB(t, "../cleanup.sql", true)
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+	_, err = keyshare.MigrateUp(db, keyshare.DialectPostgres)
+	require.NoError(t, err)
+}
+
+func TeardownDatabase(t *testing.T) {
+	test.RunScriptOnDB(t, "../cleanup.sql", false)
+}
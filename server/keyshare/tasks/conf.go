@@ -9,9 +9,20 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	EmailMaxAttemptsDefault = 10
+	EmailRetryDelayDefault  = 60 // seconds
+
+	// Default intervals in seconds between task runs in daemon mode
+	CleanupIntervalDefault          = 3600
+	ExpireAccountsIntervalDefault   = 3600
+	SendQueuedEmailsIntervalDefault = 60
+)
+
 type Configuration struct {
 	// Database configuration
-	DBConnStr string `json:"db_str" mapstructure:"db_str"`
+	DBType    keyshare.Dialect `json:"db_type" mapstructure:"db_type"`
+	DBConnStr string           `json:"db_str" mapstructure:"db_str"`
 
 	// Configuration for deleting expired accounts
 	ExpiryDelay int `json:"expiry_delay" mapstructure:"expiry_delay"`
@@ -24,6 +35,18 @@ type Configuration struct {
 	DeleteExpiredAccountSubjects map[string]string `json:"delete_expired_account_subjects" mapstructure:"delete_expired_account_subjects"`
 	deleteExpiredAccountTemplate map[string]*template.Template
 
+	// Delivery of emails from the email queue: maximum number of attempts per email, and delay
+	// in seconds before the first retry (doubling after each subsequent failed attempt)
+	EmailMaxAttempts int `json:"email_max_attempts" mapstructure:"email_max_attempts"`
+	EmailRetryDelay  int `json:"email_retry_delay" mapstructure:"email_retry_delay"`
+
+	// Intervals in seconds between task runs in daemon mode. Negative values disable the task.
+	CleanupEmailsInterval    int `json:"cleanup_emails_interval" mapstructure:"cleanup_emails_interval"`
+	CleanupTokensInterval    int `json:"cleanup_tokens_interval" mapstructure:"cleanup_tokens_interval"`
+	CleanupAccountsInterval  int `json:"cleanup_accounts_interval" mapstructure:"cleanup_accounts_interval"`
+	ExpireAccountsInterval   int `json:"expire_accounts_interval" mapstructure:"expire_accounts_interval"`
+	SendQueuedEmailsInterval int `json:"send_queued_emails_interval" mapstructure:"send_queued_emails_interval"`
+
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
 	// Don't log anything at all
@@ -45,7 +68,7 @@ func processConfiguration(conf *Configuration) error {
 	irma.Logger = conf.Logger
 
 	// Setup email templates
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		var err error
 		conf.deleteExpiredAccountTemplate, err = keyshare.ParseEmailTemplates(
 			conf.DeleteExpiredAccountFiles,
@@ -61,5 +84,30 @@ func processConfiguration(conf *Configuration) error {
 		return server.LogError(err)
 	}
 
+	if conf.DBType == "" {
+		conf.DBType = keyshare.DialectPostgres
+	}
+	if conf.DBType.DriverName() == "" {
+		return server.LogError(keyshare.ErrUnknownDialect)
+	}
+
+	if conf.EmailMaxAttempts == 0 {
+		conf.EmailMaxAttempts = EmailMaxAttemptsDefault
+	}
+	if conf.EmailRetryDelay == 0 {
+		conf.EmailRetryDelay = EmailRetryDelayDefault
+	}
+	for _, interval := range []*int{&conf.CleanupEmailsInterval, &conf.CleanupTokensInterval, &conf.CleanupAccountsInterval} {
+		if *interval == 0 {
+			*interval = CleanupIntervalDefault
+		}
+	}
+	if conf.ExpireAccountsInterval == 0 {
+		conf.ExpireAccountsInterval = ExpireAccountsIntervalDefault
+	}
+	if conf.SendQueuedEmailsInterval == 0 {
+		conf.SendQueuedEmailsInterval = SendQueuedEmailsIntervalDefault
+	}
+
 	return nil
 }
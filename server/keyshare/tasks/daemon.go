@@ -0,0 +1,202 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/jasonlvhit/gocron"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/sirupsen/logrus"
+)
+
+// Key of the postgres advisory lock that the leader among multiple daemon replicas holds.
+const leaderLockKey int64 = 0x69726d61 // "irma"
+
+// Name of the MySQL named lock with the same purpose.
+const leaderLockName = "irma_keyshare_tasks"
+
+// Metrics of task runs, per task: number of runs, failed runs, deleted rows, expired accounts and sent emails,
+// and the time of the last run. Served at /debug/vars by expvar.Handler().
+var metrics = expvar.NewMap("keyshare_tasks")
+
+type task struct {
+	name     string
+	interval int // seconds
+	run      func() runStats
+}
+
+func (t *taskHandler) tasks() []task {
+	return []task{
+		{"cleanup_emails", t.conf.CleanupEmailsInterval, t.cleanupEmails},
+		{"cleanup_tokens", t.conf.CleanupTokensInterval, t.cleanupTokens},
+		{"cleanup_accounts", t.conf.CleanupAccountsInterval, t.cleanupAccounts},
+		{"expire_accounts", t.conf.ExpireAccountsInterval, t.expireAccounts},
+		{"send_queued_emails", t.conf.SendQueuedEmailsInterval, t.sendQueuedEmails},
+	}
+}
+
+// run runs the task, and logs and records statistics of the run.
+func (t *taskHandler) run(tsk task) runStats {
+	start := time.Now()
+	stats := tsk.run()
+	duration := time.Since(start)
+
+	t.conf.Logger.WithFields(logrus.Fields{
+		"task":        tsk.name,
+		"deleted":     stats.Deleted,
+		"expired":     stats.Expired,
+		"emails_sent": stats.EmailsSent,
+		"failed":      stats.Failed,
+		"duration":    duration,
+	}).Info("Task finished")
+
+	metrics.Add(tsk.name+".runs", 1)
+	if stats.Failed {
+		metrics.Add(tsk.name+".failed_runs", 1)
+	}
+	metrics.Add(tsk.name+".deleted", stats.Deleted)
+	metrics.Add(tsk.name+".expired", stats.Expired)
+	metrics.Add(tsk.name+".emails_sent", stats.EmailsSent)
+	lastRun := new(expvar.Int)
+	lastRun.Set(start.Unix())
+	metrics.Set(tsk.name+".last_run", lastRun)
+
+	return stats
+}
+
+// Daemon runs the tasks periodically, each at its own configured interval. When multiple replicas of
+// the daemon run against the same database, only the one holding a postgres advisory lock (or in
+// MySQL, a named lock) runs tasks.
+type Daemon struct {
+	handler       *taskHandler
+	scheduler     *gocron.Scheduler
+	stopScheduler chan<- bool
+
+	// Held while running a task, so that Stop() can wait for the running task to finish
+	running sync.Mutex
+	// Dedicated database connection holding the advisory lock, nil if we are not the leader
+	leaderConn *sql.Conn
+	stopped    bool
+}
+
+func NewDaemon(conf *Configuration) (*Daemon, error) {
+	handler, err := newHandler(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Daemon{
+		handler:   handler,
+		scheduler: gocron.NewScheduler(),
+	}, nil
+}
+
+// Start starts running tasks in the background.
+func (d *Daemon) Start() {
+	for _, tsk := range d.handler.tasks() {
+		tsk := tsk
+		if tsk.interval <= 0 {
+			d.handler.conf.Logger.WithField("task", tsk.name).Info("Task disabled")
+			continue
+		}
+		d.scheduler.Every(uint64(tsk.interval)).Seconds().Do(func() { d.run(tsk) })
+	}
+	d.stopScheduler = d.scheduler.Start()
+
+	// The scheduler starts running tasks only after their first interval has passed, so run them once now
+	go d.runAll()
+}
+
+// Stop stops the daemon, waiting for the currently running task (if any) to finish.
+func (d *Daemon) Stop() {
+	d.stopScheduler <- true
+
+	d.running.Lock()
+	defer d.running.Unlock()
+	d.stopped = true
+	d.releaseLeadership()
+	if err := d.handler.db.Close(); err != nil {
+		d.handler.conf.Logger.WithField("error", err).Error("Could not close database connection")
+	}
+}
+
+func (d *Daemon) runAll() {
+	for _, tsk := range d.handler.tasks() {
+		if tsk.interval > 0 {
+			d.run(tsk)
+		}
+	}
+}
+
+func (d *Daemon) run(tsk task) {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	if d.stopped || !d.ensureLeadership() {
+		return
+	}
+	d.handler.run(tsk)
+}
+
+// ensureLeadership returns whether we are the leader, trying to become it if we are not.
+func (d *Daemon) ensureLeadership() bool {
+	logger := d.handler.conf.Logger
+	ctx := context.Background()
+
+	// If we hold the lock, check that its connection (and thus the lock) is still alive
+	if d.leaderConn != nil {
+		if err := d.leaderConn.PingContext(ctx); err == nil {
+			return true
+		}
+		logger.Warn("Lost database connection holding leader lock")
+		_ = d.leaderConn.Close()
+		d.leaderConn = nil
+	}
+
+	conn, err := d.handler.db.Conn(ctx)
+	if err != nil {
+		logger.WithField("error", err).Error("Could not connect to database")
+		return false
+	}
+	var acquired bool
+	if d.handler.conf.DBType == keyshare.DialectMySQL {
+		var locked sql.NullInt64
+		err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", leaderLockName).Scan(&locked)
+		acquired = locked.Int64 == 1
+	} else {
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&acquired)
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("Could not acquire leader lock")
+		_ = conn.Close()
+		return false
+	}
+	if !acquired {
+		logger.Debug("Not running tasks, as another instance is the leader")
+		_ = conn.Close()
+		return false
+	}
+
+	logger.Info("Acquired leader lock, running tasks")
+	d.leaderConn = conn
+	return true
+}
+
+func (d *Daemon) releaseLeadership() {
+	if d.leaderConn == nil {
+		return
+	}
+	var err error
+	if d.handler.conf.DBType == keyshare.DialectMySQL {
+		_, err = d.leaderConn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", leaderLockName)
+	} else {
+		_, err = d.leaderConn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", leaderLockKey)
+	}
+	if err != nil {
+		d.handler.conf.Logger.WithField("error", err).Error("Could not release leader lock")
+	}
+	_ = d.leaderConn.Close()
+	d.leaderConn = nil
+}
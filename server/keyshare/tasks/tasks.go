@@ -6,13 +6,33 @@ import (
 	"time"
 
 	"github.com/go-errors/errors"
+	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/jackc/pgx/stdlib"
 	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/sirupsen/logrus"
 )
 
 type taskHandler struct {
 	conf *Configuration
 	db   keyshare.DB
+
+	// Mailer used to deliver emails from the email queue, nil if the email queue is disabled
+	queueDeliveryMailer keyshare.Mailer
+}
+
+// Maximum number of queued emails delivered per task run
+const emailQueueBatchSize = 100
+
+// Time in seconds for which a queued email is claimed for delivery. If the delivery is not
+// finished by then (e.g. because the task crashed), the email is delivered again.
+const emailClaimDuration = 15 * 60
+
+// runStats contains statistics of a single run of a task.
+type runStats struct {
+	Deleted    int64 // number of deleted rows
+	Expired    int64 // number of accounts marked for deletion
+	EmailsSent int64
+	Failed     bool
 }
 
 func newHandler(conf *Configuration) (*taskHandler, error) {
@@ -20,66 +40,113 @@ func newHandler(conf *Configuration) (*taskHandler, error) {
 	if err != nil {
 		return nil, err
 	}
-	db, err := sql.Open("pgx", conf.DBConnStr)
+	connstr := conf.DBConnStr
+	if conf.DBType == keyshare.DialectMySQL {
+		if connstr, err = keyshare.MySQLConnStr(connstr); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open(conf.DBType.DriverName(), connstr)
 	if err != nil {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
 		return nil, errors.Errorf("failed to connect to database: %v", err)
 	}
+	if _, err = keyshare.MigrateUp(db, conf.DBType); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to migrate database", 0)
+	}
 
 	task := &taskHandler{db: keyshare.DB{DB: db}, conf: conf}
+	if conf.EmailQueue && conf.EmailEnabled() {
+		task.queueDeliveryMailer, err = keyshare.NewMailer(conf.EmailMailer, conf.EmailConfiguration, conf.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = conf.SetupMailer(db, conf.DBType, conf.Logger); err != nil {
+		return nil, err
+	}
 	return task, nil
 }
 
+// query converts the specified query on tables in the irma schema using $1, $2, ... placeholders
+// to the database type, see keyshare.Dialect.Query.
+func (t *taskHandler) query(query string, args ...interface{}) (string, []interface{}) {
+	return t.conf.DBType.Query(query, args...)
+}
+
 func Do(conf *Configuration) error {
 	task, err := newHandler(conf)
 	if err != nil {
 		return err
 	}
 
-	task.cleanupEmails()
-	task.cleanupTokens()
-	task.cleanupAccounts()
-	task.expireAccounts()
+	for _, tsk := range task.tasks() {
+		task.run(tsk)
+	}
 
 	return nil
 }
 
 // Remove email addresses marked for deletion long enough ago
-func (t *taskHandler) cleanupEmails() {
-	_, err := t.db.Exec("DELETE FROM irma.emails WHERE delete_on < $1", time.Now().Unix())
+func (t *taskHandler) cleanupEmails() (stats runStats) {
+	var err error
+	query, args := t.query("DELETE FROM irma.emails WHERE delete_on < $1", time.Now().Unix())
+	stats.Deleted, err = t.db.ExecCount(query, args...)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove email addresses marked for deletion")
+		stats.Failed = true
 	}
+	return
 }
 
-// Remove old login and email verification tokens
-func (t *taskHandler) cleanupTokens() {
-	_, err := t.db.Exec("DELETE FROM irma.email_login_tokens WHERE expiry < $1", time.Now().Unix())
+// Remove old login and email verification tokens, and device link codes
+func (t *taskHandler) cleanupTokens() (stats runStats) {
+	query, args := t.query("DELETE FROM irma.email_login_tokens WHERE expiry < $1", time.Now().Unix())
+	deleted, err := t.db.ExecCount(query, args...)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove email login tokens that have expired")
+		stats.Failed = true
 		return
 	}
-	_, err = t.db.Exec("DELETE FROM irma.email_verification_tokens WHERE expiry < $1", time.Now().Unix())
+	stats.Deleted += deleted
+	query, args = t.query("DELETE FROM irma.email_verification_tokens WHERE expiry < $1", time.Now().Unix())
+	deleted, err = t.db.ExecCount(query, args...)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove email verification tokens that have expired")
+		stats.Failed = true
+		return
+	}
+	stats.Deleted += deleted
+	query, args = t.query("DELETE FROM irma.device_link_codes WHERE expiry < $1", time.Now().Unix())
+	deleted, err = t.db.ExecCount(query, args...)
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove device link codes that have expired")
+		stats.Failed = true
 	}
+	stats.Deleted += deleted
+	return
 }
 
 // Cleanup accounts disabled long enough ago.
-func (t *taskHandler) cleanupAccounts() {
-	_, err := t.db.Exec("DELETE FROM irma.users WHERE delete_on < $1 AND (coredata IS NULL OR last_seen < delete_on - $2)",
+func (t *taskHandler) cleanupAccounts() (stats runStats) {
+	var err error
+	query, args := t.query("DELETE FROM irma.users WHERE delete_on < $1 AND (coredata IS NULL OR last_seen < delete_on - $2)",
 		time.Now().Unix(),
 		t.conf.DeleteDelay*24*60*60)
+	stats.Deleted, err = t.db.ExecCount(query, args...)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove accounts scheduled for deletion")
+		stats.Failed = true
 	}
+	return
 }
 
-func (t *taskHandler) sendExpiryEmails(id int64, username, lang string) error {
+func (t *taskHandler) sendExpiryEmails(id int64, username, lang string, stats *runStats) error {
 	// Fetch user's email addresses
-	err := t.db.QueryIterate("SELECT email FROM irma.emails WHERE user_id = $1",
+	query, args := t.query("SELECT email FROM irma.emails WHERE user_id = $1", id)
+	err := t.db.QueryIterate(query,
 		func(emailRes *sql.Rows) error {
 			var email string
 			err := emailRes.Scan(&email)
@@ -95,9 +162,13 @@ func (t *taskHandler) sendExpiryEmails(id int64, username, lang string) error {
 				email,
 				lang,
 			)
-			return err
+			if err != nil {
+				return err
+			}
+			stats.EmailsSent++
+			return nil
 		},
-		id,
+		args...,
 	)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not retrieve user's email addresses")
@@ -107,9 +178,9 @@ func (t *taskHandler) sendExpiryEmails(id int64, username, lang string) error {
 }
 
 // Mark old unused accounts for deletion, and inform their owners.
-func (t *taskHandler) expireAccounts() {
+func (t *taskHandler) expireAccounts() (stats runStats) {
 	// Disable this task when email server is not given
-	if t.conf.EmailServer == "" {
+	if !t.conf.EmailEnabled() {
 		t.conf.Logger.Warning("Expiring accounts is disabled, as no email server is configured")
 		return
 	}
@@ -120,7 +191,7 @@ func (t *taskHandler) expireAccounts() {
 	// We do this for only 10 users at a time to prevent us from sending out lots of emails
 	// simultaneously, which could lead to our email server being flagged as sending spam.
 	// The users excluded by this limit will get their email next time this task is executed.
-	err := t.db.QueryIterate(`
+	query, args := t.query(`
 		SELECT id, username, language
 		FROM irma.users
 		WHERE last_seen < $1 AND (
@@ -129,6 +200,9 @@ func (t *taskHandler) expireAccounts() {
 			WHERE irma.users.id = irma.emails.user_id
 		) > 0
 		LIMIT 10`,
+		time.Now().Add(time.Duration(-24*t.conf.ExpiryDelay)*time.Hour).Unix(),
+	)
+	err := t.db.QueryIterate(query,
 		func(res *sql.Rows) error {
 			var id int64
 			var username string
@@ -139,23 +213,115 @@ func (t *taskHandler) expireAccounts() {
 			}
 
 			// Send emails
-			err = t.sendExpiryEmails(id, username, lang)
+			err = t.sendExpiryEmails(id, username, lang, &stats)
 			if err != nil {
 				return err // already logged, just abort
 			}
 
 			// Finally, do marking for deletion
-			err = t.db.ExecUser("UPDATE irma.users SET delete_on = $2 WHERE id = $1", id,
+			query, args := t.query("UPDATE irma.users SET delete_on = $2 WHERE id = $1", id,
 				time.Now().Add(time.Duration(24*t.conf.DeleteDelay)*time.Hour).Unix())
-			if err != nil {
+			if err = t.db.ExecUser(query, args...); err != nil {
 				return err
 			}
+			stats.Expired++
 			return nil
 		},
-		time.Now().Add(time.Duration(-24*t.conf.ExpiryDelay)*time.Hour).Unix(),
+		args...,
 	)
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not query for accounts that have expired")
+		stats.Failed = true
+	}
+	return
+}
+
+// Deliver emails from the email queue. Failed deliveries are retried with exponential backoff,
+// until the maximum number of attempts is reached.
+func (t *taskHandler) sendQueuedEmails() (stats runStats) {
+	if t.queueDeliveryMailer == nil {
+		return
+	}
+
+	for i := 0; i < emailQueueBatchSize; i++ {
+		empty, err := t.sendQueuedEmail(&stats)
+		if err != nil {
+			t.conf.Logger.WithField("error", err).Error("Could not process email queue")
+			stats.Failed = true
+			return
+		}
+		if empty {
+			return
+		}
+	}
+	return
+}
+
+// sendQueuedEmail tries to deliver the first email from the queue that is due. It returns true
+// if there was no such email.
+func (t *taskHandler) sendQueuedEmail(stats *runStats) (bool, error) {
+	id, attempts, email, err := t.claimQueuedEmail()
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var query string
+	var args []interface{}
+	sendErr := t.queueDeliveryMailer.SendEmail(email)
+	switch {
+	case sendErr == nil:
+		stats.EmailsSent++
+		query, args = t.query("DELETE FROM irma.email_queue WHERE id = $1", id)
+	case attempts >= t.conf.EmailMaxAttempts:
+		t.conf.Logger.WithFields(logrus.Fields{"id": id, "attempts": attempts, "error": sendErr}).
+			Error("Could not deliver queued email, giving up")
+		query, args = t.query("DELETE FROM irma.email_queue WHERE id = $1", id)
+	default:
+		t.conf.Logger.WithFields(logrus.Fields{"id": id, "attempts": attempts, "error": sendErr}).
+			Warn("Could not deliver queued email, will retry")
+		backoff := attempts - 1
+		if backoff > 16 {
+			backoff = 16
+		}
+		delay := int64(t.conf.EmailRetryDelay) << backoff
+		query, args = t.query("UPDATE irma.email_queue SET next_attempt = $2, last_error = $3 WHERE id = $1",
+			id, time.Now().Unix()+delay, sendErr.Error())
+	}
+	_, err = t.db.Exec(query, args...)
+	return false, err
+}
+
+// claimQueuedEmail claims the first email from the queue that is due for delivery, by counting
+// the delivery attempt and postponing the next attempt for emailClaimDuration. As the claim is
+// committed before the email is delivered, the delivery does not hold a lock in the database.
+// It returns the email along with its number of attempts, or sql.ErrNoRows if no email is due.
+func (t *taskHandler) claimQueuedEmail() (id int64, attempts int, email keyshare.Email, err error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Lock the email, skipping emails locked by other instances of this task
+	now := time.Now().Unix()
+	query, args := t.query(
+		`SELECT id, sender, recipient, subject, body, attempts FROM irma.email_queue
+		 WHERE next_attempt <= $1 ORDER BY next_attempt LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		now,
+	)
+	if err = tx.QueryRow(query, args...).Scan(&id, &email.From, &email.To, &email.Subject, &email.Body, &attempts); err != nil {
+		return
+	}
+
+	attempts++
+	query, args = t.query("UPDATE irma.email_queue SET attempts = $2, next_attempt = $3 WHERE id = $1",
+		id, attempts, now+emailClaimDuration)
+	if _, err = tx.Exec(query, args...); err != nil {
 		return
 	}
+	err = tx.Commit()
+	return
 }
@@ -4,11 +4,17 @@ package tasks
 
 import (
 	"database/sql"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/sirupsen/logrus"
@@ -48,9 +54,10 @@ func TestCleanupEmails(t *testing.T) {
 	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
 	require.NoError(t, err)
 
-	th.cleanupEmails()
+	stats := th.cleanupEmails()
 
 	assert.Equal(t, 2, countRows(t, db, "emails", ""))
+	assert.Equal(t, runStats{Deleted: 1}, stats)
 }
 
 func TestCleanupTokens(t *testing.T) {
@@ -65,14 +72,18 @@ func TestCleanupTokens(t *testing.T) {
 	require.NoError(t, err)
 	_, err = db.Exec("INSERT INTO irma.email_login_tokens (token, email, expiry) VALUES ('t1', 't1@test.com', 0), ('t2', 't2@test.com', $1)", time.Now().Add(time.Hour).Unix())
 	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.device_link_codes (code, user_id, expiry) VALUES ('c1', 15, 0), ('c2', 15, $1)", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
 
 	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
 	require.NoError(t, err)
 
-	th.cleanupTokens()
+	stats := th.cleanupTokens()
+	assert.Equal(t, runStats{Deleted: 3}, stats)
 
 	assert.Equal(t, 1, countRows(t, db, "email_verification_tokens", ""))
 	assert.Equal(t, 1, countRows(t, db, "email_login_tokens", ""))
+	assert.Equal(t, 1, countRows(t, db, "device_link_codes", ""))
 }
 
 func TestCleanupAccounts(t *testing.T) {
@@ -128,12 +139,82 @@ func TestExpireAccounts(t *testing.T) {
 	assert.Equal(t, 1, countRows(t, db, "users", "delete_on IS NOT NULL"))
 }
 
+type failingMailer struct{}
+
+func (failingMailer) SendEmail(keyshare.Email) error {
+	return errors.New("email server unavailable")
+}
+
+func TestSendQueuedEmails(t *testing.T) {
+	testdataPath := test.FindTestdataFolder(t)
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	dir, err := ioutil.TempDir("", "emails")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	queue := keyshare.NewQueueMailer(db, keyshare.DialectPostgres)
+	require.NoError(t, queue.SendEmail(keyshare.Email{From: "from@test.com", To: "test@test.com", Subject: "s", Body: []byte("b")}))
+	require.NoError(t, queue.SendEmail(keyshare.Email{From: "from@test.com", To: "test2@test.com", Subject: "s", Body: []byte("b")}))
+
+	conf := &Configuration{
+		DBConnStr: test.PostgresTestUrl,
+		EmailConfiguration: keyshare.EmailConfiguration{
+			EmailMailer:     keyshare.MailerTypeFile,
+			EmailDir:        dir,
+			EmailQueue:      true,
+			EmailFrom:       "from@test.com",
+			DefaultLanguage: "en",
+		},
+		DeleteExpiredAccountFiles: map[string]string{
+			"en": filepath.Join(testdataPath, "emailtemplate.html"),
+		},
+		DeleteExpiredAccountSubjects: map[string]string{
+			"en": "testsubject",
+		},
+		EmailMaxAttempts: 2,
+		Logger:           irma.Logger,
+	}
+
+	// Failed delivery is retried later
+	th, err := newHandler(conf)
+	require.NoError(t, err)
+	th.queueDeliveryMailer = failingMailer{}
+	th.sendQueuedEmails()
+	assert.Equal(t, 2, countRows(t, db, "email_queue", "attempts = 1 AND last_error IS NOT NULL"))
+	assert.Equal(t, 0, countRows(t, db, "email_queue", fmt.Sprintf("next_attempt <= %d", time.Now().Unix())))
+
+	// Successful delivery removes the email from the queue
+	_, err = db.Exec("UPDATE irma.email_queue SET next_attempt = 0 WHERE recipient = 'test@test.com'")
+	require.NoError(t, err)
+	th, err = newHandler(conf)
+	require.NoError(t, err)
+	th.sendQueuedEmails()
+	assert.Equal(t, 1, countRows(t, db, "email_queue", ""))
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// After the maximum number of attempts the email is dropped
+	_, err = db.Exec("UPDATE irma.email_queue SET next_attempt = 0")
+	require.NoError(t, err)
+	th.queueDeliveryMailer = failingMailer{}
+	th.sendQueuedEmails()
+	assert.Equal(t, 0, countRows(t, db, "email_queue", ""))
+}
+
 func TestConfiguration(t *testing.T) {
 	testdataPath := test.FindTestdataFolder(t)
 
 	err := processConfiguration(&Configuration{Logger: irma.Logger})
 	assert.NoError(t, err)
 
+	err = processConfiguration(&Configuration{DBType: "sqlite", Logger: irma.Logger})
+	assert.Error(t, err)
+
 	err = processConfiguration(&Configuration{
 		EmailConfiguration: keyshare.EmailConfiguration{
 			EmailServer:     "localhost:1025",
@@ -192,9 +273,131 @@ func TestConfiguration(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestDaemon(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.emails (user_id, email, delete_on) VALUES (15, 'test@test.com', 0)")
+	require.NoError(t, err)
+
+	d1, err := NewDaemon(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
+	require.NoError(t, err)
+	d2, err := NewDaemon(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
+	require.NoError(t, err)
+
+	// Only one daemon can be the leader
+	assert.True(t, d1.ensureLeadership())
+	assert.True(t, d1.ensureLeadership())
+	assert.False(t, d2.ensureLeadership())
+
+	// Tasks are only run by the leader. The metrics are global, so compare them to their values
+	// before running the task, which depend on the other tests
+	deleted := func() int64 {
+		if v, ok := metrics.Get("cleanup_emails.deleted").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := deleted()
+	cleanupEmails := d2.handler.tasks()[0]
+	d2.run(cleanupEmails)
+	assert.Equal(t, 1, countRows(t, db, "emails", ""))
+	assert.Equal(t, before, deleted())
+	d1.run(cleanupEmails)
+	assert.Equal(t, 0, countRows(t, db, "emails", ""))
+	assert.Equal(t, before+1, deleted())
+
+	// After the leader stops, another daemon can take over
+	d1.Start()
+	d1.Stop()
+	assert.True(t, d2.ensureLeadership())
+	d2.Stop()
+}
+
+func TestMySQL(t *testing.T) {
+	testdataPath := test.FindTestdataFolder(t)
+	test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", true)
+	defer test.RunScriptOnMySQLDB(t, "../cleanup_mysql.sql", false)
+
+	conf := func() *Configuration {
+		return &Configuration{
+			DBType:      keyshare.DialectMySQL,
+			DBConnStr:   test.MySQLTestUrl,
+			DeleteDelay: 30,
+			ExpiryDelay: 1,
+			EmailConfiguration: keyshare.EmailConfiguration{
+				EmailMailer:     keyshare.MailerTypeLog,
+				EmailQueue:      true,
+				EmailFrom:       "test@test.com",
+				DefaultLanguage: "en",
+			},
+			DeleteExpiredAccountFiles: map[string]string{
+				"en": filepath.Join(testdataPath, "emailtemplate.html"),
+			},
+			DeleteExpiredAccountSubjects: map[string]string{
+				"en": "testsubject",
+			},
+			Logger: irma.Logger,
+		}
+	}
+	d1, err := NewDaemon(conf())
+	require.NoError(t, err)
+	d2, err := NewDaemon(conf())
+	require.NoError(t, err)
+
+	db, err := sql.Open("mysql", test.MySQLTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+	exec := func(query string, args ...interface{}) {
+		query, args = test.MySQLQuery(query, args...)
+		_, err := db.Exec(query, args...)
+		require.NoError(t, err)
+	}
+	count := func(table, where string) int {
+		var c int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+where).Scan(&c))
+		return c
+	}
+	now := time.Now().Unix()
+	exec("INSERT INTO irma.users (id, username, language, coredata, pin_counter, pin_block_date, last_seen, delete_on) VALUES (15, 'A', '', '', 0, 0, $1, NULL), (16, 'B', '', '', 0, 0, 0, NULL), (17, 'C', '', '', 0, 0, 0, $1-3600)", now)
+	exec("INSERT INTO irma.emails (user_id, email, delete_on) VALUES (15, 'a@test.com', 0), (15, 'a2@test.com', NULL), (16, 'b@test.com', NULL)")
+	exec("INSERT INTO irma.email_login_tokens (token, email, expiry) VALUES ('t1', 't1@test.com', 0), ('t2', 't2@test.com', $1)", now+3600)
+
+	// Only one daemon can be the leader
+	assert.True(t, d1.ensureLeadership())
+	assert.False(t, d2.ensureLeadership())
+
+	stats := map[string]runStats{}
+	for _, tsk := range d1.handler.tasks() {
+		stats[tsk.name] = d1.handler.run(tsk)
+		assert.False(t, stats[tsk.name].Failed, tsk.name)
+	}
+	assert.Equal(t, 2, count("emails", "1=1"))
+	assert.Equal(t, 1, count("email_login_tokens", "1=1"))
+	assert.Equal(t, 2, count("users", "1=1"))
+	assert.Equal(t, 1, count("users", "id = 16 AND delete_on IS NOT NULL"))
+	// The expiry email was queued and delivered from the queue
+	assert.Equal(t, 0, count("email_queue", "1=1"))
+	assert.Equal(t, int64(1), stats["send_queued_emails"].EmailsSent)
+
+	// After the leader stops, another daemon can take over
+	d1.Start()
+	d1.Stop()
+	assert.True(t, d2.ensureLeadership())
+	d2.Stop()
+}
+
 func SetupDatabase(t *testing.T) {
 	test.RunScriptOnDB(t, "../cleanup.sql", true)
-	test.RunScriptOnDB(t, "../schema.sql", false)
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+	_, err = keyshare.MigrateUp(db, keyshare.DialectPostgres)
+	require.NoError(t, err)
 }
 
 func TeardownDatabase(t *testing.T) {
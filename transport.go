@@ -34,6 +34,7 @@ type HTTPTransport struct {
 	ForceHTTPS bool
 	client     *retryablehttp.Client
 	headers    http.Header
+	ctx        context.Context
 }
 
 var HTTPHeaders = map[string]http.Header{}
@@ -174,6 +175,21 @@ func (transport *HTTPTransport) log(prefix string, message interface{}, binary b
 	}
 }
 
+// WithContext returns a copy of the transport whose requests are aborted when the context is
+// cancelled or its deadline passes. The copy shares its headers with the original.
+func (transport *HTTPTransport) WithContext(ctx context.Context) *HTTPTransport {
+	t := *transport
+	t.ctx = ctx
+	return &t
+}
+
+func (transport *HTTPTransport) context() context.Context {
+	if transport.ctx == nil {
+		return context.Background()
+	}
+	return transport.ctx
+}
+
 // SetHeader sets a header to be sent in requests.
 func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers.Set(name, val)
@@ -187,7 +203,7 @@ func (transport *HTTPTransport) request(
 	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
 		return nil, &SessionError{ErrorType: ErrorHTTPS, Err: errors.New("remote server does not use https")}
 	}
-	req.Request, err = http.NewRequest(method, u, reader)
+	req.Request, err = http.NewRequestWithContext(transport.context(), method, u, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
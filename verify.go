@@ -26,9 +26,11 @@ const (
 	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES") // Proof does not contain all requested attributes
 	ProofStatusExpired           = ProofStatus("EXPIRED")            // Attributes were expired at proof creation time (now, or according to timestamp in case of abs)
 
-	AttributeProofStatusPresent = AttributeProofStatus("PRESENT") // Attribute is disclosed and matches the value
-	AttributeProofStatusExtra   = AttributeProofStatus("EXTRA")   // Attribute is disclosed, but wasn't requested in request
-	AttributeProofStatusNull    = AttributeProofStatus("NULL")    // Attribute is disclosed but is null
+	AttributeProofStatusPresent   = AttributeProofStatus("PRESENT")   // Attribute is disclosed and matches the value
+	AttributeProofStatusExtra     = AttributeProofStatus("EXTRA")     // Attribute is disclosed, but wasn't requested in request
+	AttributeProofStatusNull      = AttributeProofStatus("NULL")      // Attribute is disclosed but is null
+	AttributeProofStatusPredicate = AttributeProofStatus("PREDICATE") // Attribute is not disclosed, but proven to satisfy the requested predicate
+	AttributeProofStatusHashed    = AttributeProofStatus("HASHED")    // Attribute is disclosed, but replaced by its salted hash as requested
 )
 
 // DisclosedAttribute represents a disclosed attribute.
@@ -40,6 +42,9 @@ type DisclosedAttribute struct {
 	IssuanceTime     Timestamp               `json:"issuancetime"`
 	NotRevoked       bool                    `json:"notrevoked,omitempty"`
 	NotRevokedBefore *Timestamp              `json:"notrevokedbefore,omitempty"`
+	Predicate        *AttributePredicate     `json:"predicate,omitempty"` // Predicate proven about the attribute, if its status is PREDICATE
+	Hash             []byte                  `json:"hash,omitempty"`      // Salted hash of the attribute, if its status is HASHED
+	Match            *bool                   `json:"match,omitempty"`     // Whether the salted hash equals the expected hash, if that was requested
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
@@ -121,6 +126,52 @@ func extractAttribute(pl gabi.ProofList, index *DisclosedAttributeIndex, notrevo
 	return attr, str, nil
 }
 
+// attributeDisclosed returns whether the attribute specified by the index is disclosed in the proof list.
+func attributeDisclosed(pl gabi.ProofList, index *DisclosedAttributeIndex) bool {
+	if index.CredentialIndex < 0 || index.CredentialIndex >= len(pl) {
+		return false
+	}
+	proofd, ok := pl[index.CredentialIndex].(*gabi.ProofD)
+	return ok && proofd.ADisclosed[index.AttributeIndex] != nil
+}
+
+// extractPredicate returns the attribute specified by the index if the proof list proves that it
+// satisfies the predicate of the attribute request, or nil otherwise.
+func extractPredicate(pl gabi.ProofList, index *DisclosedAttributeIndex, notrevoked *time.Time, request *AttributeRequest, conf *Configuration) (*DisclosedAttribute, error) {
+	if index.CredentialIndex < 0 || index.CredentialIndex >= len(pl) {
+		return nil, errors.New("Credential index out of range")
+	}
+	proofd, ok := pl[index.CredentialIndex].(*gabi.ProofD)
+	if !ok {
+		return nil, errors.New("ProofList contained proof of invalid type")
+	}
+
+	metadata := MetadataFromInt(proofd.ADisclosed[1], conf) // index 1 is metadata attribute
+	credtype := metadata.CredentialType()
+	if credtype == nil {
+		return nil, errors.New("ProofList contained a disclosure proof of an unknown credential type")
+	}
+	// The attribute must be undisclosed, and the range proofs over it must prove the predicate
+	if index.AttributeIndex < 2 || index.AttributeIndex-2 >= len(credtype.AttributeTypes) ||
+		proofd.ADisclosed[index.AttributeIndex] != nil {
+		return nil, nil
+	}
+	attrtype := credtype.AttributeTypes[index.AttributeIndex-2]
+	if attrtype.GetAttributeTypeIdentifier() != request.Type || attrtype.RandomBlind ||
+		!request.Predicate.provedBy(proofd.RangeProofs[index.AttributeIndex], metadata.Version()) {
+		return nil, nil
+	}
+
+	return &DisclosedAttribute{
+		Identifier:       request.Type,
+		Status:           AttributeProofStatusPredicate,
+		IssuanceTime:     Timestamp(metadata.SigningDate()),
+		NotRevoked:       proofd.NonRevocationProof != nil,
+		NotRevokedBefore: (*Timestamp)(notrevoked),
+		Predicate:        request.Predicate,
+	}, nil
+}
+
 // VerifyProofs verifies the proofs cryptographically.
 func (pl ProofList) VerifyProofs(
 	configuration *Configuration,